@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
 
 	"github.com/glycerine/greenpack/msgp"
 )
@@ -59,12 +57,12 @@ func WriteShadowGreenpackToFileFunction(name string) ZlispUserFunction {
 		}
 
 		// don't overwrite existing file
-		if FileExists(fn) {
+		if env.fileExists(fn) {
 			return SexpNull, fmt.Errorf("error: %s refusing to write to existing file '%s'",
 				name, fn)
 		}
 
-		f, err := os.Create(fn)
+		f, err := env.createFile(fn)
 		if err != nil {
 			return SexpNull, fmt.Errorf("error: %s sees error trying to create file '%s': '%v'", name, fn, err)
 		}
@@ -114,15 +112,10 @@ func ReadGreenpackFromFileFunction(env *Zlisp, name string, args []Sexp) (Sexp,
 		return SexpNull, fmt.Errorf("%s requires a string path to read. we got type %T / value = %v", name, args[0], args[0])
 	}
 
-	if !FileExists(string(fn)) {
-		return SexpNull, fmt.Errorf("file '%s' does not exist", fn)
-	}
-	f, err := os.Open(fn)
-	if err != nil {
+	if err := env.checkFile(fn); err != nil {
 		return SexpNull, err
 	}
-	defer f.Close()
-	by, err := ioutil.ReadAll(f)
+	by, err := env.readFile(fn)
 	if err != nil {
 		return SexpNull, err
 	}
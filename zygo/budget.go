@@ -0,0 +1,216 @@
+package zygo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Limits bounds what a script may consume. A zero field
+// means no limit. The instruction count is charged per
+// top-level evaluation (EvalString, RunContext and
+// friends), and shared with any child environments
+// created while it runs. The lengths are checked before
+// allocating by the builtins that can tell the size from
+// their arguments, such as concat, append, repeat and
+// makeArray, and on what any other builtin returns.
+type Limits struct {
+	MaxInstructions int64 // VM instructions executed
+	MaxCallDepth    int   // nested call frames on the address stack
+	MaxArrayLen     int   // elements in any array produced by a builtin
+	MaxStringLen    int   // bytes in any string produced by a builtin
+	MaxHashLen      int   // keys in any hash produced or grown by a builtin
+}
+
+// ErrBudgetExceeded is matched, via errors.Is, by every
+// error that stops a script because it ran past one of
+// its Limits.
+var ErrBudgetExceeded = errors.New("execution budget exceeded")
+
+// BudgetError reports which limit was exceeded.
+type BudgetError struct {
+	Limit string // "instructions", "call depth", "array length", ...
+	Max   int64
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("execution budget exceeded: %s limit of %d", e.Limit, e.Max)
+}
+
+func (e *BudgetError) Is(target error) bool {
+	return target == ErrBudgetExceeded
+}
+
+// how many instructions run between checks of ctx.Done().
+const ctxCheckInterval = 256
+
+// SetLimits installs resource limits for subsequent evaluation.
+func (env *Zlisp) SetLimits(lim Limits) {
+	env.limits = lim
+}
+
+// Limits returns the limits set by SetLimits.
+func (env *Zlisp) Limits() Limits {
+	return env.limits
+}
+
+// Context returns the context the current evaluation is
+// running under, or context.Background() when there is
+// none. Long-running builtins should watch its Done channel.
+func (env *Zlisp) Context() context.Context {
+	if env.ctx == nil {
+		return context.Background()
+	}
+	return env.ctx
+}
+
+// RunContext is like Run, but stops with an error
+// wrapping ctx.Err() once ctx is cancelled or its
+// deadline passes. Like any other failed Run, the env
+// should be Clear()-ed before it is used again.
+func (env *Zlisp) RunContext(ctx context.Context) (Sexp, error) {
+	prev := env.ctx
+	env.ctx = ctx
+	defer func() { env.ctx = prev }()
+	return env.Run()
+}
+
+// EvalStringContext loads and runs str under ctx; see RunContext.
+func (env *Zlisp) EvalStringContext(ctx context.Context, str string) (Sexp, error) {
+	if err := ctx.Err(); err != nil {
+		return SexpNull, err
+	}
+	err := env.LoadString(str)
+	if err != nil {
+		return SexpNull, scriptError(err)
+	}
+	res, err := env.RunContext(ctx)
+	return res, scriptError(err)
+}
+
+// budgetActive is true when Run has anything to enforce.
+func (env *Zlisp) budgetActive() bool {
+	return env.limits.MaxInstructions > 0 || env.ctx != nil
+}
+
+// chargeStep accounts for one VM instruction.
+func (env *Zlisp) chargeStep() error {
+	n := env.steps.Add(1)
+	if max := env.limits.MaxInstructions; max > 0 && n > max {
+		return &BudgetError{Limit: "instructions", Max: max}
+	}
+	if env.ctx != nil && n%ctxCheckInterval == 0 {
+		return env.ctxErr()
+	}
+	return nil
+}
+
+func (env *Zlisp) ctxErr() error {
+	if env.ctx == nil {
+		return nil
+	}
+	select {
+	case <-env.ctx.Done():
+		return fmt.Errorf("evaluation stopped: %w", env.ctx.Err())
+	default:
+		return nil
+	}
+}
+
+// budgetCause makes sure an error raised while the
+// budget is spent, or the context is done, says so even
+// if a builtin flattened the original error into a string
+// on the way out.
+func (env *Zlisp) budgetCause(err error) error {
+	if err == nil || errors.Is(err, ErrBudgetExceeded) {
+		return err
+	}
+	if max := env.limits.MaxInstructions; max > 0 && env.steps.Load() > max {
+		return &BudgetError{Limit: "instructions", Max: max}
+	}
+	if env.ctx != nil && env.ctx.Err() != nil && !errors.Is(err, env.ctx.Err()) {
+		return fmt.Errorf("evaluation stopped: %w", env.ctx.Err())
+	}
+	return err
+}
+
+// checkCallDepth is called before pushing a new call frame.
+func (env *Zlisp) checkCallDepth() error {
+	if max := env.limits.MaxCallDepth; max > 0 && env.addrstack.Size() >= max {
+		return &BudgetError{Limit: "call depth", Max: int64(max)}
+	}
+	return nil
+}
+
+// checkAlloc is called by builtins before allocating n
+// elements of the given kind: "array", "string" or "hash".
+// concat, append, repeat, makeArray, numRange and the string
+// functions, whose result size follows from their arguments,
+// call it first, so an over-long result is never made.
+func (env *Zlisp) checkAlloc(kind string, n int) error {
+	var max int
+	switch kind {
+	case "array":
+		max = env.limits.MaxArrayLen
+	case "string":
+		max = env.limits.MaxStringLen
+	case "hash":
+		max = env.limits.MaxHashLen
+	}
+	if max > 0 && n > max {
+		return &BudgetError{Limit: kind + " length", Max: int64(max)}
+	}
+	return nil
+}
+
+// checkJoined is checkAlloc for the array, or string, that
+// joining parts end to end would make. A char counts as
+// the bytes it encodes to.
+func (env *Zlisp) checkJoined(kind string, parts []Sexp) error {
+	n := 0
+	for _, p := range parts {
+		switch e := p.(type) {
+		case *SexpArray:
+			n += len(e.Val)
+		case *SexpStr:
+			n += len(e.S)
+		case *SexpChar:
+			n += utf8.RuneLen(e.Val)
+		}
+	}
+	return env.checkAlloc(kind, n)
+}
+
+// checkAllocated enforces the size limits on what a
+// builtin returned, and on any array or hash argument it
+// may have grown in place. For the builtins that do not
+// call checkAlloc first, this is after the fact: the
+// memory has been spent, though the script is stopped.
+func (env *Zlisp) checkAllocated(res Sexp, args []Sexp) error {
+	lim := env.limits
+	if lim.MaxArrayLen == 0 && lim.MaxStringLen == 0 && lim.MaxHashLen == 0 {
+		return nil
+	}
+	if err := env.checkSize(res); err != nil {
+		return err
+	}
+	for _, a := range args {
+		if err := env.checkSize(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (env *Zlisp) checkSize(x Sexp) error {
+	switch e := x.(type) {
+	case *SexpArray:
+		return env.checkAlloc("array", len(e.Val))
+	case *SexpStr:
+		return env.checkAlloc("string", len(e.S))
+	case *SexpHash:
+		return env.checkAlloc("hash", e.NumKeys)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package zygo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test070InstructionBudgetStopsRunawayLoops(t *testing.T) {
+
+	cv.Convey(`Given MaxInstructions, an infinite loop should stop with ErrBudgetExceeded, and the env should be reusable after Clear()`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.SetLimits(Limits{MaxInstructions: 10000})
+
+		_, err := env.EvalString("(def i 0) (for [(def j 0) true (set j (+ j 1))] (set i j))")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(errors.Is(err, ErrBudgetExceeded), cv.ShouldBeTrue)
+		var be *BudgetError
+		cv.So(errors.As(err, &be), cv.ShouldBeTrue)
+		cv.So(be.Limit, cv.ShouldEqual, "instructions")
+
+		// each top-level evaluation gets a fresh budget.
+		env.Clear()
+		res, err := env.EvalString("(+ 1 2)")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 3)
+	})
+}
+
+func Test071ContextCancellationStopsRun(t *testing.T) {
+
+	cv.Convey(`Given a context with a deadline, EvalStringContext should stop an infinite loop with an error wrapping context.DeadlineExceeded`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		t0 := time.Now()
+		_, err := env.EvalStringContext(ctx, "(for [(def j 0) true (set j (+ j 1))])")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(errors.Is(err, context.DeadlineExceeded), cv.ShouldBeTrue)
+		cv.So(time.Since(t0), cv.ShouldBeLessThan, 5*time.Second)
+
+		env.Clear()
+		res, err := env.EvalString("(* 2 3)")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 6)
+	})
+
+	cv.Convey(`Given an already cancelled context, EvalStringContext should not run anything`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := env.EvalStringContext(ctx, "(def ran true)")
+		cv.So(errors.Is(err, context.Canceled), cv.ShouldBeTrue)
+		_, found := env.FindObject("ran")
+		cv.So(found, cv.ShouldBeFalse)
+	})
+}
+
+func Test072CallDepthAndAllocationLimits(t *testing.T) {
+
+	cv.Convey(`Given MaxCallDepth, unbounded recursion should stop with ErrBudgetExceeded`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.SetLimits(Limits{MaxCallDepth: 50})
+
+		_, err := env.EvalString("(defn down [n] (+ 1 (down (+ n 1)))) (down 0)")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(errors.Is(err, ErrBudgetExceeded), cv.ShouldBeTrue)
+
+		env.Clear()
+		res, err := env.EvalString("(defn fact [n] (cond (<= n 1) 1 (* n (fact (- n 1))))) (fact 10)")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 3628800)
+	})
+
+	cv.Convey(`Given MaxArrayLen and MaxStringLen, builtins should refuse to produce anything larger`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.SetLimits(Limits{MaxArrayLen: 100, MaxStringLen: 8})
+
+		_, err := env.EvalString("(makeArray 1000000 0)")
+		cv.So(errors.Is(err, ErrBudgetExceeded), cv.ShouldBeTrue)
+
+		env.Clear()
+		_, err = env.EvalString(`(concat "hello" " world")`)
+		cv.So(errors.Is(err, ErrBudgetExceeded), cv.ShouldBeTrue)
+
+		env.Clear()
+		res, err := env.EvalString(`(concat "ab" "cd")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, "abcd")
+	})
+
+	cv.Convey(`Given MaxArrayLen and MaxStringLen, concat, append, repeat and makeArray should refuse before allocating, not after`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetLimits(Limits{MaxArrayLen: 3, MaxStringLen: 4})
+
+		// called directly, so that only their own checks run.
+		arr := env.NewSexpArray([]Sexp{&SexpInt{Val: 1}, &SexpInt{Val: 2}})
+		for _, call := range []struct {
+			fn   ZlispUserFunction
+			name string
+			args []Sexp
+		}{
+			{ConcatFunction, "concat", []Sexp{arr, arr}},
+			{ConcatFunction, "concat", []Sexp{&SexpStr{S: "abc"}, &SexpChar{Val: 'é'}}},
+			{AppendFunction("append"), "append", []Sexp{env.NewSexpArray([]Sexp{arr, arr, arr}), arr}},
+			{AppendFunction("appendslice"), "appendslice", []Sexp{arr, arr}},
+			{AppendFunction("append"), "append", []Sexp{&SexpStr{S: "abcd"}, &SexpChar{Val: 'e'}}},
+			{RepeatFunction, "repeat", []Sexp{&SexpStr{S: "ab"}, &SexpInt{Val: 3}}},
+			{MakeArrayFunction, "makeArray", []Sexp{&SexpInt{Val: 4}}},
+		} {
+			_, err := call.fn(env, call.name, call.args)
+			cv.So(errors.Is(err, ErrBudgetExceeded), cv.ShouldBeTrue)
+		}
+
+		res, err := ConcatFunction(env, "concat", []Sexp{&SexpStr{S: "ab"}, &SexpChar{Val: 'é'}})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, "abé")
+	})
+}
@@ -38,6 +38,10 @@ func (env *Zlisp) ImportPackageBuilder() {
 	//env.AddBuilder("import", ImportBuilder)
 	env.AddBuilder("var", VarBuilder)
 	env.AddBuilder("expectError", ExpectErrorBuilder)
+	env.AddBuilder("try", TryBuilder)
+	env.AddBuilder("atomically", AtomicallyBuilder)
+	env.AddBuilder("with-output-to-string", WithOutputToStringBuilder)
+	env.AddBuilder("withOutputToString", WithOutputToStringBuilder)
 	//	env.AddBuilder("&", AddressOfBuilder)
 
 	env.AddBuilder("import", ImportPackageBuilder)
@@ -63,6 +67,9 @@ type RecordDefn struct {
 	Name      string
 	Fields    []*SexpField
 	FieldType map[string]*RegisteredType
+
+	// the registry the struct was declared in.
+	types *GoStructRegistryType
 }
 
 func NewRecordDefn() *RecordDefn {
@@ -85,7 +92,11 @@ func (r *RecordDefn) SetFields(flds []*SexpField) {
 }
 
 func (p *RecordDefn) Type() *RegisteredType {
-	rt := GoStructRegistry.Registry[p.Name]
+	types := p.types
+	if types == nil {
+		types = &GoStructRegistry
+	}
+	rt := types.Lookup(p.Name)
 	//Q("RecordDefn) Type() sees rt = %v", rt)
 	return rt
 }
@@ -285,12 +296,13 @@ func StructBuilder(env *Zlisp, name string,
 		// update later, so that structs can refer to themselves.
 		udsR := NewRecordDefn()
 		udsR.SetName(structName)
+		udsR.types = env.TypeRegistry()
 		rtR := NewRegisteredType(func(env *Zlisp, h *SexpHash) (interface{}, error) {
 			return udsR, nil
 		})
 		rtR.UserStructDefn = udsR
 		rtR.DisplayAs = structName
-		GoStructRegistry.RegisterUserdef(rtR, false, structName)
+		env.TypeRegistry().RegisterUserdef(rtR, false, structName)
 
 		// overwrite any existing definition, deliberately ignore any error,
 		// as there may not be a prior definition present at all.
@@ -361,6 +373,7 @@ func StructBuilder(env *Zlisp, name string,
 
 	uds := NewRecordDefn()
 	uds.SetName(structName)
+	uds.types = env.TypeRegistry()
 	uds.SetFields(flat)
 	//Q("good: made typeDefnHash: '%s'", uds.SexpString(nil))
 	rt := NewRegisteredType(func(env *Zlisp, h *SexpHash) (interface{}, error) {
@@ -368,7 +381,7 @@ func StructBuilder(env *Zlisp, name string,
 	})
 	rt.UserStructDefn = uds
 	rt.DisplayAs = structName
-	GoStructRegistry.RegisterUserdef(rt, false, structName)
+	env.TypeRegistry().RegisterUserdef(rt, false, structName)
 	//Q("good: registered new userdefined struct '%s'", structName)
 
 	// replace our recursive-reference-enabling symbol with the real one.
@@ -463,6 +476,7 @@ func InterfaceBuilder(env *Zlisp, name string,
 	decl := &SexpInterfaceDecl{
 		name:    iname,
 		methods: methods,
+		env:     env,
 	}
 	return decl, nil
 }
@@ -491,7 +505,7 @@ func SliceOfFunction(env *Zlisp, name string,
 
 	//Q("sliceOf arg = '%s' with type %T", args[0].SexpString(nil), args[0])
 
-	sliceRt := GoStructRegistry.GetOrCreateSliceType(rt)
+	sliceRt := env.TypeRegistry().GetOrCreateSliceType(rt)
 	//Q("in SliceOfFunction: returning sliceRt = '%#v'", sliceRt)
 	return sliceRt, nil
 }
@@ -542,7 +556,7 @@ func PointerToFunction(env *Zlisp, name string,
 
 	//Q("pointer-to arg = '%s' with type %T", args[0].SexpString(nil), args[0])
 
-	ptrRt := GoStructRegistry.GetOrCreatePointerType(rt)
+	ptrRt := env.TypeRegistry().GetOrCreatePointerType(rt)
 	return ptrRt, nil
 }
 
@@ -676,7 +690,7 @@ func ArrayOfFunction(env *Zlisp, name string,
 	})
 	arrayRt.DisplayAs = fmt.Sprintf("(%s %s)", name, rt.DisplayAs)
 	arrayName := "arrayOf" + rt.RegisteredName
-	GoStructRegistry.RegisterUserdef(arrayRt, false, arrayName)
+	env.TypeRegistry().RegisterUserdef(arrayRt, false, arrayName)
 	return arrayRt, nil
 }
 
@@ -743,9 +757,9 @@ func VarBuilder(env *Zlisp, name string,
 			_ = rd
 			//Q("we have RecordDefn rd = %#v", *rd)
 		}
-		valSexp = &SexpReflect{Val: reflect.ValueOf(v)}
+		valSexp = &SexpReflect{Val: reflect.ValueOf(v), Typ: rt, Env: env}
 	default:
-		valSexp = &SexpReflect{Val: reflect.ValueOf(v)}
+		valSexp = &SexpReflect{Val: reflect.ValueOf(v), Typ: rt, Env: env}
 	}
 
 	//Q("var decl: valSexp is '%v'", valSexp.SexpString(nil))
@@ -13,6 +13,9 @@ import (
 // args[1] is a hash representing a method call on that struct.
 // The returned Sexp is a hash that represents the result of that call.
 func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if err := env.allow(CapReflect, name); err != nil {
+		return SexpNull, err
+	}
 	//Q("_method user func running!\n")
 
 	// protect against bad calls/bad reflection
@@ -30,6 +33,7 @@ func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 			}
 		}()
 
+		made := env.callbacks.made.Load()
 		narg := len(args)
 		if narg < 2 {
 			return SexpNull, WrongNargs
@@ -127,7 +131,8 @@ func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 
 		//P("_method: about to .Call by reflection!\n")
 
-		out := method.Func.Call(inputVa)
+		var out []reflect.Value
+		env.goCall(made, func() { out = method.Func.Call(inputVa) })
 
 		var iout []interface{}
 		for _, o := range out {
@@ -148,7 +153,7 @@ func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 			case int:
 				r = append(r, &SexpInt{Val: int64(e)})
 			case error:
-				r = append(r, &SexpError{e})
+				r = append(r, &SexpError{error: e})
 			case string:
 				r = append(r, &SexpStr{S: e})
 			case float64:
@@ -160,7 +165,7 @@ func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 			default:
 				// go through the type registry
 				found := false
-				for hashName, factory := range GoStructRegistry.Registry {
+				for hashName, factory := range env.TypeRegistry().All() {
 					st, err := factory.Factory(env, nil)
 					if err != nil {
 						return SexpNull, fmt.Errorf("MakeHash '%s' problem on Factory call: %s",
@@ -186,7 +191,7 @@ func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 					}
 				}
 				if !found {
-					r = append(r, &SexpReflect{Val: out[i]})
+					r = append(r, &SexpReflect{Val: out[i], Env: env})
 				}
 			}
 		}
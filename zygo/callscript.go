@@ -0,0 +1,105 @@
+package zygo
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Calling script functions from Go
+// ================================
+//
+// env.Call and CallAs call a script function, or a builtin,
+// by name, with Go values for arguments, converting them as
+// AddGoFunc converts the results of a Go function; a Sexp
+// passes as is. The result comes back converted as
+// AddGoFunc converts arguments: to T for CallAs, so that a
+// hash can come back as a registered Go struct, and for Call
+// as SexpToGo would have it. So, given
+//
+//	(defn area [w h] (* w h))
+//	(func greet [first:string last:string] [s:string] (concat first " " last))
+//
+// then
+//
+//	n, err := zygo.CallAs[int](env, "area", 3, 4)
+//	s, err := env.Call("greet", zygo.Named{"last", "Lovelace"}, zygo.Named{"first", "Ada"})
+//
+// Arguments given as Named go to the parameter of that name,
+// as last: "Lovelace" does in a script, and, as there, come
+// after any given by position; see params.go. A lazy
+// formal, #x, gets its argument as a value already forced.
+
+// Named passes Value as the argument for the parameter Name.
+type Named struct {
+	Name  string
+	Value interface{}
+}
+
+// Call calls the function bound to name with args.
+func (env *Zlisp) Call(name string, args ...interface{}) (interface{}, error) {
+	res, err := env.callByName(name, args)
+	if err != nil || res == SexpNull {
+		return nil, err
+	}
+	return SexpToGo(res, env, nil), nil
+}
+
+// CallAs calls the function bound to name with args, and
+// converts its result to a T; CallAs[Sexp] leaves it as is,
+// and CallAs[any] gives what Call would.
+func CallAs[T any](env *Zlisp, name string, args ...interface{}) (T, error) {
+	var out T
+	res, err := env.callByName(name, args)
+	if err != nil {
+		return out, err
+	}
+	v, err := sexpToGoValue(env, res, reflect.TypeOf(&out).Elem())
+	if err != nil {
+		return out, fmt.Errorf("%s: result: %v", name, err)
+	}
+	reflect.ValueOf(&out).Elem().Set(v)
+	return out, nil
+}
+
+func (env *Zlisp) callByName(name string, args []interface{}) (Sexp, error) {
+	obj, found := env.FindObject(name)
+	if !found {
+		return SexpNull, fmt.Errorf("symbol `%s` not found", name)
+	}
+	fun, isFun := obj.(*SexpFunction)
+	if !isFun {
+		return SexpNull, fmt.Errorf("%s is not a function, but %T", name, obj)
+	}
+
+	sargs := make([]Sexp, 0, len(args))
+	for i, a := range args {
+		nm, isNamed := a.(Named)
+		val := a
+		if isNamed {
+			val = nm.Value
+		}
+		sx, err := goValueToSexp(env, reflect.ValueOf(val))
+		if err != nil {
+			return SexpNull, fmt.Errorf("%s: argument %d: %v", name, i+1, err)
+		}
+		if isNamed {
+			// as name: would be in a script.
+			key := env.MakeSymbol(nm.Name)
+			key.colonTail = true
+			sargs = append(sargs, key)
+		}
+		sargs = append(sargs, sx)
+	}
+	return env.applyFromGo(fun, sargs)
+}
+
+// applyFromGo applies fun to args for a caller in Go.
+func (env *Zlisp) applyFromGo(fun *SexpFunction, args []Sexp) (Sexp, error) {
+	// Apply leaves the machine where the function returned
+	// to, which from Go is nowhere; put it back, so the next
+	// EvalString carries on from the end of the main function.
+	st := env.captureControlState()
+	res, err := env.Apply(fun, args)
+	env.restoreControlState(st)
+	return res, err
+}
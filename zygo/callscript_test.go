@@ -0,0 +1,126 @@
+package zygo
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test210CallScriptFunctionsFromGo(t *testing.T) {
+
+	cv.Convey(`Given script functions, Go should call them with Go values, by position or by name, and get Go values back`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`
+(defn area [w h] (* w h))
+(defn scale [xs k] (map (fn [x] (* x k)) xs))
+(defn person [first last] (persondemo first:first last:last))
+(defn show [#x] (str (substitute #x)))
+(defn both [a #b] [a (force #b)])
+(func greet [first:string last:string] [s:string] (concat first " " last))
+(defn fail [] (error "no good"))`)
+		panicOn(err)
+
+		n, err := CallAs[int](env, "area", 3, 4)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(n, cv.ShouldEqual, 12)
+
+		f, err := CallAs[float64](env, "area", 1.5, 2)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(f, cv.ShouldEqual, 3.0)
+
+		xs, err := CallAs[[]int64](env, "scale", []int{1, 2, 3}, 10)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(xs, cv.ShouldResemble, []int64{10, 20, 30})
+
+		// a record comes back as the registered struct.
+		p, err := CallAs[*Person](env, "person", "Ada", "Lovelace")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(p.First+" "+p.Last, cv.ShouldEqual, "Ada Lovelace")
+		// and goes in as one.
+		s, err := CallAs[string](env, "concat", "x", "y")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(s, cv.ShouldEqual, "xy")
+
+		// CallAs[any] agrees with Call, and CallAs[Sexp] gives
+		// the Sexp as is.
+		for _, name := range []string{"area", "scale"} {
+			args := map[string][]interface{}{"area": {3, 4}, "scale": {[]int{1, 2}, 3}}[name]
+			a, err := CallAs[any](env, name, args...)
+			cv.So(err, cv.ShouldBeNil)
+			c, err := env.Call(name, args...)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(a, cv.ShouldResemble, c)
+		}
+		a, err := CallAs[any](env, "area", 3, 4)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(a, cv.ShouldEqual, int64(12))
+		sx, err := CallAs[Sexp](env, "area", 3, 4)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(sx.(*SexpInt).Val, cv.ShouldEqual, 12)
+
+		res, err := env.Call("greet", Named{"last", "Lovelace"}, Named{"first", "Ada"})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldEqual, "Ada Lovelace")
+		res, err = env.Call("greet", "Grace", "Hopper")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldEqual, "Grace Hopper")
+		res, err = env.Call("area", Named{"h", 2}, Named{"w", 5})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldEqual, int64(10))
+
+		// lazy formals get their values already forced.
+		res, err = env.Call("show", 42)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldEqual, "42")
+		res, err = env.Call("both", Named{"b", "later"}, Named{"a", 1})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldResemble, []interface{}{int64(1), "later"})
+
+		res, err = env.Call("area", 2, 3)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldEqual, int64(6))
+	})
+
+	cv.Convey(`Given bad calls, Call should say what is wrong, and leave the environment usable`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`
+(def notfun 3)
+(defn area [w h] (* w h))
+(defn fail [] (error "no good"))
+(func greet [first:string last:string] [s:string] (concat first " " last))`)
+		panicOn(err)
+
+		for _, c := range []struct {
+			name string
+			args []interface{}
+			want string
+		}{
+			{"nope", nil, "symbol `nope` not found"},
+			{"notfun", nil, "notfun is not a function"},
+			{"area", []interface{}{1}, "area expected 2 arguments, got 1; area takes [w h]"},
+			{"fail", nil, "no good"},
+			{"greet", []interface{}{1, "x"}, "type mismatch for parameter 'first'"},
+			{"greet", []interface{}{Named{"first", "a"}}, "greet is missing argument 'last'; greet takes [first:string last:string]"},
+			{"greet", []interface{}{Named{"first", "a"}, Named{"middle", "b"}}, "greet takes no argument 'middle'"},
+			{"greet", []interface{}{Named{"first", "a"}, Named{"first", "b"}}, "duplicate named parameter 'first'"},
+			{"greet", []interface{}{Named{"first", "a"}, "b"}, `greet: argument "b", by position, follows arguments by name`},
+		} {
+			_, err := env.Call(c.name, c.args...)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, c.want)
+		}
+
+		_, err = CallAs[int](env, "greet", "a", "b")
+		cv.So(err.Error(), cv.ShouldContainSubstring, "greet: result: cannot use")
+
+		res, err := env.EvalString(`(area 2 5)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "10")
+	})
+}
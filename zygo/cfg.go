@@ -19,6 +19,30 @@ type ZlispConfig struct {
 	LoadDemoStructs     bool
 	AfterScriptDontExit bool
 
+	// Compile names a script to compile, into CompileOut
+	// if given, rather than run.
+	Compile    string
+	CompileOut string
+
+	// DAP is the address to serve the Debug Adapter
+	// Protocol on, rather than starting a repl.
+	DAP string
+
+	// LSP serves the Language Server Protocol on stdin
+	// and stdout, rather than starting a repl.
+	LSP bool
+
+	// Optimize runs the optimizer over generated code.
+	Optimize bool
+
+	// Jail, if set, is the directory scripts' file access
+	// is confined to; see JailFS.
+	Jail string
+
+	// Policy, if set, names a policy file saying what
+	// scripts may do; see LoadPolicy.
+	Policy string
+
 	// liner bombs under emacs, avoid it with this flag.
 	NoLiner bool
 	Prompt  string // default "zygo> "
@@ -43,6 +67,13 @@ func (c *ZlispConfig) DefineFlags() {
 	c.Flags.BoolVar(&c.Quiet, "quiet", false, "start repl without printing the version/mode/help banner")
 	c.Flags.BoolVar(&c.Trace, "trace", false, "trace execution (warning: very verbose and slow)")
 	c.Flags.BoolVar(&c.LoadDemoStructs, "demo", false, "load the demo structs: Event, Snoopy, Hornet, Weather and friends.")
+	c.Flags.StringVar(&c.Compile, "compile", "", "compile the named script to bytecode and exit, rather than run it")
+	c.Flags.StringVar(&c.CompileOut, "o", "", "where -compile writes; by default the script's name with a .zyc suffix")
+	c.Flags.StringVar(&c.DAP, "dap", "", "serve the Debug Adapter Protocol on this address (e.g. :4711), for debugging scripts from an editor")
+	c.Flags.BoolVar(&c.LSP, "lsp", false, "serve the Language Server Protocol on stdin/stdout, for editing scripts in an editor")
+	c.Flags.BoolVar(&c.Optimize, "O", false, "optimize generated code: fold constants, thread jumps, and drop dead code and empty scopes")
+	c.Flags.StringVar(&c.Jail, "jail", "", "confine the files scripts read and write to this directory")
+	c.Flags.StringVar(&c.Policy, "policy", "", "a JSON policy file saying which files, commands, environment variables, Go reflection, clock and randomness scripts may use")
 	c.Flags.BoolVar(&c.NoLiner, "no-liner", false, "skip the use of liner library for stdin, may be needed under emacs")
 
 }
@@ -67,4 +67,7 @@ func (env *Zlisp) ImportChannels() {
 	env.AddFunction("makeChan", MakeChanFunction)
 	env.AddFunction("send", ChanTxFunction)
 	env.AddFunction("<!", ChanTxFunction)
+	env.AddFunction("spawn", SpawnFunction)
+	env.AddFunction("wait", WaitFunction)
+	env.AddFunction("select", SelectFunction)
 }
@@ -0,0 +1,548 @@
+package zygo
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Collections
+// ===========
+//
+// filter, reduce, sort, sortBy, groupBy, zip, distinct, take,
+// drop, any?, every?, frequencies and numRange, done in
+// Go rather than re-written, recursively, in each script.
+// Each takes an array, a list or a hash alike. The elements
+// of a hash are its (key value) pairs, in key order, as hpair
+// gives them, so that (fn [[k v]] ...) takes them apart. The
+// function comes first, as for map:
+//
+//	(filter (fn [x] (> x 1)) [1 2 3])     ; [2 3]
+//	(reduce + 0 (list 1 2 3))             ; 6
+//	(sortBy (fn [[k v]] v) {a:3 b:1})     ; {b:1 a:3}
+//	(groupBy (fn [x] (mod x 2)) [1 2 3])  ; {1:[1 3] 0:[2]}
+//	(numRange 1 10 3)                     ; [1 4 7]
+//
+// filter, sort, sortBy, distinct, take and drop give back
+// the kind they were given, so a hash comes back a hash;
+// groupBy gives a hash of such groups. zip gives a list of
+// lists when its first argument is a list, and otherwise an
+// array of arrays, stopping at the shortest. frequencies
+// counts the elements, or for a hash, its values.
+//
+// numRange has its own name so that range stays the loop,
+// (range k v coll body...), that it always was.
+//
+// These are globals rather than builtins, so a script that
+// still defines its own filter goes on using that one.
+
+func (env *Zlisp) ImportCollections() {
+	env.AddFunction("filter", FilterFunction)
+	env.AddFunction("reduce", ReduceFunction)
+	env.AddFunction("sort", SortFunction)
+	env.AddFunction("sortBy", SortByFunction)
+	env.AddFunction("groupBy", GroupByFunction)
+	env.AddFunction("zip", ZipFunction)
+	env.AddFunction("distinct", DistinctFunction)
+	env.AddFunction("take", TakeDropFunction)
+	env.AddFunction("drop", TakeDropFunction)
+	env.AddFunction("any?", AnyEveryFunction)
+	env.AddFunction("every?", AnyEveryFunction)
+	env.AddFunction("frequencies", FrequenciesFunction)
+	env.AddFunction("numRange", NumRangeFunction)
+}
+
+// collElements returns the elements of coll: those of an
+// array or list, or the (key value) pairs of a hash.
+func collElements(env *Zlisp, coll Sexp) ([]Sexp, error) {
+	switch c := coll.(type) {
+	case *SexpArray:
+		return c.Val, nil
+	case *SexpPair:
+		return ListToArray(c)
+	case *SexpHash:
+		elems := make([]Sexp, 0, c.NumKeys)
+		for _, key := range c.KeyOrder {
+			val, err := c.HashGet(env, key)
+			if err != nil {
+				// deleted keys stay in KeyOrder.
+				continue
+			}
+			elems = append(elems, Cons(key, &SexpPair{Head: val, Tail: SexpNull}))
+		}
+		return elems, nil
+	case *SexpSentinel:
+		if c == SexpNull {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("expected an array, list or hash; we saw %T", coll)
+}
+
+// collRebuild makes, from elems, a collection of the kind
+// of like.
+func collRebuild(env *Zlisp, like Sexp, elems []Sexp) (Sexp, error) {
+	switch like.(type) {
+	case *SexpArray:
+		return env.NewSexpArray(elems), nil
+	case *SexpHash:
+		h, err := MakeHash(nil, "hash", env)
+		if err != nil {
+			return SexpNull, err
+		}
+		for _, e := range elems {
+			pair, ok := e.(*SexpPair)
+			if !ok {
+				return SexpNull, fmt.Errorf("hash element %s is not a (key value) pair", e.SexpString(nil))
+			}
+			val := Sexp(SexpNull)
+			if tail, ok := pair.Tail.(*SexpPair); ok {
+				val = tail.Head
+			}
+			err = h.HashSet(pair.Head, val)
+			if err != nil {
+				return SexpNull, err
+			}
+		}
+		return h, nil
+	}
+	return MakeList(elems), nil
+}
+
+func collFunction(x Sexp) (*SexpFunction, error) {
+	fun, ok := x.(*SexpFunction)
+	if !ok {
+		return nil, fmt.Errorf("first argument must be a function; we saw %T", x)
+	}
+	return fun, nil
+}
+
+// sexpIndex numbers distinct values, equal by Compare,
+// bucketed by hash so that finding one is not a scan.
+type sexpIndex struct {
+	env     *Zlisp
+	buckets map[uint64][]int
+	vals    []Sexp
+}
+
+func newSexpIndex(env *Zlisp) *sexpIndex {
+	return &sexpIndex{env: env, buckets: make(map[uint64][]int)}
+}
+
+// find returns the number of v, adding it when new.
+func (x *sexpIndex) find(v Sexp) (i int, added bool) {
+	var code uint64
+	h, isList, err := hashHelper(v)
+	if err != nil || isList {
+		code = Blake2bUint64([]byte(v.SexpString(nil)))
+	} else {
+		code = uint64(h)
+	}
+	for _, j := range x.buckets[code] {
+		res, err := x.env.Compare(x.vals[j], v)
+		if err == nil && res == 0 {
+			return j, false
+		}
+	}
+	i = len(x.vals)
+	x.vals = append(x.vals, v)
+	x.buckets[code] = append(x.buckets[code], i)
+	return i, true
+}
+
+// (filter pred coll) keeps the elements for which pred is true.
+func FilterFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	fun, err := collFunction(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	elems, err := collElements(env, args[1])
+	if err != nil {
+		return SexpNull, err
+	}
+	var keep []Sexp
+	for _, e := range elems {
+		res, err := env.Apply(fun, []Sexp{e})
+		if err != nil {
+			return SexpNull, err
+		}
+		if IsTruthy(res) {
+			keep = append(keep, e)
+		}
+	}
+	return collRebuild(env, args[1], keep)
+}
+
+// (reduce f init coll), or (reduce f coll) to start from
+// the first element, folds f over coll from the left.
+func ReduceFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return SexpNull, WrongNargs
+	}
+	fun, err := collFunction(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	elems, err := collElements(env, args[len(args)-1])
+	if err != nil {
+		return SexpNull, err
+	}
+	var acc Sexp
+	if len(args) == 3 {
+		acc = args[1]
+	} else {
+		if len(elems) == 0 {
+			return SexpNull, fmt.Errorf("reduce of an empty collection needs an initial value")
+		}
+		acc, elems = elems[0], elems[1:]
+	}
+	for _, e := range elems {
+		acc, err = env.Apply(fun, []Sexp{acc, e})
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	return acc, nil
+}
+
+// sortElements sorts elems, stably, by keys, which line up
+// with them, using Compare.
+func sortElements(env *Zlisp, elems, keys []Sexp) error {
+	idx := make([]int, len(elems))
+	for i := range idx {
+		idx[i] = i
+	}
+	var cmpErr error
+	sort.SliceStable(idx, func(i, j int) bool {
+		if cmpErr != nil {
+			return false
+		}
+		res, err := env.Compare(keys[idx[i]], keys[idx[j]])
+		if err != nil {
+			cmpErr = err
+			return false
+		}
+		return res < 0
+	})
+	if cmpErr != nil {
+		return cmpErr
+	}
+	sorted := make([]Sexp, len(elems))
+	for i, j := range idx {
+		sorted[i] = elems[j]
+	}
+	copy(elems, sorted)
+	return nil
+}
+
+// (sort coll) sorts ascending by Compare; a hash, by key.
+func SortFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	elems, err := collElements(env, args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	elems = append([]Sexp(nil), elems...)
+	keys := elems
+	if _, isHash := args[0].(*SexpHash); isHash {
+		keys = make([]Sexp, len(elems))
+		for i, e := range elems {
+			keys[i] = e.(*SexpPair).Head
+		}
+	}
+	err = sortElements(env, elems, keys)
+	if err != nil {
+		return SexpNull, err
+	}
+	return collRebuild(env, args[0], elems)
+}
+
+// (sortBy keyfn coll) sorts ascending by (keyfn element),
+// calling keyfn once for each.
+func SortByFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	fun, err := collFunction(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	elems, err := collElements(env, args[1])
+	if err != nil {
+		return SexpNull, err
+	}
+	elems = append([]Sexp(nil), elems...)
+	keys := make([]Sexp, len(elems))
+	for i, e := range elems {
+		keys[i], err = env.Apply(fun, []Sexp{e})
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	err = sortElements(env, elems, keys)
+	if err != nil {
+		return SexpNull, err
+	}
+	return collRebuild(env, args[1], elems)
+}
+
+// (groupBy f coll) gives a hash from each (f element) to
+// the elements, in order, that gave it.
+func GroupByFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	fun, err := collFunction(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	elems, err := collElements(env, args[1])
+	if err != nil {
+		return SexpNull, err
+	}
+	index := newSexpIndex(env)
+	var groups [][]Sexp
+	for _, e := range elems {
+		key, err := env.Apply(fun, []Sexp{e})
+		if err != nil {
+			return SexpNull, err
+		}
+		i, added := index.find(key)
+		if added {
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], e)
+	}
+	res, err := MakeHash(nil, "hash", env)
+	if err != nil {
+		return SexpNull, err
+	}
+	for i, key := range index.vals {
+		group, err := collRebuild(env, args[1], groups[i])
+		if err != nil {
+			return SexpNull, err
+		}
+		err = res.HashSet(key, group)
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	return res, nil
+}
+
+// (zip a b ...) gives the tuples of the i-th elements of
+// each, as long as the shortest.
+func ZipFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 {
+		return SexpNull, WrongNargs
+	}
+	cols := make([][]Sexp, len(args))
+	n := -1
+	for i, a := range args {
+		elems, err := collElements(env, a)
+		if err != nil {
+			return SexpNull, err
+		}
+		cols[i] = elems
+		if n < 0 || len(elems) < n {
+			n = len(elems)
+		}
+	}
+	asList := IsList(args[0])
+	tuples := make([]Sexp, n)
+	for j := range tuples {
+		tuple := make([]Sexp, len(cols))
+		for i := range cols {
+			tuple[i] = cols[i][j]
+		}
+		if asList {
+			tuples[j] = MakeList(tuple)
+		} else {
+			tuples[j] = env.NewSexpArray(tuple)
+		}
+	}
+	if asList {
+		return MakeList(tuples), nil
+	}
+	return env.NewSexpArray(tuples), nil
+}
+
+// (distinct coll) drops the elements equal to one before.
+func DistinctFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	elems, err := collElements(env, args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	index := newSexpIndex(env)
+	var keep []Sexp
+	for _, e := range elems {
+		if _, added := index.find(e); added {
+			keep = append(keep, e)
+		}
+	}
+	return collRebuild(env, args[0], keep)
+}
+
+// (take n coll) keeps the first n elements; (drop n coll),
+// all but those.
+func TakeDropFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	n, ok := args[0].(*SexpInt)
+	if !ok || n.Val < 0 {
+		return SexpNull, fmt.Errorf("first argument must be a count of zero or more; we saw %s", args[0].SexpString(nil))
+	}
+	elems, err := collElements(env, args[1])
+	if err != nil {
+		return SexpNull, err
+	}
+	k := len(elems)
+	if n.Val < int64(k) {
+		k = int(n.Val)
+	}
+	if name == "take" {
+		elems = elems[:k]
+	} else {
+		elems = elems[k:]
+	}
+	return collRebuild(env, args[1], append([]Sexp(nil), elems...))
+}
+
+// (any? pred coll) and (every? pred coll) stop at the first
+// element that decides.
+func AnyEveryFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	fun, err := collFunction(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	elems, err := collElements(env, args[1])
+	if err != nil {
+		return SexpNull, err
+	}
+	any := name == "any?"
+	for _, e := range elems {
+		res, err := env.Apply(fun, []Sexp{e})
+		if err != nil {
+			return SexpNull, err
+		}
+		if IsTruthy(res) == any {
+			return &SexpBool{Val: any}, nil
+		}
+	}
+	return &SexpBool{Val: !any}, nil
+}
+
+// (frequencies coll) gives a hash from each element, or
+// each value of a hash, to the number of times it appears.
+func FrequenciesFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	elems, err := collElements(env, args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	_, isHash := args[0].(*SexpHash)
+	index := newSexpIndex(env)
+	var counts []int64
+	for _, e := range elems {
+		if isHash {
+			e = e.(*SexpPair).Tail.(*SexpPair).Head
+		}
+		i, added := index.find(e)
+		if added {
+			counts = append(counts, 0)
+		}
+		counts[i]++
+	}
+	res, err := MakeHash(nil, "hash", env)
+	if err != nil {
+		return SexpNull, err
+	}
+	for i, key := range index.vals {
+		err = res.HashSet(key, &SexpInt{Val: counts[i]})
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	return res, nil
+}
+
+// NumRangeFunction implements numRange: (numRange end),
+// (numRange start end) or (numRange start end step) gives
+// the numbers from start, by step, up to but not including
+// end. They are floats if any argument is.
+func NumRangeFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return SexpNull, WrongNargs
+	}
+	var ints [3]int64
+	var floats [3]float64
+	isFloat := false
+	for i, a := range args {
+		switch x := a.(type) {
+		case *SexpInt:
+			ints[i], floats[i] = x.Val, float64(x.Val)
+		case *SexpFloat:
+			floats[i] = x.Val
+			isFloat = true
+		default:
+			return SexpNull, raised(fmt.Errorf("%s: want numbers, not %s", name, a.SexpString(nil)))
+		}
+	}
+	start, end, step := int64(0), ints[0], int64(1)
+	fstart, fend, fstep := 0.0, floats[0], 1.0
+	if len(args) > 1 {
+		start, end = ints[0], ints[1]
+		fstart, fend = floats[0], floats[1]
+	}
+	if len(args) > 2 {
+		step, fstep = ints[2], floats[2]
+	}
+	if fstep == 0 {
+		return SexpNull, raised(fmt.Errorf("%s: step cannot be 0", name))
+	}
+
+	// n, the count, rounds up.
+	var n int
+	if isFloat {
+		c := math.Ceil((fend - fstart) / fstep)
+		if c > math.MaxInt32 {
+			return SexpNull, raised(fmt.Errorf("%s: too many numbers", name))
+		}
+		if c > 0 {
+			n = int(c)
+		}
+	} else if d := end - start; d != 0 && (d > 0) == (step > 0) {
+		c := d/step + 1
+		if d%step == 0 {
+			c--
+		}
+		n = int(c)
+	}
+	err := env.checkAlloc("array", n)
+	if err != nil {
+		return SexpNull, err
+	}
+	arr := make([]Sexp, n)
+	for i := range arr {
+		if isFloat {
+			arr[i] = &SexpFloat{Val: fstart + float64(i)*fstep}
+		} else {
+			arr[i] = &SexpInt{Val: start + int64(i)*step}
+		}
+	}
+	return env.NewSexpArray(arr), nil
+}
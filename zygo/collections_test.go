@@ -0,0 +1,109 @@
+package zygo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const collectionsTestScript = `
+(def odd (fn [x] (== (mod x 2) 1)))
+(def results [
+  (filter odd [1 2 3]) (filter odd (list 1 2 3)) (filter (fn [[k v]] (odd v)) {a:1 b:2})
+  (reduce + 0 [1 2 3]) (reduce (fn [acc x] (* acc x)) (list 1 2 3 4))
+  (sort [3 1 2]) (sort {b:1 a:2}) (sortBy (fn [[k v]] v) {a:3 b:1 c:2})
+  (groupBy odd [1 2 3]) (groupBy (fn [[k v]] v) {a:1 b:2 c:1})
+  (zip [1 2 3] (list 4 5)) (zip (list 1 2) [3 4] [5 6])
+  (distinct (list 1 2 1 "x" "x")) (take 2 {a:1 b:2 c:3}) (drop 1 [1 2 3])
+  (any? odd [2 4 5]) (every? odd [1 3 4])
+  (frequencies [1 2 1 true 1.5 true]) (frequencies {a:1 b:1})
+  (numRange 3) (numRange 1 7 2) (numRange 3 0 -1) (numRange 0 0.5 0.25)])
+`
+
+const collectionsTestResults = `[[1 3] (1 3) {a:1} 6 24 [1 2 3] {a:2 b:1} {b:1 c:2 a:3} {true:[1 3] false:[2]} {1:{a:1 c:1} 2:{b:2}} [[1 4] [2 5]] ((1 3 5) (2 4 6)) (1 2 "x") {a:1 b:2} [2 3] true false {1:2 2:1 true:2 1.5:1} {1:2} [0 1 2] [1 3 5] [3 2 1] [0 0.25]]`
+
+func Test290CollectionFunctions(t *testing.T) {
+
+	cv.Convey(`Given the collection functions, they should work alike on arrays, lists and hashes, giving back the kind they were given`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		res, err := env.EvalString(collectionsTestScript + `results`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, collectionsTestResults)
+
+		// range with a body still loops, over a hash or an array.
+		res, err = env.EvalString(`
+(def acc [])
+(range k v {a:1 b:2} (set acc (append acc (str k))))
+(range i x [10 20] (set acc (append acc (str (+ i x)))))
+(concat [] acc)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["a" "b" "10" "21"]`)
+
+		// with no body, (range k v coll) is still a loop, and
+		// numRange takes numbers held in variables.
+		res, err = env.EvalString(`
+(range k v {a:1 b:2})
+(def lo 1) (def hi 4) (def step 2)
+[(numRange hi) (numRange lo hi) (numRange lo hi step)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[[0 1 2 3] [1 2 3] [1 3]]`)
+
+		// and a script may still define its own filter.
+		res, err = env.EvalString(`(defn filter [lst f] "own") (filter [1] odd)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"own"`)
+	})
+
+	cv.Convey(`Given bad arguments, the collection functions should say what they wanted`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`(def odd (fn [x] (== (mod x 2) 1)))`)
+		cv.So(err, cv.ShouldBeNil)
+
+		for src, msg := range map[string]string{
+			`(filter odd 5)`:              "expected an array, list or hash",
+			`(filter 5 [1])`:              "first argument must be a function",
+			`(reduce + [])`:               "reduce of an empty collection needs an initial value",
+			`(sort [1 "a"])`:              "cannot compare",
+			`(take -1 [1])`:               "first argument must be a count of zero or more",
+			`(numRange 1 2 0)`:            "numRange: step cannot be 0",
+			`(numRange "a")`:              `numRange: want numbers, not "a"`,
+			`(filter (fn [x] (odd)) [1])`: "expected 1 arguments, got 0",
+		} {
+			_, err = env.EvalString(src)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, msg)
+		}
+
+		env.SetLimits(Limits{MaxArrayLen: 10})
+		_, err = env.EvalString(`(numRange 11)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		_, isBudget := err.(*BudgetError)
+		cv.So(isBudget || strings.Contains(err.Error(), "array length"), cv.ShouldBeTrue)
+	})
+
+	cv.Convey(`Given compiled code using the collection functions and numRange, it should run as the source does`, t, func() {
+
+		comp := NewZlisp()
+		defer comp.Close()
+		comp.StandardSetup()
+		var buf bytes.Buffer
+		err := comp.Compile(&buf, strings.NewReader(collectionsTestScript+`results`), "collections.zy")
+		cv.So(err, cv.ShouldBeNil)
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		cv.So(env.LoadCompiled(&buf), cv.ShouldBeNil)
+		res, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, collectionsTestResults)
+	})
+}
@@ -50,7 +50,7 @@ func RemoveCommasFilter(x Sexp) bool {
 func (env *Zlisp) FilterAny(x Sexp, f Filter) (filtered Sexp, keep bool) {
 	switch ele := x.(type) {
 	case *SexpArray:
-		res := &SexpArray{Val: env.FilterArray(ele.Val, f), Typ: ele.Typ, IsFuncDeclTypeArray: ele.IsFuncDeclTypeArray, Env: env}
+		res := &SexpArray{Val: env.FilterArray(ele.Val, f), Typ: ele.Typ, IsFuncDeclTypeArray: ele.IsFuncDeclTypeArray, Env: env, Pos: ele.Pos}
 		return res, true
 	case *SexpPair:
 		return env.FilterList(ele, f), true
@@ -101,5 +101,5 @@ func (env *Zlisp) FilterList(h *SexpPair, f Filter) Sexp {
 		return h
 	}
 	res = env.FilterArray(arr, f)
-	return MakeList(res)
+	return inheritPos(MakeList(res), h.Pos)
 }
@@ -0,0 +1,1426 @@
+package zygo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Compiled code
+// =============
+//
+// Compile parses a script and generates its code just as
+// LoadFile would, then writes the instructions out, along
+// with the constants, functions, loops and symbols they
+// refer to, and the macros the script defined. LoadCompiled
+// reads them back, skipping the lexer, parser, macro
+// expansion and generator.
+//
+// A compiled file records the zygo version that wrote it
+// and a hash of its source. (source) and (import) look for
+// foo.zyc next to foo.zy, and use it only when both match;
+// otherwise they quietly read foo.zy as usual. Files pulled
+// in by (include) are baked in at compile time, and are not
+// covered by the hash.
+//
+// Code is generated against the builders and macros of the
+// compiling environment, so compile with the same setup
+// (StandardSetup, say) as the environment that loads it.
+
+// CompiledFormat is bumped whenever the layout of compiled
+// files changes.
+const CompiledFormat = 5
+
+const compiledMagic = "zygo compiled code"
+
+// ErrCompiledStale is matched, via errors.Is, when compiled
+// code, or an image, was written by another version of
+// zygo, or from source that has since changed.
+var ErrCompiledStale = errors.New("compiled code is stale")
+
+// CompiledPath returns where the compiled form of the
+// script at path is kept: foo.zy becomes foo.zyc.
+func CompiledPath(path string) string {
+	if strings.HasSuffix(path, ".zy") {
+		return path + "c"
+	}
+	return path + ".zyc"
+}
+
+type compiledHeader struct {
+	Magic      string
+	Format     int
+	Version    string
+	Source     string
+	SourceHash []byte
+}
+
+// compiledUnit is what follows the header. Symbols,
+// constants, loops and functions are kept in tables and
+// referred to by index, so that sharing, and cycles such as
+// a function whose scope refers back to it, survive.
+type compiledUnit struct {
+	Files   []string
+	Symbols []zycSym
+	Sexps   []zycSexp
+	Loops   []zycLoop
+	Funcs   []zycFunc
+	Frames  []zycFrame
+	Main    int
+	Macros  []zycMacro
+
+	// only images have these; see image.go.
+	Scopes  []zycScope
+	Stacks  []zycStack
+	Types   []zycType
+	Imports []zycImport
+	Rebound []string
+}
+
+// zycPos.File is 1 + an index into Files, 0 for none.
+type zycPos struct {
+	File, Line, Col int
+}
+
+type zycSym struct {
+	Name      string
+	IsDot     bool
+	IsSigil   bool
+	ColonTail bool
+	Sigil     string
+	Pos       zycPos
+}
+
+const (
+	zycSentinel = iota
+	zycInt
+	zycUint64
+	zycFloat
+	zycChar
+	zycStr
+	zycBool
+	zycSymbol
+	zycPair
+	zycArray
+	zycFunction
+	zycRaw
+	zycComma
+	zycSemicolon
+	zycHash
+	zycScopeStack
+	zycRegisteredType
+	zycField
+	zycError
+)
+
+type zycSexp struct {
+	Kind  int
+	Int   int64
+	Uint  uint64
+	Float float64
+	Str   string
+	Bytes []byte
+	Flag  bool
+	Flag2 bool
+	Ref   int   // the symbol or function
+	Kids  []int // pair head and tail, array elements, or hash keys and values
+	Pos   zycPos
+	Trace []zycFrameSite // where an error was raised
+}
+
+type zycFrameSite struct {
+	Func string
+	Pos  zycPos
+}
+
+type zycLoop struct {
+	Stmt, Label    int
+	ScopeDepth     int
+	LoopStart      int
+	LoopLen        int
+	BreakOffset    int
+	ContinueOffset int
+}
+
+// zycFrame is a lexFrame, with its Names in slot order;
+// Parent is an index into Frames, always less than the
+// frame's own, or -1.
+type zycFrame struct {
+	Names  []string
+	Fn     bool
+	Parent int
+}
+
+type zycFunc struct {
+	Name string
+	// Go functions, and builders, are looked up by name
+	// when loading.
+	Go      bool
+	Builder bool
+	Nargs   int
+	Varargs bool
+	HasBody bool
+	Code    []zycInstr
+	Pos     []zycPos
+	Orig    int
+	ArgSyms []int
+	// hashes of types, for (func ...), or -1.
+	InputTypes  int
+	ReturnTypes int
+	// in images, the captured scopes, an index into
+	// Stacks, and the enclosing function, or -1.
+	Closing     int
+	ClosingName string
+	Parent      int
+	ParentMain  bool
+	// the parameters as declared, and, for a function
+	// taking optional ones or &opts, their layout.
+	Sig    string
+	Params *zycParams
+}
+
+// zycParams is a paramSpec; see params.go.
+type zycParams struct {
+	Required int
+	Rest     bool
+	Opts     bool
+}
+
+type zycMacro struct {
+	Name string
+	Func int
+}
+
+const (
+	opJump = iota
+	opGoto
+	opBranch
+	opPush
+	opPushLazyArg
+	opPop
+	opDup
+	opEnvToStack
+	opPopStackPutEnv
+	opUpdate
+	opCall
+	opCallExpr
+	opDispatch
+	opReturn
+	opAddScope
+	opAddFuncScope
+	opRemoveScope
+	opExplode
+	opSquash
+	opBindlist
+	opVectorize
+	opHashize
+	opLabel
+	opBreak
+	opContinue
+	opLoopStart
+	opPushStackmark
+	opPopUntilStackmark
+	opClearStackmark
+	opDebug
+	opCreateClosure
+	opAssign
+	opPopScopeTransferToDataStack
+	opPrepareCall
+	opLoadLocal
+	opStoreLocal
+)
+
+// zycInstr holds any instruction; Op says which fields
+// mean what.
+type zycInstr struct {
+	Op   int
+	A    int
+	S    string
+	Flag bool
+	Ref  int // symbol, constant, loop or function
+	Refs []int
+	// for opCallExpr, the callSite: A is 1 + its index
+	// into Frames, 0 for none, and Locals its depths and
+	// refs; for opLoadLocal and opStoreLocal, Locals[0].
+	Locals []zycLocal
+}
+
+// zycLocal is a depth and a localRef, whose Frame is 1 +
+// its index into Frames, 0 for none.
+type zycLocal struct {
+	Depth    int
+	Frame    int
+	Shadowed bool
+}
+
+// Compile parses and generates the script read from src,
+// naming it name in positions, and writes the compiled code
+// to w. Macros defined by the script are defined in env too.
+func (env *Zlisp) Compile(w io.Writer, src io.Reader, name string) error {
+	text, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	prevName := env.parser.Filename()
+	defer env.parser.SetFilename(prevName)
+	env.parser.ResetAddNewInput(bufio.NewReader(bytes.NewReader(text)))
+	env.parser.SetFilename(name)
+	expressions, err := env.parser.ParseTokens()
+	if err != nil {
+		return &SourceError{Pos: env.parser.CurrentPos(),
+			Err: fmt.Errorf("Error on line %d: %v", env.parser.Linenum(), err)}
+	}
+	if env.WrapLoadExpressionsInInfix {
+		infixSym := env.MakeSymbol("infix")
+		expressions = []Sexp{MakeList([]Sexp{infixSym, &SexpArray{Val: expressions, Env: env}})}
+	}
+	expressions = env.FilterArray(expressions, RemoveCommentsFilter)
+	expressions = env.FilterArray(expressions, RemoveEndsFilter)
+
+	macros := make(map[int]*SexpFunction, len(env.macros))
+	for k, v := range env.macros {
+		macros[k] = v
+	}
+
+	gen := NewGenerator(env)
+	if err := gen.GenerateBegin(expressions); err != nil {
+		return sourceError(err)
+	}
+	gen.optimize()
+	main := env.MakeFunction("__main", 0, false, gen.instructions, nil)
+	main.positions = gen.positions
+
+	c := newCompiler(env)
+	if c.unit.Main, err = c.function(main); err != nil {
+		return err
+	}
+	for k, m := range env.macros {
+		if macros[k] == m || m.user {
+			continue
+		}
+		i, err := c.function(m)
+		if err != nil {
+			return err
+		}
+		c.unit.Macros = append(c.unit.Macros, zycMacro{Name: env.symbols.nameOf(k), Func: i})
+	}
+
+	sum := sha256.Sum256(text)
+	enc := gob.NewEncoder(w)
+	err = enc.Encode(&compiledHeader{
+		Magic:      compiledMagic,
+		Format:     CompiledFormat,
+		Version:    Version(),
+		Source:     name,
+		SourceHash: sum[:],
+	})
+	if err != nil {
+		return err
+	}
+	return enc.Encode(&c.unit)
+}
+
+// CompileFile compiles the script at path into out, or
+// into CompiledPath(path) if out is empty.
+func (env *Zlisp) CompileFile(path, out string) error {
+	if out == "" {
+		out = CompiledPath(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if err := env.Compile(&buf, f, path); err != nil {
+		return err
+	}
+	return os.WriteFile(out, buf.Bytes(), 0644)
+}
+
+// LoadCompiled loads code written by Compile, ready for
+// Run, as LoadFile does for source.
+func (env *Zlisp) LoadCompiled(r io.Reader) error {
+	unit, err := readCompiled(r, nil)
+	if err != nil {
+		return err
+	}
+	code, pos, err := env.installCompiled(unit)
+	if err != nil {
+		return err
+	}
+
+	if !env.ReachedEnd() {
+		env.mainfunc.appendCode([]Instruction{PopInstr(0)}, []SrcPos{{}})
+	}
+	env.mainfunc.appendCode(code, pos)
+	env.curfunc = env.mainfunc
+	return nil
+}
+
+// readCompiled checks the header, and the source hash if
+// wantHash is given, before decoding the rest.
+func readCompiled(r io.Reader, wantHash []byte) (*compiledUnit, error) {
+	dec := gob.NewDecoder(r)
+	var h compiledHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("not compiled zygo code: %v", err)
+	}
+	if h.Magic != compiledMagic {
+		return nil, fmt.Errorf("not compiled zygo code")
+	}
+	if h.Format != CompiledFormat || h.Version != Version() {
+		return nil, fmt.Errorf("%w: %s was compiled by zygo %s (format %d); this is %s (format %d)",
+			ErrCompiledStale, h.Source, h.Version, h.Format, Version(), CompiledFormat)
+	}
+	if wantHash != nil && !bytes.Equal(h.SourceHash, wantHash) {
+		return nil, fmt.Errorf("%w: %s has changed since it was compiled", ErrCompiledStale, h.Source)
+	}
+	unit := new(compiledUnit)
+	if err := dec.Decode(unit); err != nil {
+		return nil, fmt.Errorf("corrupt compiled code: %v", err)
+	}
+	return unit, nil
+}
+
+// sourceCompiled runs path's compiled form, if it has an
+// up-to-date one; done is false when it does not.
+func (env *Zlisp) sourceCompiled(path string) (done bool, err error) {
+	f, err := env.openFile(CompiledPath(path))
+	if err != nil {
+		return false, nil
+	}
+	defer f.Close()
+	text, err := env.readFile(path)
+	if err != nil {
+		return false, nil
+	}
+	sum := sha256.Sum256(text)
+	unit, err := readCompiled(bufio.NewReader(f), sum[:])
+	if err != nil {
+		return false, nil
+	}
+	code, pos, err := env.installCompiled(unit)
+	if err != nil {
+		return false, nil
+	}
+	return true, scriptError(env.sourceCode(code, pos))
+}
+
+type compiler struct {
+	env    *Zlisp
+	unit   compiledUnit
+	files  map[string]int
+	syms   map[*SexpSymbol]int
+	consts map[Sexp]int
+	loops  map[*Loop]int
+	funcs  map[*SexpFunction]int
+	frames map[*lexFrame]int
+
+	// image is set when writing an image, which keeps
+	// closures' captured scopes, and packages, as well.
+	image  bool
+	scopes map[*Scope]int
+	stacks map[*Stack]int
+	types  map[*RegisteredType]int
+}
+
+func newCompiler(env *Zlisp) *compiler {
+	return &compiler{
+		env:    env,
+		files:  make(map[string]int),
+		syms:   make(map[*SexpSymbol]int),
+		consts: make(map[Sexp]int),
+		loops:  make(map[*Loop]int),
+		funcs:  make(map[*SexpFunction]int),
+		frames: make(map[*lexFrame]int),
+		scopes: make(map[*Scope]int),
+		stacks: make(map[*Stack]int),
+		types:  make(map[*RegisteredType]int),
+	}
+}
+
+func (c *compiler) pos(p SrcPos) zycPos {
+	if !p.IsValid() {
+		return zycPos{}
+	}
+	f := 0
+	if p.File != "" {
+		i, ok := c.files[p.File]
+		if !ok {
+			i = len(c.unit.Files)
+			c.files[p.File] = i
+			c.unit.Files = append(c.unit.Files, p.File)
+		}
+		f = i + 1
+	}
+	return zycPos{File: f, Line: p.Line, Col: p.Col}
+}
+
+func (c *compiler) symbol(s *SexpSymbol) int {
+	if s == nil {
+		return -1
+	}
+	if i, ok := c.syms[s]; ok {
+		return i
+	}
+	i := len(c.unit.Symbols)
+	c.syms[s] = i
+	c.unit.Symbols = append(c.unit.Symbols, zycSym{
+		Name:      s.name,
+		IsDot:     s.isDot,
+		IsSigil:   s.isSigil,
+		ColonTail: s.colonTail,
+		Sigil:     s.sigil,
+		Pos:       c.pos(s.Pos),
+	})
+	return i
+}
+
+func (c *compiler) loop(l *Loop) int {
+	if l == nil {
+		return -1
+	}
+	if i, ok := c.loops[l]; ok {
+		return i
+	}
+	i := len(c.unit.Loops)
+	c.loops[l] = i
+	c.unit.Loops = append(c.unit.Loops, zycLoop{
+		Stmt:           c.symbol(l.stmtname),
+		Label:          c.symbol(l.label),
+		ScopeDepth:     l.scopeDepth,
+		LoopStart:      l.loopStart,
+		LoopLen:        l.loopLen,
+		BreakOffset:    l.breakOffset,
+		ContinueOffset: l.continueOffset,
+	})
+	return i
+}
+
+func (c *compiler) frame(f *lexFrame) int {
+	if f == nil {
+		return -1
+	}
+	if i, ok := c.frames[f]; ok {
+		return i
+	}
+	z := zycFrame{Fn: f.fn, Parent: c.frame(f.parent)}
+	for _, num := range f.names {
+		z.Names = append(z.Names, c.env.symbols.nameOf(num))
+	}
+	i := len(c.unit.Frames)
+	c.frames[f] = i
+	c.unit.Frames = append(c.unit.Frames, z)
+	return i
+}
+
+func (c *compiler) local(depth int, ref *localRef) zycLocal {
+	z := zycLocal{Depth: depth}
+	if ref != nil {
+		z.Frame, z.Shadowed = 1+c.frame(ref.frame), ref.shadowed
+	}
+	return z
+}
+
+func (c *compiler) sexps(xs []Sexp) ([]int, error) {
+	refs := make([]int, len(xs))
+	for i, x := range xs {
+		r, err := c.sexp(x)
+		if err != nil {
+			return nil, err
+		}
+		refs[i] = r
+	}
+	return refs, nil
+}
+
+func (c *compiler) sexp(x Sexp) (int, error) {
+	if x == nil {
+		return -1, nil
+	}
+	switch x.(type) {
+	case *SexpPair, *SexpArray, *SexpHash, *SexpField, *SexpFunction, *RegisteredType, *Stack, *SexpError:
+		if i, ok := c.consts[x]; ok {
+			return i, nil
+		}
+	}
+	i := len(c.unit.Sexps)
+	c.unit.Sexps = append(c.unit.Sexps, zycSexp{})
+
+	var z zycSexp
+	switch e := x.(type) {
+	case *SexpSentinel:
+		z = zycSexp{Kind: zycSentinel, Int: int64(e.Val)}
+	case *SexpInt:
+		z = zycSexp{Kind: zycInt, Int: e.Val}
+	case *SexpUint64:
+		z = zycSexp{Kind: zycUint64, Uint: e.Val}
+	case *SexpFloat:
+		z = zycSexp{Kind: zycFloat, Float: e.Val, Flag: e.Scientific}
+	case *SexpChar:
+		z = zycSexp{Kind: zycChar, Int: int64(e.Val)}
+	case *SexpStr:
+		z = zycSexp{Kind: zycStr, Str: e.S, Flag: e.backtick}
+	case *SexpBool:
+		z = zycSexp{Kind: zycBool, Flag: e.Val}
+	case *SexpSymbol:
+		z = zycSexp{Kind: zycSymbol, Ref: c.symbol(e)}
+	case *SexpRaw:
+		z = zycSexp{Kind: zycRaw, Bytes: e.Val, Flag: e.Base64}
+	case *SexpComma:
+		z = zycSexp{Kind: zycComma}
+	case *SexpSemicolon:
+		z = zycSexp{Kind: zycSemicolon}
+	case *SexpPair:
+		c.consts[x] = i
+		head, err := c.sexp(e.Head)
+		if err != nil {
+			return -1, err
+		}
+		tail, err := c.sexp(e.Tail)
+		if err != nil {
+			return -1, err
+		}
+		z = zycSexp{Kind: zycPair, Kids: []int{head, tail}, Pos: c.pos(e.Pos)}
+	case *SexpArray:
+		c.consts[x] = i
+		kids, err := c.sexps(e.Val)
+		if err != nil {
+			return -1, err
+		}
+		z = zycSexp{Kind: zycArray, Kids: kids, Flag: e.Infix,
+			Flag2: e.IsFuncDeclTypeArray, Pos: c.pos(e.Pos)}
+	case *SexpHash:
+		c.consts[x] = i
+		kids, err := c.hash(e)
+		if err != nil {
+			return -1, err
+		}
+		z = zycSexp{Kind: zycHash, Str: e.TypeName, Kids: kids}
+	case *SexpField:
+		c.consts[x] = i
+		kids, err := c.hash((*SexpHash)(e))
+		if err != nil {
+			return -1, err
+		}
+		z = zycSexp{Kind: zycField, Str: e.TypeName, Kids: kids}
+	case *RegisteredType:
+		c.consts[x] = i
+		t, err := c.registeredType(e)
+		if err != nil {
+			return -1, err
+		}
+		z = zycSexp{Kind: zycRegisteredType, Str: e.RegisteredName, Ref: t}
+	case *SexpError:
+		c.consts[x] = i
+		v, err := c.sexp(e.Value)
+		if err != nil {
+			return -1, err
+		}
+		z = zycSexp{Kind: zycError, Str: e.Error(), Ref: v, Pos: c.pos(e.Pos)}
+		for _, f := range e.Stack {
+			z.Trace = append(z.Trace, zycFrameSite{Func: f.Func, Pos: c.pos(f.Pos)})
+		}
+	case *Stack:
+		if !c.image {
+			return -1, fmt.Errorf("cannot compile a constant of type %T: %s", x, x.SexpString(nil))
+		}
+		c.consts[x] = i
+		s, err := c.stack(e)
+		if err != nil {
+			return -1, err
+		}
+		z = zycSexp{Kind: zycScopeStack, Ref: s}
+	case *SexpFunction:
+		c.consts[x] = i
+		f, err := c.function(e)
+		if err != nil {
+			return -1, err
+		}
+		z = zycSexp{Kind: zycFunction, Ref: f}
+	default:
+		if c.image {
+			return -1, fmt.Errorf("a value of type %T cannot be saved: %s", x, x.SexpString(nil))
+		}
+		return -1, fmt.Errorf("cannot compile a constant of type %T: %s", x, x.SexpString(nil))
+	}
+	c.unit.Sexps[i] = z
+	return i, nil
+}
+
+// hash lists the keys and values of h, in order. Deleted
+// keys stay in KeyOrder, so are skipped here.
+func (c *compiler) hash(h *SexpHash) ([]int, error) {
+	var kv []Sexp
+	for _, k := range h.KeyOrder {
+		v, err := h.HashGetDefault(c.env, k, SexpEnd)
+		if err != nil {
+			return nil, err
+		}
+		if v == SexpEnd {
+			continue
+		}
+		kv = append(kv, k, v)
+	}
+	return c.sexps(kv)
+}
+
+func (c *compiler) function(f *SexpFunction) (int, error) {
+	if i, ok := c.funcs[f]; ok {
+		return i, nil
+	}
+	i := len(c.unit.Funcs)
+	c.funcs[f] = i
+	c.unit.Funcs = append(c.unit.Funcs, zycFunc{})
+
+	if f.user {
+		c.unit.Funcs[i] = zycFunc{Name: f.name, Go: true, Builder: f.isBuilder}
+		return i, nil
+	}
+
+	z := zycFunc{
+		Name:        f.name,
+		Nargs:       f.nargs,
+		Varargs:     f.varargs,
+		HasBody:     f.hasBody,
+		Code:        make([]zycInstr, len(f.fun)),
+		Pos:         make([]zycPos, len(f.positions)),
+		InputTypes:  -1,
+		ReturnTypes: -1,
+		Closing:     -1,
+		Parent:      -1,
+		Sig:         f.sig,
+	}
+	if f.params != nil {
+		z.Params = &zycParams{Required: f.params.nreq, Rest: f.params.rest, Opts: f.params.opts}
+	}
+	for k, p := range f.positions {
+		z.Pos[k] = c.pos(p)
+	}
+	for _, s := range f.argSyms {
+		z.ArgSyms = append(z.ArgSyms, c.symbol(s))
+	}
+	var err error
+	if z.Orig, err = c.sexp(f.orig); err != nil {
+		return -1, err
+	}
+	if f.inputTypes != nil {
+		if z.InputTypes, err = c.sexp(f.inputTypes); err != nil {
+			return -1, err
+		}
+	}
+	if f.returnTypes != nil {
+		if z.ReturnTypes, err = c.sexp(f.returnTypes); err != nil {
+			return -1, err
+		}
+	}
+	if c.image {
+		if err := c.captured(f, &z); err != nil {
+			return -1, err
+		}
+	}
+	for k, instr := range f.fun {
+		if z.Code[k], err = c.instruction(instr); err != nil {
+			return -1, fmt.Errorf("cannot compile function '%s': %v", f.name, err)
+		}
+	}
+	c.unit.Funcs[i] = z
+	return i, nil
+}
+
+func (c *compiler) instruction(instr Instruction) (zycInstr, error) {
+	var err error
+	z := zycInstr{Ref: -1}
+	switch in := instr.(type) {
+	case JumpInstr:
+		z.Op, z.A, z.S = opJump, in.addpc, in.where
+	case GotoInstr:
+		z.Op, z.A = opGoto, in.location
+	case BranchInstr:
+		z.Op, z.A, z.Flag = opBranch, in.location, in.direction
+	case PushInstr:
+		z.Op = opPush
+		z.Ref, err = c.sexp(in.expr)
+	case PushLazyArgInstr:
+		z.Op = opPushLazyArg
+		z.Ref, err = c.sexp(in.expr)
+	case PopInstr:
+		z.Op, z.A = opPop, int(in)
+	case DupInstr:
+		z.Op, z.A = opDup, int(in)
+	case EnvToStackInstr:
+		z.Op, z.Ref = opEnvToStack, c.symbol(in.sym)
+	case PopStackPutEnvInstr:
+		z.Op, z.Ref = opPopStackPutEnv, c.symbol(in.sym)
+	case UpdateInstr:
+		z.Op, z.Ref = opUpdate, c.symbol(in.sym)
+	case CallInstr:
+		z.Op, z.Ref, z.A = opCall, c.symbol(in.sym), in.nargs
+	case CallExprInstr:
+		z.Op = opCallExpr
+		if z.Ref, err = c.sexp(in.callee); err == nil {
+			z.Refs, err = c.sexps(in.args)
+		}
+		if in.site != nil {
+			z.A = 1 + c.frame(in.site.lex)
+			for i, depth := range in.site.depths {
+				z.Locals = append(z.Locals, c.local(depth, in.site.ref(i)))
+			}
+		}
+	case LoadLocalInstr:
+		z.Op, z.Ref = opLoadLocal, c.symbol(in.sym)
+		z.Locals = []zycLocal{c.local(in.depth, in.ref)}
+	case StoreLocalInstr:
+		z.Op, z.Ref = opStoreLocal, c.symbol(in.sym)
+		z.Locals = []zycLocal{c.local(in.depth, in.ref)}
+	case DispatchInstr:
+		z.Op, z.A = opDispatch, in.nargs
+	case ReturnInstr:
+		z.Op = opReturn
+		if in.err != nil {
+			z.S, z.Flag = in.err.Error(), true
+		}
+	case AddScopeInstr:
+		z.Op, z.S, z.A = opAddScope, in.Name, 1+c.frame(in.frame)
+	case AddFuncScopeInstr:
+		z.Op, z.S = opAddFuncScope, in.Name
+		if in.Helper != nil {
+			z.A = 1 + c.frame(in.Helper.frame)
+			if in.Helper.MyFunction != nil {
+				z.Ref, err = c.function(in.Helper.MyFunction)
+			}
+		}
+	case RemoveScopeInstr:
+		z.Op = opRemoveScope
+	case ExplodeInstr:
+		z.Op, z.A = opExplode, int(in)
+	case SquashInstr:
+		z.Op, z.A = opSquash, int(in)
+	case BindlistInstr:
+		z.Op = opBindlist
+		for _, s := range in.syms {
+			z.Refs = append(z.Refs, c.symbol(s))
+		}
+	case VectorizeInstr:
+		z.Op, z.A = opVectorize, int(in)
+	case HashizeInstr:
+		z.Op, z.A, z.S = opHashize, in.HashLen, in.TypeName
+	case LabelInstr:
+		z.Op, z.S = opLabel, in.label
+	case *BreakInstr:
+		z.Op, z.Ref, z.A = opBreak, c.loop(in.loop), in.scopesToPop
+	case *ContinueInstr:
+		z.Op, z.Ref, z.A = opContinue, c.loop(in.loop), in.scopesToPop
+	case LoopStartInstr:
+		z.Op, z.Ref = opLoopStart, c.loop(in.loop)
+	case PushStackmarkInstr:
+		z.Op, z.Ref = opPushStackmark, c.symbol(in.sym)
+	case PopUntilStackmarkInstr:
+		z.Op, z.Ref = opPopUntilStackmark, c.symbol(in.sym)
+	case ClearStackmarkInstr:
+		z.Op, z.Ref = opClearStackmark, c.symbol(in.sym)
+	case DebugInstr:
+		z.Op, z.S = opDebug, in.diagnostic
+	case CreateClosureInstr:
+		z.Op = opCreateClosure
+		z.Ref, err = c.function(in.sfun)
+	case AssignInstr:
+		z.Op = opAssign
+	case PopScopeTransferToDataStackInstr:
+		z.Op, z.S = opPopScopeTransferToDataStack, in.PackageName
+	case PrepareCallInstr:
+		z.Op, z.Ref, z.A = opPrepareCall, c.symbol(in.sym), in.nargs
+	default:
+		return z, fmt.Errorf("unknown instruction %T", instr)
+	}
+	return z, err
+}
+
+// loader rebuilds compiled code in env.
+type loader struct {
+	env    *Zlisp
+	unit   *compiledUnit
+	syms   []*SexpSymbol
+	sexps  []Sexp
+	loops  []*Loop
+	frames []*lexFrame
+	funcs  []*SexpFunction
+	scopes []*Scope
+	stacks []*Stack
+	types  []*RegisteredType
+}
+
+var errCorruptCompiled = errors.New("corrupt compiled code")
+
+// installCompiled rebuilds the code in unit, defining its
+// macros in env, and returns the top-level code.
+func (env *Zlisp) installCompiled(unit *compiledUnit) ([]Instruction, []SrcPos, error) {
+	ld := &loader{env: env, unit: unit}
+	if err := ld.load(); err != nil {
+		return nil, nil, err
+	}
+	main, err := ld.function(unit.Main)
+	if err != nil || main == nil || main.user {
+		return nil, nil, errCorruptCompiled
+	}
+	if err := ld.macros(); err != nil {
+		return nil, nil, err
+	}
+	return main.fun, main.positions, nil
+}
+
+// macros defines the unit's macros in env.
+func (ld *loader) macros() error {
+	for _, m := range ld.unit.Macros {
+		f, err := ld.function(m.Func)
+		if err != nil || f == nil {
+			return errCorruptCompiled
+		}
+		ld.env.macros[ld.env.MakeSymbol(m.Name).number] = f
+	}
+	return nil
+}
+
+func (ld *loader) pos(p zycPos) SrcPos {
+	sp := SrcPos{Line: p.Line, Col: p.Col}
+	if p.File > 0 && p.File <= len(ld.unit.Files) {
+		sp.File = ld.unit.Files[p.File-1]
+	}
+	return sp
+}
+
+func (ld *loader) symbol(i int) (*SexpSymbol, error) {
+	if i == -1 {
+		return nil, nil
+	}
+	if i < 0 || i >= len(ld.syms) {
+		return nil, errCorruptCompiled
+	}
+	return ld.syms[i], nil
+}
+
+func (ld *loader) sexp(i int) (Sexp, error) {
+	if i == -1 {
+		return nil, nil
+	}
+	if i < 0 || i >= len(ld.sexps) {
+		return nil, errCorruptCompiled
+	}
+	return ld.sexps[i], nil
+}
+
+func (ld *loader) loop(i int) (*Loop, error) {
+	if i < 0 || i >= len(ld.loops) {
+		return nil, errCorruptCompiled
+	}
+	return ld.loops[i], nil
+}
+
+func (ld *loader) function(i int) (*SexpFunction, error) {
+	if i == -1 {
+		return nil, nil
+	}
+	if i < 0 || i >= len(ld.funcs) {
+		return nil, errCorruptCompiled
+	}
+	return ld.funcs[i], nil
+}
+
+// frame returns the frame at a, 1 + its index, or nil for 0.
+func (ld *loader) frame(a int) (*lexFrame, error) {
+	if a == 0 {
+		return nil, nil
+	}
+	if a < 0 || a > len(ld.frames) {
+		return nil, errCorruptCompiled
+	}
+	return ld.frames[a-1], nil
+}
+
+// local rebuilds the depth and ref of sym, if it was placed.
+func (ld *loader) local(sym *SexpSymbol, z zycLocal) (int, *localRef, error) {
+	frame, err := ld.frame(z.Frame)
+	if err != nil || frame == nil {
+		return z.Depth, nil, err
+	}
+	if sym == nil {
+		return 0, nil, errCorruptCompiled
+	}
+	slot, ok := frame.slot(sym.number)
+	if !ok {
+		return 0, nil, errCorruptCompiled
+	}
+	return z.Depth, &localRef{frame: frame, slot: slot, shadowed: z.Shadowed}, nil
+}
+
+// load makes every symbol, loop, function and constant,
+// then fills in the functions and composite constants, as
+// they may refer to each other.
+func (ld *loader) load() error {
+	env, unit := ld.env, ld.unit
+
+	ld.syms = make([]*SexpSymbol, len(unit.Symbols))
+	for i, z := range unit.Symbols {
+		ld.syms[i] = &SexpSymbol{
+			name:      z.Name,
+			number:    env.symbols.intern(z.Name),
+			isDot:     z.IsDot,
+			isSigil:   z.IsSigil,
+			colonTail: z.ColonTail,
+			sigil:     z.Sigil,
+			Pos:       ld.pos(z.Pos),
+		}
+	}
+
+	ld.frames = make([]*lexFrame, len(unit.Frames))
+	for i, z := range unit.Frames {
+		f := &lexFrame{slots: make(map[int]int), fn: z.Fn}
+		if z.Parent >= 0 {
+			if z.Parent >= i {
+				return errCorruptCompiled
+			}
+			f.parent = ld.frames[z.Parent]
+		}
+		for _, name := range z.Names {
+			num := env.symbols.intern(name)
+			if _, dup := f.slots[num]; dup {
+				return errCorruptCompiled
+			}
+			f.addName(num)
+		}
+		ld.frames[i] = f
+	}
+
+	ld.loops = make([]*Loop, len(unit.Loops))
+	for i, z := range unit.Loops {
+		stmt, err := ld.symbol(z.Stmt)
+		if err != nil {
+			return err
+		}
+		label, err := ld.symbol(z.Label)
+		if err != nil {
+			return err
+		}
+		ld.loops[i] = &Loop{
+			stmtname:       stmt,
+			label:          label,
+			scopeDepth:     z.ScopeDepth,
+			loopStart:      z.LoopStart,
+			loopLen:        z.LoopLen,
+			breakOffset:    z.BreakOffset,
+			continueOffset: z.ContinueOffset,
+		}
+	}
+
+	if err := ld.makeImage(); err != nil {
+		return err
+	}
+
+	ld.funcs = make([]*SexpFunction, len(unit.Funcs))
+	for i, z := range unit.Funcs {
+		if z.Go {
+			f, err := env.goFunction(z.Name, z.Builder)
+			if err != nil {
+				return err
+			}
+			ld.funcs[i] = f
+			continue
+		}
+		ld.funcs[i] = env.MakeFunction(z.Name, z.Nargs, z.Varargs, nil, nil)
+	}
+
+	ld.sexps = make([]Sexp, len(unit.Sexps))
+	for i, z := range unit.Sexps {
+		var x Sexp
+		switch z.Kind {
+		case zycSentinel:
+			switch z.Int {
+			case 0:
+				x = SexpNull
+			case 1:
+				x = SexpEnd
+			case 2:
+				x = SexpMarker
+			default:
+				return errCorruptCompiled
+			}
+		case zycInt:
+			x = &SexpInt{Val: z.Int}
+		case zycUint64:
+			x = &SexpUint64{Val: z.Uint}
+		case zycFloat:
+			x = &SexpFloat{Val: z.Float, Scientific: z.Flag}
+		case zycChar:
+			x = &SexpChar{Val: rune(z.Int)}
+		case zycStr:
+			x = &SexpStr{S: z.Str, backtick: z.Flag}
+		case zycBool:
+			x = &SexpBool{Val: z.Flag}
+		case zycSymbol:
+			sym, err := ld.symbol(z.Ref)
+			if err != nil || sym == nil {
+				return errCorruptCompiled
+			}
+			x = sym
+		case zycRaw:
+			x = &SexpRaw{Val: z.Bytes, Base64: z.Flag}
+		case zycComma:
+			x = &SexpComma{}
+		case zycSemicolon:
+			x = &SexpSemicolon{}
+		case zycPair:
+			x = &SexpPair{Pos: ld.pos(z.Pos)}
+		case zycArray:
+			x = &SexpArray{Env: env, Infix: z.Flag, IsFuncDeclTypeArray: z.Flag2, Pos: ld.pos(z.Pos)}
+		case zycHash:
+			// filled in below, once the keys and values exist.
+			x = &SexpHash{}
+		case zycField:
+			x = &SexpField{}
+		case zycRegisteredType:
+			rt, err := ld.registeredType(z.Ref, z.Str)
+			if err != nil {
+				return err
+			}
+			x = rt
+		case zycError:
+			// filled in below, as it may hold any value.
+			e := &SexpError{error: errors.New(z.Str), Pos: ld.pos(z.Pos)}
+			for _, f := range z.Trace {
+				e.Stack = append(e.Stack, StackFrame{Func: f.Func, Pos: ld.pos(f.Pos)})
+			}
+			x = e
+		case zycScopeStack:
+			if z.Ref < 0 || z.Ref >= len(ld.stacks) {
+				return errCorruptCompiled
+			}
+			x = ld.stacks[z.Ref]
+		case zycFunction:
+			f, err := ld.function(z.Ref)
+			if err != nil || f == nil {
+				return errCorruptCompiled
+			}
+			x = f
+		default:
+			return errCorruptCompiled
+		}
+		ld.sexps[i] = x
+	}
+
+	// fields go first, for the struct types that records
+	// are checked against; and, as a constant's parts come
+	// after it, going backwards fills in a hash's values
+	// before the hash itself.
+	for i, z := range unit.Sexps {
+		if x, ok := ld.sexps[i].(*SexpField); ok {
+			h, err := ld.hash(&z)
+			if err != nil {
+				return err
+			}
+			*x = SexpField(*h)
+		}
+	}
+	if err := ld.fillTypes(); err != nil {
+		return err
+	}
+	for i := len(unit.Sexps) - 1; i >= 0; i-- {
+		z := unit.Sexps[i]
+		switch x := ld.sexps[i].(type) {
+		case *SexpPair:
+			if len(z.Kids) != 2 {
+				return errCorruptCompiled
+			}
+			var err error
+			if x.Head, err = ld.sexp(z.Kids[0]); err != nil {
+				return err
+			}
+			if x.Tail, err = ld.sexp(z.Kids[1]); err != nil {
+				return err
+			}
+		case *SexpArray:
+			x.Val = make([]Sexp, len(z.Kids))
+			for k, kid := range z.Kids {
+				v, err := ld.sexp(kid)
+				if err != nil {
+					return err
+				}
+				x.Val[k] = v
+			}
+		case *SexpHash:
+			h, err := ld.hash(&z)
+			if err != nil {
+				return err
+			}
+			*x = *h
+		case *SexpError:
+			var err error
+			if x.Value, err = ld.sexp(z.Ref); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, z := range unit.Funcs {
+		if z.Go {
+			continue
+		}
+		if err := ld.fill(ld.funcs[i], &z); err != nil {
+			return err
+		}
+	}
+	return ld.fillImage()
+}
+
+func (ld *loader) hash(z *zycSexp) (*SexpHash, error) {
+	kv := make([]Sexp, len(z.Kids))
+	for k, kid := range z.Kids {
+		v, err := ld.sexp(kid)
+		if err != nil {
+			return nil, err
+		}
+		kv[k] = v
+	}
+	return MakeHash(kv, z.Str, ld.env)
+}
+
+// typeHash finds the hash of types at i, if any.
+func (ld *loader) typeHash(i int) (*SexpHash, error) {
+	x, err := ld.sexp(i)
+	if err != nil || x == nil {
+		return nil, err
+	}
+	h, ok := x.(*SexpHash)
+	if !ok {
+		return nil, errCorruptCompiled
+	}
+	return h, nil
+}
+
+func (ld *loader) fill(f *SexpFunction, z *zycFunc) error {
+	f.hasBody = z.HasBody
+	f.sig = z.Sig
+	if z.Params != nil {
+		f.params = &paramSpec{nreq: z.Params.Required, rest: z.Params.Rest, opts: z.Params.Opts}
+	}
+	orig, err := ld.sexp(z.Orig)
+	if err != nil {
+		return err
+	}
+	f.orig = orig
+	if len(z.ArgSyms) > 0 {
+		argsyms := make([]*SexpSymbol, len(z.ArgSyms))
+		for i, s := range z.ArgSyms {
+			if argsyms[i], err = ld.symbol(s); err != nil {
+				return err
+			}
+		}
+		f.SetFormalSymbols(argsyms)
+	}
+	f.positions = make([]SrcPos, len(z.Pos))
+	for i, p := range z.Pos {
+		f.positions[i] = ld.pos(p)
+	}
+	if f.inputTypes, err = ld.typeHash(z.InputTypes); err != nil {
+		return err
+	}
+	if f.returnTypes, err = ld.typeHash(z.ReturnTypes); err != nil {
+		return err
+	}
+	if err := ld.captured(f, z); err != nil {
+		return err
+	}
+	f.fun = make(ZlispFunction, len(z.Code))
+	for i := range z.Code {
+		if f.fun[i], err = ld.instruction(&z.Code[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ld *loader) instruction(z *zycInstr) (Instruction, error) {
+	var err error
+	switch z.Op {
+	case opJump:
+		return JumpInstr{addpc: z.A, where: z.S}, nil
+	case opGoto:
+		return GotoInstr{location: z.A}, nil
+	case opBranch:
+		return BranchInstr{direction: z.Flag, location: z.A}, nil
+	case opPush:
+		var x Sexp
+		x, err = ld.sexp(z.Ref)
+		return PushInstr{expr: x}, err
+	case opPushLazyArg:
+		var x Sexp
+		x, err = ld.sexp(z.Ref)
+		return PushLazyArgInstr{expr: x}, err
+	case opPop:
+		return PopInstr(z.A), nil
+	case opDup:
+		return DupInstr(z.A), nil
+	case opEnvToStack, opPopStackPutEnv, opUpdate, opCall,
+		opPushStackmark, opPopUntilStackmark, opClearStackmark, opPrepareCall,
+		opLoadLocal, opStoreLocal:
+		sym, err := ld.symbol(z.Ref)
+		if err != nil || sym == nil {
+			return nil, errCorruptCompiled
+		}
+		switch z.Op {
+		case opEnvToStack:
+			return EnvToStackInstr{sym: sym}, nil
+		case opPopStackPutEnv:
+			return PopStackPutEnvInstr{sym: sym}, nil
+		case opUpdate:
+			return UpdateInstr{sym: sym}, nil
+		case opCall:
+			return CallInstr{sym: sym, nargs: z.A}, nil
+		case opPushStackmark:
+			return PushStackmarkInstr{sym: sym}, nil
+		case opPopUntilStackmark:
+			return PopUntilStackmarkInstr{sym: sym}, nil
+		case opClearStackmark:
+			return ClearStackmarkInstr{sym: sym}, nil
+		case opLoadLocal, opStoreLocal:
+			if len(z.Locals) != 1 {
+				return nil, errCorruptCompiled
+			}
+			depth, ref, err := ld.local(sym, z.Locals[0])
+			if err != nil || ref == nil {
+				return nil, errCorruptCompiled
+			}
+			if z.Op == opLoadLocal {
+				return LoadLocalInstr{sym: sym, depth: depth, ref: ref}, nil
+			}
+			return StoreLocalInstr{sym: sym, depth: depth, ref: ref}, nil
+		default:
+			return PrepareCallInstr{sym: sym, nargs: z.A}, nil
+		}
+	case opCallExpr:
+		in := CallExprInstr{args: make([]Sexp, len(z.Refs))}
+		if in.callee, err = ld.sexp(z.Ref); err != nil {
+			return nil, err
+		}
+		for i, r := range z.Refs {
+			if in.args[i], err = ld.sexp(r); err != nil {
+				return nil, err
+			}
+		}
+		if z.A > 0 {
+			if z.A > len(ld.frames) || (z.Locals != nil && len(z.Locals) != len(in.args)+1) {
+				return nil, errCorruptCompiled
+			}
+			site := &callSite{lex: ld.frames[z.A-1]}
+			if z.Locals != nil {
+				site.depths = make([]int, len(z.Locals))
+				site.refs = make([]*localRef, len(z.Locals))
+				for i, x := range append([]Sexp{in.callee}, in.args...) {
+					sym, _ := x.(*SexpSymbol)
+					if site.depths[i], site.refs[i], err = ld.local(sym, z.Locals[i]); err != nil {
+						return nil, err
+					}
+				}
+			}
+			in.site = site
+		}
+		return in, nil
+	case opDispatch:
+		return DispatchInstr{nargs: z.A}, nil
+	case opReturn:
+		if z.Flag {
+			return ReturnInstr{err: errors.New(z.S)}, nil
+		}
+		return ReturnInstr{}, nil
+	case opAddScope:
+		frame, err := ld.frame(z.A)
+		if err != nil {
+			return nil, err
+		}
+		return AddScopeInstr{Name: z.S, frame: frame}, nil
+	case opAddFuncScope:
+		f, err := ld.function(z.Ref)
+		if err != nil {
+			return nil, err
+		}
+		frame, err := ld.frame(z.A)
+		if err != nil {
+			return nil, err
+		}
+		return AddFuncScopeInstr{Name: z.S, Helper: &AddFuncScopeHelper{MyFunction: f, frame: frame}}, nil
+	case opRemoveScope:
+		return RemoveScopeInstr{}, nil
+	case opExplode:
+		return ExplodeInstr(z.A), nil
+	case opSquash:
+		return SquashInstr(z.A), nil
+	case opBindlist:
+		syms := make([]*SexpSymbol, len(z.Refs))
+		for i, r := range z.Refs {
+			if syms[i], err = ld.symbol(r); err != nil {
+				return nil, err
+			}
+		}
+		return BindlistInstr{syms: syms}, nil
+	case opVectorize:
+		return VectorizeInstr(z.A), nil
+	case opHashize:
+		return HashizeInstr{HashLen: z.A, TypeName: z.S}, nil
+	case opLabel:
+		return LabelInstr{label: z.S}, nil
+	case opBreak, opContinue, opLoopStart:
+		loop, err := ld.loop(z.Ref)
+		if err != nil {
+			return nil, err
+		}
+		switch z.Op {
+		case opBreak:
+			return &BreakInstr{loop: loop, scopesToPop: z.A}, nil
+		case opContinue:
+			return &ContinueInstr{loop: loop, scopesToPop: z.A}, nil
+		default:
+			return LoopStartInstr{loop: loop}, nil
+		}
+	case opDebug:
+		return DebugInstr{diagnostic: z.S}, nil
+	case opCreateClosure:
+		f, err := ld.function(z.Ref)
+		if err != nil || f == nil {
+			return nil, errCorruptCompiled
+		}
+		return CreateClosureInstr{sfun: f}, nil
+	case opAssign:
+		return AssignInstr{}, nil
+	case opPopScopeTransferToDataStack:
+		return PopScopeTransferToDataStackInstr{PackageName: z.S}, nil
+	}
+	return nil, errCorruptCompiled
+}
+
+// goFunction finds the builtin, or builder, named name,
+// for compiled code that refers to one directly.
+func (env *Zlisp) goFunction(name string, builder bool) (*SexpFunction, error) {
+	if !builder {
+		if f, ok := env.builtins[env.MakeSymbol(name).number]; ok {
+			return f, nil
+		}
+	}
+	if x, found := env.FindObject(name); found {
+		if f, ok := x.(*SexpFunction); ok && f.user && f.isBuilder == builder {
+			return f, nil
+		}
+	}
+	kind := "Go function"
+	if builder {
+		kind = "builder"
+	}
+	return nil, fmt.Errorf("compiled code refers to %s '%s', which this environment lacks", kind, name)
+}
@@ -0,0 +1,107 @@
+package zygo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const compileTestScript = `
+(defmac twice [x] ^(begin ~x ~x))
+(defn counter [] (let [n 0] (fn [] (set n (+ n 1)) n)))
+(def c (counter))
+(twice (c))
+(def evens [])
+(for [(def i 0) (< i 20) (set i (+ i 1))]
+  (cond (> i 9) (break)
+        (== 1 (mod i 2)) (continue)
+        (set evens (append evens i))))
+(struct Point [(field x: int64) (field y: int64)])
+(def p (Point x: 3 y: 4))
+(def h {a: 1 b: [1 2 3]})
+[(c) evens (:x p) (:b h) (quote (a "b" 'c' 1.5))]
+`
+
+func Test110CompiledCodeRunsLikeSource(t *testing.T) {
+
+	cv.Convey(`Given a script using macros, closures, loops, structs and literals, LoadCompiled should give the same answer as loading its source`, t, func() {
+
+		src := NewZlisp()
+		defer src.Close()
+		src.StandardSetup()
+		want, err := src.EvalString(compileTestScript)
+		panicOn(err)
+
+		comp := NewZlisp()
+		defer comp.Close()
+		comp.StandardSetup()
+		var buf bytes.Buffer
+		err = comp.Compile(&buf, strings.NewReader(compileTestScript), "script.zy")
+		cv.So(err, cv.ShouldBeNil)
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		err = env.LoadCompiled(&buf)
+		cv.So(err, cv.ShouldBeNil)
+		got, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(got.SexpString(nil), cv.ShouldEqual, want.SexpString(nil))
+
+		// the macro came along, and the code keeps its positions.
+		res, err := env.EvalString(`(def k 0) (twice (set k (+ k 1))) k`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 2)
+		fn, _ := env.FindObject("counter")
+		cv.So(fn.(*SexpFunction).PosAt(1).File, cv.ShouldEqual, "script.zy")
+	})
+
+	cv.Convey(`Given compiled code from another version, LoadCompiled should refuse it`, t, func() {
+
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		panicOn(enc.Encode(&compiledHeader{Magic: compiledMagic, Format: CompiledFormat, Version: "v0.0.0/old"}))
+		panicOn(enc.Encode(&compiledUnit{}))
+
+		env := NewZlisp()
+		defer env.Close()
+		err := env.LoadCompiled(&buf)
+		cv.So(errors.Is(err, ErrCompiledStale), cv.ShouldBeTrue)
+	})
+}
+
+func Test111SourceUsesUpToDateCompiledCode(t *testing.T) {
+
+	cv.Convey(`Given foo.zy and a foo.zyc compiled from it, (source) should run the compiled code until foo.zy changes`, t, func() {
+
+		dir := t.TempDir()
+		path := filepath.Join(dir, "foo.zy")
+		text := "(def a 1)\n(+ a nope)\n"
+		panicOn(os.WriteFile(path, []byte(text), 0644))
+
+		// compile under another name, so that errors tell us
+		// which of the two ran.
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		var buf bytes.Buffer
+		panicOn(env.Compile(&buf, strings.NewReader(text), "compiled.zy"))
+		panicOn(os.WriteFile(CompiledPath(path), buf.Bytes(), 0644))
+
+		_, err := env.EvalString(`(source "` + path + `")`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "compiled.zy:2:6: symbol `nope` not found")
+
+		panicOn(os.WriteFile(path, []byte(text+"// edited\n"), 0644))
+		env.Clear()
+		_, err = env.EvalString(`(source "` + path + `")`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, path+":2:6: symbol `nope` not found")
+	})
+}
@@ -0,0 +1,579 @@
+package zygo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Debug Adapter Protocol
+// ======================
+//
+// zygo -dap :port listens for an editor to connect, and
+// serves it one debug session at a time over the Debug
+// Adapter Protocol, on top of Debugger. Each session gets
+// a fresh environment; its launch request names the
+// script to run. There is one thread, with id 1.
+//
+// Requests that look at the script (stackTrace, scopes,
+// variables, evaluate) and those that resume it are only
+// answered while it is stopped, and run on the goroutine
+// running the script.
+
+const dapThreadID = 1
+
+// ServeDAP accepts debug sessions on addr, serving each in
+// turn with an environment from newEnv.
+func ServeDAP(addr string, newEnv func() *Zlisp) error {
+	lsn, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer lsn.Close()
+	fmt.Fprintf(os.Stderr, "zygo debug adapter listening on %s\n", lsn.Addr())
+	for {
+		conn, err := lsn.Accept()
+		if err != nil {
+			return err
+		}
+		err = ServeDAPConn(conn, newEnv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "debug session ended: %v\n", err)
+		}
+	}
+}
+
+// ServeDAPConn serves a single debug session on conn,
+// returning when the client disconnects.
+func ServeDAPConn(conn io.ReadWriteCloser, newEnv func() *Zlisp) error {
+	defer conn.Close()
+	s := &dapSession{
+		r:     bufio.NewReader(conn),
+		w:     conn,
+		env:   newEnv(),
+		calls: make(chan dapCall),
+		done:  make(chan struct{}),
+	}
+	s.dbg = NewDebugger(s.env)
+	s.dbg.OnStop = s.onStop
+	return s.serve()
+}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+// dapCall is work for the script's goroutine while it is
+// stopped. If resume, the script then goes on per mode.
+type dapCall struct {
+	run    func()
+	resume bool
+	mode   StepMode
+}
+
+type dapSession struct {
+	r   *bufio.Reader
+	w   io.Writer
+	wmu sync.Mutex
+	seq int
+
+	env *Zlisp
+	dbg *Debugger
+
+	program     string
+	stopOnEntry bool
+	launched    bool
+	configured  bool
+	started     bool
+
+	mu          sync.Mutex
+	stopped     bool
+	terminating bool
+	calls       chan dapCall
+	done        chan struct{}
+
+	// belong to the script's goroutine; reset at each stop.
+	stops  int
+	frames []DebugFrame
+	refs   [][]dapVariableSource
+}
+
+// dapVariableSource is a variable whose children, if it
+// has any, can be asked for.
+type dapVariableSource struct {
+	name  string
+	value Sexp
+}
+
+func (s *dapSession) serve() error {
+	defer s.shutdown()
+	for {
+		req, err := s.read()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if s.handle(req) {
+			return nil
+		}
+	}
+}
+
+func (s *dapSession) read() (*dapRequest, error) {
+	buf, err := readFramed(s.r)
+	if err != nil {
+		return nil, err
+	}
+	var req dapRequest
+	if err := json.Unmarshal(buf, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (s *dapSession) send(msg interface{}) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	switch m := msg.(type) {
+	case *dapResponse:
+		m.Seq = s.seq
+	case *dapEvent:
+		m.Seq = s.seq
+	}
+	writeFramed(s.w, msg)
+}
+
+// readFramed reads one Content-Length framed message, as
+// both the debug adapter and language server protocols
+// send them.
+func readFramed(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if length < 0 {
+				continue
+			}
+			break
+		}
+		if v, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+			length, err = strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("bad Content-Length header '%s'", line)
+			}
+		}
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeFramed writes msg as JSON with a Content-Length header.
+func writeFramed(w io.Writer, msg interface{}) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	return err
+}
+
+func (s *dapSession) respond(req *dapRequest, body interface{}) {
+	s.send(&dapResponse{Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body})
+}
+
+func (s *dapSession) fail(req *dapRequest, err error) {
+	s.send(&dapResponse{Type: "response", RequestSeq: req.Seq, Command: req.Command, Message: err.Error()})
+}
+
+func (s *dapSession) event(name string, body interface{}) {
+	s.send(&dapEvent{Type: "event", Event: name, Body: body})
+}
+
+// handle answers req, reporting whether the session is over.
+func (s *dapSession) handle(req *dapRequest) bool {
+	var err error
+	switch req.Command {
+	case "initialize":
+		s.respond(req, map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		})
+		s.event("initialized", nil)
+	case "launch":
+		var args struct {
+			Program     string `json:"program"`
+			StopOnEntry bool   `json:"stopOnEntry"`
+		}
+		if err = json.Unmarshal(req.Arguments, &args); err != nil {
+			break
+		}
+		if args.Program == "" {
+			err = errors.New("launch needs a program to run")
+			break
+		}
+		s.program, s.stopOnEntry, s.launched = args.Program, args.StopOnEntry, true
+		s.respond(req, nil)
+		s.maybeStart()
+	case "configurationDone":
+		s.configured = true
+		s.respond(req, nil)
+		s.maybeStart()
+	case "setBreakpoints":
+		err = s.setBreakpoints(req)
+	case "setFunctionBreakpoints":
+		err = s.setFunctionBreakpoints(req)
+	case "setExceptionBreakpoints":
+		s.respond(req, map[string]interface{}{"breakpoints": []interface{}{}})
+	case "threads":
+		s.respond(req, map[string]interface{}{
+			"threads": []interface{}{map[string]interface{}{"id": dapThreadID, "name": "main"}},
+		})
+	case "pause":
+		s.dbg.Pause()
+		s.respond(req, nil)
+	case "stackTrace", "scopes", "variables", "evaluate":
+		err = s.whileStopped(req, false, DebugContinue)
+	case "continue":
+		err = s.whileStopped(req, true, DebugContinue)
+	case "next":
+		err = s.whileStopped(req, true, DebugStepOver)
+	case "stepIn":
+		err = s.whileStopped(req, true, DebugStepIn)
+	case "stepOut":
+		err = s.whileStopped(req, true, DebugStepOut)
+	case "terminate":
+		s.terminate()
+		s.respond(req, nil)
+	case "disconnect":
+		s.terminate()
+		s.respond(req, nil)
+		return true
+	default:
+		err = fmt.Errorf("unsupported request '%s'", req.Command)
+	}
+	if err != nil {
+		s.fail(req, err)
+	}
+	return false
+}
+
+func (s *dapSession) setBreakpoints(req *dapRequest) error {
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line      int    `json:"line"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return err
+	}
+	s.dbg.ClearFileBreakpoints(args.Source.Path)
+	set := []interface{}{}
+	for _, b := range args.Breakpoints {
+		bp := s.dbg.SetBreakpoint(args.Source.Path, b.Line, b.Condition)
+		set = append(set, map[string]interface{}{"id": bp.ID, "verified": true, "line": bp.Line})
+	}
+	s.respond(req, map[string]interface{}{"breakpoints": set})
+	return nil
+}
+
+func (s *dapSession) setFunctionBreakpoints(req *dapRequest) error {
+	var args struct {
+		Breakpoints []struct {
+			Name      string `json:"name"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return err
+	}
+	s.dbg.ClearFuncBreakpoints()
+	set := []interface{}{}
+	for _, b := range args.Breakpoints {
+		bp := s.dbg.SetFuncBreakpoint(b.Name, b.Condition)
+		set = append(set, map[string]interface{}{"id": bp.ID, "verified": true})
+	}
+	s.respond(req, map[string]interface{}{"breakpoints": set})
+	return nil
+}
+
+// maybeStart runs the script once it is both launched and
+// configured.
+func (s *dapSession) maybeStart() {
+	if !s.launched || !s.configured || s.started {
+		return
+	}
+	s.started = true
+	if s.stopOnEntry {
+		s.dbg.Pause()
+	}
+	go s.run()
+}
+
+func (s *dapSession) run() {
+	defer close(s.done)
+	exitCode := 0
+	err := s.load()
+	if err == nil {
+		_, err = s.env.Run()
+	}
+	if err != nil && !errors.Is(err, ErrDebugTerminated) {
+		exitCode = 1
+		s.event("output", map[string]interface{}{"category": "stderr", "output": err.Error() + "\n"})
+	}
+	s.event("exited", map[string]interface{}{"exitCode": exitCode})
+	s.event("terminated", nil)
+}
+
+func (s *dapSession) load() error {
+	file, err := os.Open(s.program)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return loadScript(s.env, file)
+}
+
+// whileStopped hands req to the script's goroutine, which
+// must be stopped.
+func (s *dapSession) whileStopped(req *dapRequest, resume bool, mode StepMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return ErrNotStopped
+	}
+	if resume {
+		s.stopped = false
+	}
+	s.calls <- dapCall{run: func() { s.answer(req) }, resume: resume, mode: mode}
+	return nil
+}
+
+// terminate stops the script, whether it is running or
+// stopped.
+func (s *dapSession) terminate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.terminating = true
+	if s.stopped {
+		s.stopped = false
+		s.calls <- dapCall{run: func() {}, resume: true, mode: DebugTerminate}
+		return
+	}
+	s.dbg.Pause()
+}
+
+func (s *dapSession) shutdown() {
+	s.terminate()
+	if s.started {
+		<-s.done
+	}
+}
+
+// onStop runs on the script's goroutine.
+func (s *dapSession) onStop(d *Debugger, ev StopEvent) StepMode {
+	s.mu.Lock()
+	if s.terminating {
+		s.mu.Unlock()
+		return DebugTerminate
+	}
+	s.stopped = true
+	s.mu.Unlock()
+
+	s.stops++
+	s.frames = d.Frames()
+	s.refs = nil
+	body := map[string]interface{}{
+		"reason":            ev.Reason,
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+	}
+	if s.stops == 1 && s.stopOnEntry && ev.Reason == StopPause {
+		body["reason"] = "entry"
+	}
+	if ev.Breakpoint != nil {
+		body["hitBreakpointIds"] = []int{ev.Breakpoint.ID}
+	}
+	s.event("stopped", body)
+
+	for call := range s.calls {
+		call.run()
+		if call.resume {
+			return call.mode
+		}
+	}
+	return DebugTerminate
+}
+
+// answer runs on the script's goroutine, while it is stopped.
+func (s *dapSession) answer(req *dapRequest) {
+	switch req.Command {
+	case "stackTrace":
+		frames := []interface{}{}
+		for i, f := range s.frames {
+			frame := map[string]interface{}{
+				"id":     i,
+				"name":   f.Func,
+				"line":   f.Pos.Line,
+				"column": f.Pos.Col,
+			}
+			if f.Pos.File != "" {
+				path, err := filepath.Abs(f.Pos.File)
+				if err != nil {
+					path = f.Pos.File
+				}
+				frame["source"] = dapSource{Name: filepath.Base(path), Path: path}
+			}
+			frames = append(frames, frame)
+		}
+		s.respond(req, map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)})
+
+	case "scopes":
+		var args struct {
+			FrameID int `json:"frameId"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		if args.FrameID < 0 || args.FrameID >= len(s.frames) {
+			s.fail(req, fmt.Errorf("no frame %d", args.FrameID))
+			return
+		}
+		locals := s.newRef(s.frames[args.FrameID].Locals)
+		globals := s.newRef(s.dbg.Globals())
+		s.respond(req, map[string]interface{}{"scopes": []interface{}{
+			map[string]interface{}{"name": "Locals", "variablesReference": locals, "expensive": false},
+			map[string]interface{}{"name": "Globals", "variablesReference": globals, "expensive": true},
+		}})
+
+	case "variables":
+		var args struct {
+			Ref int `json:"variablesReference"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		if args.Ref < 1 || args.Ref > len(s.refs) {
+			s.fail(req, fmt.Errorf("no variables with reference %d", args.Ref))
+			return
+		}
+		vars := []dapVariable{}
+		for _, v := range s.refs[args.Ref-1] {
+			vars = append(vars, s.variable(v.name, v.value))
+		}
+		s.respond(req, map[string]interface{}{"variables": vars})
+
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+		}
+		json.Unmarshal(req.Arguments, &args)
+		res, err := s.dbg.Eval(args.Expression)
+		if err != nil {
+			s.fail(req, err)
+			return
+		}
+		v := s.variable("", res)
+		s.respond(req, map[string]interface{}{"result": v.Value, "type": v.Type, "variablesReference": v.VariablesReference})
+
+	default:
+		// resuming needs no more than the response.
+		s.respond(req, nil)
+	}
+}
+
+func (s *dapSession) newRef(vars []DebugVar) int {
+	src := make([]dapVariableSource, len(vars))
+	for i, v := range vars {
+		src[i] = dapVariableSource{name: v.Name, value: v.Value}
+	}
+	s.refs = append(s.refs, src)
+	return len(s.refs)
+}
+
+// variable describes value, giving arrays, lists and
+// hashes a reference to their elements.
+func (s *dapSession) variable(name string, value Sexp) dapVariable {
+	v := dapVariable{Name: name, Value: value.SexpString(nil), Type: fmt.Sprintf("%T", value)}
+	var kids []dapVariableSource
+	switch x := value.(type) {
+	case *SexpArray:
+		for i, e := range x.Val {
+			kids = append(kids, dapVariableSource{name: fmt.Sprintf("[%d]", i), value: e})
+		}
+	case *SexpPair:
+		elems, err := ListToArray(x)
+		if err == nil {
+			for i, e := range elems {
+				kids = append(kids, dapVariableSource{name: fmt.Sprintf("[%d]", i), value: e})
+			}
+		}
+	case *SexpHash:
+		for _, k := range x.KeyOrder {
+			val, err := x.HashGet(s.env, k)
+			if err != nil {
+				continue
+			}
+			key := k.SexpString(nil)
+			if sym, ok := k.(*SexpSymbol); ok {
+				key = sym.name
+			}
+			kids = append(kids, dapVariableSource{name: key, value: val})
+		}
+	}
+	if len(kids) > 0 {
+		s.refs = append(s.refs, kids)
+		v.VariablesReference = len(s.refs)
+	}
+	return v
+}
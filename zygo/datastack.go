@@ -3,6 +3,8 @@ package zygo
 import (
 	"errors"
 	"fmt"
+	"io"
+	"os"
 )
 
 type DataStackElem struct {
@@ -61,9 +63,17 @@ func (stack *Stack) GetExpr(n int) (Sexp, error) {
 }
 
 func (stack *Stack) PrintStack() {
+	out := io.Writer(os.Stdout)
+	if stack.env != nil {
+		out = stack.env.Output()
+	}
+	stack.fprintStack(out)
+}
+
+func (stack *Stack) fprintStack(w io.Writer) {
 	for i := 0; i <= stack.tos; i++ {
 		expr := stack.elements[i].(DataStackElem).expr
-		fmt.Println("\t" + expr.SexpString(nil))
+		fmt.Fprintln(w, "\t"+expr.SexpString(nil))
 	}
 }
 
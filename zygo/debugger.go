@@ -0,0 +1,536 @@
+package zygo
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Debugging
+// =========
+//
+// A Debugger attached to an environment with NewDebugger
+// stops the VM at breakpoints, between steps and when
+// asked to Pause, and calls OnStop on the goroutine that
+// is running the script. While OnStop runs, Frames, Eval
+// and Watches look at the paused script; what OnStop
+// returns says how to go on. ServeDAP speaks the Debug
+// Adapter Protocol on top of this.
+//
+// The VM stops only on arriving at a new line: a line
+// holding several expressions, or a loop all on one line,
+// is a single step.
+
+// StepMode says how the script goes on after a stop.
+type StepMode int
+
+const (
+	// DebugContinue runs on to the next breakpoint.
+	DebugContinue StepMode = iota
+	// DebugStepIn stops at the next line, inside any call.
+	DebugStepIn
+	// DebugStepOver stops at the next line of this call
+	// or its callers.
+	DebugStepOver
+	// DebugStepOut stops once this call has returned.
+	DebugStepOut
+	// DebugTerminate stops the script with ErrDebugTerminated.
+	DebugTerminate
+)
+
+// Reasons given in a StopEvent. They match the reasons
+// of the Debug Adapter Protocol's stopped event.
+const (
+	StopBreakpoint         = "breakpoint"
+	StopFunctionBreakpoint = "function breakpoint"
+	StopStep               = "step"
+	StopPause              = "pause"
+)
+
+// ErrDebugTerminated is returned from Run when OnStop
+// answers DebugTerminate. Like running out of budget, it
+// cannot be caught.
+var ErrDebugTerminated = errors.New("terminated by the debugger")
+
+var ErrNotStopped = errors.New("the debugger is not stopped")
+
+// Breakpoint stops the script on arriving at Line of
+// File or, when Func is set instead, on entering the
+// function of that name. If Cond is given, it is
+// evaluated first and the script stops only when it is
+// truthy.
+type Breakpoint struct {
+	ID   int
+	File string
+	Line int
+	Func string
+	Cond string
+
+	// Hits counts the stops made here.
+	Hits int
+}
+
+// StopEvent describes where and why the script stopped.
+type StopEvent struct {
+	Reason     string
+	Breakpoint *Breakpoint // a copy, for breakpoint stops.
+	Func       string
+	Pos        SrcPos
+}
+
+// DebugVar is a variable shown in a frame.
+type DebugVar struct {
+	Name  string
+	Value Sexp
+}
+
+// DebugFrame is a call in progress, innermost first.
+type DebugFrame struct {
+	Func   string
+	Pos    SrcPos
+	Locals []DebugVar
+}
+
+// DebugWatch is the value of a watch expression at a stop.
+type DebugWatch struct {
+	Expr  string
+	Value Sexp
+	Err   error
+}
+
+type Debugger struct {
+	// OnStop is called when the script stops. Without it
+	// stops are ignored.
+	OnStop func(d *Debugger, ev StopEvent) StepMode
+
+	env *Zlisp
+
+	mu      sync.Mutex
+	bps     []*Breakpoint
+	watches []string
+	nextID  int
+
+	pausing atomic.Bool
+
+	// the rest belong to the goroutine running the script.
+	mode       StepMode
+	from       debugSpot   // where the last stop was.
+	lines      []debugSpot // the last line seen by each call.
+	stopped    bool
+	evaluating bool
+}
+
+// debugSpot identifies a line within one call.
+type debugSpot struct {
+	fn    *SexpFunction
+	file  string
+	line  int
+	depth int
+}
+
+// NewDebugger attaches a new Debugger to env.
+func NewDebugger(env *Zlisp) *Debugger {
+	d := &Debugger{env: env}
+	env.debugger = d
+	return d
+}
+
+// Detach removes the debugger from its environment; the
+// script then runs on undisturbed.
+func (d *Debugger) Detach() {
+	if d.env.debugger == d {
+		d.env.debugger = nil
+	}
+}
+
+// SetBreakpoint stops the script on arriving at file:line.
+// file matches positions with the same absolute path or,
+// if it has no directory, with the same base name.
+func (d *Debugger) SetBreakpoint(file string, line int, cond string) *Breakpoint {
+	return d.addBreakpoint(&Breakpoint{File: file, Line: line, Cond: cond})
+}
+
+// SetFuncBreakpoint stops the script on entering any
+// function called name.
+func (d *Debugger) SetFuncBreakpoint(name string, cond string) *Breakpoint {
+	return d.addBreakpoint(&Breakpoint{Func: name, Cond: cond})
+}
+
+func (d *Debugger) addBreakpoint(bp *Breakpoint) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nextID++
+	bp.ID = d.nextID
+	d.bps = append(d.bps, bp)
+	cp := *bp
+	return &cp
+}
+
+// ClearBreakpoint removes the breakpoint with the given id,
+// reporting whether there was one.
+func (d *Debugger) ClearBreakpoint(id int) bool {
+	return d.clearBreakpoints(func(bp *Breakpoint) bool { return bp.ID == id }) > 0
+}
+
+// ClearFileBreakpoints removes the line breakpoints in file.
+func (d *Debugger) ClearFileBreakpoints(file string) {
+	d.clearBreakpoints(func(bp *Breakpoint) bool { return bp.Func == "" && bp.File == file })
+}
+
+// ClearFuncBreakpoints removes all function breakpoints.
+func (d *Debugger) ClearFuncBreakpoints() {
+	d.clearBreakpoints(func(bp *Breakpoint) bool { return bp.Func != "" })
+}
+
+func (d *Debugger) clearBreakpoints(match func(bp *Breakpoint) bool) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	kept := d.bps[:0]
+	for _, bp := range d.bps {
+		if !match(bp) {
+			kept = append(kept, bp)
+		}
+	}
+	n := len(d.bps) - len(kept)
+	d.bps = kept
+	return n
+}
+
+// Breakpoints returns copies of the breakpoints set.
+func (d *Debugger) Breakpoints() []Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bps := make([]Breakpoint, len(d.bps))
+	for i, bp := range d.bps {
+		bps[i] = *bp
+	}
+	return bps
+}
+
+// AddWatch adds an expression for Watches to evaluate.
+func (d *Debugger) AddWatch(expr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.watches = append(d.watches, expr)
+}
+
+// RemoveWatch removes a watch expression.
+func (d *Debugger) RemoveWatch(expr string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, w := range d.watches {
+		if w == expr {
+			d.watches = append(d.watches[:i], d.watches[i+1:]...)
+			return
+		}
+	}
+}
+
+// Pause asks the script to stop at the next line. It may
+// be called from any goroutine, and before the script
+// starts, to stop on its first line.
+func (d *Debugger) Pause() {
+	d.pausing.Store(true)
+}
+
+// start is called by Run as a top-level evaluation begins.
+func (d *Debugger) start() {
+	d.lines = d.lines[:0]
+	d.from = debugSpot{}
+}
+
+// before is called by Run ahead of each instruction.
+func (d *Debugger) before(fn *SexpFunction, pc int) error {
+	if d.evaluating {
+		return nil
+	}
+	pos := fn.PosAt(pc)
+	if !pos.IsValid() {
+		return nil
+	}
+	if opensFuncScope(fn) && pos == fn.PosAt(0) {
+		// setting up or leaving the call.
+		return nil
+	}
+	here := debugSpot{fn: fn, file: pos.File, line: pos.Line, depth: d.env.addrstack.Size()}
+	k := here.depth
+	for len(d.lines) <= k {
+		d.lines = append(d.lines, debugSpot{})
+	}
+	d.lines = d.lines[:k+1]
+	// coming back from the call being stepped over or
+	// out of stops at once, part way through the line.
+	returned := (d.mode == DebugStepOver || d.mode == DebugStepOut) && k < d.from.depth
+	if d.lines[k] == here && !returned {
+		return nil
+	}
+	entered := d.lines[k].fn != fn
+	d.lines[k] = here
+
+	ev := StopEvent{Func: fn.name, Pos: pos}
+	switch {
+	case d.pausing.Swap(false):
+		ev.Reason = StopPause
+	case d.stepDone(here):
+		ev.Reason = StopStep
+	default:
+		bp := d.breakpointAt(fn, pos, entered)
+		if bp == nil {
+			return nil
+		}
+		ev.Reason = StopBreakpoint
+		if bp.Func != "" {
+			ev.Reason = StopFunctionBreakpoint
+		}
+		ev.Breakpoint = bp
+	}
+
+	d.mode = DebugContinue
+	if d.OnStop == nil {
+		return nil
+	}
+	d.stopped = true
+	mode := d.OnStop(d, ev)
+	d.stopped = false
+	d.from = here
+	if mode == DebugTerminate {
+		return ErrDebugTerminated
+	}
+	d.mode = mode
+	return nil
+}
+
+func (d *Debugger) stepDone(here debugSpot) bool {
+	switch d.mode {
+	case DebugStepIn:
+		return here != d.from
+	case DebugStepOver:
+		return here.depth < d.from.depth ||
+			(here.depth == d.from.depth && here != d.from)
+	case DebugStepOut:
+		return here.depth < d.from.depth
+	}
+	return false
+}
+
+// breakpointAt returns a copy of the breakpoint to stop
+// at, if any, having counted the hit.
+func (d *Debugger) breakpointAt(fn *SexpFunction, pos SrcPos, entered bool) *Breakpoint {
+	d.mu.Lock()
+	var found []*Breakpoint
+	for _, bp := range d.bps {
+		if bp.Func != "" {
+			if entered && bp.Func == fn.name {
+				found = append(found, bp)
+			}
+		} else if bp.Line == pos.Line && sameFile(bp.File, pos.File) {
+			found = append(found, bp)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, bp := range found {
+		if bp.Cond != "" {
+			// a condition that fails to evaluate stops the
+			// script, so that it can be looked at.
+			v, err := d.eval(bp.Cond)
+			if err == nil && !IsTruthy(v) {
+				continue
+			}
+		}
+		d.mu.Lock()
+		bp.Hits++
+		cp := *bp
+		d.mu.Unlock()
+		return &cp
+	}
+	return nil
+}
+
+func sameFile(want, have string) bool {
+	if want == have {
+		return true
+	}
+	if want == "" || have == "" {
+		return false
+	}
+	if !strings.ContainsRune(want, filepath.Separator) && !strings.ContainsRune(want, '/') {
+		return want == filepath.Base(have)
+	}
+	a, err1 := filepath.Abs(want)
+	b, err2 := filepath.Abs(have)
+	return err1 == nil && err2 == nil && a == b
+}
+
+// Frames returns the calls in progress at the stop,
+// innermost first, with their local variables.
+func (d *Debugger) Frames() []DebugFrame {
+	if !d.stopped {
+		return nil
+	}
+	env := d.env
+
+	type call struct {
+		fn *SexpFunction
+		pc int
+	}
+	calls := []call{{env.curfunc, env.pc}}
+	for i := 0; i < env.addrstack.Size(); i++ {
+		elem, err := env.addrstack.Get(i)
+		if err != nil {
+			break
+		}
+		addr := elem.(Address)
+		// the address is the return point, just past the call.
+		calls = append(calls, call{addr.function, addr.position - 1})
+	}
+
+	// each script function opens a function scope as it
+	// starts; those split the scope stack between frames.
+	// The bottom scope is the global one, shown by Globals.
+	nscope := env.linearstack.Size() - 1
+	next := 0
+	takeScopes := func() []*Scope {
+		var scopes []*Scope
+		for ; next < nscope; next++ {
+			elem, err := env.linearstack.Get(next)
+			if err != nil {
+				break
+			}
+			sc, ok := elem.(*Scope)
+			if !ok {
+				continue
+			}
+			scopes = append(scopes, sc)
+			if sc.IsFunction {
+				next++
+				break
+			}
+		}
+		return scopes
+	}
+
+	var frames []DebugFrame
+	for i, c := range calls {
+		if c.fn == nil || c.fn.user || generatedFunction(c.fn.name) {
+			continue
+		}
+		fr := DebugFrame{Func: c.fn.name, Pos: c.fn.PosAt(c.pc)}
+		var scopes []*Scope
+		if opensFuncScope(c.fn) && (i > 0 || c.pc > 0) {
+			scopes = takeScopes()
+		}
+		if i == len(calls)-1 {
+			// the outermost call has whatever is left.
+			for next < nscope {
+				scopes = append(scopes, takeScopes()...)
+			}
+		}
+		fr.Locals = d.scopeVars(scopes)
+		if !fr.Pos.IsValid() && len(fr.Locals) == 0 {
+			continue
+		}
+		frames = append(frames, fr)
+	}
+	return frames
+}
+
+func opensFuncScope(fn *SexpFunction) bool {
+	if len(fn.fun) == 0 {
+		return false
+	}
+	_, ok := fn.fun[0].(AddFuncScopeInstr)
+	return ok
+}
+
+// Globals returns the variables of the global scope.
+func (d *Debugger) Globals() []DebugVar {
+	if !d.stopped {
+		return nil
+	}
+	elem, err := d.env.linearstack.Get(d.env.linearstack.Size() - 1)
+	if err != nil {
+		return nil
+	}
+	sc, ok := elem.(*Scope)
+	if !ok {
+		return nil
+	}
+	return d.scopeVars([]*Scope{sc})
+}
+
+// scopeVars lists the variables of scopes, innermost
+// first, leaving out those that are shadowed.
+func (d *Debugger) scopeVars(scopes []*Scope) []DebugVar {
+	var vars []DebugVar
+	seen := make(map[int]bool)
+	for _, sc := range scopes {
+		start := len(vars)
+		sc.each(func(num int, val Sexp) {
+			if seen[num] {
+				return
+			}
+			seen[num] = true
+			vars = append(vars, DebugVar{Name: d.env.symbols.nameOf(num), Value: val})
+		})
+		inScope := vars[start:]
+		sort.Slice(inScope, func(i, j int) bool { return inScope[i].Name < inScope[j].Name })
+	}
+	return vars
+}
+
+// Eval evaluates expr in the innermost frame of the
+// stopped script.
+func (d *Debugger) Eval(expr string) (Sexp, error) {
+	if !d.stopped {
+		return SexpNull, ErrNotStopped
+	}
+	return d.eval(expr)
+}
+
+func (d *Debugger) eval(expr string) (Sexp, error) {
+	env := d.env
+	prevName := env.parser.Filename()
+	env.parser.ResetAddNewInput(strings.NewReader(expr + "\n"))
+	env.parser.SetFilename("")
+	expressions, err := env.parser.ParseTokens()
+	env.parser.SetFilename(prevName)
+	if err != nil {
+		return SexpNull, fmt.Errorf("Error parsing '%s': %v", expr, err)
+	}
+	if len(expressions) == 0 {
+		return SexpNull, nil
+	}
+
+	// run as if from a builder: the evaluation returns to
+	// an empty function, which ends the nested Run.
+	state := env.captureControlState()
+	d.evaluating = true
+	env.curfunc = &SexpFunction{name: "debugEval"}
+	env.pc = -1
+	res, err := EvalFunction(env, "debugEval", expressions)
+	env.restoreControlState(state)
+	d.evaluating = false
+	if err != nil {
+		return SexpNull, stripPos(err)
+	}
+	return res, nil
+}
+
+// Watches evaluates the watch expressions at the stop.
+func (d *Debugger) Watches() []DebugWatch {
+	d.mu.Lock()
+	exprs := append([]string(nil), d.watches...)
+	d.mu.Unlock()
+
+	ws := make([]DebugWatch, len(exprs))
+	for i, expr := range exprs {
+		ws[i].Expr = expr
+		ws[i].Value, ws[i].Err = d.Eval(expr)
+	}
+	return ws
+}
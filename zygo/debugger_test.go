@@ -0,0 +1,256 @@
+package zygo
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const debugTestScript = `(defn add [a b]
+  (def s (+ a b))
+  s)
+(defn twice [x]
+  (def y (add x x))
+  (* y 1))
+(def r (twice 5))
+(def r2 (twice 1))
+r
+`
+
+// debugRun runs debugTestScript, answering each stop with
+// the next of modes, and returns a line per stop.
+func debugRun(setup func(d *Debugger), modes ...StepMode) ([]string, Sexp, error) {
+	env := NewZlisp()
+	defer env.Close()
+	env.StandardSetup()
+	d := NewDebugger(env)
+	setup(d)
+
+	var stops []string
+	d.OnStop = func(d *Debugger, ev StopEvent) StepMode {
+		var frames []string
+		for _, f := range d.Frames() {
+			var locals []string
+			for _, v := range f.Locals {
+				locals = append(locals, v.Name+"="+v.Value.SexpString(nil))
+			}
+			frames = append(frames, fmt.Sprintf("%s:%d{%s}", f.Func, f.Pos.Line, strings.Join(locals, " ")))
+		}
+		stops = append(stops, ev.Reason+" "+strings.Join(frames, " "))
+		if len(modes) == 0 {
+			return DebugContinue
+		}
+		m := modes[0]
+		modes = modes[1:]
+		return m
+	}
+	err := env.LoadString(debugTestScript)
+	panicOn(err)
+	res, err := env.Run()
+	return stops, res, err
+}
+
+func Test120DebuggerStepsAndBreaks(t *testing.T) {
+
+	cv.Convey(`Given a line breakpoint, stepping in, out and over should visit the lines of each call, showing its locals`, t, func() {
+
+		stops, res, err := debugRun(func(d *Debugger) { d.SetBreakpoint("", 7, "") },
+			DebugStepIn, DebugStepIn, DebugStepIn, DebugStepOut, DebugStepOver, DebugStepOver)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 10)
+		cv.So(stops, cv.ShouldResemble, []string{
+			"breakpoint __main:7{}",
+			"step twice:5{x=5} __main:7{}",
+			"step add:2{a=5 b=5} twice:5{x=5} __main:7{}",
+			"step add:3{a=5 b=5 s=10} twice:5{x=5} __main:7{}",
+			"step twice:5{x=5} __main:7{}",
+			"step twice:6{x=5 y=10} __main:7{}",
+			"step __main:7{}",
+		})
+	})
+
+	cv.Convey(`Given a conditional function breakpoint, the script should stop only on entering that function when the condition holds`, t, func() {
+
+		stops, _, err := debugRun(func(d *Debugger) { d.SetFuncBreakpoint("add", "(== a 1)") })
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(stops, cv.ShouldResemble, []string{
+			"function breakpoint add:2{a=1 b=1} twice:5{x=1} __main:8{}",
+		})
+	})
+
+	cv.Convey(`Given Pause before the script starts, it should stop on the first line; stepping over should then skip the calls`, t, func() {
+
+		stops, _, err := debugRun(func(d *Debugger) { d.Pause() },
+			DebugStepOver, DebugStepOver, DebugStepOver, DebugStepOver)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(stops, cv.ShouldResemble, []string{
+			"pause __main:1{}",
+			"step __main:4{}",
+			"step __main:7{}",
+			"step __main:8{}",
+			"step __main:9{}",
+		})
+	})
+
+	cv.Convey(`While stopped, Eval and Watches should see the locals of the innermost frame, and Terminate should end the script uncatchably`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		d := NewDebugger(env)
+		d.SetBreakpoint("", 3, "")
+		d.AddWatch("(+ a b)")
+		d.AddWatch("x")
+
+		var watches []DebugWatch
+		var sum Sexp
+		d.OnStop = func(d *Debugger, ev StopEvent) StepMode {
+			watches = d.Watches()
+			sum, _ = d.Eval("(* s 2)")
+			return DebugTerminate
+		}
+		_, err := env.EvalString(`(try ` + debugTestScript + ` (catch e 0))`)
+		cv.So(errors.Is(err, ErrDebugTerminated), cv.ShouldBeTrue)
+		cv.So(sum.(*SexpInt).Val, cv.ShouldEqual, 20)
+		cv.So(watches[0].Value.(*SexpInt).Val, cv.ShouldEqual, 10)
+		cv.So(watches[1].Err.Error(), cv.ShouldContainSubstring, "symbol `x` not found")
+
+		_, err = d.Eval("1")
+		cv.So(err, cv.ShouldEqual, ErrNotStopped)
+	})
+}
+
+// dapClient drives a debug session for tests.
+type dapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	seq  int
+}
+
+func (c *dapClient) request(command string, args interface{}) {
+	c.seq++
+	buf, err := json.Marshal(map[string]interface{}{
+		"seq": c.seq, "type": "request", "command": command, "arguments": args,
+	})
+	panicOn(err)
+	fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+}
+
+// next reads messages until one of the given kind, an
+// event or response name, turns up.
+func (c *dapClient) next(kind string) map[string]interface{} {
+	for {
+		length := 0
+		for {
+			line, err := c.r.ReadString('\n')
+			panicOn(err)
+			line = strings.TrimSpace(line)
+			if line == "" {
+				break
+			}
+			if v, ok := strings.CutPrefix(line, "Content-Length:"); ok {
+				length, err = strconv.Atoi(strings.TrimSpace(v))
+				panicOn(err)
+			}
+		}
+		buf := make([]byte, length)
+		_, err := io.ReadFull(c.r, buf)
+		panicOn(err)
+		var msg map[string]interface{}
+		panicOn(json.Unmarshal(buf, &msg))
+		if msg["event"] == kind || msg["command"] == kind {
+			return msg
+		}
+	}
+}
+
+func body(msg map[string]interface{}) map[string]interface{} {
+	b, _ := msg["body"].(map[string]interface{})
+	return b
+}
+
+func Test121DebugAdapterProtocolSession(t *testing.T) {
+
+	cv.Convey(`Given a DAP client, it should be able to set a breakpoint, launch a script, look at its stack and variables, evaluate, and continue to the end`, t, func() {
+
+		dir := t.TempDir()
+		prog := filepath.Join(dir, "prog.zy")
+		panicOn(os.WriteFile(prog, []byte(debugTestScript), 0644))
+
+		server, client := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- ServeDAPConn(server, func() *Zlisp {
+				env := NewZlisp()
+				env.StandardSetup()
+				return env
+			})
+		}()
+		c := &dapClient{conn: client, r: bufio.NewReader(client)}
+
+		c.request("initialize", map[string]interface{}{"adapterID": "zygo"})
+		cv.So(c.next("initialize")["success"], cv.ShouldEqual, true)
+		c.next("initialized")
+
+		c.request("setBreakpoints", map[string]interface{}{
+			"source":      map[string]interface{}{"path": prog},
+			"breakpoints": []interface{}{map[string]interface{}{"line": 3}},
+		})
+		bps := body(c.next("setBreakpoints"))["breakpoints"].([]interface{})
+		cv.So(bps[0].(map[string]interface{})["verified"], cv.ShouldEqual, true)
+		c.request("launch", map[string]interface{}{"program": prog})
+		c.next("launch")
+		c.request("configurationDone", nil)
+
+		stopped := body(c.next("stopped"))
+		cv.So(stopped["reason"], cv.ShouldEqual, "breakpoint")
+
+		c.request("stackTrace", map[string]interface{}{"threadId": 1})
+		frames := body(c.next("stackTrace"))["stackFrames"].([]interface{})
+		cv.So(len(frames), cv.ShouldEqual, 3)
+		top := frames[0].(map[string]interface{})
+		cv.So(top["name"], cv.ShouldEqual, "add")
+		cv.So(top["line"], cv.ShouldEqual, 3)
+		cv.So(top["source"].(map[string]interface{})["path"], cv.ShouldEqual, prog)
+
+		c.request("scopes", map[string]interface{}{"frameId": 0})
+		scopes := body(c.next("scopes"))["scopes"].([]interface{})
+		ref := scopes[0].(map[string]interface{})["variablesReference"]
+		c.request("variables", map[string]interface{}{"variablesReference": ref})
+		vars := body(c.next("variables"))["variables"].([]interface{})
+		var shown []string
+		for _, v := range vars {
+			m := v.(map[string]interface{})
+			shown = append(shown, fmt.Sprintf("%v=%v", m["name"], m["value"]))
+		}
+		cv.So(shown, cv.ShouldResemble, []string{"a=5", "b=5", "s=10"})
+
+		c.request("evaluate", map[string]interface{}{"expression": "[a (+ s 1)]", "frameId": 0})
+		ev := body(c.next("evaluate"))
+		cv.So(ev["result"], cv.ShouldEqual, "[5 11]")
+		c.request("variables", map[string]interface{}{"variablesReference": ev["variablesReference"]})
+		vars = body(c.next("variables"))["variables"].([]interface{})
+		cv.So(vars[1].(map[string]interface{})["value"], cv.ShouldEqual, "11")
+
+		c.request("continue", map[string]interface{}{"threadId": 1})
+		c.next("continue")
+		cv.So(body(c.next("stopped"))["reason"], cv.ShouldEqual, "breakpoint")
+		c.request("continue", map[string]interface{}{"threadId": 1})
+		cv.So(body(c.next("exited"))["exitCode"], cv.ShouldEqual, 0)
+		c.next("terminated")
+
+		c.request("disconnect", nil)
+		c.next("disconnect")
+		cv.So(<-done, cv.ShouldBeNil)
+	})
+}
@@ -126,12 +126,12 @@ func (env *Zlisp) ImportDemoData() {
 	rt := &RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
 		return &NestOuter{}, nil
 	}}
-	GoStructRegistry.RegisterUserdef(rt, true, "nestouter", "NestOuter")
+	env.TypeRegistry().RegisterUserdef(rt, true, "nestouter", "NestOuter")
 
 	rt = &RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
 		return &NestInner{}, nil
 	}}
-	GoStructRegistry.RegisterUserdef(rt, true, "nestinner", "NestInner")
+	env.TypeRegistry().RegisterUserdef(rt, true, "nestinner", "NestInner")
 
 }
 
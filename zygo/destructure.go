@@ -0,0 +1,312 @@
+package zygo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Destructuring
+// =============
+//
+// Where let, letseq, mdef and function parameters take a
+// name, they also take a pattern, to bind names to the
+// parts of the value:
+//
+//	(let [[x y & more] arr
+//	      {name: n port: p :or {port: 80}} cfg]
+//	  ...)
+//
+// [a b & rest] takes an array, or a list, of two or more,
+// binding rest to the others; elements past those named are
+// left alone. {key: pat ...} takes a hash, or record, with
+// each key; :or gives a hash of values for keys it lacks,
+// evaluated before binding. Patterns nest, and _ binds
+// nothing. A value that does not fit, an array too short
+// or a hash missing a key, is an error that says so.
+//
+// In infix, for i, [a b] := range pairs { ... } unpacks each
+// value the same way.
+
+// destructuring gathers, from a pattern, the names it binds
+// and the :or defaults, in the order __destructure takes them.
+type destructuring struct {
+	seen     map[int]bool
+	vars     []*SexpSymbol
+	defaults []Sexp
+}
+
+// isDestructuring reports whether x, where a name to bind
+// was expected, is a pattern.
+func isDestructuring(x Sexp) bool {
+	switch p := x.(type) {
+	case *SexpArray:
+		return true
+	case *SexpPair:
+		return isSymbolNamed(p.Head, "hash")
+	}
+	return false
+}
+
+func (d *destructuring) scan(pat Sexp) error {
+	switch p := pat.(type) {
+	case *SexpSymbol:
+		switch {
+		case p.name == "_":
+			return nil
+		case p.name == "&":
+			return fmt.Errorf("destructuring: & outside an array pattern")
+		case p.isDot || p.colonTail:
+			return fmt.Errorf("destructuring: cannot bind %s", patternString(p))
+		case d.seen[p.number]:
+			return fmt.Errorf("destructuring: %s is bound twice", p.name)
+		}
+		if d.seen == nil {
+			d.seen = make(map[int]bool)
+		}
+		d.seen[p.number] = true
+		d.vars = append(d.vars, p)
+		return nil
+	case *SexpArray:
+		fixed, rest, err := splitRestPattern(p.Val)
+		if err != nil {
+			return fmt.Errorf("destructuring: & must be followed by a single pattern, for the rest")
+		}
+		for _, q := range fixed {
+			if err := d.scan(q); err != nil {
+				return err
+			}
+		}
+		if rest != nil {
+			return d.scan(rest)
+		}
+		return nil
+	case *SexpPair:
+		if isSymbolNamed(p.Head, "hash") {
+			_, pats, defaults, err := hashDestructuring(p)
+			if err != nil {
+				return err
+			}
+			if defaults != nil {
+				d.defaults = append(d.defaults, defaults)
+			}
+			for _, q := range pats {
+				if err := d.scan(q); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("destructuring: cannot bind to %s", patternString(pat))
+}
+
+// hashDestructuring takes apart {key: pat ... :or defaults},
+// which parses as (hash key: pat ... : or defaults).
+func hashDestructuring(p *SexpPair) (keys, pats []Sexp, defaults Sexp, err error) {
+	elems, err := ListToArray(p.Tail)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("destructuring: bad hash pattern %s", patternString(p))
+	}
+	for i := 0; i < len(elems); {
+		if isSymbolNamed(elems[i], ":") && i+1 < len(elems) && isSymbolNamed(elems[i+1], "or") {
+			if i+2 >= len(elems) || defaults != nil {
+				return nil, nil, nil, fmt.Errorf("destructuring: :or needs one hash of defaults, in %s", patternString(p))
+			}
+			defaults = elems[i+2]
+			i += 3
+			continue
+		}
+		key := elems[i]
+		i++
+		// {"key": pat} has the colon as a symbol of its own.
+		if i < len(elems) && isSymbolNamed(elems[i], ":") {
+			i++
+		}
+		if i >= len(elems) {
+			return nil, nil, nil, fmt.Errorf("destructuring: nothing to bind key %s to, in %s", key.SexpString(nil), patternString(p))
+		}
+		keys = append(keys, key)
+		pats = append(pats, elems[i])
+		i++
+	}
+	return keys, pats, defaults, nil
+}
+
+// patternString shows pat as it was written, with
+// {key: pat ...} rather than the (hash key pat ...) it
+// parses as, for error messages.
+func patternString(pat Sexp) string {
+	switch p := pat.(type) {
+	case *SexpArray:
+		s := make([]string, len(p.Val))
+		for i, q := range p.Val {
+			s[i] = patternString(q)
+		}
+		return "[" + strings.Join(s, " ") + "]"
+	case *SexpPair:
+		if !isSymbolNamed(p.Head, "hash") {
+			break
+		}
+		keys, pats, defaults, err := hashDestructuring(p)
+		if err != nil {
+			break
+		}
+		s := make([]string, 0, len(keys)+1)
+		for i, key := range keys {
+			s = append(s, key.SexpString(nil)+": "+patternString(pats[i]))
+		}
+		if defaults != nil {
+			s = append(s, ":or "+patternString(defaults))
+		}
+		return "{" + strings.Join(s, " ") + "}"
+	}
+	return pat.SexpString(nil)
+}
+
+// generateDestructure binds the names in pat to the parts
+// of the value on top of the stack, which it pops.
+func (gen *Generator) generateDestructure(pat Sexp) error {
+	var d destructuring
+	err := d.scan(pat)
+	if err != nil {
+		return err
+	}
+	gen.AddInstruction(PushInstr{pat})
+	oldtail := gen.Tail
+	gen.Tail = false
+	for _, x := range d.defaults {
+		err = gen.Generate(x)
+		if err != nil {
+			return err
+		}
+	}
+	gen.Tail = oldtail
+	gen.AddInstruction(CallInstr{sym: gen.env.MakeSymbol("__destructure"), nargs: 2 + len(d.defaults)})
+	gen.AddInstruction(PopInstr(0))
+	for _, v := range d.vars {
+		gen.bind(v)
+	}
+	return nil
+}
+
+// generateBind binds lhs, a name or a pattern, to the
+// value on top of the stack, which it pops.
+func (gen *Generator) generateBind(lhs Sexp) error {
+	if sym, ok := lhs.(*SexpSymbol); ok {
+		gen.AddInstruction(PopStackPutEnvInstr{sym})
+		gen.bind(sym)
+		return nil
+	}
+	return gen.generateDestructure(lhs)
+}
+
+type destructurer struct {
+	env      *Zlisp
+	defaults []Sexp
+	next     int
+}
+
+// bind binds the names in pat, in the current scope, to
+// the parts of val.
+func (d *destructurer) bind(pat, val Sexp) error {
+	switch p := pat.(type) {
+	case *SexpSymbol:
+		if p.name == "_" {
+			return nil
+		}
+		return d.env.LexicalBindSymbol(p, val)
+	case *SexpArray:
+		var elems []Sexp
+		switch v := val.(type) {
+		case *SexpArray:
+			elems = v.Val
+		default:
+			var err error
+			elems, err = ListToArray(val)
+			if err != nil {
+				return fmt.Errorf("destructuring: cannot unpack %s into %s, which wants an array", val.SexpString(nil), patternString(p))
+			}
+		}
+		fixed, rest, err := splitRestPattern(p.Val)
+		if err != nil {
+			return err
+		}
+		if len(elems) < len(fixed) {
+			return fmt.Errorf("destructuring: %s is too short for %s", val.SexpString(nil), patternString(p))
+		}
+		for i, q := range fixed {
+			if err := d.bind(q, elems[i]); err != nil {
+				return err
+			}
+		}
+		if rest == nil {
+			return nil
+		}
+		more := append([]Sexp(nil), elems[len(fixed):]...)
+		if _, isArray := val.(*SexpArray); isArray {
+			return d.bind(rest, &SexpArray{Val: more, Env: d.env})
+		}
+		return d.bind(rest, MakeList(more))
+	case *SexpPair:
+		keys, pats, defaults, err := hashDestructuring(p)
+		if err != nil {
+			return err
+		}
+		var dflt *SexpHash
+		if defaults != nil {
+			if d.next >= len(d.defaults) {
+				return fmt.Errorf("destructuring: missing the :or defaults for %s", patternString(p))
+			}
+			h, isHash := d.defaults[d.next].(*SexpHash)
+			if !isHash {
+				return fmt.Errorf("destructuring: :or needs a hash, not %s", d.defaults[d.next].SexpString(nil))
+			}
+			dflt = h
+			d.next++
+		}
+		h, isHash := val.(*SexpHash)
+		if !isHash {
+			return fmt.Errorf("destructuring: cannot unpack %s into %s, which wants a hash", val.SexpString(nil), patternString(p))
+		}
+		for i, key := range keys {
+			v, err := h.HashGetDefault(d.env, key, SexpEnd)
+			if err != nil {
+				return err
+			}
+			if v == SexpEnd && dflt != nil {
+				v, err = dflt.HashGetDefault(d.env, key, SexpEnd)
+				if err != nil {
+					return err
+				}
+			}
+			if v == SexpEnd {
+				return fmt.Errorf("destructuring: missing key %s in %s", key.SexpString(nil), val.SexpString(nil))
+			}
+			if err := d.bind(pats[i], v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("destructuring: cannot bind to %s", patternString(pat))
+}
+
+// DestructureFunction implements __destructure, called by
+// the code for a pattern with the value, the pattern and
+// the values of its :or defaults.
+func DestructureFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 2 {
+		return SexpNull, WrongNargs
+	}
+	val, err := env.RValue(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	d := &destructurer{env: env, defaults: args[2:]}
+	err = d.bind(args[1], val)
+	if err != nil {
+		// raised, as (error) would, without naming __destructure.
+		return SexpNull, raised(err)
+	}
+	return SexpNull, nil
+}
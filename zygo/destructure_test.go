@@ -0,0 +1,79 @@
+package zygo
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test270DestructuringBindings(t *testing.T) {
+
+	cv.Convey(`Given array and hash patterns in let, letseq, fn parameters and mdef, the names should bind to the parts of the value`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		res, err := env.EvalString(`
+(def cfg {name: "svc" hosts: ["a" "b" "c"]})
+(def r1 (let [[x y & more] [1 2 3 4] {name: n port: p :or {port: 80}} cfg] [x y more n p]))
+(def r2 (letseq [pt [1 [2 3]] [a [b c]] pt] [a b c]))
+(defn f [[a b] {hosts: [h & _]} & [r & rs]] [a b h r rs])
+(def r3 (f [1 2] cfg 3 4 5))
+(mdef q [s t] {name: u} (list 1 [2 3] cfg))
+[r1 r2 r3 [q s t u] (defined? "more")]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[[1 2 [3 4] "svc" 80] [1 2 3] [1 2 "a" 3 (4 5)] [1 2 3 "svc"] false]`)
+
+		// a list unpacks into an array pattern, its rest a list;
+		// and a destructured parameter survives a tail call.
+		res, err = env.EvalString(`
+(defn total [[h & t] acc] (cond (empty? t) (+ acc h) (total t (+ acc h))))
+[(let [[a & b] (list 1 2 3)] [a b]) (total (list 1 2 3 4) 0)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[[1 (2 3)] 10]`)
+	})
+
+	cv.Convey(`Given the infix range loop, a pattern for the value should unpack each element`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		res, err := env.EvalString(`
+{
+  sum := 0
+  for _, [a b] := range [[1 2] [3 4]] { sum += a * b }
+  for _, {n: n} := range [{n: 100}] { sum += n }
+}
+(+ sum 0)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `114`)
+
+		_, err = env.EvalString(`{ for _, [a b] = range [[1 2]] { } }`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "destructuring the value needs :=")
+	})
+
+	cv.Convey(`Given a value that does not fit, the error should name the missing key or the short array`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		for src, msg := range map[string]string{
+			`(let [[x y] [1]] x)`:                              "destructuring: [1] is too short for [x y]",
+			`(let [{port: p} {name: "svc"}] p)`:                `destructuring: missing key port in {name:"svc"}`,
+			`(let [[x] 5] x)`:                                  "cannot unpack 5 into [x], which wants an array",
+			`(let [{a: x} [1]] x)`:                             "cannot unpack [1] into {a: x}, which wants a hash",
+			`(let [[{p: p} {"q": [a b] :or {q: 1}}] [5 6]] p)`: "cannot unpack 5 into {p: p}, which wants a hash",
+			`(let [[n {p: [q r]}] [1 {p: [2]}]] q)`:            "[2] is too short for [q r]",
+			`(let [[{p: p}] 5] p)`:                             "cannot unpack 5 into [{p: p}], which wants an array",
+			`((fn [[a b c]] a) [1 2])`:                         "[1 2] is too short for [a b c]",
+			`(let [[x x] [1 2]] x)`:                            "x is bound twice",
+			`(let [[x & y z] [1 2]] x)`:                        "& must be followed by a single pattern",
+			`(let [{a: x :or 3} {}] x)`:                        ":or needs a hash",
+		} {
+			_, err := env.EvalString(src)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, msg)
+		}
+	})
+}
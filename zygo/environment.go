@@ -3,12 +3,14 @@ package zygo
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"runtime"
-	"strconv"
+	"sync/atomic"
 )
 
 type PreHook func(*Zlisp, string, []Sexp)
@@ -25,21 +27,22 @@ type Zlisp struct {
 	// loopstack: let break and continue find the nearest enclosing loop.
 	loopstack *Stack
 
-	symtable    map[string]int
-	revsymtable map[int]string
-	builtins    map[int]*SexpFunction
-	reserved    map[int]bool
-	macros      map[int]*SexpFunction
-	curfunc     *SexpFunction
-	mainfunc    *SexpFunction
-	pc          int
-	nextsymbol  int
-	before      []PreHook
-	after       []PostHook
+	symbols  *symbolTable
+	builtins map[int]*SexpFunction
+	reserved map[int]bool
+	macros   map[int]*SexpFunction
+	curfunc  *SexpFunction
+	mainfunc *SexpFunction
+	pc       int
+	before   []PreHook
+	after    []PostHook
 
 	debugExec           bool
 	debugSymbolNotFound bool
 
+	// see debugger.go.
+	debugger *Debugger
+
 	showGlobalScope bool
 	baseTypeCtor    *SexpFunction
 
@@ -51,6 +54,52 @@ type Zlisp struct {
 
 	// API use, since infix is already default at repl
 	WrapLoadExpressionsInInfix bool
+
+	// Go and (defstruct) types; see gotypereg.go.
+	types *GoStructRegistryType
+
+	// import path and loaded packages; see import.go.
+	imports *importer
+
+	// in a spawned task, its copies of the parent's
+	// functions; see spawn.go.
+	funcCopies map[*SexpFunction]*SexpFunction
+
+	// execution budget; see budget.go. steps is shared
+	// with child envs made by Duplicate and Clone, but only
+	// the env that owns it resets it when a new top-level
+	// Run starts.
+	limits     Limits
+	ctx        context.Context
+	steps      *atomic.Int64
+	stepsOwner bool
+	runDepth   int
+
+	// the optimizer; see optimize.go. rebound holds the
+	// builtins whose names have been bound as variables.
+	optimize bool
+	rebound  map[int]bool
+
+	// input and output streams; see iostreams.go.
+	stdout   io.Writer
+	stderr   io.Writer
+	stdin    io.Reader
+	stdinBuf *bufio.Reader
+
+	// the file system scripts use; see filesystem.go.
+	fsys fs.FS
+
+	// what scripts may do; see policy.go.
+	policy *Policy
+
+	// calls back from Go; see gocallback.go.
+	callbacks callbackGate
+
+	// the transaction in progress; see tx.go.
+	tx *txLog
+
+	// set on the base of an EnvPool; see pool.go.
+	frozen bool
 }
 
 // allow clients to establish a callback to
@@ -70,7 +119,7 @@ const DataStackSize = 100
 const StackStackSize = 5
 const LoopStackSize = 5
 
-var ReservedWords = []string{"byte", "defbuild", "builder", "field", "and", "or", "cond", "quote", "def", "mdef", "fn", "defn", "begin", "let", "letseq", "assert", "defmac", "macexpand", "syntaxQuote", "include", "for", "set", "break", "continue", "newScope", "_ls", "int8", "int16", "int32", "int64", "uint8", "uint16", "uint32", "uint64", "float32", "float64", "complex64", "complex128", "bool", "string", "any", "break", "case", "chan", "const", "continue", "default", "else", "defer", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct", "switch", "type", "var", "append", "cap", "close", "complex", "copy", "delete", "imag", "len", "make", "new", "panic", "print", "println", "real", "recover", "null", "nil", "-", "+", "--", "++", "-=", "+=", ":=", "=", ">", "<", ">=", "<=", "send", "NaN", "nan"}
+var ReservedWords = []string{"byte", "defbuild", "builder", "field", "and", "or", "cond", "quote", "def", "mdef", "fn", "defn", "begin", "let", "letseq", "assert", "defmac", "macexpand", "syntaxQuote", "include", "for", "set", "break", "continue", "newScope", "_ls", "match", "int8", "int16", "int32", "int64", "uint8", "uint16", "uint32", "uint64", "float32", "float64", "complex64", "complex128", "bool", "string", "any", "break", "case", "chan", "const", "continue", "default", "else", "defer", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct", "switch", "type", "var", "append", "cap", "close", "complex", "copy", "delete", "imag", "len", "make", "new", "panic", "print", "println", "real", "recover", "null", "nil", "-", "+", "--", "++", "-=", "+=", ":=", "=", ">", "<", ">=", "<=", "send", "NaN", "nan"}
 
 func NewZlisp() *Zlisp {
 	return NewZlispWithFuncs(AllBuiltinFunctions())
@@ -87,9 +136,12 @@ func (env *Zlisp) Close() error {
 }
 
 // NewZlispSandbox returns a new *Zlisp instance that does not allow the
-// user to get to the outside world
+// user to get to the outside world. Its policy is SandboxPolicy, so
+// that the builtins StandardSetup adds back, like sys, cannot either.
 func NewZlispSandbox() *Zlisp {
-	return NewZlispWithFuncs(SandboxSafeFunctions())
+	env := NewZlispWithFuncs(SandboxSafeFunctions())
+	env.SetPolicy(SandboxPolicy())
+	return env
 }
 
 // NewZlispWithFuncs returns a new *Zlisp instance with access to only the given builtin functions
@@ -109,12 +161,15 @@ func NewZlispWithFuncs(funcs map[string]ZlispUserFunction) *Zlisp {
 	env.builtins = make(map[int]*SexpFunction)
 	env.reserved = make(map[int]bool)
 	env.macros = make(map[int]*SexpFunction)
-	env.symtable = make(map[string]int)
-	env.revsymtable = make(map[int]string)
-	env.nextsymbol = 1
+	env.symbols = newSymbolTable()
 	env.before = []PreHook{}
 	env.after = []PostHook{}
 	env.infixOps = make(map[string]*InfixOp)
+	env.steps = new(atomic.Int64)
+	env.stepsOwner = true
+	env.types = NewGoStructRegistry(&GoStructRegistry)
+	env.imports = newImporter()
+	env.rebound = make(map[int]bool)
 	env.AddGlobal("null", SexpNull)
 	env.AddGlobal("nil", SexpNull)
 
@@ -158,9 +213,7 @@ func (env *Zlisp) Clone() *Zlisp {
 	dupenv.builtins = env.builtins
 	dupenv.reserved = env.reserved
 	dupenv.macros = env.macros
-	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.symbols = env.symbols
 	dupenv.before = env.before
 	dupenv.after = env.after
 	dupenv.infixOps = env.infixOps
@@ -175,6 +228,19 @@ func (env *Zlisp) Clone() *Zlisp {
 	dupenv.showGlobalScope = env.showGlobalScope
 	dupenv.WrapLoadExpressionsInInfix = env.WrapLoadExpressionsInInfix
 	dupenv.booter = env.booter
+	dupenv.limits = env.limits
+	dupenv.ctx = env.ctx
+	dupenv.steps = env.steps
+	dupenv.types = env.types
+	dupenv.imports = env.imports.child()
+	dupenv.optimize = env.optimize
+	dupenv.rebound = env.rebound
+	dupenv.stdout = env.stdout
+	dupenv.stderr = env.stderr
+	dupenv.stdin = env.stdin
+	dupenv.fsys = env.fsys
+	dupenv.policy = env.policy
+	dupenv.funcCopies = env.funcCopies
 	return dupenv
 }
 
@@ -189,9 +255,7 @@ func (env *Zlisp) Duplicate() *Zlisp {
 	dupenv.builtins = env.builtins
 	dupenv.reserved = env.reserved
 	dupenv.macros = env.macros
-	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.symbols = env.symbols
 	dupenv.before = env.before
 	dupenv.after = env.after
 	dupenv.infixOps = env.infixOps
@@ -207,6 +271,19 @@ func (env *Zlisp) Duplicate() *Zlisp {
 	dupenv.showGlobalScope = env.showGlobalScope
 	dupenv.WrapLoadExpressionsInInfix = env.WrapLoadExpressionsInInfix
 	dupenv.booter = env.booter
+	dupenv.limits = env.limits
+	dupenv.ctx = env.ctx
+	dupenv.steps = env.steps
+	dupenv.types = env.types
+	dupenv.imports = env.imports.child()
+	dupenv.optimize = env.optimize
+	dupenv.rebound = env.rebound
+	dupenv.stdout = env.stdout
+	dupenv.stderr = env.stderr
+	dupenv.stdin = env.stdin
+	dupenv.fsys = env.fsys
+	dupenv.policy = env.policy
+	dupenv.funcCopies = env.funcCopies
 
 	return dupenv
 }
@@ -235,39 +312,24 @@ func (env *Zlisp) DetectSigils(sym *SexpSymbol) {
 }
 
 func (env *Zlisp) DumpSymTable() {
-	for kk, vv := range env.symtable {
-		fmt.Printf("symtable entry: kk: '%v' -> '%v'\n", kk, vv)
-	}
+	env.symbols.each(func(kk string, vv int) {
+		fmt.Fprintf(env.Output(), "symtable entry: kk: '%v' -> '%v'\n", kk, vv)
+	})
 }
 func (env *Zlisp) MakeSymbol(name string) *SexpSymbol {
 	if env == nil {
 		panic("internal problem:  env.MakeSymbol called with nil env")
 	}
-	symnum, ok := env.symtable[name]
-	if ok {
-		symbol := &SexpSymbol{name: name, number: symnum}
-		env.DetectSigils(symbol)
-		return symbol
-	}
-	for {
-		_, used := env.revsymtable[env.nextsymbol]
-		if !used {
-			break
-		}
-		env.nextsymbol++
-	}
-	symbol := &SexpSymbol{name: name, number: env.nextsymbol}
-	env.symtable[name] = symbol.number
-	env.revsymtable[symbol.number] = name
-
-	env.nextsymbol++
+	symbol := &SexpSymbol{name: name, number: env.symbols.intern(name)}
 	env.DetectSigils(symbol)
 	return symbol
 }
 
 func (env *Zlisp) GenSymbol(prefix string) *SexpSymbol {
-	symname := prefix + strconv.Itoa(env.nextsymbol)
-	return env.MakeSymbol(symname)
+	symname, symnum := env.symbols.gensym(prefix)
+	symbol := &SexpSymbol{name: symname, number: symnum}
+	env.DetectSigils(symbol)
+	return symbol
 }
 
 func (env *Zlisp) CurrentFunctionSize() int {
@@ -340,10 +402,20 @@ func (env *Zlisp) prepareLazyFinalArgs(function *SexpFunction, args []Sexp) ([]S
 }
 
 func (env *Zlisp) EvalCallExpression(expr Sexp) (Sexp, error) {
+	return env.evalCallExpression(expr, nil, -1, nil)
+}
+
+// evalCallExpression evaluates expr, found at depth in lex,
+// at ref, if it is a local variable; see lexical.go.
+func (env *Zlisp) evalCallExpression(expr Sexp, lex *lexFrame, depth int, ref *localRef) (Sexp, error) {
 	if expr == nil {
 		return SexpNull, nil
 	}
 	if sym, isSym := expr.(*SexpSymbol); isSym {
+		if depth >= 0 {
+			val, err := env.lookupLocal(sym, depth, ref)
+			return val, annotatePos(err, sym.Pos)
+		}
 		macxpr, isMacro := env.macros[sym.number]
 		if isMacro {
 			if macxpr.orig != nil {
@@ -352,10 +424,17 @@ func (env *Zlisp) EvalCallExpression(expr Sexp) (Sexp, error) {
 			return SexpNull, fmt.Errorf("'%s' is a builtin macro.\n", sym.name)
 		}
 		val, err, _ := env.LexicalLookupSymbol(sym, nil)
-		return val, err
+		return val, annotatePos(err, sym.Pos)
+	}
+	switch expr.(type) {
+	case *SexpPair, *SexpArray, *SexpComment:
+	default:
+		// generated, it would only push itself.
+		return expr, nil
 	}
 
 	gen := NewGenerator(env)
+	gen.lex, gen.outerLex = lex, lex
 	if err := gen.Generate(expr); err != nil {
 		return SexpNull, err
 	}
@@ -366,6 +445,7 @@ func (env *Zlisp) EvalCallExpression(expr Sexp) (Sexp, error) {
 
 	callState := env.captureControlState()
 	sfun := env.MakeFunction("callExprEval", 0, false, ZlispFunction(gen.instructions), expr)
+	sfun.positions = gen.positions
 	sfun.parent = callState.curfunc
 
 	env.pc = -2
@@ -402,12 +482,16 @@ func (env *Zlisp) ResolveCallable(funcobj Sexp) (Sexp, string, error) {
 }
 
 func (env *Zlisp) PrepareCallExprArgs(function *SexpFunction, args []Sexp) error {
+	return env.prepareCallExprArgs(function, args, nil)
+}
+
+func (env *Zlisp) prepareCallExprArgs(function *SexpFunction, args []Sexp, site *callSite) error {
 	for i, expr := range args {
-		if function != nil && !function.user && function.HasLazyFormals() && function.IsLazyCallArg(i) {
+		if function != nil && !function.user && function.lazyArg(args, i) {
 			env.datastack.PushExpr(NewSourceLazyArg(env, expr))
 			continue
 		}
-		val, err := env.EvalCallExpression(expr)
+		val, err := env.evalCallExpression(expr, site.frame(), site.depth(i+1), site.ref(i+1))
 		if err != nil {
 			return err
 		}
@@ -417,9 +501,13 @@ func (env *Zlisp) PrepareCallExprArgs(function *SexpFunction, args []Sexp) error
 }
 
 func (env *Zlisp) CallResolved(funcobj Sexp, callName string, args []Sexp) error {
+	return env.callResolved(funcobj, callName, args, nil)
+}
+
+func (env *Zlisp) callResolved(funcobj Sexp, callName string, args []Sexp, site *callSite) error {
 	startingDataStackSize := env.datastack.Size()
 	prepare := func(function *SexpFunction) error {
-		if err := env.PrepareCallExprArgs(function, args); err != nil {
+		if err := env.prepareCallExprArgs(function, args, site); err != nil {
 			env.datastack.TruncateToSize(startingDataStackSize)
 			return err
 		}
@@ -512,34 +600,18 @@ func (env *Zlisp) CallFunction(function *SexpFunction, nargs int) error {
 		prehook(env, function.name, expressions)
 	}
 
-	// do name and type checking
-	if function.inputTypes != nil && !function.varargs {
-		err := env.FunctionCallNameTypeCheck(function, &nargs)
-		if err != nil {
-			return err
-		}
-	} else {
-		err := env.prepareLazyCallArgs(function, &nargs)
-		if err != nil {
-			return err
-		}
-	}
-
-	if function.varargs {
-		err := env.wrangleOptargs(function.nargs, nargs)
-		if err != nil {
-			return err
-		}
-	} else if nargs != function.nargs {
-		return errors.New(
-			fmt.Sprintf("%s expected %d arguments, got %d",
-				function.name, function.nargs, nargs))
+	err := env.callArgs(function, &nargs)
+	if err != nil {
+		return err
 	}
 
 	if env.linearstack.IsEmpty() {
 		panic("where's the global scope?")
 	}
 
+	if err := env.checkCallDepth(); err != nil {
+		return err
+	}
 	env.addrstack.PushAddr(env.curfunc, env.pc+1)
 
 	//P("DEBUG linearstack with this next:")
@@ -585,6 +657,9 @@ func (env *Zlisp) CallUserFunction(
 		return 0, errors.New(
 			fmt.Sprintf("Error calling '%s': %v", name, err))
 	}
+	if err := env.checkCallDepth(); err != nil {
+		return 0, err
+	}
 
 	callState := env.captureControlState()
 	env.addrstack.PushAddr(env.curfunc, env.pc+1)
@@ -621,10 +696,16 @@ func (env *Zlisp) CallUserFunction(
 			"'%s': '%v'\n stack trace:\n%v\n",
 			name, recovered, string(trace))
 	}
+	if err == nil {
+		err = env.checkAllocated(res, args)
+	}
 	if err != nil {
 		env.restoreControlState(callState)
-		return 0, errors.New(
-			fmt.Sprintf("Error calling '%s': %v", name, err))
+		if _, raised := err.(*SexpError); raised {
+			// (throw), (error) and (try) pass errors on as is.
+			return 0, err
+		}
+		return 0, fmt.Errorf("Error calling '%s': %w", name, err)
 	}
 
 	env.datastack.PushExpr(res)
@@ -668,26 +749,32 @@ func (env *Zlisp) LoadExpressions(xs []Sexp) error {
 	if err != nil {
 		return err
 	}
+	gen.optimize()
 
-	env.mainfunc.fun = append(env.mainfunc.fun, gen.instructions...)
+	env.mainfunc.appendCode(gen.instructions, gen.positions)
 	env.curfunc = env.mainfunc
 
 	return nil
 }
 
 func (env *Zlisp) ParseFile(file string) ([]Sexp, error) {
-	in, err := os.Open(file)
+	in, err := env.openFile(file)
 	if err != nil {
 		return nil, err
 	}
 
 	var exp []Sexp
 
+	prevName := env.parser.Filename()
+	defer env.parser.SetFilename(prevName)
+
 	env.parser.Reset()
+	env.parser.SetFilename(file)
 	env.parser.NewInput(bufio.NewReader(in))
 	exp, err = env.parser.ParseTokens()
 	if err != nil {
-		return nil, fmt.Errorf("Error on line %d: %v (ParseFile err = '%#v')\n", env.parser.Linenum(), err, err)
+		return nil, &SourceError{Pos: env.parser.CurrentPos(),
+			Err: fmt.Errorf("Error on line %d: %v (ParseFile err = '%#v')\n", env.parser.Linenum(), err, err)}
 	}
 
 	in.Close()
@@ -696,21 +783,33 @@ func (env *Zlisp) ParseFile(file string) ([]Sexp, error) {
 }
 
 func (env *Zlisp) LoadStream(stream io.RuneScanner) error {
+	return env.loadNamedStream(stream, "")
+}
+
+// loadNamedStream parses and loads stream, recording
+// filename in the positions of what it parses.
+func (env *Zlisp) loadNamedStream(stream io.RuneScanner, filename string) error {
 	env.parser.ResetAddNewInput(stream)
+	env.parser.SetFilename(filename)
 	expressions, err := env.parser.ParseTokens()
 	if err != nil {
-		return fmt.Errorf("Error on line %d: %v (LoadStream err='%#v')\n", env.parser.Linenum(), err, err)
+		return &SourceError{Pos: env.parser.CurrentPos(),
+			Err: fmt.Errorf("Error on line %d: %v (LoadStream err='%#v')\n", env.parser.Linenum(), err, err)}
 	}
-	return env.LoadExpressions(expressions)
+	return sourceError(env.LoadExpressions(expressions))
 }
 
+// EvalString loads and runs str. Errors raised while running
+// are returned as a *ScriptError; those that can be traced to
+// a place in str also unwrap to a *SourceError.
 func (env *Zlisp) EvalString(str string) (Sexp, error) {
 	err := env.LoadString(str)
 	if err != nil {
-		return SexpNull, err
+		return SexpNull, scriptError(err)
 	}
 	//VPrintf("\n EvalString: LoadString() done, now to Run():\n")
-	return env.Run()
+	res, err := env.Run()
+	return res, scriptError(err)
 }
 
 // for most things now (except the main repl), prefer EvalFunction() instead of EvalExpressions.
@@ -723,8 +822,15 @@ func (env *Zlisp) EvalExpressions(xs []Sexp) (Sexp, error) {
 	return env.Run()
 }
 
+// LoadFile loads the script read from file. If file has a
+// Name method, as *os.File does, positions in error
+// messages are reported against that name.
 func (env *Zlisp) LoadFile(file io.Reader) error {
-	return env.LoadStream(bufio.NewReader(file))
+	name := ""
+	if nm, ok := file.(interface{ Name() string }); ok {
+		name = nm.Name()
+	}
+	return env.loadNamedStream(bufio.NewReader(file), name)
 }
 
 func (env *Zlisp) LoadString(str string) error {
@@ -740,11 +846,17 @@ func (env *Zlisp) AddBuilder(name string, function ZlispUserFunction) {
 }
 
 func (env *Zlisp) AddGlobal(name string, obj Sexp) {
+	if isHyphenatedName(name) {
+		env.symbols.addHyphenated(name)
+	}
 	sym := env.MakeSymbol(name)
-	env.linearstack.elements[0].(*Scope).Map[sym.number] = obj
+	env.linearstack.elements[0].(*Scope).bind(sym.number, obj)
 }
 
 func (env *Zlisp) AddMacro(name string, function ZlispUserFunction) {
+	if isHyphenatedName(name) {
+		env.symbols.addHyphenated(name)
+	}
 	sym := env.MakeSymbol(name)
 	env.macros[sym.number] = MakeUserFunction(name, function)
 }
@@ -775,12 +887,16 @@ func (env *Zlisp) DumpFunctionByName(name string) error {
 	default:
 		return errors.New("dump by name error: not a function")
 	}
-	DumpFunction(fun, -1)
+	fdumpFunction(env.Output(), fun, -1)
 	return nil
 }
 
 // if pc is -1, don't show it.
 func DumpFunction(fun ZlispFunction, pc int) {
+	fdumpFunction(os.Stdout, fun, pc)
+}
+
+func fdumpFunction(w io.Writer, fun ZlispFunction, pc int) {
 	blank := "      "
 	extra := blank
 	for i, instr := range fun {
@@ -789,22 +905,23 @@ func DumpFunction(fun ZlispFunction, pc int) {
 		} else {
 			extra = blank
 		}
-		fmt.Printf("%s %d: %s\n", extra, i, instr.InstrString())
+		fmt.Fprintf(w, "%s %d: %s\n", extra, i, instr.InstrString())
 	}
 	if pc == len(fun) {
-		fmt.Printf(" PC just past end at %d -----\n\n", pc)
+		fmt.Fprintf(w, " PC just past end at %d -----\n\n", pc)
 	}
 }
 
 func (env *Zlisp) DumpEnvironment() {
-	fmt.Printf("PC: %d\n", env.pc)
-	fmt.Println("Instructions:")
+	out := env.Output()
+	fmt.Fprintf(out, "PC: %d\n", env.pc)
+	fmt.Fprintln(out, "Instructions:")
 	if !env.curfunc.user {
-		DumpFunction(env.curfunc.fun, env.pc)
+		fdumpFunction(out, env.curfunc.fun, env.pc)
 	}
-	fmt.Printf("DataStack (%p): (length %d)\n", env.datastack, env.datastack.Size())
-	env.datastack.PrintStack()
-	fmt.Printf("Linear stack: (length %d)\n", env.linearstack.Size())
+	fmt.Fprintf(out, "DataStack (%p): (length %d)\n", env.datastack, env.datastack.Size())
+	env.datastack.fprintStack(out)
+	fmt.Fprintf(out, "Linear stack: (length %d)\n", env.linearstack.Size())
 	//env.linearstack.PrintScopeStack()
 	// instead of the above, try:
 	env.showStackHelper(env.linearstack, "linearstack")
@@ -815,16 +932,31 @@ func (env *Zlisp) ReachedEnd() bool {
 }
 
 func (env *Zlisp) GetStackTrace(err error) string {
-	str := fmt.Sprintf("error in %s:%d: %v\n",
-		env.curfunc.name, env.pc, err)
+	var str string
+	if pos, ok := ErrorPos(err); ok {
+		msg := err
+		var se *SourceError
+		if errors.As(err, &se) {
+			msg = se.Err
+		}
+		str = fmt.Sprintf("%s: error in %s:%d: %v\n",
+			pos, env.curfunc.name, env.pc, msg)
+	} else {
+		str = fmt.Sprintf("error in %s:%d: %v\n",
+			env.curfunc.name, env.pc, err)
+	}
 	for i := 0; i < env.addrstack.Size(); i++ {
 		elem, getErr := env.addrstack.Get(i)
 		if getErr != nil {
 			break
 		}
 		addr := elem.(Address)
-		fun, pos := addr.function, addr.position
-		str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+		fun, pc := addr.function, addr.position
+		if pos := fun.PosAt(pc); pos.IsValid() {
+			str += fmt.Sprintf("in %s:%d (%s)\n", fun.name, pc, pos)
+			continue
+		}
+		str += fmt.Sprintf("in %s:%d\n", fun.name, pc)
 	}
 	return str
 }
@@ -839,6 +971,10 @@ func (env *Zlisp) Clear() {
 		make([]Instruction, 0), nil)
 	env.curfunc = env.mainfunc
 	env.pc = 0
+	env.parser.SetFilename("")
+	if env.stepsOwner {
+		env.steps.Store(0)
+	}
 }
 
 func (env *Zlisp) FindObject(name string) (Sexp, bool) {
@@ -859,7 +995,7 @@ func (env *Zlisp) Apply(fun *SexpFunction, args []Sexp) (Sexp, error) {
 	callState := env.captureControlState()
 	env.pc = -2
 	for i, expr := range args {
-		if fun.IsLazyCallArg(i) {
+		if fun.lazyArg(args, i) {
 			env.datastack.PushExpr(NewValueLazyArg(expr))
 			continue
 		}
@@ -882,28 +1018,66 @@ func (env *Zlisp) Apply(fun *SexpFunction, args []Sexp) (Sexp, error) {
 }
 
 func (env *Zlisp) Run() (Sexp, error) {
+	if env.frozen {
+		return SexpNull, ErrFrozen
+	}
 	runState := env.captureControlState()
 
+	env.runDepth++
+	defer func() { env.runDepth-- }()
+	if env.runDepth == 1 && env.stepsOwner {
+		// a fresh top-level evaluation gets a fresh budget.
+		env.steps.Store(0)
+	}
+	if env.runDepth == 1 && env.debugger != nil {
+		env.debugger.start()
+	}
+	budgeted := env.budgetActive()
+	if budgeted {
+		if err := env.ctxErr(); err != nil {
+			return SexpNull, err
+		}
+	}
+
 	for env.pc != -1 && !env.ReachedEnd() {
+		if budgeted {
+			if err := env.chargeStep(); err != nil {
+				err = env.annotateErr(err, env.curfunc, env.pc)
+				env.restoreControlState(runState)
+				env.pc = functionSize(env.curfunc)
+				return SexpNull, err
+			}
+		}
 		instr := env.curfunc.fun[env.pc]
 		if env.debugExec {
-			fmt.Printf("\n ====== in '%s', about to run: '%v'\n",
+			fmt.Fprintf(env.Output(), "\n ====== in '%s', about to run: '%v'\n",
 				env.curfunc.name, instr.InstrString())
 			env.DumpEnvironment()
-			fmt.Printf("\n ====== in '%s', now running the above.\n",
+			fmt.Fprintf(env.Output(), "\n ====== in '%s', now running the above.\n",
 				env.curfunc.name)
 		}
-		err := instr.Execute(env)
+		fn, pc := env.curfunc, env.pc
+		var err error
+		if env.debugger != nil {
+			err = env.debugger.before(fn, pc)
+		}
+		if err == nil {
+			err = instr.Execute(env)
+		}
 		if err != nil {
+			if budgeted {
+				err = env.budgetCause(err)
+			}
+			err = env.annotateErr(err, fn, pc)
 			env.restoreControlState(runState)
 			env.pc = functionSize(env.curfunc)
 			return SexpNull, err
 		}
 		if env.debugExec {
-			fmt.Printf("\n ****** in '%s', after running, stack is: \n",
+			fmt.Fprintf(env.Output(), "\n ****** in '%s', after running, stack is: \n",
 				env.curfunc.name)
 			env.DumpEnvironment()
-			fmt.Printf("\n ****** \n")
+			fmt.Fprintf(env.Output(), "\n ****** \n")
 
 		}
 	}
@@ -948,7 +1122,8 @@ func (env *Zlisp) showStackHelper(stack *Stack, name string) {
 	if n < 0 {
 		note = "(empty)"
 	}
-	fmt.Printf(" ========  env(%p).%s is %v deep: %s\n", env, name, n+1, note)
+	out := env.Output()
+	fmt.Fprintf(out, " ========  env(%p).%s is %v deep: %s\n", env, name, n+1, note)
 	s := ""
 	for i := 0; i <= n; i++ {
 		ele, err := stack.Get(n - i)
@@ -969,7 +1144,7 @@ func (env *Zlisp) showStackHelper(stack *Stack, name string) {
 			panic(fmt.Errorf("unrecognized element on %s: %T/val=%v",
 				name, x, x))
 		}
-		fmt.Println(s)
+		fmt.Fprintln(out, s)
 	}
 }
 
@@ -978,18 +1153,19 @@ func (env *Zlisp) dumpParentChain(curfunc *SexpFunction) {
 	cur := curfunc
 	par := cur.parent
 	for par != nil {
-		fmt.Printf(" parent chain: cur:%v -> parent:%v\n", cur.name, par.name)
-		fmt.Printf("        cur.closures = %s", ClosureToString(cur, env))
+		fmt.Fprintf(env.Output(), " parent chain: cur:%v -> parent:%v\n", cur.name, par.name)
+		fmt.Fprintf(env.Output(), "        cur.closures = %s", ClosureToString(cur, env))
 		cur = par
 		par = par.parent
 	}
 }
 
 func (env *Zlisp) ShowStackStackAndScopeStack() error {
+	out := env.Output()
 	env.showStackHelper(env.linearstack, "linearstack")
-	fmt.Println(" --- done with env.linearstack, now here is env.curfunc --- ")
-	fmt.Println(ClosureToString(env.curfunc, env))
-	fmt.Println(" --- done with env.curfunc closure, now here is parent chain: --- ")
+	fmt.Fprintln(out, " --- done with env.linearstack, now here is env.curfunc --- ")
+	fmt.Fprintln(out, ClosureToString(env.curfunc, env))
+	fmt.Fprintln(out, " --- done with env.curfunc closure, now here is parent chain: --- ")
 	env.dumpParentChain(env.curfunc)
 	return nil
 }
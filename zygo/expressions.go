@@ -26,6 +26,9 @@ type Sexp interface {
 type SexpPair struct {
 	Head Sexp
 	Tail Sexp
+
+	// Pos is where the list opened in the source, if parsed.
+	Pos SrcPos
 }
 
 type SexpPointer struct {
@@ -35,7 +38,18 @@ type SexpPointer struct {
 	MyType        *RegisteredType
 }
 
+// NewSexpPointer derives the pointer type in the base
+// GoStructRegistry; env.NewSexpPointer keeps it in the
+// environment's own registry.
 func NewSexpPointer(pointedTo Sexp) *SexpPointer {
+	return newSexpPointer(&GoStructRegistry, pointedTo)
+}
+
+func (env *Zlisp) NewSexpPointer(pointedTo Sexp) *SexpPointer {
+	return newSexpPointer(env.TypeRegistry(), pointedTo)
+}
+
+func newSexpPointer(gsr *GoStructRegistryType, pointedTo Sexp) *SexpPointer {
 	pointedToType := pointedTo.Type()
 
 	var reftarg reflect.Value
@@ -49,7 +63,7 @@ func NewSexpPointer(pointedTo Sexp) *SexpPointer {
 		reftarg = reflect.ValueOf(pointedTo)
 	}
 
-	ptrRt := GoStructRegistry.GetOrCreatePointerType(pointedToType)
+	ptrRt := gsr.GetOrCreatePointerType(pointedToType)
 	//Q("pointer type is ptrRt = '%#v'", ptrRt)
 	p := &SexpPointer{
 		ReflectTarget: reftarg,
@@ -136,13 +150,25 @@ func (r *SexpRaw) Type() *RegisteredType {
 
 type SexpReflect struct {
 	Val reflect.Value
+
+	// set when the value was made from a known
+	// RegisteredType, e.g. by (var).
+	Typ *RegisteredType
+
+	// Env, when set, is the environment whose type
+	// registry names the value's type; otherwise it is
+	// looked up in GoStructRegistry.
+	Env *Zlisp
 }
 
 func (r *SexpReflect) Type() *RegisteredType {
+	if r.Typ != nil {
+		return r.Typ
+	}
 	k := reflectName(reflect.Value(r.Val))
 	//Q("SexpReflect.Type() looking up type named '%s'", k)
-	ty, ok := GoStructRegistry.Registry[k]
-	if !ok {
+	ty := r.Env.TypeRegistry().Lookup(k)
+	if ty == nil {
 		//Q("SexpReflect.Type(): type named '%s' not found", k)
 		return nil
 	}
@@ -150,8 +176,20 @@ func (r *SexpReflect) Type() *RegisteredType {
 	return ty
 }
 
+// SexpError is an error as a script sees it, in (catch e).
 type SexpError struct {
 	error
+
+	// Value is what (throw) raised, if it was not an error.
+	Value Sexp
+
+	// Pos and Stack record where the error was raised.
+	Pos   SrcPos
+	Stack []StackFrame
+
+	// passing is set when the error only carries another
+	// out of a (try) on its way up.
+	passing bool
 }
 
 func (r *SexpError) Type() *RegisteredType {
@@ -220,7 +258,7 @@ func (sent *SexpSentinel) SexpString(ps *PrintState) string {
 }
 
 func Cons(a Sexp, b Sexp) *SexpPair {
-	return &SexpPair{a, b}
+	return &SexpPair{Head: a, Tail: b}
 }
 
 func (pair *SexpPair) SexpString(ps *PrintState) string {
@@ -259,6 +297,9 @@ type SexpArray struct {
 	Infix               bool
 
 	Env *Zlisp
+
+	// Pos is where the array opened in the source, if parsed.
+	Pos SrcPos
 }
 
 func (r *SexpArray) Type() *RegisteredType {
@@ -267,7 +308,7 @@ func (r *SexpArray) Type() *RegisteredType {
 			// take type from first element
 			ty := r.Val[0].Type()
 			if ty != nil {
-				r.Typ = GoStructRegistry.GetOrCreateSliceType(ty)
+				r.Typ = r.Env.TypeRegistry().GetOrCreateSliceType(ty)
 			}
 		} else {
 			// empty array
@@ -530,6 +571,10 @@ type SexpSymbol struct {
 	isSigil   bool
 	colonTail bool
 	sigil     string
+
+	// Pos is where this occurrence of the symbol
+	// appeared in the source, if parsed.
+	Pos SrcPos
 }
 
 func (sym *SexpSymbol) RHS(env *Zlisp) (Sexp, error) {
@@ -633,6 +678,7 @@ func (lazy *SexpLazyArg) Force(env *Zlisp) (Sexp, error) {
 	gen.AddInstruction(ReturnInstr{nil})
 
 	sfun := env.MakeFunction("lazyArgForce", 0, false, ZlispFunction(gen.instructions), lazy.Expr)
+	sfun.positions = gen.positions
 	if lazy.Stack != nil {
 		sfun.SetClosing(&Closing{
 			Stack: lazy.Stack.Clone(),
@@ -666,6 +712,9 @@ func (lazy *SexpLazyArg) Force(env *Zlisp) (Sexp, error) {
 type SexpInterfaceDecl struct {
 	name    string
 	methods []*SexpFunction
+
+	// env is the environment that declared it.
+	env *Zlisp
 }
 
 func (r *SexpInterfaceDecl) SexpString(ps *PrintState) string {
@@ -685,7 +734,7 @@ func (r *SexpInterfaceDecl) SexpString(ps *PrintState) string {
 
 func (r *SexpInterfaceDecl) Type() *RegisteredType {
 	// todo: how to register/what to register?
-	return GoStructRegistry.Registry[r.name]
+	return r.env.TypeRegistry().Lookup(r.name)
 }
 
 // SexpFunction
@@ -706,6 +755,19 @@ type SexpFunction struct {
 	inputTypes        *SexpHash
 	returnTypes       *SexpHash
 	hasBody           bool // could just be declaration in an interface, without a body
+
+	// params describes optional parameters and &opts, and
+	// sig shows the parameters as declared; see params.go.
+	params *paramSpec
+	sig    string
+
+	// positions parallels fun: the source position
+	// each instruction was generated from.
+	positions []SrcPos
+
+	// generated is fun as it was before the optimizer
+	// rewrote it, if it did.
+	generated ZlispFunction
 }
 
 func (sf *SexpFunction) Type() *RegisteredType {
@@ -0,0 +1,205 @@
+package zygo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// File systems
+// ============
+//
+// Scripts reach files only through their environment's
+// file system: source, include, import, slurpf, the
+// writef family, and bload and bsave. It
+// starts out as OSFS, which takes paths just as os.Open
+// does. SetFS swaps in any fs.FS instead, such as an
+// embed.FS of scripts shipped inside a program, or an
+// fstest.MapFS under test; a path is then slash separated
+// and relative to its root, and is cleaned first, so that
+// "./a/../b.zy" is "b.zy", while a path leading above
+// the root is refused. Scripts can write only to a file
+// system that is also a CreateFS, and only where the
+// environment's policy, if it has one, lets them (see
+// policy.go).
+//
+// JailFS(dir) is the operating system's file system seen
+// from dir: it refuses any path that leads out of dir,
+// whether by "..", by being absolute, or by a symbolic link.
+
+// CreateFS is a file system that scripts can write to.
+type CreateFS interface {
+	fs.FS
+
+	// Create creates the named file, or truncates it if it exists.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// OSFS is the operating system's file system, and the
+// default. Its paths are those of the os package, not
+// fs.ValidPath ones.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (fs.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OSFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Create(name string) (io.WriteCloser, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// jailFS is an os.Root, which does the refusing.
+type jailFS struct {
+	root *os.Root
+}
+
+// JailFS returns the file system under dir, as a CreateFS
+// that refuses paths leading out of it. dir stays open for
+// as long as the file system is in use.
+func JailFS(dir string) (CreateFS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &jailFS{root: root}, nil
+}
+
+func (j *jailFS) Open(name string) (fs.File, error) {
+	f, err := j.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (j *jailFS) Stat(name string) (fs.FileInfo, error) {
+	return j.root.Stat(name)
+}
+
+func (j *jailFS) Create(name string) (io.WriteCloser, error) {
+	f, err := j.root.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetFS has scripts read, and if fsys is a CreateFS,
+// write, through fsys. Environments spawned or duplicated
+// from env afterwards share it.
+func (env *Zlisp) SetFS(fsys fs.FS) {
+	env.fsys = fsys
+}
+
+// FS returns the file system set by SetFS, or OSFS.
+func (env *Zlisp) FS() fs.FS {
+	if env.fsys == nil {
+		return OSFS{}
+	}
+	return env.fsys
+}
+
+// fsName turns a script's path into one for fsys. OSFS and
+// JailFS take operating system paths as they are.
+func fsName(fsys fs.FS, op, name string) (string, error) {
+	switch fsys.(type) {
+	case OSFS, *jailFS:
+		return name, nil
+	}
+	p := path.Clean(filepath.ToSlash(name))
+	if !fs.ValidPath(p) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return p, nil
+}
+
+// fsPath gives the file system, and the path in it, for a
+// script's path, once the environment's policy allows c on it.
+func (env *Zlisp) fsPath(op string, c Capability, name string) (fs.FS, string, error) {
+	fsys := env.FS()
+	p, err := fsName(fsys, op, name)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := env.allowPath(c, name, p); err != nil {
+		return nil, "", err
+	}
+	return fsys, p, nil
+}
+
+func (env *Zlisp) openFile(name string) (fs.File, error) {
+	fsys, p, err := env.fsPath("open", CapRead, name)
+	if err != nil {
+		return nil, err
+	}
+	return fsys.Open(p)
+}
+
+func (env *Zlisp) readFile(name string) ([]byte, error) {
+	fsys, p, err := env.fsPath("open", CapRead, name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(fsys, p)
+}
+
+func (env *Zlisp) createFile(name string) (io.WriteCloser, error) {
+	fsys, p, err := env.fsPath("create", CapWrite, name)
+	if err != nil {
+		return nil, err
+	}
+	cfs, ok := fsys.(CreateFS)
+	if !ok {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrPermission}
+	}
+	return cfs.Create(p)
+}
+
+// statFile is fs.Stat on the environment's file system. A
+// policy allowing either reading or writing name allows it,
+// so that writef can see what it would overwrite.
+func (env *Zlisp) statFile(name string) (fs.FileInfo, error) {
+	fsys, p, err := env.fsPath("stat", CapRead, name)
+	if err != nil {
+		var werr error
+		if fsys, p, werr = env.fsPath("stat", CapWrite, name); werr != nil {
+			return nil, err
+		}
+	}
+	return fs.Stat(fsys, p)
+}
+
+// checkFile is nil if name is a file, or else says why not:
+// it does not exist, or the file system refused the path.
+func (env *Zlisp) checkFile(name string) error {
+	fi, err := env.statFile(name)
+	if err == nil && !fi.IsDir() {
+		return nil
+	}
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("file '%s' does not exist", name)
+	}
+	return err
+}
+
+// fileExists is FileExists on the environment's file system.
+func (env *Zlisp) fileExists(name string) bool {
+	fi, err := env.statFile(name)
+	return err == nil && !fi.IsDir()
+}
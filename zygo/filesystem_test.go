@@ -0,0 +1,131 @@
+package zygo
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+// memFS is an fstest.MapFS that scripts can write to.
+type memFS struct {
+	fstest.MapFS
+}
+
+type memFile struct {
+	bytes.Buffer
+	fsys memFS
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fsys.MapFS[f.name] = &fstest.MapFile{Data: f.Bytes()}
+	return nil
+}
+
+func (m memFS) Create(name string) (io.WriteCloser, error) {
+	return &memFile{fsys: m, name: name}, nil
+}
+
+func Test190ScriptsReadAndWriteThroughTheEnvFS(t *testing.T) {
+
+	cv.Convey(`Given an in-memory file system, source, include, import and slurpf should read from it, with paths cleaned, and none leading out of it`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetFS(fstest.MapFS{
+			"lib/a.zy":       {Data: []byte(`(def fromA 1) (+ fromA 1)`)},
+			"lib/b.zy":       {Data: []byte(`(def fromB 10)`)},
+			"pkg/m.zy":       {Data: []byte(`(package "m" (def Val 100))`)},
+			"data/lines.txt": {Data: []byte("one\ntwo\n")},
+		})
+
+		res, err := env.EvalString(`(source "lib/a.zy")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "2")
+
+		res, err = env.EvalString(`(include "./lib/b.zy") (+ fromA fromB)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "11")
+
+		res, err = env.EvalString(`(import "pkg/m") (+ m.Val 0)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "100")
+
+		res, err = env.EvalString(`(slurpf "data/../data/lines.txt")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["one" "two"]`)
+
+		_, err = env.EvalString(`(slurpf "../module/go.mod")`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "invalid argument")
+		_, err = env.EvalString(`(source "/etc/hostname")`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "invalid argument")
+		_, err = env.EvalString(`(slurpf "nope.txt")`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "file 'nope.txt' does not exist")
+
+		_, err = env.EvalString(`(owritef "x" "out.txt")`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "permission denied")
+	})
+
+	cv.Convey(`Given a file system that can create files, the writef family should write to it, and writef still not overwrite`, t, func() {
+
+		fsys := memFS{fstest.MapFS{}}
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetFS(fsys)
+
+		res, err := env.EvalString(`(owritef ["a" "b"] "out/x.txt") (slurpf "out/x.txt")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["a" "b"]`)
+		cv.So(string(fsys.MapFS["out/x.txt"].Data), cv.ShouldEqual, "a\nb\n")
+
+		_, err = env.EvalString(`(writef "c" "out/x.txt")`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "refusing to write to existing file")
+
+		// spawned environments share it.
+		res, err = env.Duplicate().EvalString(`(slurpf "out/x.txt")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["a" "b"]`)
+	})
+
+	cv.Convey(`Given a jail, scripts should read and write under its directory, and be refused paths leading out of it`, t, func() {
+
+		dir := t.TempDir()
+		jail := filepath.Join(dir, "jail")
+		panicOn(os.Mkdir(jail, 0755))
+		panicOn(os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret\n"), 0644))
+		panicOn(os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(jail, "link.txt")))
+
+		fsys, err := JailFS(jail)
+		panicOn(err)
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetFS(fsys)
+
+		res, err := env.EvalString(`(owritef "(def inJail 7)" "sub.zy") (source "sub.zy") inJail`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "7")
+		_, err = os.Stat(filepath.Join(jail, "sub.zy"))
+		cv.So(err, cv.ShouldBeNil)
+
+		for _, script := range []string{
+			`(slurpf "../secret.txt")`,
+			`(slurpf "link.txt")`,
+			`(source "` + filepath.Join(dir, "secret.txt") + `")`,
+			`(owritef "x" "../escaped.txt")`,
+		} {
+			_, err = env.EvalString(script)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "escapes")
+		}
+		_, err = os.Stat(filepath.Join(dir, "escaped.txt"))
+		cv.So(os.IsNotExist(err), cv.ShouldBeTrue)
+	})
+}
@@ -114,7 +114,11 @@ func FuncBuilder(env *Zlisp, name string,
 	//Q("in func builder, returns = %v", returns.SexpString(nil))
 	//Q("in func builder, body = %v", (&SexpArray{Val: body, Env: env}).SexpString(nil))
 
-	inHash, err := GetFuncArgArray(inputs, env, "inputs")
+	pairs, spec, defaults, opts, err := funcInputs(inputs)
+	if err != nil {
+		return SexpNull, fmt.Errorf("inputs array parsing error: %v", err)
+	}
+	inHash, err := GetFuncArgArray(pairs, env, "inputs")
 	if err != nil {
 		return SexpNull, fmt.Errorf("inputs array parsing error: %v", err)
 	}
@@ -151,6 +155,7 @@ func FuncBuilder(env *Zlisp, name string,
 
 	gen := NewGenerator(env)
 	gen.Tail = true
+	gen.pos = PosOf(symN)
 
 	gen.funcname = funcName
 
@@ -163,11 +168,14 @@ func FuncBuilder(env *Zlisp, name string,
 	for i := range funcargs {
 		argsyms[i] = funcargs[i].(*SexpSymbol)
 	}
+	if opts != nil {
+		argsyms = append(argsyms, opts)
+	}
 
 	varargs := false
-	nargs := len(funcargs)
+	nargs := len(argsyms)
 
-	if len(argsyms) >= 2 && argsyms[len(argsyms)-2].name == "&" {
+	if spec == nil && len(argsyms) >= 2 && argsyms[len(argsyms)-2].name == "&" {
 		argsyms[len(argsyms)-2] = argsyms[len(argsyms)-1]
 		argsyms = argsyms[0 : len(argsyms)-1]
 		varargs = true
@@ -176,10 +184,19 @@ func FuncBuilder(env *Zlisp, name string,
 
 	//VPrintf("\n in buildSexpFun(): DumpFunction just before %v args go onto stack\n", len(argsyms))
 	if Working {
-		DumpFunction(ZlispFunction(gen.instructions), -1)
+		fdumpFunction(gen.env.Output(), ZlispFunction(gen.instructions), -1)
 	}
+	gen.pushFrame(true)
+	afsHelper.frame = gen.lex
 	for i := len(argsyms) - 1; i >= 0; i-- {
 		gen.AddInstruction(PopStackPutEnvInstr{argsyms[i]})
+		gen.bind(argsyms[i])
+	}
+	if spec != nil {
+		err = gen.generateDefaults(argsyms[spec.nreq:], defaults)
+		if err != nil {
+			return MissingFunction, err
+		}
 	}
 	err = gen.GenerateBegin(body)
 	if err != nil {
@@ -196,13 +213,18 @@ func FuncBuilder(env *Zlisp, name string,
 
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.AddInstruction(ReturnInstr{nil}) // nil is the error returned
+	generated := gen.optimize()
 
 	newfunc := ZlispFunction(gen.instructions)
 	sfun := gen.env.MakeFunction(gen.funcname, nargs,
 		varargs, newfunc, orig)
+	sfun.positions = gen.positions
+	sfun.generated = generated
 	sfun.SetFormalSymbols(argsyms)
 	sfun.inputTypes = inHash
 	sfun.returnTypes = retHash
+	sfun.params = spec
+	sfun.sig = formalsString(inputs.Val, true)
 
 	// tell the function scope where their function is, to
 	// provide access to the captured-closure scopes at runtime.
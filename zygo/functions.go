@@ -604,10 +604,16 @@ func AppendFunction(name string) ZlispUserFunction {
 		case *SexpArray:
 			switch name {
 			case "append":
+				if err := env.checkAlloc("array", len(t.Val)+1); err != nil {
+					return SexpNull, err
+				}
 				return &SexpArray{Val: append(t.Val, args[1]), Env: env, Typ: t.Typ}, nil
 			case "appendslice":
 				switch sl := args[1].(type) {
 				case *SexpArray:
+					if err := env.checkJoined("array", args); err != nil {
+						return SexpNull, err
+					}
 					return &SexpArray{Val: append(t.Val, sl.Val...), Env: env, Typ: t.Typ}, nil
 				default:
 					return SexpNull, fmt.Errorf("Second argument of appendslice must be slice")
@@ -616,6 +622,9 @@ func AppendFunction(name string) ZlispUserFunction {
 				return SexpNull, fmt.Errorf("unrecognized append variant: '%s'", name)
 			}
 		case *SexpStr:
+			if err := env.checkJoined("string", args); err != nil {
+				return SexpNull, err
+			}
 			return AppendStr(t, args[1])
 		}
 
@@ -635,8 +644,14 @@ func ConcatFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 
 	switch t := args[0].(type) {
 	case *SexpArray:
+		if err := env.checkJoined("array", args); err != nil {
+			return SexpNull, err
+		}
 		return ConcatArray(t, args[1:])
 	case *SexpStr:
+		if err := env.checkJoined("string", args); err != nil {
+			return SexpNull, err
+		}
 		return ConcatStr(t, args[1:])
 	case *SexpPair:
 		n := len(args)
@@ -652,6 +667,9 @@ func ConcatFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 }
 
 func ReadFunction(env *Zlisp, name string, args []Sexp) (sx Sexp, err error) {
+	if len(args) == 0 {
+		return env.readInput()
+	}
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
 	}
@@ -713,10 +731,12 @@ func EvalFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, nil
 	}
 	gen.AddInstruction(ReturnInstr{nil})
+	gen.optimize()
 
 	newfunc := ZlispFunction(gen.instructions)
 	orig := &SexpArray{Val: args}
 	sfun := env.MakeFunction("evalGeneratedFunction", 0, false, newfunc, orig)
+	sfun.positions = gen.positions
 
 	err = env.CallFunction(sfun, 0)
 	if err != nil {
@@ -812,14 +832,15 @@ func PrintFunction(name string) ZlispUserFunction {
 			str = expr.SexpString(nil)
 		}
 
+		out := env.Output()
 		switch name {
 		case "println":
-			fmt.Println(str)
+			fmt.Fprintln(out, str)
 		case "print":
-			fmt.Print(str)
+			fmt.Fprint(out, str)
 		case "printf", "sprintf":
 			if len(args) == 1 && name == "printf" {
-				fmt.Print(str)
+				fmt.Fprint(out, str)
 			} else {
 				ar := make([]interface{}, len(args)-1)
 				for i := 0; i < len(ar); i++ {
@@ -841,7 +862,7 @@ func PrintFunction(name string) ZlispUserFunction {
 					}
 				}
 				if name == "printf" {
-					fmt.Printf(str, ar...)
+					fmt.Fprintf(out, str, ar...)
 				} else {
 					// sprintf
 					return &SexpStr{S: fmt.Sprintf(str, ar...)}, nil
@@ -963,6 +984,9 @@ func MakeArrayFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		fill = SexpNull
 	}
 
+	if err := env.checkAlloc("array", size); err != nil {
+		return SexpNull, err
+	}
 	arr := make([]Sexp, size)
 	for i := range arr {
 		arr[i] = fill
@@ -1090,6 +1114,7 @@ func MergeFuncMap(funcs ...map[string]ZlispUserFunction) map[string]ZlispUserFun
 func SandboxSafeFunctions() map[string]ZlispUserFunction {
 	return MergeFuncMap(
 		CoreFunctions(),
+		ErrorFunctions(),
 		StrFunctions(),
 		EncodingFunctions(),
 	)
@@ -1099,6 +1124,7 @@ func SandboxSafeFunctions() map[string]ZlispUserFunction {
 func AllBuiltinFunctions() map[string]ZlispUserFunction {
 	return MergeFuncMap(
 		CoreFunctions(),
+		ErrorFunctions(),
 		StrFunctions(),
 		EncodingFunctions(),
 		SystemFunctions(),
@@ -1164,24 +1190,28 @@ func CoreFunctions() map[string]ZlispUserFunction {
 		"sget":       SgetFunction,
 		"hget":       GenericAccessFunction, // handles arrays or hashes
 		//":":          ColonAccessFunction,
-		"hset":        HashAccessFunction("hset"),
-		"hdel":        HashAccessFunction("hdel"),
-		"keys":        HashAccessFunction("keys"),
-		"hpair":       GenericHpairFunction,
-		"__rangeLen":  RangeLenFunction,
-		"__rangeKey":  RangeKeyFunction,
-		"__rangePair": RangePairFunction,
-		"slice":       SliceFunction,
-		"len":         LenFunction,
-		"append":      AppendFunction("append"),
-		"appendslice": AppendFunction("appendslice"),
-		"concat":      ConcatFunction,
-		"field":       ConstructorFunction("field"),
-		"struct":      ConstructorFunction("struct"),
-		"array":       ConstructorFunction("array"),
-		"list":        ConstructorFunction("list"),
-		"hash":        ConstructorFunction("hash"),
-		"raw":         ConstructorFunction("raw"),
+		"hset":          HashAccessFunction("hset"),
+		"hdel":          HashAccessFunction("hdel"),
+		"keys":          HashAccessFunction("keys"),
+		"hpair":         GenericHpairFunction,
+		"__rangeLen":    RangeLenFunction,
+		"__rangeKey":    RangeKeyFunction,
+		"__rangePair":   RangePairFunction,
+		"__match":       MatchFunction,
+		"__nomatch":     NoMatchFunction,
+		"__destructure": DestructureFunction,
+		"__unsupplied":  UnsuppliedFunction,
+		"slice":         SliceFunction,
+		"len":           LenFunction,
+		"append":        AppendFunction("append"),
+		"appendslice":   AppendFunction("appendslice"),
+		"concat":        ConcatFunction,
+		"field":         ConstructorFunction("field"),
+		"struct":        ConstructorFunction("struct"),
+		"array":         ConstructorFunction("array"),
+		"list":          ConstructorFunction("list"),
+		"hash":          ConstructorFunction("hash"),
+		"raw":           ConstructorFunction("raw"),
 
 		"raw64":      ConstructorFunction("raw64"),
 		"unbase64":   ConstructorFunction("unbase64"),
@@ -1265,6 +1295,7 @@ func SystemFunctions() map[string]ZlispUserFunction {
 		"system":    SystemFunction,
 		"exit":      ExitFunction,
 		"_closdump": DumpClosureEnvFunction,
+		"_disasm":   DisasmFunction,
 		"rmsym":     RemoveSymFunction,
 		"typelist":  TypeListFunction,
 		"setenv":    GetEnvFunction("setenv"),
@@ -1373,6 +1404,9 @@ func GensymFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 }
 
 func ExitFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if err := env.allow(CapExec, name); err != nil {
+		return SexpNull, err
+	}
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
 	}
@@ -1725,7 +1759,7 @@ func AddressOfFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, WrongNargs
 	}
 
-	return NewSexpPointer(args[0]), nil
+	return env.NewSexpPointer(args[0]), nil
 }
 
 func DerefFunction(name string) ZlispUserFunction {
@@ -1754,7 +1788,7 @@ func DerefFunction(name string) ZlispUserFunction {
 		case *SexpPointer:
 			ptr = e
 		case *SexpReflect:
-			ptr = NewSexpPointer(e)
+			ptr = env.NewSexpPointer(e)
 		default:
 			return SexpNull, fmt.Errorf("%s only operates on pointers (*SexpPointer); we saw %T instead", name, e)
 		}
@@ -1945,12 +1979,18 @@ func (env *Zlisp) SubstituteRHS(args []Sexp) ([]Sexp, error) {
 }
 
 func ScriptFacingRegisterDemoStructs(env *Zlisp, name string, args []Sexp) (Sexp, error) {
-	RegisterDemoStructs()
+	if err := env.allow(CapReflect, name); err != nil {
+		return SexpNull, err
+	}
+	env.TypeRegistry().RegisterDemoStructs()
 	return SexpNull, nil
 }
 
 func GetEnvFunction(name string) ZlispUserFunction {
 	return func(env *Zlisp, _ string, args []Sexp) (Sexp, error) {
+		if err := env.allow(CapEnv, name); err != nil {
+			return SexpNull, err
+		}
 		narg := len(args)
 		//fmt.Printf("GetEnv name='%s' called with narg = %v\n", name, narg)
 		if name == "getenv" {
@@ -13,6 +13,17 @@ type Generator struct {
 	scopes         int
 	instructions   []Instruction
 	knownFunctions map[int]*SexpFunction
+
+	// positions parallels instructions, giving the source
+	// position each was generated from; pos is the position
+	// of the expression currently being generated.
+	positions []SrcPos
+	pos       SrcPos
+
+	// lex models the scopes the code will run in; see lexical.go.
+	// outerLex, if set, is shared with code already generated.
+	lex      *lexFrame
+	outerLex *lexFrame
 }
 
 type Loop struct {
@@ -31,6 +42,7 @@ func NewGenerator(env *Zlisp) *Generator {
 	gen := new(Generator)
 	gen.env = env
 	gen.instructions = make([]Instruction, 0)
+	gen.positions = make([]SrcPos, 0)
 	gen.knownFunctions = make(map[int]*SexpFunction)
 	// tail marks whether or not we are in the tail position
 	gen.Tail = false
@@ -42,15 +54,40 @@ func NewGenerator(env *Zlisp) *Generator {
 func (gen *Generator) NewSubGenerator() *Generator {
 	subgen := NewGenerator(gen.env)
 	subgen.knownFunctions = gen.knownFunctions
+	subgen.pos = gen.pos
+	subgen.lex = gen.lex
+	subgen.outerLex = gen.outerLex
 	return subgen
 }
 
+// AddInstructions appends instr, attributing all of
+// them to the current source position. Prefer addCode
+// when the instructions came from a sub-generator.
 func (gen *Generator) AddInstructions(instr []Instruction) {
 	gen.instructions = append(gen.instructions, instr...)
+	for range instr {
+		gen.positions = append(gen.positions, gen.pos)
+	}
 }
 
 func (gen *Generator) AddInstruction(instr Instruction) {
 	gen.instructions = append(gen.instructions, instr)
+	gen.positions = append(gen.positions, gen.pos)
+}
+
+// addCode appends instructions along with their source positions.
+func (gen *Generator) addCode(instr []Instruction, pos []SrcPos) {
+	if len(pos) != len(instr) {
+		gen.AddInstructions(instr)
+		return
+	}
+	gen.instructions = append(gen.instructions, instr...)
+	gen.positions = append(gen.positions, pos...)
+}
+
+// Positions returns the source position of each generated instruction.
+func (gen *Generator) Positions() []SrcPos {
+	return gen.positions
 }
 
 func (gen *Generator) GenerateBegin(expressions []Sexp) error {
@@ -95,6 +132,7 @@ func buildSexpFun(
 		gen.knownFunctions = knownFunctions
 	}
 	gen.Tail = true
+	gen.pos = PosOf(orig)
 
 	if len(name) == 0 {
 		gen.funcname = env.GenSymbol("__anon").name
@@ -105,22 +143,36 @@ func buildSexpFun(
 	afsHelper := &AddFuncScopeHelper{}
 	gen.AddInstruction(AddFuncScopeInstr{Name: "runtime " + gen.funcname, Helper: afsHelper})
 
-	argsyms := make([]*SexpSymbol, len(funcargs.Val))
+	formals, spec, defaults, err := parseFormals(env, funcargs.Val)
+	if err != nil {
+		return MissingFunction, err
+	}
+	argsyms := make([]*SexpSymbol, len(formals))
 
-	for i, expr := range funcargs.Val {
+	// a pattern parameter is passed in a hidden one, and
+	// destructured from it.
+	var patterns map[*SexpSymbol]Sexp
+	for i, expr := range formals {
 		switch t := expr.(type) {
 		case *SexpSymbol:
 			argsyms[i] = t
 		default:
-			return MissingFunction,
-				fmt.Errorf("function argument must be symbol")
+			if !isDestructuring(t) {
+				return MissingFunction,
+					fmt.Errorf("function argument must be symbol")
+			}
+			if patterns == nil {
+				patterns = make(map[*SexpSymbol]Sexp)
+			}
+			argsyms[i] = env.GenSymbol("__arg")
+			patterns[argsyms[i]] = t
 		}
 	}
 
 	varargs := false
-	nargs := len(funcargs.Val)
+	nargs := len(formals)
 
-	if len(argsyms) >= 2 && argsyms[len(argsyms)-2].name == "&" {
+	if spec == nil && len(argsyms) >= 2 && argsyms[len(argsyms)-2].name == "&" {
 		argsyms[len(argsyms)-2] = argsyms[len(argsyms)-1]
 		argsyms = argsyms[0 : len(argsyms)-1]
 		varargs = true
@@ -129,27 +181,49 @@ func buildSexpFun(
 
 	sfun := gen.env.MakeFunction(gen.funcname, nargs, varargs, nil, orig)
 	sfun.SetFormalSymbols(argsyms)
+	sfun.params = spec
+	sfun.sig = formalsString(funcargs.Val, false)
 	if len(name) > 0 {
 		gen.knownFunctions[env.MakeSymbol(name).number] = sfun
 	}
 
 	//VPrintf("\n in buildSexpFun(): DumpFunction just before %v args go onto stack\n", len(argsyms))
 	if Working {
-		DumpFunction(ZlispFunction(gen.instructions), -1)
+		fdumpFunction(gen.env.Output(), ZlispFunction(gen.instructions), -1)
 	}
+	gen.pushFrame(true)
+	afsHelper.frame = gen.lex
 	for i := len(argsyms) - 1; i >= 0; i-- {
 		gen.AddInstruction(PopStackPutEnvInstr{argsyms[i]})
+		gen.bind(argsyms[i])
+	}
+	for _, sym := range argsyms {
+		if pat, ok := patterns[sym]; ok {
+			gen.AddInstruction(EnvToStackInstr{sym})
+			err := gen.generateDestructure(pat)
+			if err != nil {
+				return MissingFunction, err
+			}
+		}
+	}
+	if spec != nil {
+		err = gen.generateDefaults(argsyms[spec.nreq:], defaults)
+		if err != nil {
+			return MissingFunction, err
+		}
 	}
-	err := gen.GenerateBegin(funcbody)
+	err = gen.GenerateBegin(funcbody)
 	if err != nil {
 		return MissingFunction, err
 	}
 
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.AddInstruction(ReturnInstr{nil})
+	sfun.generated = gen.optimize()
 
 	newfunc := ZlispFunction(gen.instructions)
 	sfun.fun = newfunc
+	sfun.positions = gen.positions
 
 	// tell the function scope where their function is, to
 	// provide access to the captured-closure scopes at runtime.
@@ -181,7 +255,7 @@ func (gen *Generator) GenerateFn(args []Sexp, orig Sexp) error {
 
 	//VPrintf("in GenerateFn(): gen of sfun:\n")
 	if Working {
-		DumpFunction(sfun.fun, -1)
+		fdumpFunction(gen.env.Output(), sfun.fun, -1)
 	}
 
 	gen.AddInstruction(CreateClosureInstr{sfun})
@@ -212,9 +286,14 @@ func (gen *Generator) GenerateDef(args []Sexp, opname string) error {
 		switch opname {
 		case "def":
 			instr = PopStackPutEnvInstr{lhs}
+			defer gen.bind(lhs)
 		case "set":
 			Q("GenerateDef is doing set with UpdateInstr: lhs = '%s'", lhs.SexpString(nil))
-			instr = UpdateInstr{lhs}
+			if depth, ref := gen.local(lhs); depth >= 0 {
+				instr = StoreLocalInstr{sym: lhs, depth: depth, ref: ref}
+			} else {
+				instr = UpdateInstr{lhs}
+			}
 		default:
 			panic(fmt.Errorf("unknown opname '%s'", opname))
 		}
@@ -275,11 +354,12 @@ func (gen *Generator) GenerateDefn(args []Sexp, orig Sexp) error {
 
 	//VPrintf("in GenerateDefn(): gen of sfun:\n")
 	if Working {
-		DumpFunction(sfun.fun, -1)
+		fdumpFunction(gen.env.Output(), sfun.fun, -1)
 	}
 
 	gen.AddInstruction(CreateClosureInstr{sfun})
 	gen.AddInstruction(PopStackPutEnvInstr{sym})
+	gen.bind(sym)
 	gen.AddInstruction(PushInstr{SexpNull})
 
 	return nil
@@ -390,6 +470,7 @@ func (gen *Generator) GenerateShortCircuit(or bool, args []Sexp) error {
 	subgen.funcname = gen.funcname
 	subgen.Generate(args[size-1])
 	instructions := subgen.instructions
+	positions := subgen.positions
 
 	for i := size - 2; i >= 0; i-- {
 		subgen = gen.NewSubGenerator()
@@ -398,8 +479,9 @@ func (gen *Generator) GenerateShortCircuit(or bool, args []Sexp) error {
 		subgen.AddInstruction(BranchInstr{or, len(instructions) + 2})
 		subgen.AddInstruction(PopInstr(0))
 		instructions = append(subgen.instructions, instructions...)
+		positions = append(subgen.positions, positions...)
 	}
-	gen.AddInstructions(instructions)
+	gen.addCode(instructions, positions)
 
 	return nil
 }
@@ -418,6 +500,7 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 		return err
 	}
 	instructions := subgen.instructions
+	positions := subgen.positions
 
 	// we generate the cond bottom up, so i counts down.
 	for i := len(args)/2 - 1; i >= 0; i-- {
@@ -427,6 +510,7 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 			return err
 		}
 		pred_code := subgen.instructions
+		pred_pos := subgen.positions
 
 		subgen.Reset()
 		subgen.Tail = gen.Tail
@@ -437,18 +521,20 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 			return err
 		}
 		body_code := subgen.instructions
+		body_pos := subgen.positions
 
 		subgen.Reset()
-		subgen.AddInstructions(pred_code)
+		subgen.addCode(pred_code, pred_pos)
 		subgen.AddInstruction(BranchInstr{false, len(body_code) + 2})
-		subgen.AddInstructions(body_code)
+		subgen.addCode(body_code, body_pos)
 		subgen.AddInstruction(JumpInstr{addpc: len(instructions) + 1})
-		subgen.AddInstructions(instructions)
+		subgen.addCode(instructions, positions)
 
 		instructions = subgen.instructions
+		positions = subgen.positions
 	}
 
-	gen.AddInstructions(instructions)
+	gen.addCode(instructions, positions)
 	return nil
 }
 
@@ -464,7 +550,7 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 		return fmt.Errorf("malformed let statement")
 	}
 
-	lstatements := make([]*SexpSymbol, 0)
+	lstatements := make([]Sexp, 0)
 	rstatements := make([]Sexp, 0)
 	var bindings []Sexp
 
@@ -480,16 +566,17 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 	}
 
 	for i := 0; i < len(bindings)/2; i++ {
-		switch t := bindings[2*i].(type) {
-		case *SexpSymbol:
-			lstatements = append(lstatements, t)
-		default:
+		// a symbol, or a pattern to destructure.
+		lhs := bindings[2*i]
+		if _, isSym := lhs.(*SexpSymbol); !isSym && !isDestructuring(lhs) {
 			return fmt.Errorf("cannot bind to non-symbol")
 		}
+		lstatements = append(lstatements, lhs)
 		rstatements = append(rstatements, bindings[2*i+1])
 	}
 
-	gen.AddInstruction(AddScopeInstr{Name: "runtime " + name})
+	gen.pushFrame(false)
+	gen.AddInstruction(AddScopeInstr{Name: "runtime " + name, frame: gen.lex})
 	gen.scopes++
 
 	if name == "letseq" {
@@ -498,7 +585,10 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 			if err != nil {
 				return err
 			}
-			gen.AddInstruction(PopStackPutEnvInstr{lstatements[i]})
+			err = gen.generateBind(lstatements[i])
+			if err != nil {
+				return err
+			}
 		}
 	} else if name == "let" {
 		for _, rs := range rstatements {
@@ -508,7 +598,10 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 			}
 		}
 		for i := len(lstatements) - 1; i >= 0; i-- {
-			gen.AddInstruction(PopStackPutEnvInstr{lstatements[i]})
+			err := gen.generateBind(lstatements[i])
+			if err != nil {
+				return err
+			}
 		}
 	}
 	err := gen.GenerateBegin(args[1:])
@@ -517,6 +610,7 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 	}
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.scopes--
+	gen.popFrame()
 
 	return nil
 }
@@ -601,6 +695,8 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 		return gen.GenerateShortCircuit(true, args)
 	case "cond":
 		return gen.GenerateCond(args)
+	case "match":
+		return gen.GenerateMatch(args)
 	case "quote":
 		return gen.GenerateQuote(args)
 	case "def":
@@ -681,7 +777,7 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 		gen.AddInstruction(PrepareCallInstr{sym, len(args)})
 		gen.AddInstruction(GotoInstr{1}) // goto 1 instead of 0 to avoid adding a new scope
 	} else {
-		gen.AddInstruction(CallExprInstr{callee: sym, args: append([]Sexp(nil), args...)})
+		gen.AddInstruction(gen.callExpr(sym, args))
 	}
 	gen.Tail = oldtail
 	return nil
@@ -717,7 +813,7 @@ func (gen *Generator) LookupKnownFunction(sym *SexpSymbol) *SexpFunction {
 
 func (gen *Generator) GenerateCallArgsForFunction(function *SexpFunction, args []Sexp) error {
 	for i, expr := range args {
-		if function != nil && function.IsLazyCallArg(i) {
+		if function.lazyArg(args, i) {
 			gen.AddInstruction(PushLazyArgInstr{expr: expr})
 			continue
 		}
@@ -750,7 +846,7 @@ func (gen *Generator) GenerateInfix(args []Sexp) error {
 }
 
 func (gen *Generator) GenerateDispatch(fun Sexp, args []Sexp) error {
-	gen.AddInstruction(CallExprInstr{callee: fun, args: append([]Sexp(nil), args...)})
+	gen.AddInstruction(gen.callExpr(fun, args))
 	return nil
 }
 
@@ -822,8 +918,17 @@ func (gen *Generator) Generate(expr Sexp) error {
 	if _, isComment := expr.(*SexpComment); isComment {
 		return nil
 	}
+	if p := PosOf(expr); p.IsValid() {
+		outer := gen.pos
+		gen.pos = p
+		defer func() { gen.pos = outer }()
+	}
 	switch e := expr.(type) {
 	case *SexpSymbol:
+		if depth, ref := gen.local(e); depth >= 0 {
+			gen.AddInstruction(LoadLocalInstr{sym: e, depth: depth, ref: ref})
+			return nil
+		}
 		gen.AddInstruction(EnvToStackInstr{e})
 		return nil
 	case *SexpPair:
@@ -839,15 +944,15 @@ func (gen *Generator) Generate(expr Sexp) error {
 			if isAssign && pos > 0 && legalLeftHandSide {
 				err := gen.GenerateAssignment(e, pos)
 				if err != nil {
-					return fmt.Errorf("Error generating %s:\n%v",
-						expr.SexpString(nil), err)
+					return annotatePos(fmt.Errorf("Error generating %s:\n%w",
+						expr.SexpString(nil), err), gen.pos)
 				}
 				return nil
 			}
 			err := gen.GenerateCall(e)
 			if err != nil {
-				return fmt.Errorf("Error generating %s:\n%v",
-					expr.SexpString(nil), err)
+				return annotatePos(fmt.Errorf("Error generating %s:\n%w",
+					expr.SexpString(nil), err), gen.pos)
 			}
 			return nil
 		} else {
@@ -874,6 +979,7 @@ func (gen *Generator) GenerateAll(expressions []Sexp) error {
 
 func (gen *Generator) Reset() {
 	gen.instructions = make([]Instruction, 0)
+	gen.positions = make([]SrcPos, 0)
 	gen.Tail = false
 	gen.scopes = 0
 }
@@ -964,7 +1070,8 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	// loops use repeat the use variable i in an index and then
 	// end up clobering the parents loop index
 	// inadvertently.
-	gen.AddInstruction(AddScopeInstr{Name: "runtime " + loop.stmtname.name})
+	gen.pushFrame(false)
+	gen.AddInstruction(AddScopeInstr{Name: "runtime " + loop.stmtname.name, frame: gen.lex})
 	gen.scopes++
 	gen.AddInstruction(PushStackmarkInstr{sym: loop.stmtname})
 
@@ -993,6 +1100,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	// insert pop so the stack remains clean
 	subgenInit.AddInstruction(PopUntilStackmarkInstr{sym: loop.stmtname})
 	init_code := subgenInit.instructions
+	init_pos := subgenInit.positions
 
 	// generate the test
 	subgenT := gen.NewSubGenerator()
@@ -1007,6 +1115,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	// need to leave value on stack to branch on
 	// so do not popuntil stackmark here!
 	test_code := subgenT.instructions
+	test_pos := subgenT.positions
 
 	// generate the increment code
 	subgenIncr := gen.NewSubGenerator()
@@ -1020,19 +1129,20 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	}
 	subgenIncr.AddInstruction(PopUntilStackmarkInstr{sym: loop.stmtname})
 	incr_code := subgenIncr.instructions
+	incr_pos := subgenIncr.positions
 
 	exit_loop := len_body_code + 3
 	jump_to_test := len(incr_code) + 2
 
 	gen.AddInstruction(LabelInstr{label: "start of init for " + loop.stmtname.name})
-	gen.AddInstructions(init_code)
+	gen.addCode(init_code, init_pos)
 	gen.AddInstruction(JumpInstr{addpc: jump_to_test, where: "to-test"})
 	// top of loop starts with test_code: (continue) target.
 	continuePos := len(gen.instructions)
 	gen.AddInstruction(LabelInstr{label: "start of increment for " + loop.stmtname.name})
-	gen.AddInstructions(incr_code)
+	gen.addCode(incr_code, incr_pos)
 	gen.AddInstruction(LabelInstr{label: "start of test for " + loop.stmtname.name})
-	gen.AddInstructions(test_code)
+	gen.addCode(test_code, test_pos)
 	gen.AddInstruction(BranchInstr{false, exit_loop})
 	bodyPos := len(gen.instructions)
 
@@ -1044,7 +1154,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	// the additional (negative) distance to startPos.
 
 	gen.AddInstruction(LabelInstr{label: "start of body for " + loop.stmtname.name})
-	gen.AddInstructions(subgenBody.instructions)
+	gen.addCode(subgenBody.instructions, subgenBody.positions)
 	gen.AddInstruction(JumpInstr{addpc: continuePos - len(gen.instructions),
 		where: "to-continue-position-aka-increment"})
 	gen.AddInstruction(LabelInstr{label: "end of body for " + loop.stmtname.name})
@@ -1055,6 +1165,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	gen.AddInstruction(ClearStackmarkInstr{sym: loop.stmtname})
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.scopes--
+	gen.popFrame()
 	gen.AddInstruction(PushInstr{SexpNull}) // for is a statement; leave null on the stack.
 
 	loop.loopStart = startPos - bodyPos // offset; should be negative.
@@ -1115,6 +1226,9 @@ func (gen *Generator) GenerateMultiDef(args []Sexp) error {
 	nsym := len(args) - 1
 	lastpos := len(args) - 1
 	syms := make([]*SexpSymbol, nsym)
+	// with patterns among the targets, they all make an
+	// array pattern for the value.
+	var patterns []Sexp
 	for i := 0; i < nsym; i++ {
 		switch sym := args[i].(type) {
 		case *SexpSymbol:
@@ -1128,6 +1242,12 @@ func (gen *Generator) GenerateMultiDef(args []Sexp) error {
 			unquotedSymbol, isQuo := isQuotedSymbol(sym)
 			if isQuo {
 				syms[i] = unquotedSymbol.(*SexpSymbol)
+			} else if isDestructuring(sym) && patterns == nil {
+				patterns = make([]Sexp, nsym)
+			}
+		case *SexpArray:
+			if patterns == nil {
+				patterns = make([]Sexp, nsym)
 			}
 		default:
 			return fmt.Errorf("All mdef targets must be symbols, but %d-th was not, instead of type %T: '%s'", i+1, sym, sym.SexpString(nil))
@@ -1143,7 +1263,21 @@ func (gen *Generator) GenerateMultiDef(args []Sexp) error {
 	// on the stack and becomes an expression rather
 	// than a statement.
 	gen.AddInstruction(DupInstr(0))
+	if patterns != nil {
+		for i := range patterns {
+			patterns[i] = args[i]
+			if syms[i] != nil {
+				patterns[i] = syms[i]
+			}
+		}
+		return gen.generateDestructure(&SexpArray{Val: patterns, Env: gen.env})
+	}
 	gen.AddInstruction(BindlistInstr{syms: syms})
+	for _, sym := range syms {
+		if sym != nil {
+			gen.bind(sym)
+		}
+	}
 	return nil
 }
 
@@ -1466,7 +1600,8 @@ func (gen *Generator) GenerateNewScope(expressions []Sexp) error {
 		//return NoExpressionsFound
 	}
 
-	gen.AddInstruction(AddScopeInstr{Name: "newScope"})
+	gen.pushFrame(false)
+	gen.AddInstruction(AddScopeInstr{Name: "newScope", frame: gen.lex})
 	gen.scopes++
 	for _, expr := range expressions[:size-1] {
 		err := gen.Generate(expr)
@@ -1484,6 +1619,7 @@ func (gen *Generator) GenerateNewScope(expressions []Sexp) error {
 	}
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.scopes--
+	gen.popFrame()
 	return nil
 }
 
@@ -1511,7 +1647,9 @@ func (gen *Generator) GeneratePackage(expressions []Sexp) error {
 	oldtail := gen.Tail
 	gen.Tail = false
 
-	gen.AddInstruction(AddScopeInstr{Name: pkgName})
+	gen.pushFrame(false)
+	gen.AddInstruction(AddScopeInstr{Name: pkgName, frame: gen.lex})
+	defer gen.popFrame()
 	gen.AddInstruction(PushStackmarkInstr{sym: symPkgName})
 
 	if size > 1 {
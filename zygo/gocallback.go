@@ -0,0 +1,209 @@
+package zygo
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Script functions as Go funcs
+// ============================
+//
+// Where Go wants a func, a script can give a function: as
+// an argument to a Go method called with _method, or to a
+// Go function bound with AddGoFunc, or as the value of a
+// func field of a registered struct made with togo. GoFunc
+// makes the func, with reflect.MakeFunc; calling it calls
+// the script function in the environment that made it,
+// with the arguments converted as AddGoFunc converts
+// results, and the result converted back as AddGoFunc
+// converts arguments. Several results come from an array.
+// If the func type ends in an error, an error raised by
+// the script function is returned there; otherwise the
+// func panics with it.
+//
+// An environment runs one thing at a time, so calls back
+// into it are serialized. While a script waits on a Go
+// call, the environment runs the calls back that the Go
+// code makes, from any goroutine, one at a time, in the
+// waiting script's goroutine, when the Go call was given
+// such a func. Otherwise, as when no script is waiting on
+// Go, a call back runs in the caller's goroutine, after
+// any other call back, but not after the host's own use of
+// the environment, which should then leave it alone: for
+// example, have a script register an HTTP handler and then
+// call the Go that serves it, rather than serve it from the
+// host while evaluating something else.
+
+// callbackGate serializes calls back into an environment;
+// see above.
+type callbackGate struct {
+	// made counts the funcs the environment has made.
+	made atomic.Int64
+
+	mu      sync.Mutex
+	serving *callbackServer
+
+	// held while a call back runs outside a Go call.
+	direct sync.Mutex
+}
+
+// callbackServer takes calls back during one Go call.
+type callbackServer struct {
+	calls   chan *callback
+	stopped chan struct{}
+}
+
+type callback struct {
+	fun  *SexpFunction
+	args []Sexp
+	res  Sexp
+	err  error
+	done chan struct{}
+}
+
+// GoFunc returns a func of type t that calls fun in env.
+func (env *Zlisp) GoFunc(fun *SexpFunction, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() != reflect.Func {
+		return reflect.Value{}, fmt.Errorf("cannot use function %s as %s", fun.name, t)
+	}
+	nout := t.NumOut()
+	returnsErr := nout > 0 && t.Out(nout-1) == errorType
+	if returnsErr {
+		nout--
+	}
+	env.callbacks.made.Add(1)
+
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		if t.IsVariadic() {
+			last := in[len(in)-1]
+			in = in[:len(in)-1]
+			for i := 0; i < last.Len(); i++ {
+				in = append(in, last.Index(i))
+			}
+		}
+		args := make([]Sexp, len(in))
+		for i, v := range in {
+			sx, err := goValueToSexp(env, v)
+			if err != nil {
+				panic(fmt.Errorf("%s: argument %d: %v", fun.name, i+1, err))
+			}
+			args[i] = sx
+		}
+
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			out[i] = reflect.Zero(t.Out(i))
+		}
+		res, err := env.callBack(fun, args)
+		if err == nil {
+			err = setResults(env, res, out[:nout], t)
+		}
+		if err != nil {
+			if !returnsErr {
+				panic(fmt.Errorf("%s: %v", fun.name, err))
+			}
+			for i := 0; i < nout; i++ {
+				out[i] = reflect.Zero(t.Out(i))
+			}
+			out[nout] = reflect.ValueOf(&err).Elem()
+		}
+		return out
+	}), nil
+}
+
+// setResults converts res to the results of t, into out.
+func setResults(env *Zlisp, res Sexp, out []reflect.Value, t reflect.Type) error {
+	switch len(out) {
+	case 0:
+		return nil
+	case 1:
+		v, err := sexpToGoValue(env, res, t.Out(0))
+		if err != nil {
+			return fmt.Errorf("result: %v", err)
+		}
+		out[0] = v
+		return nil
+	}
+	arr, ok := res.(*SexpArray)
+	if !ok || len(arr.Val) != len(out) {
+		return fmt.Errorf("need an array of %d results, got %s", len(out), res.SexpString(nil))
+	}
+	for i := range out {
+		v, err := sexpToGoValue(env, arr.Val[i], t.Out(i))
+		if err != nil {
+			return fmt.Errorf("result %d: %v", i+1, err)
+		}
+		out[i] = v
+	}
+	return nil
+}
+
+// callBack runs fun(args...) for a func made by GoFunc:
+// through the script waiting on a Go call, if there is one,
+// or else here.
+func (env *Zlisp) callBack(fun *SexpFunction, args []Sexp) (Sexp, error) {
+	g := &env.callbacks
+	g.mu.Lock()
+	s := g.serving
+	g.mu.Unlock()
+	if s != nil {
+		c := &callback{fun: fun, args: args, done: make(chan struct{})}
+		select {
+		case s.calls <- c:
+			<-c.done
+			return c.res, c.err
+		case <-s.stopped:
+			// the Go call returned first.
+		}
+	}
+	g.direct.Lock()
+	defer g.direct.Unlock()
+	return env.applyFromGo(fun, args)
+}
+
+// goCall runs call, a call into Go, taking the calls back
+// it makes while it runs. Go panics are passed on. made is
+// what callbacks.made was before converting the arguments:
+// only a call given funcs made since, which it may hand to
+// other goroutines, runs on a goroutine of its own; any
+// other runs here, and calls back, if at all, directly.
+func (env *Zlisp) goCall(made int64, call func()) {
+	g := &env.callbacks
+	if g.made.Load() == made {
+		call()
+		return
+	}
+	s := &callbackServer{calls: make(chan *callback), stopped: make(chan struct{})}
+	g.mu.Lock()
+	outer := g.serving
+	g.serving = s
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		g.serving = outer
+		g.mu.Unlock()
+		close(s.stopped)
+	}()
+
+	finished := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			finished <- recover()
+		}()
+		call()
+	}()
+	for {
+		select {
+		case c := <-s.calls:
+			c.res, c.err = env.applyFromGo(c.fun, c.args)
+			close(c.done)
+		case r := <-finished:
+			if r != nil {
+				panic(r)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package zygo
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+// cbPicker holds script functions in func fields.
+type cbPicker struct {
+	Keep  func(int) bool            `json:"keep"`
+	Label func(int) (string, error) `json:"label"`
+}
+
+func (p *cbPicker) Count(xs []int) int {
+	n := 0
+	for _, x := range xs {
+		if p.Keep(x) {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *cbPicker) Labels(xs []int) (string, error) {
+	var s []string
+	for _, x := range xs {
+		l, err := p.Label(x)
+		if err != nil {
+			return "", err
+		}
+		s = append(s, l)
+	}
+	return strings.Join(s, ","), nil
+}
+
+// Parallel calls f from n goroutines at once.
+func (p *cbPicker) Parallel(n int, f func(int)) int {
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+	return n
+}
+
+// goroutineID reads the running goroutine's number from its stack.
+func goroutineID() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	return strings.Fields(string(buf))[1]
+}
+
+func Test220ScriptFunctionsAsGoFuncs(t *testing.T) {
+
+	cv.Convey(`Given Go functions taking funcs, scripts should pass them functions and closures, with arguments and results converted`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.AddGoFunc("keepIf", func(xs []int, keep func(int) bool) []int {
+			var r []int
+			for _, x := range xs {
+				if keep(x) {
+					r = append(r, x)
+				}
+			}
+			return r
+		})
+		env.AddGoFunc("describe", func(x int, f func(int) (string, bool)) string {
+			s, ok := f(x)
+			return fmt.Sprintf("%s/%v", s, ok)
+		})
+		env.AddGoFunc("tryIt", func(f func() error) string {
+			if err := f(); err != nil {
+				return "failed: " + err.Error()
+			}
+			return "ok"
+		})
+
+		res, err := env.EvalString(`(def k 2) (keepIf [1 2 3 4] (fn [x] (> x k)))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[3 4]")
+
+		res, err = env.EvalString(`(describe 7 (fn [x] [(str x) (> x 5)]))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"7/true"`)
+
+		res, err = env.EvalString(`[(tryIt (fn [] 1)) (tryIt (fn [] (error "nope")))]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["ok" "failed: nope"]`)
+
+		// and from Go, with Call.
+		_, err = env.EvalString(`(defn gt2 [x] (> x 2))`)
+		panicOn(err)
+		fn, _ := env.FindObject("gt2")
+		got, err := CallAs[[]int64](env, "keepIf", []int{5, 1, 9}, fn)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(got, cv.ShouldResemble, []int64{5, 9})
+	})
+
+	cv.Convey(`Given a registered struct with func fields, togo and _method should fill them from script functions, and calls back from other goroutines should be serialized`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.TypeRegistry().RegisterUserdef(&RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
+			return &cbPicker{}, nil
+		}}, true, "picker")
+
+		res, err := env.EvalString(`
+(defmap picker)
+(def p (picker keep: (fn [x] (== 0 (mod x 2)))
+               label: (fn [x] (cond (< x 0) (error "negative") (concat "#" (str x))))))
+[(_method p "Count" [1 2 3 4 6]) (_method p "Labels" [1 2])]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[[3] ["#1,#2" nil]]`)
+
+		res, err = env.EvalString(`(_method p "Labels" [1 -2])`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldContainSubstring, "negative")
+
+		// many goroutines at once, each adding to one total.
+		res, err = env.EvalString(`
+(def total 0)
+(_method p "Parallel" 50 (fn [i] (set total (+ total i))))
+(+ total 0)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "1275")
+
+		// a func field still works once back in Go, with the
+		// environment idle.
+		_, err = env.EvalString(`(togo p)`)
+		panicOn(err)
+		p, _ := env.FindObject("p")
+		pk := p.(*SexpHash).GoShadowStruct.(*cbPicker)
+		cv.So(pk.Keep(10), cv.ShouldBeTrue)
+		cv.So(pk.Keep(11), cv.ShouldBeFalse)
+		res, err = env.EvalString(`(+ total 1)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "1276")
+
+		// a callback error with nowhere to go is raised in the script.
+		_, err = env.EvalString(`(def bad (picker keep: (fn [x] (error "no keeping")))) (_method bad "Count" [1])`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "no keeping")
+
+		_, err = env.EvalString(`(togo (picker keep: 3))`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "last recordKey field name was 'keep'")
+	})
+
+	cv.Convey(`Given funcs made for one Go call, later Go calls given none should still run on the caller's goroutine`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.AddGoFunc("where", func() string { return goroutineID() })
+		env.AddGoFunc("whereWith", func(f func() string) []string { return []string{goroutineID(), f()} })
+
+		res, err := env.EvalString(`(whereWith (fn [] (where)))`)
+		cv.So(err, cv.ShouldBeNil)
+		ids := res.(*SexpArray).Val
+		here := goroutineID()
+		// the call given a func ran elsewhere, its call back here.
+		cv.So(ids[0].(*SexpStr).S, cv.ShouldNotEqual, here)
+		cv.So(ids[1].(*SexpStr).S, cv.ShouldEqual, here)
+
+		res, err = env.EvalString(`(where)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, here)
+	})
+}
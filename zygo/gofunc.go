@@ -0,0 +1,433 @@
+package zygo
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Binding Go functions
+// ====================
+//
+// AddGoFunc makes any Go function callable from scripts,
+// converting arguments and results by reflection, so that
+//
+//	env.AddGoFunc("repeat", strings.Repeat)
+//
+// gives (repeat "ab" 3). Numbers, strings, booleans,
+// chars, raw bytes and times convert to the like Go
+// types; arrays and lists to slices; hashes to maps, or
+// to registered Go structs via SexpToGoStructs; functions
+// to funcs (see gocallback.go); a parameter of type
+// Sexp, or of any type implementing it, takes the
+// argument as is, while one of type any takes it as
+// SexpToGo converts it. Variadic functions take
+// any number of trailing arguments. On the way back a
+// single result is converted, several come back as an
+// array, and a trailing error result, if not nil, is
+// raised as a script error.
+
+var (
+	sexpType  = reflect.TypeOf((*Sexp)(nil)).Elem()
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	timeType  = reflect.TypeOf(time.Time{})
+)
+
+// AddGoFunc binds the Go function fn to name. It panics
+// if fn is not a function.
+func (env *Zlisp) AddGoFunc(name string, fn interface{}) {
+	userfun, err := GoFunction(name, fn)
+	panicOn(err)
+	env.AddFunction(name, userfun)
+}
+
+// GoFunction wraps the Go function fn as a ZlispUserFunction;
+// see AddGoFunc.
+func GoFunction(name string, fn interface{}) (ZlispUserFunction, error) {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return nil, fmt.Errorf("AddGoFunc '%s': need a function, not %T", name, fn)
+	}
+	ft := fv.Type()
+	nin := ft.NumIn()
+	variadic := ft.IsVariadic()
+	nout := ft.NumOut()
+	returnsErr := nout > 0 && ft.Out(nout-1) == errorType
+
+	return func(env *Zlisp, callname string, args []Sexp) (Sexp, error) {
+		if variadic {
+			if len(args) < nin-1 {
+				return SexpNull, fmt.Errorf("%s needs at least %d arguments, got %d", callname, nin-1, len(args))
+			}
+		} else if len(args) != nin {
+			return SexpNull, fmt.Errorf("%s needs %d arguments, got %d", callname, nin, len(args))
+		}
+
+		made := env.callbacks.made.Load()
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var t reflect.Type
+			if variadic && i >= nin-1 {
+				t = ft.In(nin - 1).Elem()
+			} else {
+				t = ft.In(i)
+			}
+			v, err := sexpToGoValue(env, arg, t)
+			if err != nil {
+				return SexpNull, fmt.Errorf("%s: argument %d: %v", callname, i+1, err)
+			}
+			in[i] = v
+		}
+
+		var out []reflect.Value
+		env.goCall(made, func() { out = fv.Call(in) })
+		if returnsErr {
+			if err, _ := out[nout-1].Interface().(error); err != nil {
+				return SexpNull, err
+			}
+			out = out[:nout-1]
+		}
+		switch len(out) {
+		case 0:
+			return SexpNull, nil
+		case 1:
+			return goValueToSexp(env, out[0])
+		}
+		res := make([]Sexp, len(out))
+		for i, o := range out {
+			sx, err := goValueToSexp(env, o)
+			if err != nil {
+				return SexpNull, err
+			}
+			res[i] = sx
+		}
+		return env.NewSexpArray(res), nil
+	}, nil
+}
+
+// sexpToGoValue converts x to a Go value of type t.
+func sexpToGoValue(env *Zlisp, x Sexp, t reflect.Type) (reflect.Value, error) {
+	if t.Kind() == reflect.Interface && t.NumMethod() > 0 && sexpType.Implements(t) ||
+		t.Implements(sexpType) && reflect.TypeOf(x).AssignableTo(t) {
+		// Sexp itself, or one of its implementations; an
+		// empty interface gets the Go value, below.
+		if x == nil {
+			return reflect.Zero(t), nil
+		}
+		return reflect.ValueOf(x), nil
+	}
+	if x == SexpNull {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			return reflect.Zero(t), nil
+		}
+	}
+	if t == timeType {
+		if tm, ok := x.(*SexpTime); ok {
+			return reflect.ValueOf(tm.Tm), nil
+		}
+		return cannotConvert(x, t)
+	}
+
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Func:
+		fun, ok := x.(*SexpFunction)
+		if !ok {
+			return cannotConvert(x, t)
+		}
+		return env.GoFunc(fun, t)
+
+	case reflect.Interface:
+		if t.NumMethod() > 0 {
+			return cannotConvert(x, t)
+		}
+		if g := SexpToGo(x, env, nil); g != nil {
+			v.Set(reflect.ValueOf(g))
+		}
+		return v, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch e := x.(type) {
+		case *SexpInt:
+			n = e.Val
+		case *SexpUint64:
+			n = int64(e.Val)
+		case *SexpChar:
+			n = int64(e.Val)
+		default:
+			return cannotConvert(x, t)
+		}
+		if v.OverflowInt(n) {
+			return v, fmt.Errorf("%d overflows %s", n, t)
+		}
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		switch e := x.(type) {
+		case *SexpInt:
+			if e.Val < 0 {
+				return v, fmt.Errorf("%d is negative, so cannot be %s", e.Val, t)
+			}
+			n = uint64(e.Val)
+		case *SexpUint64:
+			n = e.Val
+		default:
+			return cannotConvert(x, t)
+		}
+		if v.OverflowUint(n) {
+			return v, fmt.Errorf("%d overflows %s", n, t)
+		}
+		v.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		switch e := x.(type) {
+		case *SexpFloat:
+			v.SetFloat(e.Val)
+		case *SexpInt:
+			v.SetFloat(float64(e.Val))
+		default:
+			return cannotConvert(x, t)
+		}
+
+	case reflect.Bool:
+		b, ok := x.(*SexpBool)
+		if !ok {
+			return cannotConvert(x, t)
+		}
+		v.SetBool(b.Val)
+
+	case reflect.String:
+		switch e := x.(type) {
+		case *SexpStr:
+			v.SetString(e.S)
+		case *SexpSymbol:
+			v.SetString(e.name)
+		case *SexpRaw:
+			v.SetString(string(e.Val))
+		default:
+			return cannotConvert(x, t)
+		}
+
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			switch e := x.(type) {
+			case *SexpRaw:
+				v.SetBytes(append([]byte(nil), e.Val...))
+				return v, nil
+			case *SexpStr:
+				v.SetBytes([]byte(e.S))
+				return v, nil
+			}
+		}
+		var elems []Sexp
+		switch e := x.(type) {
+		case *SexpArray:
+			elems = e.Val
+		case *SexpPair:
+			var err error
+			elems, err = ListToArray(e)
+			if err != nil {
+				return v, err
+			}
+		default:
+			return cannotConvert(x, t)
+		}
+		v = reflect.MakeSlice(t, len(elems), len(elems))
+		for i, e := range elems {
+			ev, err := sexpToGoValue(env, e, t.Elem())
+			if err != nil {
+				return v, fmt.Errorf("element %d: %v", i, err)
+			}
+			v.Index(i).Set(ev)
+		}
+
+	case reflect.Map:
+		h, ok := x.(*SexpHash)
+		if !ok || h.TypeName != "hash" {
+			return cannotConvert(x, t)
+		}
+		v = reflect.MakeMapWithSize(t, len(h.KeyOrder))
+		for _, key := range h.KeyOrder {
+			val, err := h.HashGet(env, key)
+			if err != nil {
+				return v, err
+			}
+			kv, err := sexpToGoValue(env, key, t.Key())
+			if err != nil {
+				return v, fmt.Errorf("key %s: %v", key.SexpString(nil), err)
+			}
+			vv, err := sexpToGoValue(env, val, t.Elem())
+			if err != nil {
+				return v, fmt.Errorf("value of %s: %v", key.SexpString(nil), err)
+			}
+			v.SetMapIndex(kv, vv)
+		}
+
+	case reflect.Struct, reflect.Ptr:
+		h, ok := x.(*SexpHash)
+		st := t
+		if t.Kind() == reflect.Ptr {
+			st = t.Elem()
+		}
+		if !ok || st.Kind() != reflect.Struct {
+			return cannotConvert(x, t)
+		}
+		// as CallGoMethodFunction does.
+		ptr := reflect.New(st)
+		var err error
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%v", r)
+				}
+			}()
+			_, err = SexpToGoStructs(h, ptr.Interface(), env, nil, 0, ptr.Interface())
+		}()
+		if err != nil {
+			return v, err
+		}
+		if t.Kind() == reflect.Ptr {
+			return ptr, nil
+		}
+		return ptr.Elem(), nil
+
+	default:
+		return cannotConvert(x, t)
+	}
+	return v, nil
+}
+
+func cannotConvert(x Sexp, t reflect.Type) (reflect.Value, error) {
+	return reflect.Value{}, fmt.Errorf("cannot use %s (%T) as %s", x.SexpString(nil), x, t)
+}
+
+// goValueToSexp converts a Go value to a Sexp. Registered
+// Go structs become records; other structs become hashes
+// of their exported fields; what GoToSexp knows, such as
+// times, goes through it; anything else is wrapped as a
+// SexpReflect.
+func goValueToSexp(env *Zlisp, v reflect.Value) (Sexp, error) {
+	if !v.IsValid() {
+		return SexpNull, nil
+	}
+	if v.Type().Implements(sexpType) {
+		if v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return SexpNull, nil
+			}
+		}
+		return v.Interface().(Sexp), nil
+	}
+	if v.Type() == timeType {
+		return GoToSexp(v.Interface(), env)
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return SexpNull, nil
+		}
+		if err, ok := v.Interface().(error); ok {
+			return &SexpError{error: err}, nil
+		}
+		return goValueToSexp(env, v.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &SexpInt{Val: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uintptr:
+		return &SexpInt{Val: int64(v.Uint())}, nil
+	case reflect.Uint64:
+		return &SexpUint64{Val: v.Uint()}, nil
+	case reflect.Float32, reflect.Float64:
+		return &SexpFloat{Val: v.Float()}, nil
+	case reflect.Bool:
+		return &SexpBool{Val: v.Bool()}, nil
+	case reflect.String:
+		return &SexpStr{S: v.String()}, nil
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice {
+			if v.IsNil() {
+				return SexpNull, nil
+			}
+			if v.Type().Elem().Kind() == reflect.Uint8 {
+				return &SexpRaw{Val: append([]byte(nil), v.Bytes()...)}, nil
+			}
+		}
+		elems := make([]Sexp, v.Len())
+		for i := range elems {
+			e, err := goValueToSexp(env, v.Index(i))
+			if err != nil {
+				return SexpNull, err
+			}
+			elems[i] = e
+		}
+		return env.NewSexpArray(elems), nil
+
+	case reflect.Map:
+		if v.IsNil() {
+			return SexpNull, nil
+		}
+		var args []Sexp
+		iter := v.MapRange()
+		for iter.Next() {
+			k, err := goValueToSexp(env, iter.Key())
+			if err != nil {
+				return SexpNull, err
+			}
+			val, err := goValueToSexp(env, iter.Value())
+			if err != nil {
+				return SexpNull, err
+			}
+			args = append(args, k, val)
+		}
+		return MakeHash(args, "hash", env)
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return SexpNull, nil
+		}
+		if v.Elem().Kind() == reflect.Struct {
+			return goStructToSexp(env, v)
+		}
+		return goValueToSexp(env, v.Elem())
+
+	case reflect.Struct:
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		return goStructToSexp(env, ptr)
+	}
+	return &SexpReflect{Val: v, Env: env}, nil
+}
+
+// goStructToSexp converts ptr, a pointer to a struct.
+func goStructToSexp(env *Zlisp, ptr reflect.Value) (Sexp, error) {
+	st := ptr.Type().Elem()
+	if rt := env.TypeRegistry().Lookup(st.String()); rt != nil && rt.TypeCache == ptr.Type() {
+		h, err := MakeHash(nil, rt.RegisteredName, env)
+		if err != nil {
+			return SexpNull, err
+		}
+		err = h.FillHashFromShadow(env, ptr.Interface())
+		if err != nil {
+			return SexpNull, err
+		}
+		return h, nil
+	}
+
+	var args []Sexp
+	for i := 0; i < st.NumField(); i++ {
+		fld := st.Field(i)
+		if !fld.IsExported() {
+			continue
+		}
+		val, err := goValueToSexp(env, ptr.Elem().Field(i))
+		if err != nil {
+			return SexpNull, fmt.Errorf("field %s: %v", fld.Name, err)
+		}
+		args = append(args, env.MakeSymbol(fld.Name), val)
+	}
+	return MakeHash(args, "hash", env)
+}
@@ -0,0 +1,104 @@
+package zygo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test140GoFunctionsBoundByReflection(t *testing.T) {
+
+	cv.Convey(`Given plain Go functions bound with AddGoFunc, scripts should call them with arguments and results converted both ways, and a returned error should be a script error`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+
+		env.AddGoFunc("repeat", strings.Repeat)
+		env.AddGoFunc("half", func(x float64) float64 { return x / 2 })
+		env.AddGoFunc("small", func(b int8) int8 { return b })
+		env.AddGoFunc("sum", func(base int, xs ...int) int {
+			for _, x := range xs {
+				base += x
+			}
+			return base
+		})
+		env.AddGoFunc("divmod", func(a, b int) (int, int) { return a / b, a % b })
+		env.AddGoFunc("safediv", func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, errors.New("divide by zero")
+			}
+			return a / b, nil
+		})
+		env.AddGoFunc("greet", func(p Person) string { return "hi " + p.First + " " + p.Last })
+		env.AddGoFunc("rename", func(p *Person, last string) *Person {
+			p.Last = last
+			return p
+		})
+		env.AddGoFunc("lens", func(ss []string) map[string]int {
+			m := map[string]int{}
+			for _, s := range ss {
+				m[s] = len(s)
+			}
+			return m
+		})
+		env.AddGoFunc("total", func(m map[string]float64) (tot float64) {
+			for _, v := range m {
+				tot += v
+			}
+			return
+		})
+		env.AddGoFunc("pair", func(a, b string) struct{ A, B string } { return struct{ A, B string }{a, b} })
+		env.AddGoFunc("quiet", func() {})
+		env.AddGoFunc("spf", fmt.Sprintf)
+		env.AddGoFunc("kind", func(x any) string { return fmt.Sprintf("%T", x) })
+
+		cases := []struct{ expr, want string }{
+			{`(repeat "ab" 3)`, `"ababab"`},
+			{`(half 5)`, `2.5`},
+			{`(half 5.0)`, `2.5`},
+			{`(sum 1)`, `1`},
+			{`(sum 1 2 3 4)`, `10`},
+			{`(divmod 17 5)`, `[3 2]`},
+			{`(safediv 9 3)`, `3`},
+			{`(greet (persondemo first:"Ada" last:"L"))`, `"hi Ada L"`},
+			{`(:last (rename (persondemo first:"Ada" last:"L") "Lovelace"))`, `"Lovelace"`},
+			{`(hget (lens ["a" "bcd"]) "bcd")`, `3`},
+			{`(total (hash a:1.5 b:2))`, `3.5`},
+			{`(:B (pair "x" "y"))`, `"y"`},
+			{`(quiet)`, `nil`},
+			{`(spf "%v %v %q %v" 3 1.5 "s" [1 2])`, `"3 1.5 \"s\" [1 2]"`},
+			{`(kind 3)`, `"int64"`},
+		}
+		for _, c := range cases {
+			res, err := env.EvalString(c.expr)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.SexpString(nil), cv.ShouldEqual, c.want)
+		}
+
+		res, err := env.EvalString(`(try (safediv 1 0) (catch e (errorMessage (errorCause e))))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, "divide by zero")
+
+		bad := []struct{ expr, want string }{
+			{`(repeat "ab")`, "repeat needs 2 arguments, got 1"},
+			{`(sum)`, "sum needs at least 1 arguments, got 0"},
+			{`(half "x")`, `half: argument 1: cannot use "x" (*zygo.SexpStr) as float64`},
+			{`(small 300)`, "small: argument 1: 300 overflows int8"},
+			{`(sum 1 2 "3")`, "sum: argument 3: cannot use"},
+		}
+		for _, b := range bad {
+			env.Clear()
+			_, err := env.EvalString(b.expr)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, b.want)
+		}
+
+		cv.So(func() { env.AddGoFunc("notfunc", 3) }, cv.ShouldPanic)
+		_, err = GoFunction("notfunc", 3)
+		cv.So(err.Error(), cv.ShouldEqual, "AddGoFunc 'notfunc': need a function, not int")
+	})
+}
@@ -25,6 +25,16 @@ import (
 // The repl will automatically do a (defmap record)
 // for each record defined in the registry. e.g.
 // for snoopy, hornet, hellcat, etc.
+//
+// GoStructRegistry is the process-wide base registry.
+// Each *Zlisp gets its own registry layered on top of it
+// (see NewGoStructRegistry and env.TypeRegistry()), so
+// types declared by one environment, whether by
+// (defstruct), RegisterUserdef, or derived pointer and
+// slice types, are not seen by any other. Since every
+// environment reads the base concurrently, finish
+// registering into GoStructRegistry before creating
+// environments.
 var GoStructRegistry GoStructRegistryType
 
 // the registry type
@@ -40,11 +50,37 @@ type GoStructRegistryType struct {
 
 	// lazily added functions
 	LazyFunc map[string]ZlispUserFunction
+
+	// read-only registry consulted when a name is not
+	// found here; nil for GoStructRegistry itself.
+	base *GoStructRegistryType
+
+	// registration order of the names in this registry,
+	// for (typelist).
+	order []string
 }
 
-// consistently ordered list of all registered types (created at init time).
+// consistently ordered list of all types registered in
+// the base GoStructRegistry (created at init time).
 var ListRegisteredTypes = []string{}
 
+// NewGoStructRegistry returns an empty registry that
+// falls back to base for lookups, and never modifies base.
+// Pass &GoStructRegistry to see the builtin types.
+func NewGoStructRegistry(base *GoStructRegistryType) *GoStructRegistryType {
+	return &GoStructRegistryType{
+		Registry: make(map[string]*RegisteredType),
+		Builtin:  make(map[string]*RegisteredType),
+		Userdef:  make(map[string]*RegisteredType),
+		base:     base,
+	}
+}
+
+// Base returns the registry that r falls back to, or nil.
+func (r *GoStructRegistryType) Base() *GoStructRegistryType {
+	return r.base
+}
+
 func (r *GoStructRegistryType) RegisterBuiltin(name string, e *RegisteredType) {
 	r.register(name, e, false)
 	e.IsUser = false
@@ -71,13 +107,11 @@ func (r *GoStructRegistryType) register(name string, e *RegisteredType, isUser b
 	e.Aliases[name] = true
 	e.Aliases[e.ReflectName] = true
 
-	_, found := r.Registry[name]
-	if !found {
-		ListRegisteredTypes = append(ListRegisteredTypes, name)
+	if r.Lookup(name) == nil {
+		r.addToOrder(name)
 	}
-	_, found2 := r.Registry[e.ReflectName]
-	if !found2 {
-		ListRegisteredTypes = append(ListRegisteredTypes, e.ReflectName)
+	if r.Lookup(e.ReflectName) == nil {
+		r.addToOrder(e.ReflectName)
 	}
 
 	if isUser {
@@ -89,6 +123,13 @@ func (r *GoStructRegistryType) register(name string, e *RegisteredType, isUser b
 	r.Registry[e.ReflectName] = e
 }
 
+func (r *GoStructRegistryType) addToOrder(name string) {
+	r.order = append(r.order, name)
+	if r == &GoStructRegistry {
+		ListRegisteredTypes = r.order
+	}
+}
+
 func (e *RegisteredType) Init() {
 	e.Aliases = make(map[string]bool)
 	val, err := e.Factory(nil, nil)
@@ -138,8 +179,43 @@ func (r *GoStructRegistryType) RegisterUserdef(
 	}
 }
 
+// Lookup finds name in r, or failing that in its base.
 func (r *GoStructRegistryType) Lookup(name string) *RegisteredType {
-	return r.Registry[name]
+	if rt, ok := r.Registry[name]; ok {
+		return rt
+	}
+	if r.base != nil {
+		return r.base.Lookup(name)
+	}
+	return nil
+}
+
+// All returns every name visible through r. Names
+// registered in r shadow those in the base. The map
+// may be r's own, so don't modify it.
+func (r *GoStructRegistryType) All() map[string]*RegisteredType {
+	if r.base == nil {
+		return r.Registry
+	}
+	all := r.base.All()
+	m := make(map[string]*RegisteredType, len(all)+len(r.Registry))
+	for name, rt := range all {
+		m[name] = rt
+	}
+	for name, rt := range r.Registry {
+		m[name] = rt
+	}
+	return m
+}
+
+// TypeList returns the names visible through r, base
+// names first, each in registration order.
+func (r *GoStructRegistryType) TypeList() []string {
+	var list []string
+	if r.base != nil {
+		list = r.base.TypeList()
+	}
+	return append(list, r.order...)
 }
 
 // wait to AddFunction until EnvAvail()
@@ -377,7 +453,7 @@ func init() {
 	gsr.RegisterBuiltin("error", &RegisteredType{GenDefMap: false, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
 		var err error
 		return &err, nil
-	}})
+	}, Constructor: MakeUserFunction("error", ErrorFunction)})
 
 	// SentinelRT *RegisteredType
 	// ClosureRT *RegisteredType
@@ -388,7 +464,7 @@ func TypeListFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	if narg != 0 {
 		return SexpNull, WrongNargs
 	}
-	r := ListRegisteredTypes
+	r := env.TypeRegistry().TypeList()
 	s := make([]Sexp, len(r))
 	for i := range r {
 		s[i] = &SexpStr{S: r[i]}
@@ -397,15 +473,40 @@ func TypeListFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 }
 
 func (env *Zlisp) ImportBaseTypes() {
-	for _, e := range GoStructRegistry.Builtin {
+	env.importTypes(env.TypeRegistry())
+}
+
+// base first, so that the environment's own types win.
+func (env *Zlisp) importTypes(r *GoStructRegistryType) {
+	if r.base != nil {
+		env.importTypes(r.base)
+	}
+	for _, e := range r.Builtin {
 		env.AddGlobal(e.RegisteredName, e)
 	}
 
-	for _, e := range GoStructRegistry.Userdef {
+	for _, e := range r.Userdef {
 		env.AddGlobal(e.RegisteredName, e)
 	}
 }
 
+// TypeRegistry returns the registry holding the Go and
+// (defstruct) types of this environment. Environments
+// made by Duplicate and Clone share their parent's.
+func (env *Zlisp) TypeRegistry() *GoStructRegistryType {
+	if env == nil || env.types == nil {
+		return &GoStructRegistry
+	}
+	return env.types
+}
+
+// SetTypeRegistry replaces the environment's type
+// registry, for instance with one built by
+// NewGoStructRegistry over a different base.
+func (env *Zlisp) SetTypeRegistry(r *GoStructRegistryType) {
+	env.types = r
+}
+
 func compareRegisteredTypes(a *RegisteredType, bs Sexp) (int, error) {
 
 	var b *RegisteredType
@@ -461,9 +562,15 @@ func (gsr *GoStructRegistryType) GetOrCreateSliceType(rt *RegisteredType) *Regis
 	return sliceRt
 }
 
+// RegisterDemoStructs adds the demo structs to the base
+// GoStructRegistry, where every environment can see them.
 func RegisterDemoStructs() {
+	GoStructRegistry.RegisterDemoStructs()
+}
 
-	gsr := &GoStructRegistry
+// RegisterDemoStructs adds the demo structs (snoopy,
+// hornet, hellcat, etc) to gsr.
+func (gsr *GoStructRegistryType) RegisterDemoStructs() {
 
 	// demo and user defined structs
 	gsr.RegisterUserdef(&RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
@@ -0,0 +1,130 @@
+package zygo
+
+import (
+	"reflect"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+type tenantWidget struct {
+	Name string
+}
+
+func Test080StructDeclarationsStayInTheirEnvironment(t *testing.T) {
+
+	cv.Convey(`Given two environments, a struct declared in one should not be visible in the other, nor in the base GoStructRegistry`, t, func() {
+
+		a := NewZlisp()
+		defer a.Close()
+		a.StandardSetup()
+		b := NewZlisp()
+		defer b.Close()
+		b.StandardSetup()
+
+		_, err := a.EvalString("(struct Tenant [(field name: string)]) (def ptr (* Tenant)) (def sl (sliceOf Tenant))")
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.So(a.TypeRegistry().Lookup("Tenant"), cv.ShouldNotBeNil)
+		cv.So(a.TypeRegistry().Lookup("*Tenant"), cv.ShouldNotBeNil)
+		cv.So(a.TypeRegistry().Lookup("[]Tenant"), cv.ShouldNotBeNil)
+		cv.So(b.TypeRegistry().Lookup("Tenant"), cv.ShouldBeNil)
+		cv.So(b.TypeRegistry().Lookup("*Tenant"), cv.ShouldBeNil)
+		cv.So(b.TypeRegistry().Lookup("[]Tenant"), cv.ShouldBeNil)
+		cv.So(GoStructRegistry.Lookup("Tenant"), cv.ShouldBeNil)
+
+		// both still see the builtins from the shared base.
+		cv.So(a.TypeRegistry().Lookup("int64"), cv.ShouldEqual, GoStructRegistry.Lookup("int64"))
+		cv.So(b.TypeRegistry().Lookup("int64"), cv.ShouldEqual, GoStructRegistry.Lookup("int64"))
+
+		// the same name may mean different things in each.
+		_, err = b.EvalString("(struct Tenant [(field id: int64)])")
+		cv.So(err, cv.ShouldBeNil)
+		ta := a.TypeRegistry().Lookup("Tenant")
+		tb := b.TypeRegistry().Lookup("Tenant")
+		cv.So(ta, cv.ShouldNotEqual, tb)
+		cv.So(ta.UserStructDefn.Fields[0].SexpString(nil), cv.ShouldContainSubstring, "name")
+		cv.So(tb.UserStructDefn.Fields[0].SexpString(nil), cv.ShouldContainSubstring, "id")
+
+		// child environments share their parent's registry.
+		cv.So(a.Duplicate().TypeRegistry(), cv.ShouldEqual, a.TypeRegistry())
+	})
+}
+
+func Test081RegisterUserdefAndTypelistArePerEnvironment(t *testing.T) {
+
+	cv.Convey(`Given a Go type registered with one environment, only that environment's typelist should include it`, t, func() {
+
+		a := NewZlisp()
+		defer a.Close()
+		a.StandardSetup()
+		b := NewZlisp()
+		defer b.Close()
+		b.StandardSetup()
+
+		a.TypeRegistry().RegisterUserdef(&RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
+			return &tenantWidget{}, nil
+		}}, true, "widget")
+
+		cv.So(a.TypeRegistry().Lookup("widget"), cv.ShouldNotBeNil)
+		cv.So(b.TypeRegistry().Lookup("widget"), cv.ShouldBeNil)
+
+		hasWidget := func(env *Zlisp) bool {
+			res, err := env.EvalString("(typelist)")
+			panicOn(err)
+			for _, x := range res.(*SexpArray).Val {
+				if x.(*SexpStr).S == "widget" {
+					return true
+				}
+			}
+			return false
+		}
+		cv.So(hasWidget(a), cv.ShouldBeTrue)
+		cv.So(hasWidget(b), cv.ShouldBeFalse)
+
+		// records made in a are backed by the Go shadow struct;
+		// in b, widget is just an untyped record name.
+		res, err := a.EvalString(`(defmap widget) (widget Name:"w1")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpHash).GoStructFactory, cv.ShouldEqual, a.TypeRegistry().Lookup("widget"))
+
+		res, err = b.EvalString(`(defmap widget) (widget Name:"w1")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpHash).GoStructFactory, cv.ShouldNotEqual, a.TypeRegistry().Lookup("widget"))
+		cv.So(b.TypeRegistry().Lookup("widget").hasShadowStruct, cv.ShouldBeFalse)
+	})
+}
+
+func Test082ValuesResolveTheirTypeInTheirOwnEnvironment(t *testing.T) {
+
+	cv.Convey(`Given a Go type registered with one environment, a Go value or interface declaration from that environment should find it, and one from another should not`, t, func() {
+
+		a := NewZlisp()
+		defer a.Close()
+		a.StandardSetup()
+		b := NewZlisp()
+		defer b.Close()
+		b.StandardSetup()
+
+		widget := &RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
+			return &tenantWidget{}, nil
+		}}
+		a.TypeRegistry().RegisterUserdef(widget, true, "widget", "Widgety")
+
+		v := reflect.ValueOf(&tenantWidget{Name: "w"})
+		cv.So((&SexpReflect{Val: v, Env: a}).Type(), cv.ShouldEqual, a.TypeRegistry().Lookup(reflectName(v)))
+		cv.So((&SexpReflect{Val: v, Env: a}).Type(), cv.ShouldNotBeNil)
+		cv.So((&SexpReflect{Val: v, Env: b}).Type(), cv.ShouldBeNil)
+		cv.So((&SexpReflect{Val: v}).Type(), cv.ShouldBeNil)
+
+		// the base registry is still consulted.
+		cv.So((&SexpReflect{Val: reflect.ValueOf(new(int64)), Env: a}).Type(), cv.ShouldEqual, GoStructRegistry.Lookup("int64"))
+
+		declA, err := a.EvalString(`(interface Widgety [])`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(declA.Type(), cv.ShouldEqual, a.TypeRegistry().Lookup("Widgety"))
+		declB, err := b.EvalString(`(interface Widgety [])`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(declB.Type(), cv.ShouldBeNil)
+	})
+}
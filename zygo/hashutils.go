@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"reflect"
 	"strings"
 )
@@ -46,6 +47,13 @@ func hashHelper(expr Sexp) (hashcode int, isList bool, err error) {
 		return int(e.Val), false, nil
 	case *SexpChar:
 		return int(e.Val), false, nil
+	case *SexpBool:
+		if e.Val {
+			return 1, false, nil
+		}
+		return 0, false, nil
+	case *SexpFloat:
+		return int(math.Float64bits(e.Val)), false, nil
 	case *SexpSymbol:
 		return e.number, false, nil
 	case *SexpStr:
@@ -92,7 +100,7 @@ func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
 	var iface interface{}
 	jsonMap := make(map[string]*HashFieldDet)
 
-	factory := GoStructRegistry.Lookup(typename)
+	factory := env.TypeRegistry().Lookup(typename)
 	if factory == nil {
 		factory = &RegisteredType{Factory: MakeGoStructFunc(func(env *Zlisp, h *SexpHash) (interface{}, error) { return MakeHash(nil, typename, env) })}
 		factory.Aliases = make(map[string]bool)
@@ -140,9 +148,9 @@ func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
 		k++
 	}
 
-	//Q("doing factory, foundRecordType := GoStructRegistry.Registry[typename]")
-	factoryShad, foundRecordType := GoStructRegistry.Registry[typename]
-	if foundRecordType {
+	//Q("doing factory, foundRecordType := env.TypeRegistry().Lookup(typename)")
+	factoryShad := env.TypeRegistry().Lookup(typename)
+	if factoryShad != nil {
 		//Q("factoryShad = '%#v' for typename='%s'\n", factoryShad, typename)
 		if factoryShad.hasShadowStruct {
 			//Q("\n in MakeHash: found struct associated with '%s'\n", typename)
@@ -165,7 +173,7 @@ func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
 		factory.ReflectName = typename
 		factory.DisplayAs = typename
 
-		GoStructRegistry.RegisterUserdef(factory, false, typename)
+		env.TypeRegistry().RegisterUserdef(factory, false, typename)
 	}
 
 	return &hash, nil
@@ -272,7 +280,7 @@ func (h *SexpHash) TypeCheckField(key Sexp, val Sexp) error {
 		//Q("SexpHash.TypeCheckField() sees nil has.GoStructFactory.UserStructDefn, bailing out.")
 
 		// check in the registry for this type!
-		rt := GoStructRegistry.Lookup(h.TypeName)
+		rt := h.Env.TypeRegistry().Lookup(h.TypeName)
 
 		// was it found? If so, use it!
 		if rt != nil && rt.UserStructDefn != nil {
@@ -366,6 +374,7 @@ func (hash *SexpHash) HashSet(key Sexp, val Sexp) error {
 	if err != nil {
 		return err
 	}
+	hash.willChange()
 	arr, ok := hash.Map[hashval]
 
 	if !ok {
@@ -407,6 +416,7 @@ func (hash *SexpHash) HashDelete(key Sexp) error {
 	if !ok {
 		return nil
 	}
+	hash.willChange()
 
 	hash.NumKeys--
 	for i, pair := range arr {
@@ -441,6 +451,7 @@ func HashIsEmpty(hash *SexpHash) bool {
 }
 
 func SetHashKeyOrder(hash *SexpHash, keyOrd Sexp) error {
+	hash.willChange()
 	// truncate down to zero, then build back up correctly.
 	hash.KeyOrder = hash.KeyOrder[:0]
 
@@ -483,6 +494,9 @@ func (hash *SexpHash) HashPairi(pos int) (*SexpPair, error) {
 }
 
 func GoMethodListFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if err := env.allow(CapReflect, name); err != nil {
+		return SexpNull, err
+	}
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
 	}
@@ -688,7 +702,7 @@ func fillHashHelper(r interface{}, depth int, env *Zlisp, preferSym bool) (Sexp,
 	// check for one of our registered structs
 
 	// go through the type registry upfront
-	for hashName, factory := range GoStructRegistry.Registry {
+	for hashName, factory := range env.TypeRegistry().All() {
 		//P("fillHashHelper is trying hashName='%s'", hashName)
 		st, err := factory.Factory(env, nil)
 		if err != nil {
@@ -935,7 +949,7 @@ func (hash *SexpHash) SexpString(ps *PrintState) string {
 }
 
 func (r *SexpHash) Type() *RegisteredType {
-	return GoStructRegistry.Registry[r.TypeName]
+	return r.Env.TypeRegistry().Lookup(r.TypeName)
 }
 
 func compareHash(a *SexpHash, bs Sexp) (int, error) {
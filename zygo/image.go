@@ -0,0 +1,482 @@
+package zygo
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Images
+// ======
+//
+// SaveImage writes out the state of an environment: its
+// globals, the functions and closures they hold along with
+// the scopes those closures captured, macros, packages
+// imported so far, and the types declared with (struct).
+// LoadImage puts them back into another environment, which
+// then behaves as the saved one did, without running the
+// scripts that built it. NewZlispFromImage does that for a
+// new environment set up by StandardSetup.
+//
+// Images use the tables of compiled code (see compile.go),
+// and likewise are only read by the zygo that wrote them.
+// Go functions and Go types are saved by name, and found by
+// name when loading, so the loading environment must have
+// the same AddFunction, AddGoFunc and RegisterUserdef calls
+// made first. Go values that only live in Go, such as
+// channels, tasks and the Go structs made by (togo), cannot
+// be saved; records keep their fields, and (togo) makes
+// their Go structs again after loading.
+
+const imageMagic = "zygo image"
+
+// zycScope is a Scope. Global marks the global scope of
+// the saved environment, which becomes that of the loading
+// one. MyFunction and Parent are indices into Funcs and
+// Scopes, or -1; Values into Sexps.
+type zycScope struct {
+	Global      bool
+	Name        string
+	PackageName string
+	IsGlobal    bool
+	IsFunction  bool
+	IsPackage   bool
+	MyFunction  int
+	Parent      int
+	Names       []string
+	Values      []int
+}
+
+// zycStack is a package, or the scopes a closure
+// captured; Scopes are indices into Scopes.
+type zycStack struct {
+	Name        string
+	PackageName string
+	IsPackage   bool
+	Scopes      []int
+}
+
+// zycType is a type declared by (struct); Fields are
+// indices into Sexps. Registered is false for a type that
+// has since been declared again.
+type zycType struct {
+	Name       string
+	DisplayAs  string
+	Registered bool
+	Fields     []int
+}
+
+// zycImport is a package in the import cache.
+type zycImport struct {
+	Key string
+	Pkg int
+}
+
+// SaveImage writes the state of env to w.
+func (env *Zlisp) SaveImage(w io.Writer) error {
+	c := newCompiler(env)
+	c.image = true
+	c.unit.Main = -1
+
+	if _, err := c.scope(env.globalScope()); err != nil {
+		return err
+	}
+
+	var macros []string
+	for k, m := range env.macros {
+		if !m.user {
+			macros = append(macros, env.symbols.nameOf(k))
+		}
+	}
+	sort.Strings(macros)
+	for _, name := range macros {
+		i, err := c.function(env.macros[env.symbols.intern(name)])
+		if err != nil {
+			return fmt.Errorf("cannot save macro '%s': %v", name, err)
+		}
+		c.unit.Macros = append(c.unit.Macros, zycMacro{Name: name, Func: i})
+	}
+
+	if env.imports != nil {
+		var keys []string
+		for key := range env.imports.cache {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			i, err := c.sexp(env.imports.cache[key])
+			if err != nil {
+				return fmt.Errorf("cannot save package '%s': %v", key, err)
+			}
+			c.unit.Imports = append(c.unit.Imports, zycImport{Key: key, Pkg: i})
+		}
+	}
+
+	for num := range env.rebound {
+		c.unit.Rebound = append(c.unit.Rebound, env.symbols.nameOf(num))
+	}
+	sort.Strings(c.unit.Rebound)
+
+	enc := gob.NewEncoder(w)
+	err := enc.Encode(&compiledHeader{
+		Magic:   imageMagic,
+		Format:  CompiledFormat,
+		Version: Version(),
+	})
+	if err != nil {
+		return err
+	}
+	return enc.Encode(&c.unit)
+}
+
+// LoadImage reads an image written by SaveImage into env,
+// binding its globals over any env has of the same name.
+func (env *Zlisp) LoadImage(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	var h compiledHeader
+	if err := dec.Decode(&h); err != nil {
+		return fmt.Errorf("not a zygo image: %v", err)
+	}
+	if h.Magic != imageMagic {
+		return fmt.Errorf("not a zygo image")
+	}
+	if h.Format != CompiledFormat || h.Version != Version() {
+		return fmt.Errorf("%w: the image was written by zygo %s (format %d); this is %s (format %d)",
+			ErrCompiledStale, h.Version, h.Format, Version(), CompiledFormat)
+	}
+	unit := new(compiledUnit)
+	if err := dec.Decode(unit); err != nil {
+		return fmt.Errorf("corrupt image: %v", err)
+	}
+
+	ld := &loader{env: env, unit: unit}
+	if err := ld.load(); err != nil {
+		return err
+	}
+	return ld.macros()
+}
+
+// NewZlispFromImage returns a new environment, set up by
+// StandardSetup, with the image read from r loaded into it.
+func NewZlispFromImage(r io.Reader) (*Zlisp, error) {
+	env := NewZlisp()
+	env.StandardSetup()
+	if err := env.LoadImage(r); err != nil {
+		env.Close()
+		return nil, err
+	}
+	return env, nil
+}
+
+func (env *Zlisp) globalScope() *Scope {
+	return env.linearstack.elements[0].(*Scope)
+}
+
+func (c *compiler) scope(s *Scope) (int, error) {
+	if i, ok := c.scopes[s]; ok {
+		return i, nil
+	}
+	i := len(c.unit.Scopes)
+	c.scopes[s] = i
+	c.unit.Scopes = append(c.unit.Scopes, zycScope{})
+
+	z := zycScope{
+		Global:      s == c.env.globalScope(),
+		Name:        s.Name,
+		PackageName: s.PackageName,
+		IsGlobal:    s.IsGlobal,
+		IsFunction:  s.IsFunction,
+		IsPackage:   s.IsPackage,
+		MyFunction:  -1,
+		Parent:      -1,
+	}
+	vals := make(map[string]Sexp)
+	s.each(func(num int, val Sexp) {
+		name := c.env.symbols.nameOf(num)
+		z.Names = append(z.Names, name)
+		vals[name] = val
+	})
+	sort.Strings(z.Names)
+	for _, name := range z.Names {
+		v, err := c.sexp(vals[name])
+		if err != nil {
+			if z.Global {
+				return -1, fmt.Errorf("cannot save global '%s': %v", name, err)
+			}
+			return -1, fmt.Errorf("cannot save '%s': %v", name, err)
+		}
+		z.Values = append(z.Values, v)
+	}
+	var err error
+	if s.Parent != nil {
+		if z.Parent, err = c.scope(s.Parent); err != nil {
+			return -1, err
+		}
+	}
+	if s.MyFunction != nil {
+		if z.MyFunction, err = c.function(s.MyFunction); err != nil {
+			return -1, err
+		}
+	}
+	c.unit.Scopes[i] = z
+	return i, nil
+}
+
+func (c *compiler) stack(st *Stack) (int, error) {
+	if i, ok := c.stacks[st]; ok {
+		return i, nil
+	}
+	i := len(c.unit.Stacks)
+	c.stacks[st] = i
+	c.unit.Stacks = append(c.unit.Stacks, zycStack{})
+
+	z := zycStack{Name: st.Name, PackageName: st.PackageName, IsPackage: st.IsPackage}
+	for _, elem := range st.elements[:st.tos+1] {
+		s, ok := elem.(*Scope)
+		if !ok {
+			return -1, fmt.Errorf("cannot save a stack holding %T", elem)
+		}
+		k, err := c.scope(s)
+		if err != nil {
+			return -1, err
+		}
+		z.Scopes = append(z.Scopes, k)
+	}
+	c.unit.Stacks[i] = z
+	return i, nil
+}
+
+// registeredType returns the index into Types of rt, a type
+// declared by (struct) when saving an image; otherwise -1,
+// for rt to be found by name.
+func (c *compiler) registeredType(rt *RegisteredType) (int, error) {
+	if !c.image || rt.UserStructDefn == nil {
+		return -1, nil
+	}
+	if i, ok := c.types[rt]; ok {
+		return i, nil
+	}
+	i := len(c.unit.Types)
+	c.types[rt] = i
+	c.unit.Types = append(c.unit.Types, zycType{})
+
+	z := zycType{
+		Name:       rt.RegisteredName,
+		DisplayAs:  rt.DisplayAs,
+		Registered: c.env.TypeRegistry().Userdef[rt.RegisteredName] == rt,
+	}
+	for _, f := range rt.UserStructDefn.Fields {
+		k, err := c.sexp(f)
+		if err != nil {
+			return -1, err
+		}
+		z.Fields = append(z.Fields, k)
+	}
+	c.unit.Types[i] = z
+	return i, nil
+}
+
+// captured notes the scopes f closes over, and the
+// function it was made in.
+func (c *compiler) captured(f *SexpFunction, z *zycFunc) error {
+	var err error
+	if f.closingOverScopes != nil {
+		if z.Closing, err = c.stack(f.closingOverScopes.Stack); err != nil {
+			return err
+		}
+		z.ClosingName = f.closingOverScopes.Name
+	}
+	switch {
+	case f.parent == nil:
+	case f.parent == c.env.mainfunc:
+		z.ParentMain = true
+	default:
+		if z.Parent, err = c.function(f.parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeImage makes the scopes, stacks and types of an
+// image, to be filled in by fillTypes and fillImage once
+// the rest exists. Types are registered now, as records
+// are checked against them when made.
+func (ld *loader) makeImage() error {
+	env, unit := ld.env, ld.unit
+
+	ld.types = make([]*RegisteredType, len(unit.Types))
+	for i, z := range unit.Types {
+		uds := NewRecordDefn()
+		uds.SetName(z.Name)
+		uds.types = env.TypeRegistry()
+		rt := NewRegisteredType(func(env *Zlisp, h *SexpHash) (interface{}, error) {
+			return uds, nil
+		})
+		rt.UserStructDefn = uds
+		rt.DisplayAs = z.DisplayAs
+		if z.Registered {
+			env.TypeRegistry().RegisterUserdef(rt, false, z.Name)
+		}
+		ld.types[i] = rt
+	}
+
+	ld.scopes = make([]*Scope, len(unit.Scopes))
+	for i, z := range unit.Scopes {
+		if z.Global {
+			ld.scopes[i] = env.globalScope()
+			continue
+		}
+		s := env.NewNamedScope(z.Name)
+		s.PackageName = z.PackageName
+		s.IsGlobal = z.IsGlobal
+		s.IsFunction = z.IsFunction
+		s.IsPackage = z.IsPackage
+		ld.scopes[i] = s
+	}
+
+	ld.stacks = make([]*Stack, len(unit.Stacks))
+	for i, z := range unit.Stacks {
+		st := env.NewStack(len(z.Scopes))
+		st.Name = z.Name
+		st.PackageName = z.PackageName
+		st.IsPackage = z.IsPackage
+		ld.stacks[i] = st
+	}
+	return nil
+}
+
+func (ld *loader) fillTypes() error {
+	for i, z := range ld.unit.Types {
+		flds := make([]*SexpField, len(z.Fields))
+		for k, r := range z.Fields {
+			x, err := ld.sexp(r)
+			if err != nil {
+				return err
+			}
+			f, ok := x.(*SexpField)
+			if !ok || len(f.KeyOrder) == 0 {
+				return errCorruptCompiled
+			}
+			flds[k] = f
+		}
+		ld.types[i].UserStructDefn.SetFields(flds)
+	}
+	return nil
+}
+
+// fillImage fills in the scopes and stacks, binding the
+// globals, and adds the packages to the import cache.
+func (ld *loader) fillImage() error {
+	env, unit := ld.env, ld.unit
+
+	for i, z := range unit.Stacks {
+		for _, k := range z.Scopes {
+			if k < 0 || k >= len(ld.scopes) {
+				return errCorruptCompiled
+			}
+			ld.stacks[i].Push(ld.scopes[k])
+		}
+	}
+
+	for i, z := range unit.Scopes {
+		s := ld.scopes[i]
+		if len(z.Values) != len(z.Names) {
+			return errCorruptCompiled
+		}
+		for k, name := range z.Names {
+			v, err := ld.sexp(z.Values[k])
+			if err != nil || v == nil {
+				return errCorruptCompiled
+			}
+			s.bind(env.symbols.intern(name), v)
+		}
+		if z.Global {
+			continue
+		}
+		if z.Parent >= 0 {
+			if z.Parent >= len(ld.scopes) {
+				return errCorruptCompiled
+			}
+			s.Parent = ld.scopes[z.Parent]
+		}
+		f, err := ld.function(z.MyFunction)
+		if err != nil {
+			return err
+		}
+		s.MyFunction = f
+	}
+
+	for _, z := range unit.Imports {
+		x, err := ld.sexp(z.Pkg)
+		if err != nil {
+			return err
+		}
+		pkg, ok := x.(*Stack)
+		if !ok || env.imports == nil {
+			return errCorruptCompiled
+		}
+		env.imports.cache[z.Key] = pkg
+	}
+
+	for _, name := range unit.Rebound {
+		env.rebound[env.symbols.intern(name)] = true
+	}
+	return nil
+}
+
+// registeredType returns the type at i in Types, or if i is
+// -1, the one called name in env.
+func (ld *loader) registeredType(i int, name string) (*RegisteredType, error) {
+	if i != -1 {
+		if i < 0 || i >= len(ld.types) {
+			return nil, errCorruptCompiled
+		}
+		return ld.types[i], nil
+	}
+	if rt := lookupType(ld.env.TypeRegistry(), name); rt != nil {
+		return rt, nil
+	}
+	return nil, fmt.Errorf("compiled code refers to type '%s', which this environment lacks", name)
+}
+
+// lookupType finds the type called name in reg, making
+// pointer and slice types, which are made as they are
+// needed, if need be.
+func lookupType(reg *GoStructRegistryType, name string) *RegisteredType {
+	if rt := reg.Lookup(name); rt != nil {
+		return rt
+	}
+	switch {
+	case strings.HasPrefix(name, "*"):
+		if rt := lookupType(reg, name[1:]); rt != nil {
+			return reg.GetOrCreatePointerType(rt)
+		}
+	case strings.HasPrefix(name, "[]"):
+		if rt := lookupType(reg, name[2:]); rt != nil {
+			return reg.GetOrCreateSliceType(rt)
+		}
+	}
+	return nil
+}
+
+func (ld *loader) captured(f *SexpFunction, z *zycFunc) error {
+	if z.Closing >= 0 {
+		if z.Closing >= len(ld.stacks) {
+			return errCorruptCompiled
+		}
+		f.closingOverScopes = &Closing{Stack: ld.stacks[z.Closing], Name: z.ClosingName, env: ld.env}
+	}
+	if z.ParentMain {
+		f.parent = ld.env.mainfunc
+		return nil
+	}
+	parent, err := ld.function(z.Parent)
+	if err != nil {
+		return err
+	}
+	f.parent = parent
+	return nil
+}
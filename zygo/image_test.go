@@ -0,0 +1,109 @@
+package zygo
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test240ImageRoundTrip(t *testing.T) {
+
+	cv.Convey(`Given an environment warmed up by scripts, an image of it should load into a new one that behaves the same`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`
+(def counter (let [n 0] (fn [] (set n (+ n 1)) n)))
+(counter) (counter)
+(defn adder [k] (fn [x] (+ x k)))
+(def add5 (adder 5))
+(defmac twice [x] ^(begin ~x ~x))
+(def h (hash a:1 b:[1 2 3]))
+(struct Car [(field Id: int64) (field Name: string)])
+(def auto (Car Id:7 Name:"zoom"))
+(def mypkg (package "mypkg" (defn Double [x] (+ x x)) (defn Quad [x] (Double (Double x)))))
+(func typed [a:int64] [n:int64] (+ a 1))
+`)
+		panicOn(err)
+
+		var buf bytes.Buffer
+		cv.So(env.SaveImage(&buf), cv.ShouldBeNil)
+
+		env2, err := NewZlispFromImage(&buf)
+		cv.So(err, cv.ShouldBeNil)
+		defer env2.Close()
+
+		res, err := env2.EvalString(`[(counter) (add5 10) (let [i 0] (twice (set i (+ i 1))) i) h (concat auto.Name "") (mypkg.Quad 3) (typed 4)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[3 15 2 {a:1 b:[1 2 3]} "zoom" 12 5]`)
+
+		// the new one has its own state.
+		res, err = env.EvalString(`(counter)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "3")
+
+		// and the struct type, still checked.
+		res, err = env2.EvalString(`(def c2 (Car Id:8 Name:"vroom")) (+ c2.Id 0)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "8")
+		_, err = env2.EvalString(`(Car Id:"eight")`)
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+
+	cv.Convey(`Given Go functions and Go types, an image should find them by name in the loading environment`, t, func() {
+
+		setup := func() *Zlisp {
+			env := NewZlisp()
+			env.StandardSetup()
+			env.AddGoFunc("triple", func(x int) int { return 3 * x })
+			env.TypeRegistry().RegisterUserdef(&RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
+				return &cbPicker{}, nil
+			}}, true, "picker")
+			return env
+		}
+
+		env := setup()
+		defer env.Close()
+		_, err := env.EvalString(`
+(defmap picker)
+(defn sixTimes [x] (* 2 (triple x)))
+(def p (picker keep: (fn [x] (> x 2))))`)
+		panicOn(err)
+		var buf bytes.Buffer
+		cv.So(env.SaveImage(&buf), cv.ShouldBeNil)
+		image := buf.Bytes()
+
+		_, err = NewZlispFromImage(bytes.NewReader(image))
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "'triple', which this environment lacks")
+
+		env2 := setup()
+		defer env2.Close()
+		cv.So(env2.LoadImage(bytes.NewReader(image)), cv.ShouldBeNil)
+		res, err := env2.EvalString(`[(sixTimes 7) (_method p "Count" [1 2 3 4])]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[42 [2]]")
+	})
+
+	cv.Convey(`Given a global holding a Go-only value, SaveImage should say which; and LoadImage should refuse what is not an image`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`(def ch (makeChan))`)
+		panicOn(err)
+		err = env.SaveImage(&bytes.Buffer{})
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "cannot save global 'ch'")
+
+		var buf bytes.Buffer
+		panicOn(env.Compile(&buf, bytes.NewReader([]byte(`(+ 1 2)`)), "three.zy"))
+		err = env.LoadImage(&buf)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "not a zygo image")
+		cv.So(errors.Is(err, ErrCompiledStale), cv.ShouldBeFalse)
+	})
+}
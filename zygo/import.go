@@ -1,9 +1,207 @@
 package zygo
 
 import (
+	"bufio"
 	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
+// Packages and import
+// ===================
+//
+// (import "name") finds a package, sources it once per
+// environment, and binds it under its package name;
+// (import k "name") binds it as k instead, and
+// (import "name" [Foo Bar]) binds only the exported
+// Foo and Bar, directly.
+//
+// The name is first tried as a path in the environment's
+// file system (see filesystem.go), from the current
+// directory as it always was, then under each directory
+// of the import path, which starts out as $ZYGOPATH, then
+// in each fs.FS added with AddImportFS, such as an
+// embed.FS of packages shipped with a program. At each
+// place name, name.zy and name/package.zy are tried in
+// that order. A versioned name like "mathx@v2" is looked
+// for as mathx@v2 and then as mathx/v2, and each version
+// is a package of its own.
+//
+// A package imported again, from anywhere in the same
+// environment, is the one loaded the first time; a
+// package that imports itself again before it is done
+// loading is an import cycle, and an error.
+
+// ImportPathEnvVar names the environment variable that
+// gives the initial import path, a list of directories
+// separated as for PATH.
+const ImportPathEnvVar = "ZYGOPATH"
+
+type importer struct {
+	dirs []string
+	fss  []fs.FS
+
+	cache   map[string]*Stack
+	loading []importing
+}
+
+type importing struct {
+	key  string
+	name string
+}
+
+// a resolved package source: a file in the environment's
+// file system if fsys is nil.
+type importSource struct {
+	fsys fs.FS
+	path string
+	key  string
+}
+
+func newImporter() *importer {
+	return &importer{
+		dirs:  filepath.SplitList(os.Getenv(ImportPathEnvVar)),
+		cache: make(map[string]*Stack),
+	}
+}
+
+// child gives a spawned or duplicated environment the same
+// search path, but a cache of its own, as it has its own
+// globals to load packages into.
+func (im *importer) child() *importer {
+	return &importer{
+		dirs:  append([]string(nil), im.dirs...),
+		fss:   append([]fs.FS(nil), im.fss...),
+		cache: make(map[string]*Stack),
+	}
+}
+
+// SetImportPath replaces the directories that import
+// searches, which start out as those in $ZYGOPATH.
+func (env *Zlisp) SetImportPath(dirs ...string) {
+	env.imports.dirs = append([]string(nil), dirs...)
+}
+
+// ImportPath returns the directories that import searches.
+func (env *Zlisp) ImportPath() []string {
+	return append([]string(nil), env.imports.dirs...)
+}
+
+// AddImportFS adds fsys, searched after the import path
+// directories and any file systems added before it.
+func (env *Zlisp) AddImportFS(fsys fs.FS) {
+	env.imports.fss = append(env.imports.fss, fsys)
+}
+
+// importCandidates lists the file names tried for name, in order.
+func importCandidates(name string) []string {
+	names := []string{name}
+	if at := strings.LastIndex(name, "@"); at > 0 {
+		names = append(names, name[:at]+"/"+name[at+1:])
+	}
+	var cands []string
+	for _, n := range names {
+		cands = append(cands, n, n+".zy", n+"/package.zy")
+	}
+	return cands
+}
+
+// resolveImport looks in env's file system first, then in the
+// file systems added with AddImportFS.
+func (env *Zlisp) resolveImport(name string) (*importSource, error) {
+	im := env.imports
+	cands := importCandidates(name)
+	var where []string
+
+	dirs := []string{""}
+	if !filepath.IsAbs(name) {
+		dirs = append(dirs, im.dirs...)
+	}
+	for _, dir := range dirs {
+		for _, c := range cands {
+			p := filepath.Join(dir, filepath.FromSlash(c))
+			if fi, err := env.statFile(p); err == nil && fi.Mode().IsRegular() {
+				key, err := filepath.Abs(p)
+				if err != nil {
+					key = p
+				}
+				return &importSource{path: p, key: key}, nil
+			}
+		}
+		if dir == "" {
+			where = append(where, ".")
+		} else {
+			where = append(where, dir)
+		}
+	}
+
+	for i, fsys := range im.fss {
+		for _, c := range cands {
+			p := path.Clean(c)
+			if !fs.ValidPath(p) {
+				continue
+			}
+			fi, err := fs.Stat(fsys, p)
+			if err == nil && fi.Mode().IsRegular() {
+				return &importSource{fsys: fsys, path: p, key: fmt.Sprintf("fs%d:%s", i, p)}, nil
+			}
+		}
+		where = append(where, fmt.Sprintf("file system %d", i+1))
+	}
+
+	return nil, fmt.Errorf("import error: package '%s' not found; searched %s",
+		name, strings.Join(where, ", "))
+}
+
+// load sources src, or returns it from the cache.
+func (env *Zlisp) loadPackage(name string, src *importSource) (*Stack, error) {
+	im := env.imports
+	if pkg, ok := im.cache[src.key]; ok {
+		return pkg, nil
+	}
+	for i, l := range im.loading {
+		if l.key == src.key {
+			var chain []string
+			for _, m := range im.loading[i:] {
+				chain = append(chain, m.name)
+			}
+			return nil, fmt.Errorf("import error: import cycle: %s -> %s",
+				strings.Join(chain, " -> "), name)
+		}
+	}
+	im.loading = append(im.loading, importing{key: src.key, name: name})
+	defer func() { im.loading = im.loading[:len(im.loading)-1] }()
+
+	var err error
+	if src.fsys == nil {
+		err = env.sourceItem(&SexpStr{S: src.path})
+	} else {
+		var f fs.File
+		f, err = src.fsys.Open(src.path)
+		if err == nil {
+			err = env.sourceNamedStream(bufio.NewReader(f), src.path)
+			f.Close()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("import error: attempt to import path '%s' resulted in: '%s'", name, err)
+	}
+	pkg, err := env.datastack.PopExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	asPkg, isPkg := pkg.(*Stack)
+	if !isPkg || !asPkg.IsPackage {
+		return nil, fmt.Errorf("import error: attempt to import path '%s' resulted value that was not a package, but rather '%T'", name, pkg)
+	}
+	im.cache[src.key] = asPkg
+	return asPkg, nil
+}
+
 // import a package, analagous to Golang.
 func ImportPackageBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	//P("starting ImportPackageBuilder")
@@ -14,17 +212,25 @@ func ImportPackageBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 
 	var path Sexp
 	var alias string
+	var only *SexpArray
 
 	switch n {
 	case 1:
 		path = args[0]
 	case 2:
-		path = args[1]
 		//P("import debug: alias position at args[0] is '%#v'", args[0])
 		switch sy := args[0].(type) {
 		case *SexpSymbol:
 			//P("import debug: alias is symbol, ok: '%v'", sy.name)
 			alias = sy.name
+			path = args[1]
+		case *SexpStr:
+			path = sy
+			arr, isArr := args[1].(*SexpArray)
+			if !isArr {
+				return SexpNull, fmt.Errorf("import error: names to import must be an array of symbols")
+			}
+			only = arr
 		default:
 			return SexpNull, fmt.Errorf("import error: alias was not a symbol name")
 		}
@@ -37,19 +243,19 @@ func ImportPackageBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	default:
 		return SexpNull, fmt.Errorf("import error: path argument must be string")
 	}
-	if !FileExists(pth) {
-		return SexpNull, fmt.Errorf("import error: path '%s' does not exist", pth)
-	}
 
-	pkg, err := SourceFileFunction(env, "source", []Sexp{path})
+	src, err := env.resolveImport(pth)
+	if err != nil {
+		return SexpNull, err
+	}
+	asPkg, err := env.loadPackage(pth, src)
 	if err != nil {
-		return SexpNull, fmt.Errorf("import error: attempt to import path '%s' resulted in: '%s'", pth, err)
+		return SexpNull, err
 	}
 	//P("pkg = '%#v'", pkg)
 
-	asPkg, isPkg := pkg.(*Stack)
-	if !isPkg || !asPkg.IsPackage {
-		return SexpNull, fmt.Errorf("import error: attempt to import path '%s' resulted value that was not a package, but rather '%T'", pth, pkg)
+	if only != nil {
+		return asPkg, env.importNames(asPkg, only)
 	}
 
 	if n == 1 {
@@ -63,5 +269,27 @@ func ImportPackageBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, err
 	}
 
-	return pkg, nil
+	return asPkg, nil
+}
+
+// importNames binds the exported names listed in only,
+// as themselves.
+func (env *Zlisp) importNames(pkg *Stack, only *SexpArray) error {
+	for _, x := range only.Val {
+		sym, isSym := x.(*SexpSymbol)
+		if !isSym {
+			return fmt.Errorf("import error: names to import must be symbols, not '%s'", x.SexpString(nil))
+		}
+		if err := errIfPrivate(sym.name, pkg); err != nil {
+			return fmt.Errorf("import error: %v", err)
+		}
+		val, err, _ := pkg.LookupSymbol(sym, nil)
+		if err != nil {
+			return fmt.Errorf("import error: package '%s' has no '%s'", pkg.PackageName, sym.name)
+		}
+		if err := env.LexicalBindSymbol(sym, val); err != nil {
+			return err
+		}
+	}
+	return nil
 }
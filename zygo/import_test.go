@@ -1,8 +1,12 @@
 package zygo
 
 import (
-	cv "github.com/glycerine/goconvey/convey"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
 )
 
 func Test050ImportWorks(t *testing.T) {
@@ -29,3 +33,69 @@ func Test050ImportWorks(t *testing.T) {
 		panicOn(dothings())
 	})
 }
+
+func Test150ImportSearchPathCacheAndCycles(t *testing.T) {
+
+	cv.Convey(`Given packages on an import path and in an fs.FS, import should find them, load each once, refuse cycles, and bind selected names`, t, func() {
+
+		dir := t.TempDir()
+		write := func(name, src string) {
+			p := filepath.Join(dir, filepath.FromSlash(name))
+			panicOn(os.MkdirAll(filepath.Dir(p), 0755))
+			panicOn(os.WriteFile(p, []byte(src), 0644))
+		}
+		write("geom.zy", `(package "geom" (tick) (defn Sq [x] (* x x)) (def secret 7))`)
+		write("mathx/v2/package.zy", `(package "mathx" (def Version 2))`)
+		write("mathx@v1.zy", `(package "mathx" (def Version 1))`)
+		write("cyc/a.zy", `(package "a" (import "cyc/b"))`)
+		write("cyc/b.zy", `(package "b" (import "cyc/a"))`)
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		loads := 0
+		env.AddGoFunc("tick", func() { loads++ })
+		env.SetImportPath(filepath.Join(dir, "nowhere"), dir)
+		cv.So(env.ImportPath(), cv.ShouldResemble, []string{filepath.Join(dir, "nowhere"), dir})
+
+		env.AddImportFS(fstest.MapFS{
+			"std/strs.zy": {Data: []byte(`(package "strs" (defn Twice [s] (concat s s)))`)},
+		})
+
+		res, err := env.EvalString(`
+(import "geom")
+(import g "geom")
+(import "geom" [Sq])
+(import "std/strs")
+(import m1 "mathx@v1")
+(import m2 "mathx@v2")
+[(geom.Sq 3) (g.Sq 4) (Sq 5) (strs.Twice "ab") (+ m1.Version 0) (+ m2.Version 0)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[9 16 25 "abab" 1 2]`)
+		cv.So(loads, cv.ShouldEqual, 1)
+
+		// a duplicate has its own globals, so loads its own copy.
+		dup := env.Duplicate()
+		_, err = dup.EvalString(`(import "geom")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(loads, cv.ShouldEqual, 2)
+
+		bad := []struct{ expr, want string }{
+			{`(import "cyc/a")`, "import cycle: cyc/a -> cyc/b -> cyc/a"},
+			{`(import "nope")`, "package 'nope' not found; searched ., " + filepath.Join(dir, "nowhere") + ", " + dir + ", file system 1"},
+			{`(import "geom" [secret])`, "Cannot access private member 'secret' of package 'geom'"},
+			{`(import "geom" [Cube])`, "package 'geom' has no 'Cube'"},
+		}
+		for _, b := range bad {
+			env.Clear()
+			_, err = env.EvalString(b.expr)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, b.want)
+		}
+
+		// a failed load is not cached, and leaves nothing loading.
+		cv.So(env.imports.loading, cv.ShouldBeEmpty)
+		_, cached := env.imports.cache[filepath.Join(dir, "cyc", "a.zy")]
+		cv.So(cached, cv.ShouldBeFalse)
+	})
+}
@@ -0,0 +1,143 @@
+package zygo
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"strings"
+)
+
+// Input and output streams
+// ========================
+//
+// Each environment prints through its own output stream,
+// and reads through its own input stream, so that several
+// environments in one program can be kept apart, and their
+// output captured. Unless set, they are the process's
+// standard streams, looked up each time they are used.
+//
+// (with-output-to-string body...) runs body with the output
+// stream going to a string instead, and returns that string;
+// withOutputToString is the same builder.
+
+// SetOutput sends the output of print, println, printf,
+// timeit, the scope listings and the repl's results to w;
+// the repl's errors go to ErrOutput.
+func (env *Zlisp) SetOutput(w io.Writer) {
+	env.stdout = w
+}
+
+// SetErrOutput sends error messages to w. Once it is set,
+// (system) sends a command's standard error here, rather
+// than returning it along with its output.
+func (env *Zlisp) SetErrOutput(w io.Writer) {
+	env.stderr = w
+}
+
+// SetInput has (read) with no argument, the repl and
+// (system) read from r.
+func (env *Zlisp) SetInput(r io.Reader) {
+	env.stdin = r
+	env.stdinBuf = nil
+}
+
+// Output returns the stream set by SetOutput, or os.Stdout.
+func (env *Zlisp) Output() io.Writer {
+	if env.stdout == nil {
+		return os.Stdout
+	}
+	return env.stdout
+}
+
+// ErrOutput returns the stream set by SetErrOutput, or os.Stderr.
+func (env *Zlisp) ErrOutput() io.Writer {
+	if env.stderr == nil {
+		return os.Stderr
+	}
+	return env.stderr
+}
+
+// Input returns the stream set by SetInput, or os.Stdin.
+func (env *Zlisp) Input() io.Reader {
+	if env.stdin == nil {
+		return os.Stdin
+	}
+	return env.stdin
+}
+
+// inputReader buffers Input, once, so that what one (read)
+// buffers past its expression is there for the next.
+func (env *Zlisp) inputReader() *bufio.Reader {
+	if env.stdinBuf == nil {
+		env.stdinBuf = bufio.NewReader(env.Input())
+	}
+	return env.stdinBuf
+}
+
+// readInput reads lines from Input until they make up a
+// whole expression, and returns that expression. Like the
+// repl, it feeds the parser a line at a time.
+func (env *Zlisp) readInput() (Sexp, error) {
+	reader := env.inputReader()
+	line, err := getLine(reader)
+	for err == nil && strings.TrimSpace(line) == "" {
+		line, err = getLine(reader)
+	}
+	if err != nil {
+		return SexpNull, err
+	}
+	lines := []string{line}
+
+	// pulled, as ParseTokens does, so that stopping part way
+	// through an expression leaves the parser able to stop.
+	env.parser.ResetAddNewInput(bytes.NewBufferString(line + "\n"))
+	next, stop := iter.Pull(env.parser.ParsingIter())
+	defer stop()
+	for {
+		reply, ok := next()
+		if !ok {
+			return SexpNull, io.EOF
+		}
+		switch reply.Err {
+		case nil:
+			for _, x := range reply.Expr {
+				if x != SexpEnd {
+					return x, nil
+				}
+			}
+			return SexpNull, io.EOF
+		case ErrMoreInputNeeded, UnexpectedEnd, ResetRequested:
+			line, err = getLine(reader)
+			if err == io.EOF {
+				return SexpNull, fmt.Errorf("read: input ended inside an expression: '%s'",
+					strings.Join(lines, "\n"))
+			}
+			if err != nil {
+				return SexpNull, err
+			}
+			lines = append(lines, line)
+			env.parser.NewInput(bytes.NewBufferString(line + "\n"))
+		default:
+			return SexpNull, reply.Err
+		}
+	}
+}
+
+// (with-output-to-string body...) is a builder, so body is
+// run here, like the body of (try).
+func WithOutputToStringBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	var buf bytes.Buffer
+	prev := env.stdout
+	env.stdout = &buf
+	defer func() { env.stdout = prev }()
+
+	if len(args) > 0 {
+		if _, err := EvalFunction(env, name, args); err != nil {
+			return SexpNull, err
+		}
+	}
+	return &SexpStr{S: buf.String()}, nil
+}
@@ -0,0 +1,140 @@
+package zygo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test180EnvironmentsHaveTheirOwnStreams(t *testing.T) {
+
+	cv.Convey(`Given two environments with their own output, each should print only to its own`, t, func() {
+
+		var out1, out2 bytes.Buffer
+		env1 := NewZlisp()
+		defer env1.Close()
+		env1.StandardSetup()
+		env1.SetOutput(&out1)
+		env2 := NewZlisp()
+		defer env2.Close()
+		env2.StandardSetup()
+		env2.SetOutput(&out2)
+
+		_, err := env1.EvalString(`(println "one") (printf "%d\n" 1)`)
+		panicOn(err)
+		_, err = env2.EvalString(`(print "two")`)
+		panicOn(err)
+		cv.So(out1.String(), cv.ShouldEqual, "one\n1\n")
+		cv.So(out2.String(), cv.ShouldEqual, "two")
+	})
+
+	cv.Convey(`Given (with-output-to-string), or its alias withOutputToString, its body's output should come back as a string, and output go back where it was after, even on error`, t, func() {
+
+		var out bytes.Buffer
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetOutput(&out)
+
+		res, err := env.EvalString(`(with-output-to-string (println "a") (print "b"))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, "a\nb")
+
+		res, err = env.EvalString(`(withOutputToString (print "x") (print (withOutputToString (print "y"))))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, "xy")
+
+		_, err = env.EvalString(`(withOutputToString (print "lost") (error "bad"))`)
+		cv.So(err, cv.ShouldNotBeNil)
+		_, err = env.EvalString(`(print "after")`)
+		panicOn(err)
+		cv.So(out.String(), cv.ShouldEqual, "after")
+	})
+
+	cv.Convey(`Given an environment's own input, (read) should take one expression at a time from it, across lines`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetInput(strings.NewReader("(+ 1\n 2)\n\n[3 4]\n(unfinished\n"))
+
+		res, err := env.EvalString(`(read)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "(+ 1 2)")
+		res, err = env.EvalString(`(read)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[3 4]")
+		_, err = env.EvalString(`(read)`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "input ended inside an expression")
+	})
+
+	cv.Convey(`Given an environment's own input and error output, (system) should read the one and write the other`, t, func() {
+
+		var errout bytes.Buffer
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetInput(strings.NewReader("piped in\n"))
+		env.SetErrOutput(&errout)
+
+		res, err := env.EvalString(`(system "cat; echo oops 1>&2")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, "piped in")
+		cv.So(errout.String(), cv.ShouldEqual, "oops\n")
+	})
+
+	cv.Convey(`Given an environment's own input and output, the repl should read from the one, answer on the other, and return at the end of input`, t, func() {
+
+		var out bytes.Buffer
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetInput(strings.NewReader("(def a 20)\n(+ a\n 22)\n"))
+		env.SetOutput(&out)
+
+		cfg := NewZlispConfig("test")
+		cfg.Quiet = true
+		cfg.Prompt = "> "
+		Repl(env, cfg)
+		cv.So(out.String(), cv.ShouldContainSubstring, "42\n")
+		cv.So(out.String(), cv.ShouldStartWith, "> ")
+	})
+
+	cv.Convey(`Given an environment's own error output, the repl should send its errors and stack traces there, not to the output`, t, func() {
+
+		var out, errout bytes.Buffer
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetInput(strings.NewReader("(undefinedThing 1)\n(+ 1 2)\n"))
+		env.SetOutput(&out)
+		env.SetErrOutput(&errout)
+
+		cfg := NewZlispConfig("test")
+		cfg.Quiet = true
+		Repl(env, cfg)
+		cv.So(errout.String(), cv.ShouldContainSubstring, "undefinedThing")
+		cv.So(out.String(), cv.ShouldNotContainSubstring, "undefinedThing")
+		cv.So(out.String(), cv.ShouldContainSubstring, "3\n")
+	})
+	cv.Convey(`Given an environment's own output, function dumps and stack prints should go there too`, t, func() {
+
+		var out bytes.Buffer
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetOutput(&out)
+
+		_, err := env.EvalString(`(defn twice [x] (* 2 x))`)
+		panicOn(err)
+		cv.So(env.DumpFunctionByName("twice"), cv.ShouldBeNil)
+		cv.So(out.String(), cv.ShouldContainSubstring, "add func scope runtime twice")
+
+		out.Reset()
+		env.datastack.PushExpr(&SexpStr{S: "on the stack"})
+		env.datastack.PrintStack()
+		cv.So(out.String(), cv.ShouldEqual, "\t\"on the stack\"\n")
+	})
+}
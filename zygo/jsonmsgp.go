@@ -367,7 +367,7 @@ func decodeGoToSexpHelper(r interface{}, depth int, env *Zlisp, preferSym bool)
 	default:
 		// do we have a struct for it?
 		nm := fmt.Sprintf("%T", val)
-		rt := GoStructRegistry.Lookup(nm)
+		rt := env.TypeRegistry().Lookup(nm)
 		if rt == nil {
 			fmt.Printf("unknown type '%s' in type switch, val = %#v.  type = %T.\n", nm, val, val)
 		} else {
@@ -516,6 +516,9 @@ func SexpToGo(sexp Sexp, env *Zlisp, dedup map[*SexpHash]interface{}) (result in
 }
 
 func ToGoFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if err := env.allow(CapGoValues, name); err != nil {
+		return SexpNull, err
+	}
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
 	}
@@ -548,8 +551,8 @@ func toGoHelper(env *Zlisp, name string, arg Sexp) (Sexp, error) {
 		} else {
 			//vv("ToGo: tn '%s' does not have GoShadowStruct set, making a new one", tn)
 
-			factory, hasMaker := GoStructRegistry.Registry[tn]
-			if !hasMaker {
+			factory := env.TypeRegistry().Lookup(tn)
+			if factory == nil {
 				return SexpNull, fmt.Errorf("type '%s' not registered in GoStructRegistry", tn)
 			}
 			newStruct, err = factory.Factory(env, asHash)
@@ -576,6 +579,9 @@ func toGoHelper(env *Zlisp, name string, arg Sexp) (Sexp, error) {
 }
 
 func FromGoFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if err := env.allow(CapGoValues, name); err != nil {
+		return SexpNull, err
+	}
 	if len(args) != 1 {
 		return SexpNull, WrongNargs
 	}
@@ -907,8 +913,8 @@ func SexpToGoStructs(
 		}
 
 		// use targVa, but check against the type in the registry for sanity/type checking.
-		factory, hasMaker := GoStructRegistry.Registry[tn]
-		if !hasMaker {
+		factory := env.TypeRegistry().Lookup(tn)
+		if factory == nil {
 			panic(fmt.Errorf("type '%s' not registered in GoStructRegistry", tn))
 			//return nil, fmt.Errorf("type '%s' not registered in GoStructRegistry", tn)
 		}
@@ -1042,9 +1048,14 @@ func SexpToGoStructs(
 	case *SexpSymbol:
 		targVa.Elem().SetString(src.name)
 	case *SexpFunction:
-		panic("unimplemented: *SexpFunction converstion.")
-		// no conversion done
-		//return src
+		if targElemKind != reflect.Func {
+			panic(fmt.Errorf("cannot translate function '%s' into %v", src.name, targElemTyp))
+		}
+		fv, err := env.GoFunc(src, targElemTyp)
+		if err != nil {
+			return nil, err
+		}
+		targVa.Elem().Set(fv)
 	case *SexpSentinel:
 		// set to nil
 		targVa.Elem().Set(reflect.Zero(targVa.Type().Elem()))
@@ -7,6 +7,8 @@ import (
 	"io"
 	"regexp"
 	"strconv"
+	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -56,6 +58,10 @@ const (
 type Token struct {
 	typ TokenType
 	str string
+
+	// line and col locate the first rune of the token.
+	line int
+	col  int
 }
 
 var EndTk = Token{typ: TokenEnd}
@@ -142,10 +148,34 @@ type Lexer struct {
 	preBuiltinRune rune
 	stream         io.RuneScanner
 	next           []io.RuneScanner
-	linenum        int
+
+	// line and col are the position of the most recently
+	// lexed rune, hereLine/hereCol; tokLine and tokCol mark
+	// where the token being accumulated began. opLine and
+	// opCol remember a ':' or '/' whose meaning is not known
+	// until the following rune arrives.
+	line     int
+	col      int
+	hereLine int
+	hereCol  int
+	tokLine  int
+	tokCol   int
+	opLine   int
+	opCol    int
 
 	priori    int
 	priorRune [20]rune
+
+	// hyphens are the buffer offsets, and hyphenCols the
+	// columns, of hyphens taken into a word because it might
+	// be a registered hyphenated name; see dumpHyphenated.
+	// hyphenPending is set until the rune after the latest
+	// one shows whether a word follows it, and hyphenPreRune
+	// is the rune before it.
+	hyphens       []int
+	hyphenCols    []int
+	hyphenPending bool
+	hyphenPreRune rune
 }
 
 func (lexer *Lexer) AppendToken(tok Token) {
@@ -181,25 +211,35 @@ func canStartSignedNumberAfter(r rune) bool {
 
 func NewLexer(p *Parser) *Lexer {
 	return &Lexer{
-		parser:  p,
-		tokens:  make([]Token, 0, 10),
-		buffer:  new(bytes.Buffer),
-		state:   LexerNormal,
-		linenum: 1,
+		parser: p,
+		tokens: make([]Token, 0, 10),
+		buffer: new(bytes.Buffer),
+		state:  LexerNormal,
+		line:   1,
 	}
 }
 
 func (lexer *Lexer) Linenum() int {
-	return lexer.linenum
+	return lexer.line
+}
+
+// Pos returns the position of the most recently lexed rune.
+func (lexer *Lexer) Pos() (line, col int) {
+	return lexer.hereLine, lexer.hereCol
 }
 
 func (lex *Lexer) Reset() {
 	lex.stream = nil
 	lex.tokens = lex.tokens[:0]
 	lex.state = LexerNormal
-	lex.linenum = 1
+	lex.line = 1
+	lex.col = 0
+	lex.hereLine = 0
+	lex.hereCol = 0
 	lex.preBuiltinRune = 0
 	lex.buffer.Reset()
+	lex.hyphens, lex.hyphenCols = nil, nil
+	lex.hyphenPending = false
 }
 
 func (lex *Lexer) EmptyToken() Token {
@@ -208,8 +248,10 @@ func (lex *Lexer) EmptyToken() Token {
 
 func (lex *Lexer) Token(typ TokenType, str string) Token {
 	t := Token{
-		typ: typ,
-		str: str,
+		typ:  typ,
+		str:  str,
+		line: lex.tokLine,
+		col:  lex.tokCol,
 	}
 	return t
 }
@@ -384,6 +426,9 @@ func (lexer *Lexer) dumpBuffer() error {
 	if n <= 0 {
 		return nil
 	}
+	if len(lexer.hyphens) > 0 {
+		return lexer.dumpHyphenated()
+	}
 
 	tok, err := lexer.DecodeAtom(lexer.buffer.String())
 	if err != nil {
@@ -391,8 +436,102 @@ func (lexer *Lexer) dumpBuffer() error {
 	}
 	lexer.buffer.Reset()
 	lexer.AppendToken(tok)
+	// whatever comes next starts at the current rune.
+	lexer.markTokenStart()
+	return nil
+
+}
+
+// hyphenatedPrefix reports whether the word in the buffer,
+// with a hyphen after it, begins a registered hyphenated
+// name, such as with-output-to-string.
+func (lexer *Lexer) hyphenatedPrefix() bool {
+	if lexer.buffer.Len() == 0 || lexer.parser == nil || lexer.parser.env == nil {
+		return false
+	}
+	return lexer.parser.env.symbols.hyphenatedPrefix(lexer.buffer.String() + "-")
+}
+
+// dumpHyphenated dumps a word that took in hyphens as one
+// symbol if it is a registered name, and otherwise as the
+// words and minus signs it would have been without them,
+// so that {a-b} still subtracts.
+func (lexer *Lexer) dumpHyphenated() error {
+	word := lexer.buffer.String()
+	hyphens, cols := lexer.hyphens, lexer.hyphenCols
+	lexer.hyphens, lexer.hyphenCols = nil, nil
+	lexer.hyphenPending = false
+	lexer.buffer.Reset()
+	defer lexer.markTokenStart()
+
+	name := strings.TrimSuffix(word, ":")
+	if lexer.parser.env.symbols.isHyphenated(name) {
+		if name != word {
+			lexer.AppendToken(lexer.Token(TokenSymbolColon, name))
+		} else {
+			lexer.AppendToken(lexer.Token(TokenSymbol, name))
+		}
+		return nil
+	}
+
+	line := lexer.tokLine
+	start := 0
+	for i := 0; i <= len(hyphens); i++ {
+		end := len(word)
+		if i < len(hyphens) {
+			end = hyphens[i]
+		}
+		if start < end {
+			tok, err := lexer.DecodeAtom(word[start:end])
+			if err != nil {
+				return err
+			}
+			lexer.AppendToken(tok)
+		}
+		if i < len(hyphens) {
+			lexer.tokLine, lexer.tokCol = line, cols[i]
+			lexer.AppendToken(lexer.Token(TokenSymbol, "-"))
+			lexer.tokCol = cols[i] + 1
+			start = end + 1
+		}
+	}
+	return nil
+}
+
+// backOffHyphen gives back the latest hyphen taken into
+// the word, when no word follows it: it is minus, or the
+// start of an operator, after all.
+func (lexer *Lexer) backOffHyphen() error {
+	n := len(lexer.hyphens) - 1
+	col := lexer.hyphenCols[n]
+	lexer.buffer.Truncate(lexer.hyphens[n])
+	lexer.hyphens, lexer.hyphenCols = lexer.hyphens[:n], lexer.hyphenCols[:n]
+	lexer.hyphenPending = false
+	err := lexer.dumpBuffer()
+	if err != nil {
+		return err
+	}
+	lexer.tokLine, lexer.tokCol = lexer.hereLine, col
+	lexer.state = LexerBuiltinOperator
+	lexer.preBuiltinRune = lexer.hyphenPreRune
+	lexer.prevrune = '-'
 	return nil
+}
+
+// markTokenStart notes that the next token begins at the
+// rune currently being lexed.
+func (lexer *Lexer) markTokenStart() {
+	lexer.tokLine, lexer.tokCol = lexer.hereLine, lexer.hereCol
+}
+
+// markOpStart notes the current rune as a pending operator.
+func (lexer *Lexer) markOpStart() {
+	lexer.opLine, lexer.opCol = lexer.hereLine, lexer.hereCol
+}
 
+// useOpStart makes the pending operator the start of the next token.
+func (lexer *Lexer) useOpStart() {
+	lexer.tokLine, lexer.tokCol = lexer.opLine, lexer.opCol
 }
 
 // with block comments, we've got to tell
@@ -442,7 +581,18 @@ func (lexer *Lexer) LexNextRune(r rune) error {
 	lexer.priorRune[lexer.priori] = r
 	lexer.priori = (lexer.priori + 1) % len(lexer.priorRune)
 
+	// track where r sits in the source
+	lexer.col++
+	lexer.hereLine, lexer.hereCol = lexer.line, lexer.col
+	if r == '\n' {
+		lexer.line++
+		lexer.col = 0
+	}
+
 top:
+	if lexer.state == LexerNormal && lexer.buffer.Len() == 0 {
+		lexer.markTokenStart()
+	}
 	switch lexer.state {
 
 	case LexerCommentBlock:
@@ -509,6 +659,7 @@ top:
 		if err != nil {
 			return err
 		}
+		lexer.useOpStart()
 		goto top // process the unknown rune r
 
 	case LexerCommentLine:
@@ -580,6 +731,7 @@ top:
 			lexer.AppendToken(lexer.Token(TokenTildeAt, ""))
 		} else {
 			lexer.AppendToken(lexer.Token(TokenTilde, ""))
+			lexer.markTokenStart()
 			lexer.buffer.WriteRune(r)
 		}
 		lexer.state = LexerNormal
@@ -601,6 +753,7 @@ top:
 			if err != nil {
 				return err
 			}
+			lexer.useOpStart()
 			lexer.AppendToken(lexer.Token(TokenFreshAssign, ":="))
 			return nil
 		} else {
@@ -609,6 +762,7 @@ top:
 				if err != nil {
 					return err
 				}
+				lexer.useOpStart()
 				lexer.AppendToken(lexer.Token(TokenColonOperator, ":"))
 				goto top // process the unknown rune r in Normal mode
 			}
@@ -662,10 +816,27 @@ top:
 		goto top // still have to parse r in normal
 
 	case LexerNormal:
+		if lexer.hyphenPending && !unicode.IsLetter(r) {
+			err := lexer.backOffHyphen()
+			if err != nil {
+				return err
+			}
+			goto top
+		}
+		lexer.hyphenPending = false
+
 		switch r {
 		case '+':
 			fallthrough
 		case '-':
+			if r == '-' && lexer.hyphenatedPrefix() {
+				// perhaps a hyphenated name; see dumpHyphenated.
+				lexer.hyphens = append(lexer.hyphens, lexer.buffer.Len())
+				lexer.hyphenCols = append(lexer.hyphenCols, lexer.hereCol)
+				lexer.hyphenPending = true
+				lexer.hyphenPreRune = lexer.twoback()
+				goto writeRuneToBuffer
+			}
 			// 1e-1, 1E+1, 1e1 are allowed, scientific notation for floats.
 			pr := lexer.twoback()
 			if pr == 'e' || pr == 'E' {
@@ -698,12 +869,14 @@ top:
 			if err != nil {
 				return err
 			}
+			lexer.markTokenStart()
 			lexer.state = LexerBuiltinOperator
 			lexer.preBuiltinRune = lexer.twoback()
 			lexer.prevrune = r
 			return nil
 
 		case '/':
+			lexer.markOpStart()
 			lexer.state = LexerFirstFwdSlash
 			return nil
 
@@ -750,6 +923,7 @@ top:
 		// mykey is the symbol.
 		// Exception: unless it is the := operator for fresh assigment.
 		case ':':
+			lexer.markOpStart()
 			lexer.state = LexerFreshAssignOrColon
 			// won't know if it is ':' alone or ':=' for sure
 			// until we get the next rune
@@ -796,7 +970,6 @@ top:
 			lexer.AppendToken(lexer.DecodeBrace(r))
 			return nil
 		case '\n':
-			lexer.linenum++
 			fallthrough
 		case ' ':
 			fallthrough
@@ -364,3 +364,24 @@ func Test042InfRegex(t *testing.T) {
 		cv.So(ans, cv.ShouldEqual, false)
 	})
 }
+
+func Test043HyphenatedNames(t *testing.T) {
+
+	cv.Convey("a registered hyphenated name such as with-output-to-string should lex as one symbol, while other words joined by a minus still subtract", t, func() {
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+
+		res, err := env.EvalString(`(with-output-to-string (print "hi"))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"hi"`)
+
+		res, err = env.EvalString(`(def with 10) (def output 3) [{with-output} {with-1} {with--with} (quote with-output-to-string)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[7 9 9 with-output-to-string]`)
+
+		_, err = env.EvalString(`(+ with-nope 1)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldStartWith, "1:9: symbol `nope` not found")
+	})
+}
@@ -0,0 +1,351 @@
+package zygo
+
+import (
+	"fmt"
+)
+
+// Lexical addressing
+// ==================
+//
+// The generator keeps a model of the scopes its code will
+// run in: one lexFrame for each scope that AddScopeInstr,
+// or a function's AddFuncScopeInstr, will push, giving a
+// slot to each name that code binds there with def, let, or
+// as a parameter. A scope pushed for a frame keeps the
+// values of those names in an array, indexed by slot; its
+// Map holds only what is bound there dynamically, by (eval)
+// or by builders like (import).
+//
+// A variable read or (set) that finds its name in one of
+// the frames of the current function is compiled to
+// LoadLocalInstr or StoreLocalInstr, addressed by depth,
+// the number of scopes above its frame at run time, and
+// slot. Those index the scope stack and the frame's array
+// directly. When the scopes are not as the generator laid
+// them out, when a scope above has bound something
+// dynamically, or when a frame above binds the same name
+// later in the code, they take the full lookup,
+// LexicalLookupSymbol, as does a name not yet bound.
+// Captured variables and globals always take the full
+// lookup, as do the operands of code generated as it runs,
+// for a call's arguments, which runs once.
+
+// lexicalAddressing can be turned off to compare against
+// the scope walk; see BenchmarkLocalLoop.
+var lexicalAddressing = true
+
+type lexFrame struct {
+	names  []int       // symbol numbers, by slot
+	slots  map[int]int // and back
+	refs   []*localRef // by slot, for code no frame can shadow
+	fn     bool        // a function's own scope: the outermost frame to search.
+	parent *lexFrame
+
+	// refs to names in frames below, made while this one
+	// is generated; see localRef.
+	through map[int][]*localRef
+}
+
+// localRef is where the generator placed a local: a slot
+// of frame.
+type localRef struct {
+	frame *lexFrame
+	slot  int
+	// shadowed is set when a frame between the code and
+	// frame binds the name after the ref was made.
+	shadowed bool
+}
+
+func (gen *Generator) pushFrame(fn bool) {
+	gen.lex = &lexFrame{slots: make(map[int]int), fn: fn, parent: gen.lex}
+}
+
+func (f *lexFrame) addName(num int) {
+	f.slots[num] = len(f.names)
+	f.refs = append(f.refs, &localRef{frame: f, slot: len(f.names)})
+	f.names = append(f.names, num)
+}
+
+// slot returns the slot of num in f, if any; most frames
+// have a few names, and a scan beats hashing.
+func (f *lexFrame) slot(num int) (int, bool) {
+	if len(f.names) > 8 {
+		i, ok := f.slots[num]
+		return i, ok
+	}
+	for i, n := range f.names {
+		if n == num {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (gen *Generator) popFrame() {
+	if gen.lex != nil {
+		gen.lex = gen.lex.parent
+	}
+}
+
+// bind notes that sym is bound in the innermost frame,
+// unless that belongs to the code around a call whose
+// arguments are being generated as it runs.
+func (gen *Generator) bind(sym *SexpSymbol) {
+	gen.env.noteBound(sym)
+	f := gen.lex
+	if f == nil || f == gen.outerLex {
+		return
+	}
+	if _, ok := f.slots[sym.number]; ok {
+		return
+	}
+	f.addName(sym.number)
+	for _, ref := range f.through[sym.number] {
+		ref.shadowed = true
+	}
+	delete(f.through, sym.number)
+}
+
+// local returns how many scopes above sym's frame the code
+// being generated will run, and where in that frame sym
+// is, or -1 and nil if sym is not a local of the current
+// function.
+func (gen *Generator) local(sym *SexpSymbol) (int, *localRef) {
+	env := gen.env
+	if !lexicalAddressing || sym.isDot || sym.colonTail || sym.isSigil {
+		return -1, nil
+	}
+	if _, isMacro := env.macros[sym.number]; isMacro {
+		return -1, nil
+	}
+	depth := 0
+	for f := gen.lex; f != nil; f = f.parent {
+		if slot, ok := f.slot(sym.number); ok {
+			// frames generated before this code runs are
+			// done; the others may yet bind sym.
+			g := gen.lex
+			if g == f || g == gen.outerLex {
+				return depth, f.refs[slot]
+			}
+			ref := &localRef{frame: f, slot: slot}
+			for ; g != f && g != gen.outerLex; g = g.parent {
+				if g.through == nil {
+					g.through = make(map[int][]*localRef)
+				}
+				g.through[sym.number] = append(g.through[sym.number], ref)
+			}
+			return depth, ref
+		}
+		if f.fn {
+			break
+		}
+		depth++
+	}
+	return -1, nil
+}
+
+// localScope returns the scope holding ref, depth scopes
+// down, or nil if the full lookup must decide.
+func (env *Zlisp) localScope(depth int, ref *localRef) *Scope {
+	if ref == nil || ref.shadowed {
+		return nil
+	}
+	st := env.linearstack
+	i := st.tos - depth
+	if i < 0 {
+		return nil
+	}
+	for j := st.tos; j > i; j-- {
+		sc, ok := st.elements[j].(*Scope)
+		if !ok || sc.IsFunction || len(sc.Map) > 0 {
+			return nil
+		}
+	}
+	sc, ok := st.elements[i].(*Scope)
+	if !ok || sc.frame != ref.frame || ref.slot >= len(sc.slots) {
+		return nil
+	}
+	return sc
+}
+
+// lookupLocal reads sym, placed at ref, depth scopes down.
+func (env *Zlisp) lookupLocal(sym *SexpSymbol, depth int, ref *localRef) (Sexp, error) {
+	if sc := env.localScope(depth, ref); sc != nil {
+		if val := sc.slots[ref.slot]; val != nil {
+			return val, nil
+		}
+	}
+	expr, err, _ := env.LexicalLookupSymbol(sym, nil)
+	return expr, err
+}
+
+// newFrameScope returns a scope for frame, with a slot for
+// each of its names.
+func (env *Zlisp) newFrameScope(name string, frame *lexFrame) *Scope {
+	sc := env.NewNamedScope(name)
+	if frame != nil {
+		sc.frame = frame
+		sc.slots = make([]Sexp, len(frame.names))
+	}
+	return sc
+}
+
+// slotOf returns the slot of s that holds num, if any.
+func (s *Scope) slotOf(num int) (int, bool) {
+	if s.frame == nil {
+		return 0, false
+	}
+	i, ok := s.frame.slot(num)
+	if !ok || i >= len(s.slots) {
+		return 0, false
+	}
+	return i, true
+}
+
+// each calls f with each name bound in s, and its value.
+func (s *Scope) each(f func(num int, val Sexp)) {
+	if s.frame != nil {
+		for i, val := range s.slots {
+			if val != nil {
+				f(s.frame.names[i], val)
+			}
+		}
+	}
+	for num, val := range s.Map {
+		f(num, val)
+	}
+}
+
+// count returns how many names are bound in s.
+func (s *Scope) count() int {
+	n := len(s.Map)
+	for _, val := range s.slots {
+		if val != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// LoadLocalInstr pushes the value of a local variable; it
+// is EnvToStackInstr for a name the generator could place.
+type LoadLocalInstr struct {
+	sym   *SexpSymbol
+	depth int
+	ref   *localRef
+}
+
+func (l LoadLocalInstr) InstrString() string {
+	return fmt.Sprintf("loadLocal %s %d", l.sym.name, l.depth)
+}
+
+func (l LoadLocalInstr) Execute(env *Zlisp) error {
+	expr, err := env.lookupLocal(l.sym, l.depth, l.ref)
+	if err != nil {
+		return err
+	}
+	env.datastack.PushExpr(expr)
+	env.pc++
+	return nil
+}
+
+// StoreLocalInstr is UpdateInstr, implementing (set), for
+// a name the generator could place.
+type StoreLocalInstr struct {
+	sym   *SexpSymbol
+	depth int
+	ref   *localRef
+}
+
+func (s StoreLocalInstr) InstrString() string {
+	return fmt.Sprintf("storeLocal %s %d", s.sym.name, s.depth)
+}
+
+func (s StoreLocalInstr) Execute(env *Zlisp) error {
+	sc := env.localScope(s.depth, s.ref)
+	if sc == nil || sc.slots[s.ref.slot] == nil {
+		return UpdateInstr{sym: s.sym}.Execute(env)
+	}
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	expr, err = env.RValue(expr)
+	if err != nil {
+		return err
+	}
+	sc.setSlot(s.ref.slot, s.sym.number, expr)
+	env.pc++
+	return nil
+}
+
+// callSite carries what the generator knew about the scopes
+// around a call, for CallExprInstr, which evaluates its
+// callee and arguments only when it runs. depths[0] and
+// refs[0] are for the callee, depths[i+1] and refs[i+1] for
+// argument i; both are nil when none of them is a local.
+type callSite struct {
+	lex    *lexFrame
+	depths []int
+	refs   []*localRef
+}
+
+func (gen *Generator) callExpr(callee Sexp, args []Sexp) CallExprInstr {
+	in := CallExprInstr{callee: callee, args: append([]Sexp(nil), args...)}
+	if gen.lex == nil || !lexicalAddressing {
+		return in
+	}
+	site := &callSite{lex: gen.lex}
+	if gen.outerLex != nil {
+		// generated as it runs, to run once: placing its
+		// operands costs more than it saves.
+		in.site = site
+		return in
+	}
+	for i := 0; i <= len(args); i++ {
+		x := callee
+		if i > 0 {
+			x = args[i-1]
+		}
+		sym, ok := x.(*SexpSymbol)
+		if !ok {
+			continue
+		}
+		depth, ref := gen.local(sym)
+		if depth < 0 {
+			continue
+		}
+		if site.depths == nil {
+			// most calls made as code runs have no locals.
+			site.depths = make([]int, len(args)+1)
+			site.refs = make([]*localRef, len(args)+1)
+			for j := range site.depths {
+				site.depths[j] = -1
+			}
+		}
+		site.depths[i], site.refs[i] = depth, ref
+	}
+	in.site = site
+	return in
+}
+
+func (site *callSite) frame() *lexFrame {
+	if site == nil {
+		return nil
+	}
+	return site.lex
+}
+
+func (site *callSite) depth(i int) int {
+	if site == nil || i >= len(site.depths) {
+		return -1
+	}
+	return site.depths[i]
+}
+
+func (site *callSite) ref(i int) *localRef {
+	if site == nil || i >= len(site.refs) {
+		return nil
+	}
+	return site.refs[i]
+}
@@ -0,0 +1,212 @@
+package zygo
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+// each gives the same answer whether or not locals are
+// lexically addressed.
+var lexicalTestScripts = []string{
+	// parameters, let and letseq frames, and set on each.
+	`(defn f [a b] (let [c 1] (letseq [d (+ c 1) e (+ d a)] (set a 10) (set c (+ c b)) [a b c d e])))
+	 (f 3 4)`,
+	// for loops push a scope per loop; def in the body.
+	`(defn sum [n] (def acc 0) (for [(def i 0) (< i n) (set i (+ i 1))] (def sq (* i i)) (set acc (+ acc sq))) acc)
+	 (sum 10)`,
+	// a def on a branch not taken leaves the name to the globals.
+	`(def z "global")
+	 (defn k [c] (cond c (def z "local") nil) z)
+	 [(k false) (k true)]`,
+	// captured variables, and set on them.
+	`(defn counter [n] (fn [] (set n (+ n 1)) n))
+	 (def c (counter 5)) (c) (c)`,
+	// a tail call from inside a let.
+	`(defn down [i acc] (cond (== i 0) acc (let [j (- i 1)] (down j (+ acc i)))))
+	 (down 100 0)`,
+	// catch binds its name in a scope of its own.
+	`(defn t [e] (try (throw "boom") (catch e (concat "caught " e))))
+	 (t "param")`,
+	// eval binds where the generator cannot see.
+	`(defn ev [x] (let [y 1] (eval (quote (def y 2))) (+ x y)))
+	 (ev 40)`,
+	// a local shadowing a global function in a call.
+	`(defn bump [x] (+ x 1))
+	 (defn ap [bump x] (bump (bump x)))
+	 [(ap (fn [y] (* y 10)) 3) (bump 3)]`,
+	// newScope and nested functions.
+	`(defn outer [a] (newScope (def b 2) ((fn [c] (+ a b c)) 3)))
+	 (outer 1)`,
+	// a loop's def hides the parameter from the next time round.
+	`(defn sh [x] (def r []) (for [(def i 0) (< i 2) (set i (+ i 1))] (set r (append r x)) (def x "inner")) r)
+	 (sh "outer")`,
+	// set on a local is rolled back with the transaction.
+	`(defn tx [] (def v 1) (try (atomically (set v 2) (error "undo")) (catch e nil)) v)
+	 (tx)`,
+	// match binds its names in a frame of its own.
+	`(defn m [p] (match p [a b] (+ a b) _ 0))
+	 [(m [1 2]) (m 5)]`,
+}
+
+func Test160LexicalAddressingGivesTheSameAnswers(t *testing.T) {
+
+	cv.Convey(`Given scripts mixing locals, scopes, closures, tail calls and runtime binding, lexically addressed code should agree with the scope walk, compiled or not`, t, func() {
+
+		run := func(addressed bool, script string) string {
+			lexicalAddressing = addressed
+			defer func() { lexicalAddressing = true }()
+			env := NewZlisp()
+			defer env.Close()
+			env.StandardSetup()
+			res, err := env.EvalString(script)
+			if err != nil {
+				return "error: " + err.Error()
+			}
+			return res.SexpString(nil)
+		}
+		for _, script := range lexicalTestScripts {
+			want := run(false, script)
+			cv.So(want, cv.ShouldNotStartWith, "error")
+			cv.So(run(true, script), cv.ShouldEqual, want)
+		}
+
+		// and through a compiled file.
+		script := strings.Join(lexicalTestScripts[:2], "\n")
+		comp := NewZlisp()
+		defer comp.Close()
+		comp.StandardSetup()
+		var buf bytes.Buffer
+		cv.So(comp.Compile(&buf, strings.NewReader(script), "lex.zy"), cv.ShouldBeNil)
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		cv.So(env.LoadCompiled(&buf), cv.ShouldBeNil)
+		res, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, run(false, script))
+	})
+
+	cv.Convey(`Given a function with parameters and a let, its locals should be addressed by depth, and its globals looked up by name`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`(def g 1) (defn f [a] (let [c 1] (set a 2) a (+ a c g)))`)
+		panicOn(err)
+		f, _ := env.FindObject("f")
+
+		var code []string
+		var sites [][]int
+		for _, in := range f.(*SexpFunction).fun {
+			switch x := in.(type) {
+			case LoadLocalInstr, StoreLocalInstr:
+				code = append(code, in.InstrString())
+			case CallExprInstr:
+				sites = append(sites, x.site.depths)
+			}
+		}
+		cv.So(code, cv.ShouldResemble, []string{"storeLocal a 1", "loadLocal a 1"})
+		cv.So(sites, cv.ShouldResemble, [][]int{{-1, 1, 0, -1}})
+	})
+}
+
+func Test161FrameScopesKeepTheirNamesInSlots(t *testing.T) {
+
+	cv.Convey(`Given a scope for a frame, its frame's names should live in slots, and any others in its Map`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		a, b, c := env.MakeSymbol("a"), env.MakeSymbol("b"), env.MakeSymbol("c")
+		frame := &lexFrame{slots: make(map[int]int)}
+		frame.addName(a.number)
+		frame.addName(b.number)
+		sc := env.newFrameScope("test", frame)
+
+		sc.bind(b.number, &SexpInt{Val: 2})
+		sc.bind(c.number, &SexpInt{Val: 3})
+		cv.So(len(sc.slots), cv.ShouldEqual, 2)
+		cv.So(sc.slots[1].SexpString(nil), cv.ShouldEqual, "2")
+		cv.So(len(sc.Map), cv.ShouldEqual, 1)
+		_, bound := sc.get(a.number)
+		cv.So(bound, cv.ShouldBeFalse)
+		cv.So(sc.count(), cv.ShouldEqual, 2)
+
+		sc.unbind(b.number)
+		_, bound = sc.get(b.number)
+		cv.So(bound, cv.ShouldBeFalse)
+		cv.So(sc.CloneScope().count(), cv.ShouldEqual, 1)
+	})
+
+	cv.Convey(`Given a dynamic bind in a scope above, or a frame above binding the name later, a local read should take the full lookup`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`(defn f [x] (let [y 1] (eval (quote (def x 5))) (+ x y)))`)
+		panicOn(err)
+		res, err := env.EvalString(`(f 1)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "6")
+
+		gen := NewGenerator(env)
+		gen.pushFrame(true)
+		x := env.MakeSymbol("x")
+		gen.bind(x)
+		gen.pushFrame(false)
+		depth, ref := gen.local(x)
+		cv.So(depth, cv.ShouldEqual, 1)
+		cv.So(ref.shadowed, cv.ShouldBeFalse)
+		gen.bind(x)
+		cv.So(ref.shadowed, cv.ShouldBeTrue)
+		depth, ref = gen.local(x)
+		cv.So(depth, cv.ShouldEqual, 0)
+		cv.So(ref.shadowed, cv.ShouldBeFalse)
+	})
+}
+
+func BenchmarkArrayMult(b *testing.B) {
+	src, err := os.ReadFile("../benchmarks/array-mult.zy")
+	panicOn(err)
+	benchmarkAddressing(b, string(src))
+}
+
+// BenchmarkLocalLoop reads and sets locals in nested loops,
+// where most of the time goes on variables.
+func BenchmarkLocalLoop(b *testing.B) {
+	benchmarkAddressing(b, `
+(defn sums [n]
+  (def acc 0)
+  (for [(def i 0) (< i n) (set i (+ i 1))]
+    (for [(def j 0) (< j n) (set j (+ j 1))]
+      (set acc (+ acc i j)))))
+(sums 100)`)
+}
+
+func benchmarkAddressing(b *testing.B, src string) {
+	for _, mode := range []struct {
+		name      string
+		addressed bool
+	}{{"addressed", true}, {"scopewalk", false}} {
+		b.Run(mode.name, func(b *testing.B) {
+			lexicalAddressing = mode.addressed
+			defer func() { lexicalAddressing = true }()
+			env := NewZlisp()
+			defer env.Close()
+			env.StandardSetup()
+			panicOn(env.LoadString(src))
+			code := env.mainfunc.fun
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				env.Clear()
+				env.mainfunc.fun = code
+				if _, err := env.Run(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,702 @@
+package zygo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Language Server Protocol
+// ========================
+//
+// zygo -lsp serves the Language Server Protocol on stdin
+// and stdout, for editors. Documents are parsed but never
+// run. The server reports parse errors, and indexes the
+// def, defn, defmac, func and struct forms of each open
+// document for go-to-definition and hover. Completion
+// offers those names, the builtins, reserved words, macros
+// and registered types; inside a constructor call such as
+// (Point ...) it offers the fields of the type instead.
+//
+// Positions count characters in UTF-16 code units, as the
+// protocol has them by default, while the lexer counts
+// runes; lspPos and position convert.
+
+// LSP completion item kinds.
+const (
+	lspKindFunction = 3
+	lspKindField    = 5
+	lspKindVariable = 6
+	lspKindKeyword  = 14
+	lspKindStruct   = 22
+)
+
+// ServeLSP serves the Language Server Protocol on r and w
+// until the client sends exit, or r ends. env supplies the
+// builtins, macros and types known to the server.
+func ServeLSP(r io.Reader, w io.Writer, env *Zlisp) error {
+	s := &lspServer{
+		env:    env,
+		parser: env.NewParser(),
+		w:      w,
+		docs:   make(map[string]*lspDoc),
+	}
+	br := bufio.NewReader(r)
+	for {
+		buf, err := readFramed(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var msg lspMessage
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		s.handle(&msg)
+	}
+}
+
+type lspMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type lspResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+}
+
+type lspErrorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   lspError        `json:"error"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspServer struct {
+	env    *Zlisp
+	parser *Parser
+	w      io.Writer
+	docs   map[string]*lspDoc
+}
+
+type lspDoc struct {
+	uri   string
+	text  string
+	lines []string
+	defs  []lspDef
+}
+
+// lspDef is a form that names something.
+type lspDef struct {
+	name  string
+	pos   SrcPos      // of the name.
+	start lspPosition // pos, as the client counts.
+	form  []Sexp
+}
+
+func (s *lspServer) reply(id json.RawMessage, result interface{}) {
+	writeFramed(s.w, &lspResponse{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *lspServer) notify(method string, params interface{}) {
+	writeFramed(s.w, &lspNotification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *lspServer) handle(msg *lspMessage) {
+	var pos lspTextDocumentPosition
+	switch msg.Method {
+	case "initialize":
+		s.reply(msg.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"positionEncoding":   "utf-16",
+				"textDocumentSync":   1, // the whole text, each change.
+				"hoverProvider":      true,
+				"definitionProvider": true,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"("}},
+			},
+			"serverInfo": map[string]interface{}{"name": "zygo", "version": Version()},
+		})
+	case "shutdown":
+		s.reply(msg.ID, nil)
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		json.Unmarshal(msg.Params, &p)
+		s.update(p.TextDocument.URI, p.TextDocument.Text)
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		json.Unmarshal(msg.Params, &p)
+		if n := len(p.ContentChanges); n > 0 {
+			s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+	case "textDocument/didClose":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		json.Unmarshal(msg.Params, &p)
+		delete(s.docs, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+			"uri": p.TextDocument.URI, "diagnostics": []lspDiagnostic{},
+		})
+	case "textDocument/definition":
+		json.Unmarshal(msg.Params, &pos)
+		s.reply(msg.ID, s.definition(pos))
+	case "textDocument/hover":
+		json.Unmarshal(msg.Params, &pos)
+		s.reply(msg.ID, s.hover(pos))
+	case "textDocument/completion":
+		json.Unmarshal(msg.Params, &pos)
+		s.reply(msg.ID, s.completion(pos))
+	default:
+		if msg.ID != nil {
+			writeFramed(s.w, &lspErrorResponse{JSONRPC: "2.0", ID: msg.ID,
+				Error: lspError{Code: -32601, Message: "method not found: " + msg.Method}})
+		}
+	}
+}
+
+// update re-parses a document and publishes its diagnostics.
+func (s *lspServer) update(uri, text string) {
+	doc := &lspDoc{uri: uri, text: text, lines: strings.Split(text, "\n")}
+	s.docs[uri] = doc
+
+	diags := []lspDiagnostic{}
+	expressions, err := s.parse(uri, text)
+	for _, x := range expressions {
+		doc.index(x)
+	}
+	if err != nil {
+		diags = append(diags, s.diagnose(doc, err))
+	}
+	s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri": uri, "diagnostics": diags,
+	})
+}
+
+func (s *lspServer) parse(uri, text string) (expressions []Sexp, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	s.parser.ResetAddNewInput(strings.NewReader(text + "\n"))
+	s.parser.SetFilename(uri)
+	return s.parser.ParseTokens()
+}
+
+func (s *lspServer) diagnose(doc *lspDoc, err error) lspDiagnostic {
+	d := lspDiagnostic{Severity: 1, Source: "zygo", Message: err.Error()}
+	if err == ErrMoreInputNeeded {
+		// point at whatever was left open, if we can.
+		open := unclosed(doc.text)
+		if len(open) > 0 {
+			at := open[len(open)-1]
+			d.Range = doc.rangeAt(at, at+1)
+			d.Message = fmt.Sprintf("unclosed '%c'", doc.text[at])
+			return d
+		}
+		d.Message = "unexpected end of input; is a string left open?"
+	}
+	start := doc.lspPos(s.parser.CurrentPos())
+	d.Range = lspRange{Start: start, End: start}
+	return d
+}
+
+// unclosed returns the byte offsets of the brackets left
+// open at the end of text, outermost first, skipping
+// strings and comments.
+func unclosed(text string) []int {
+	var open []int
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case '(', '[', '{':
+			open = append(open, i)
+		case ')', ']', '}':
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		case '"', '`':
+			for i++; i < len(text) && text[i] != c; i++ {
+				if c == '"' && text[i] == '\\' {
+					i++
+				}
+			}
+		case '/':
+			if strings.HasPrefix(text[i:], "//") {
+				for i < len(text) && text[i] != '\n' {
+					i++
+				}
+			} else if strings.HasPrefix(text[i:], "/*") {
+				end := strings.Index(text[i+2:], "*/")
+				if end < 0 {
+					return open
+				}
+				i += end + 3
+			}
+		}
+	}
+	return open
+}
+
+// index records the naming forms within x.
+func (doc *lspDoc) index(x Sexp) {
+	var elems []Sexp
+	switch e := x.(type) {
+	case *SexpPair:
+		var err error
+		elems, err = ListToArray(e)
+		if err != nil {
+			return
+		}
+		if len(elems) > 1 {
+			head, _ := elems[0].(*SexpSymbol)
+			name, _ := elems[1].(*SexpSymbol)
+			if head != nil && name != nil {
+				switch head.name {
+				case "def", "defn", "defmac", "func", "struct":
+					pos := PosOf(name)
+					doc.defs = append(doc.defs, lspDef{name: name.name, pos: pos, start: doc.lspPos(pos), form: elems})
+				}
+			}
+		}
+	case *SexpArray:
+		elems = e.Val
+	}
+	for _, sub := range elems {
+		doc.index(sub)
+	}
+}
+
+// offset returns the byte offset of an LSP position.
+func (doc *lspDoc) offset(p lspPosition) int {
+	off := 0
+	for i := 0; i < p.Line && i < len(doc.lines); i++ {
+		off += len(doc.lines[i]) + 1
+	}
+	if p.Line < len(doc.lines) {
+		line := doc.lines[p.Line]
+		n := 0
+		for i, r := range line {
+			if n >= p.Character {
+				return off + i
+			}
+			n += utf16.RuneLen(r)
+		}
+		return off + len(line)
+	}
+	return off
+}
+
+func (doc *lspDoc) position(off int) lspPosition {
+	line := strings.Count(doc.text[:off], "\n")
+	start := strings.LastIndexByte(doc.text[:off], '\n') + 1
+	return lspPosition{Line: line, Character: utf16Len(doc.text[start:off])}
+}
+
+// lspPos converts pos, whose column counts runes from 1,
+// to an LSP position.
+func (doc *lspDoc) lspPos(pos SrcPos) lspPosition {
+	p := lspPosition{Line: max(pos.Line-1, 0)}
+	col := max(pos.Col-1, 0)
+	if p.Line < len(doc.lines) {
+		for _, r := range doc.lines[p.Line] {
+			if col == 0 {
+				break
+			}
+			p.Character += utf16.RuneLen(r)
+			col--
+		}
+	}
+	// past the end of the line, a rune a unit.
+	p.Character += col
+	return p
+}
+
+// utf16Len is the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+func (doc *lspDoc) rangeAt(start, end int) lspRange {
+	return lspRange{Start: doc.position(start), End: doc.position(end)}
+}
+
+func isSymbolRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune("()[]{}\"'`,:.", r)
+}
+
+// symbolAt returns the symbol around p, and the part of it
+// before p.
+func (doc *lspDoc) symbolAt(p lspPosition) (string, string) {
+	off := doc.offset(p)
+	start, end := off, off
+	for start > 0 {
+		r, n := utf8.DecodeLastRuneInString(doc.text[:start])
+		if !isSymbolRune(r) {
+			break
+		}
+		start -= n
+	}
+	for end < len(doc.text) {
+		r, n := utf8.DecodeRuneInString(doc.text[end:])
+		if !isSymbolRune(r) {
+			break
+		}
+		end += n
+	}
+	return doc.text[start:end], doc.text[start:off]
+}
+
+// lookup finds the definition of name, preferring doc.
+func (s *lspServer) lookup(doc *lspDoc, name string) *lspDef {
+	docs := []*lspDoc{doc}
+	for _, other := range s.docs {
+		if other != doc {
+			docs = append(docs, other)
+		}
+	}
+	for _, d := range docs {
+		for i := range d.defs {
+			if d.defs[i].name == name {
+				return &d.defs[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (s *lspServer) definition(p lspTextDocumentPosition) interface{} {
+	doc := s.docs[p.TextDocument.URI]
+	if doc == nil {
+		return nil
+	}
+	name, _ := doc.symbolAt(p.Position)
+	def := s.lookup(doc, name)
+	if def == nil {
+		return nil
+	}
+	start := def.start
+	end := start
+	end.Character += utf16Len(name)
+	return lspLocation{URI: def.pos.File, Range: lspRange{Start: start, End: end}}
+}
+
+func (s *lspServer) hover(p lspTextDocumentPosition) interface{} {
+	doc := s.docs[p.TextDocument.URI]
+	if doc == nil {
+		return nil
+	}
+	name, _ := doc.symbolAt(p.Position)
+	if name == "" {
+		return nil
+	}
+	var text string
+	if def := s.lookup(doc, name); def != nil {
+		text = "```zygo\n" + def.signature() + "\n```"
+	} else if rt := s.env.TypeRegistry().Lookup(name); rt != nil {
+		text = "```zygo\n" + strings.TrimSpace(rt.SexpString(nil)) + "\n```\nregistered type"
+	} else if _, ok := s.env.builtins[s.env.MakeSymbol(name).number]; ok {
+		text = "builtin function `" + name + "`"
+	} else if mac, ok := s.env.macros[s.env.MakeSymbol(name).number]; ok {
+		text = "macro `" + name + "`"
+		if form, err := ListToArray(mac.orig); err == nil && len(form) > 2 {
+			text = "```zygo\n(defmac " + name + " " + form[2].SexpString(nil) + ")\n```"
+		}
+	} else if s.env.reserved[s.env.MakeSymbol(name).number] {
+		text = "reserved word `" + name + "`"
+	} else {
+		return nil
+	}
+	return map[string]interface{}{
+		"contents": map[string]interface{}{"kind": "markdown", "value": text},
+	}
+}
+
+// signature renders the head of a naming form: the
+// arguments of a function, with declared types for func,
+// or the fields of a struct.
+func (def *lspDef) signature() string {
+	head := def.form[0].SexpString(nil)
+	switch head {
+	case "defn", "defmac":
+		if len(def.form) > 2 {
+			return fmt.Sprintf("(%s %s %s)", head, def.name, def.form[2].SexpString(nil))
+		}
+	case "func":
+		var parts []string
+		for _, x := range def.form[2:] {
+			arr, ok := x.(*SexpArray)
+			if !ok || len(parts) == 2 {
+				break
+			}
+			parts = append(parts, typedNames(arr.Val))
+		}
+		return fmt.Sprintf("(func %s %s)", def.name, strings.Join(parts, " "))
+	case "struct":
+		var fields []string
+		for _, f := range structFormFields(def.form) {
+			fields = append(fields, f[0]+":"+f[1])
+		}
+		return fmt.Sprintf("(struct %s [%s])", def.name, strings.Join(fields, " "))
+	case "def":
+		if len(def.form) > 2 {
+			val := def.form[2].SexpString(nil)
+			if len(val) > 60 {
+				val = val[:57] + "..."
+			}
+			return fmt.Sprintf("(def %s %s)", def.name, val)
+		}
+	}
+	return fmt.Sprintf("(%s %s)", head, def.name)
+}
+
+// typedNames renders [a int64 b string], as the parser
+// splits a:int64 b:string, back the way it was written.
+func typedNames(xs []Sexp) string {
+	var parts []string
+	for i := 0; i+1 < len(xs); i += 2 {
+		parts = append(parts, xs[i].SexpString(nil)+":"+xs[i+1].SexpString(nil))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// structFormFields returns the [name type] of each
+// (field name: type) in a struct form.
+func structFormFields(form []Sexp) [][2]string {
+	var fields [][2]string
+	if len(form) < 3 {
+		return nil
+	}
+	arr, ok := form[2].(*SexpArray)
+	if !ok {
+		return nil
+	}
+	for _, x := range arr.Val {
+		elems, err := ListToArray(x)
+		if err != nil || len(elems) < 2 {
+			continue
+		}
+		if head, ok := elems[0].(*SexpSymbol); !ok || head.name != "field" {
+			continue
+		}
+		f := [2]string{elems[1].SexpString(nil), "any"}
+		if len(elems) > 2 {
+			f[1] = elems[2].SexpString(nil)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func (s *lspServer) completion(p lspTextDocumentPosition) interface{} {
+	items := []lspCompletionItem{}
+	doc := s.docs[p.TextDocument.URI]
+	if doc == nil {
+		return items
+	}
+	_, prefix := doc.symbolAt(p.Position)
+	seen := make(map[string]bool)
+	add := func(label string, kind int, detail string) {
+		if seen[label] || !strings.HasPrefix(label, prefix) {
+			return
+		}
+		seen[label] = true
+		items = append(items, lspCompletionItem{Label: label, Kind: kind, Detail: detail})
+	}
+
+	// inside (Type ...), offer the fields of Type.
+	off := doc.offset(p.Position) - len(prefix)
+	if open := unclosed(doc.text[:off]); len(open) > 0 && doc.text[open[len(open)-1]] == '(' {
+		head, _ := doc.symbolAt(doc.position(open[len(open)-1] + 1))
+		if fields := s.typeFields(doc, head); len(fields) > 0 {
+			for _, f := range fields {
+				add(f+":", lspKindField, head+" field")
+			}
+			return items
+		}
+	}
+
+	for _, d := range s.allDefs(doc) {
+		kind := lspKindVariable
+		switch d.form[0].SexpString(nil) {
+		case "defn", "defmac", "func":
+			kind = lspKindFunction
+		case "struct":
+			kind = lspKindStruct
+		}
+		add(d.name, kind, d.signature())
+	}
+	for _, name := range s.env.TypeRegistry().TypeList() {
+		add(name, lspKindStruct, "registered type")
+	}
+	for num := range s.env.macros {
+		add(s.env.symbols.nameOf(num), lspKindFunction, "macro")
+	}
+	for num := range s.env.builtins {
+		add(s.env.symbols.nameOf(num), lspKindFunction, "builtin")
+	}
+	for _, w := range ReservedWords {
+		add(w, lspKindKeyword, "reserved word")
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+func (s *lspServer) allDefs(doc *lspDoc) []lspDef {
+	defs := append([]lspDef(nil), doc.defs...)
+	for _, other := range s.docs {
+		if other != doc {
+			defs = append(defs, other.defs...)
+		}
+	}
+	return defs
+}
+
+// typeFields returns the field names of the struct
+// declared, or the Go struct registered, as name.
+func (s *lspServer) typeFields(doc *lspDoc, name string) []string {
+	if name == "" {
+		return nil
+	}
+	if def := s.lookup(doc, name); def != nil && def.form[0].SexpString(nil) == "struct" {
+		var names []string
+		for _, f := range structFormFields(def.form) {
+			names = append(names, f[0])
+		}
+		return names
+	}
+	rt := s.env.TypeRegistry().Lookup(name)
+	if rt == nil {
+		return nil
+	}
+	if rt.UserStructDefn != nil {
+		var names []string
+		for _, f := range rt.UserStructDefn.Fields {
+			if key, ok := f.KeyOrder[0].(*SexpSymbol); ok {
+				names = append(names, key.name)
+			}
+		}
+		return names
+	}
+	if rt.Factory == nil {
+		return nil
+	}
+	return goStructFields(s.env, rt)
+}
+
+// goStructFields lists the keys a constructor call of a
+// registered Go struct accepts: json tags, or else field
+// names, including those of embedded structs.
+func goStructFields(env *Zlisp, rt *RegisteredType) (names []string) {
+	defer func() {
+		if recover() != nil {
+			names = nil
+		}
+	}()
+	v, err := rt.Factory(env, nil)
+	if err != nil || v == nil {
+		return nil
+	}
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			fld := t.Field(i)
+			name := fld.Name
+			if tag := fld.Tag.Get("json"); tag != "" {
+				name, _, _ = strings.Cut(tag, ",")
+			}
+			if name != "" && name != "-" {
+				names = append(names, name)
+			}
+			if fld.Anonymous && fld.Type.Kind() == reflect.Struct {
+				walk(fld.Type)
+			}
+		}
+	}
+	walk(t)
+	return names
+}
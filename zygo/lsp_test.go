@@ -0,0 +1,178 @@
+package zygo
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+type lspTestClient struct {
+	w   io.Writer
+	r   *bufio.Reader
+	seq int
+}
+
+func (c *lspTestClient) send(method string, params interface{}, isRequest bool) {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+	if isRequest {
+		c.seq++
+		msg["id"] = c.seq
+	}
+	panicOn(writeFramed(c.w, msg))
+}
+
+func (c *lspTestClient) read() map[string]interface{} {
+	buf, err := readFramed(c.r)
+	panicOn(err)
+	var msg map[string]interface{}
+	panicOn(json.Unmarshal(buf, &msg))
+	return msg
+}
+
+func (c *lspTestClient) call(method string, params interface{}) interface{} {
+	c.send(method, params, true)
+	return c.read()["result"]
+}
+
+func at(uri string, line, char int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"position":     map[string]interface{}{"line": line, "character": char},
+	}
+}
+
+type lspTestWidget struct {
+	Size  int    `json:"size"`
+	Label string `json:"label,omitempty"`
+	Color string
+}
+
+func Test130LanguageServer(t *testing.T) {
+
+	cv.Convey(`Given an editor talking to zygo -lsp, it should get parse diagnostics, definitions, hovers and completions`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.TypeRegistry().RegisterUserdef(&RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
+			return &lspTestWidget{}, nil
+		}}, true, "widget")
+
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- ServeLSP(inR, outW, env) }()
+		c := &lspTestClient{w: inW, r: bufio.NewReader(outR)}
+
+		res := c.call("initialize", map[string]interface{}{}).(map[string]interface{})
+		caps := res["capabilities"].(map[string]interface{})
+		cv.So(caps["hoverProvider"], cv.ShouldEqual, true)
+		c.send("initialized", map[string]interface{}{}, false)
+
+		const uri = "file:///tmp/doc.zy"
+		broken := "(defn add [a b]\n  (+ a b)\n\n(def x 1)\n"
+		c.send("textDocument/didOpen", map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": uri, "languageId": "zygo", "version": 1, "text": broken},
+		}, false)
+		diag := c.read()["params"].(map[string]interface{})
+		diags := diag["diagnostics"].([]interface{})
+		cv.So(len(diags), cv.ShouldEqual, 1)
+		d := diags[0].(map[string]interface{})
+		cv.So(d["message"], cv.ShouldEqual, "unclosed '('")
+		start := d["range"].(map[string]interface{})["start"].(map[string]interface{})
+		cv.So(start["line"], cv.ShouldEqual, 0)
+		cv.So(start["character"], cv.ShouldEqual, 0)
+
+		text := `(func add [a:int64 b:int64] [n:int64] (+ a b))
+(struct Point [(field x: int64) (field y: int64)])
+(def total (add 1 2))
+(Point )
+(widget )
+(prin)
+`
+		c.send("textDocument/didChange", map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+			"contentChanges": []interface{}{map[string]interface{}{"text": text}},
+		}, false)
+		diag = c.read()["params"].(map[string]interface{})
+		cv.So(len(diag["diagnostics"].([]interface{})), cv.ShouldEqual, 0)
+
+		// go to the definition of add, from its use on line 3.
+		loc := c.call("textDocument/definition", at(uri, 2, 13)).(map[string]interface{})
+		cv.So(loc["uri"], cv.ShouldEqual, uri)
+		rng := loc["range"].(map[string]interface{})
+		cv.So(rng["start"], cv.ShouldResemble, map[string]interface{}{"line": 0.0, "character": 6.0})
+		cv.So(rng["end"], cv.ShouldResemble, map[string]interface{}{"line": 0.0, "character": 9.0})
+
+		hover := c.call("textDocument/hover", at(uri, 2, 13)).(map[string]interface{})
+		cv.So(hover["contents"].(map[string]interface{})["value"], cv.ShouldContainSubstring,
+			"(func add [a:int64 b:int64] [n:int64])")
+		hover = c.call("textDocument/hover", at(uri, 3, 2)).(map[string]interface{})
+		cv.So(hover["contents"].(map[string]interface{})["value"], cv.ShouldContainSubstring,
+			"(struct Point [x:int64 y:int64])")
+		hover = c.call("textDocument/hover", at(uri, 0, 39)).(map[string]interface{})
+		cv.So(hover["contents"].(map[string]interface{})["value"], cv.ShouldEqual, "builtin function `+`")
+		cv.So(c.call("textDocument/hover", at(uri, 5, 2)), cv.ShouldBeNil)
+		cv.So(c.call("textDocument/hover", at(uri, 2, 9)).(map[string]interface{})["contents"].(map[string]interface{})["value"],
+			cv.ShouldContainSubstring, "(def total (add 1 2))")
+
+		labels := func(result interface{}) []string {
+			var ls []string
+			for _, it := range result.([]interface{}) {
+				ls = append(ls, it.(map[string]interface{})["label"].(string))
+			}
+			return ls
+		}
+		cv.So(labels(c.call("textDocument/completion", at(uri, 3, 7))), cv.ShouldResemble, []string{"x:", "y:"})
+		cv.So(labels(c.call("textDocument/completion", at(uri, 4, 8))), cv.ShouldResemble, []string{"size:", "label:", "Color:"})
+		got := labels(c.call("textDocument/completion", at(uri, 5, 5)))
+		cv.So(got, cv.ShouldContain, "println")
+		cv.So(got, cv.ShouldContain, "printf")
+
+		cv.So(c.call("shutdown", nil), cv.ShouldBeNil)
+		c.send("exit", nil, false)
+		cv.So(<-done, cv.ShouldBeNil)
+	})
+	cv.Convey(`Given text with characters outside the Basic Multilingual Plane, positions should count UTF-16 code units, as the protocol does`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- ServeLSP(inR, outW, env) }()
+		c := &lspTestClient{w: inW, r: bufio.NewReader(outR)}
+
+		res := c.call("initialize", map[string]interface{}{}).(map[string]interface{})
+		cv.So(res["capabilities"].(map[string]interface{})["positionEncoding"], cv.ShouldEqual, "utf-16")
+
+		// the emoji is one rune, but two UTF-16 code units.
+		const uri = "file:///tmp/wide.zy"
+		c.send("textDocument/didOpen", map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": uri, "languageId": "zygo", "version": 1,
+				"text": "(def e \"😀\") (def total 1)\n(+ total 1)\n(def f \"😀\") )\n"},
+		}, false)
+		diags := c.read()["params"].(map[string]interface{})["diagnostics"].([]interface{})
+		cv.So(len(diags), cv.ShouldEqual, 1)
+		start := diags[0].(map[string]interface{})["range"].(map[string]interface{})["start"]
+		cv.So(start, cv.ShouldResemble, map[string]interface{}{"line": 2.0, "character": 13.0})
+
+		loc := c.call("textDocument/definition", at(uri, 1, 4)).(map[string]interface{})
+		rng := loc["range"].(map[string]interface{})
+		cv.So(rng["start"], cv.ShouldResemble, map[string]interface{}{"line": 0.0, "character": 18.0})
+		cv.So(rng["end"], cv.ShouldResemble, map[string]interface{}{"line": 0.0, "character": 23.0})
+
+		// and a position after the emoji finds the name there.
+		hover := c.call("textDocument/hover", at(uri, 0, 22)).(map[string]interface{})
+		cv.So(hover["contents"].(map[string]interface{})["value"], cv.ShouldContainSubstring, "(def total 1)")
+
+		cv.So(c.call("shutdown", nil), cv.ShouldBeNil)
+		c.send("exit", nil, false)
+		cv.So(<-done, cv.ShouldBeNil)
+	})
+}
@@ -0,0 +1,467 @@
+package zygo
+
+import (
+	"fmt"
+)
+
+// Pattern matching
+// ================
+//
+// (match x pattern body pattern body ...) tries each
+// pattern against x in turn, and evaluates the body of the
+// first that matches, with the pattern's variables bound
+// around it. A pattern may be followed by `if guard`, when
+// the clause also needs guard, evaluated with those
+// variables, to be true. If nothing matches, match raises
+// an error naming x.
+//
+//	_               matches anything.
+//	n               matches anything, binding n.
+//	1 "s" 'c' true  match an equal value; nil and () match nil.
+//	%sym  k:        match that symbol.
+//	[a b & rest]    matches an array of two or more, binding
+//	                rest to an array of the others; without
+//	                & the length must be equal.
+//	(head & tail)   the same for lists; tail is a list.
+//	{key: pat ...}  matches a hash having each key, with a
+//	                value matching pat; {} matches any hash.
+//	(Car Id: id)    matches a record, made by a defmap or
+//	                struct type, whose TypeName is Car, as
+//	                {} does. Name one field at least.
+//
+// Patterns nest. A name may be bound only once in a pattern.
+//
+// In infix, the clauses go in a block, each body in braces:
+//
+//	{kind = match x {
+//	   [a b & rest] if a > b { "down" }
+//	   _ { "other" }
+//	}}
+
+type matchClause struct {
+	pat   Sexp
+	guard Sexp
+	body  Sexp
+}
+
+func matchClauses(args []Sexp) ([]matchClause, error) {
+	var clauses []matchClause
+	for i := 0; i < len(args); {
+		cl := matchClause{pat: args[i]}
+		i++
+		if i < len(args) && isSymbolNamed(args[i], "if") {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("match: missing guard after pattern %s", cl.pat.SexpString(nil))
+			}
+			cl.guard = args[i+1]
+			i += 2
+		}
+		if i >= len(args) {
+			return nil, fmt.Errorf("match: pattern %s has no body", cl.pat.SexpString(nil))
+		}
+		cl.body = args[i]
+		i++
+		clauses = append(clauses, cl)
+	}
+	return clauses, nil
+}
+
+// GenerateMatch compiles each clause to code that, in a
+// scope of its own, asks __match to match and bind the
+// value, left on the stack by the code before it; tries
+// the guard; and then drops the value and runs the body.
+// Like cond, the clauses are generated from the bottom up,
+// the last falling through to __nomatch.
+func (gen *Generator) GenerateMatch(args []Sexp) error {
+	if len(args) < 1 {
+		return fmt.Errorf("match: missing the value to match")
+	}
+	clauses, err := matchClauses(args[1:])
+	if err != nil {
+		return err
+	}
+
+	matchSym := gen.env.MakeSymbol("__match")
+	subgen := gen.NewSubGenerator()
+	subgen.AddInstruction(CallInstr{sym: gen.env.MakeSymbol("__nomatch"), nargs: 1})
+	instructions := subgen.instructions
+	positions := subgen.positions
+
+	for i := len(clauses) - 1; i >= 0; i-- {
+		cl := clauses[i]
+		vars, err := matchVars(cl.pat, make(map[int]bool), nil)
+		if err != nil {
+			return err
+		}
+
+		subgen = gen.NewSubGenerator()
+		subgen.scopes = gen.scopes + 1
+		subgen.funcname = gen.funcname
+		subgen.pushFrame(false)
+		frame := subgen.lex
+		for _, v := range vars {
+			subgen.bind(v)
+		}
+		var guardCode []Instruction
+		var guardPos []SrcPos
+		if cl.guard != nil {
+			err = subgen.Generate(cl.guard)
+			if err != nil {
+				return err
+			}
+			guardCode, guardPos = subgen.instructions, subgen.positions
+			subgen.instructions, subgen.positions = nil, nil
+		}
+		subgen.Tail = gen.Tail
+		err = subgen.Generate(cl.body)
+		if err != nil {
+			return err
+		}
+		bodyCode, bodyPos := subgen.instructions, subgen.positions
+
+		// from the last branch, past the pop, the body, the
+		// scope removal and the jump to the end, is the
+		// removal that starts the next clause.
+		toNext := len(bodyCode) + 4
+
+		subgen = gen.NewSubGenerator()
+		subgen.AddInstruction(AddScopeInstr{Name: "match", frame: frame})
+		subgen.AddInstruction(DupInstr(0))
+		subgen.AddInstruction(PushInstr{cl.pat})
+		subgen.AddInstruction(CallInstr{sym: matchSym, nargs: 2})
+		if cl.guard != nil {
+			subgen.AddInstruction(BranchInstr{false, len(guardCode) + 1 + toNext})
+			subgen.addCode(guardCode, guardPos)
+		}
+		subgen.AddInstruction(BranchInstr{false, toNext})
+		subgen.AddInstruction(PopInstr(0))
+		subgen.addCode(bodyCode, bodyPos)
+		subgen.AddInstruction(RemoveScopeInstr{})
+		subgen.AddInstruction(JumpInstr{addpc: len(instructions) + 2})
+		subgen.AddInstruction(RemoveScopeInstr{})
+		subgen.addCode(instructions, positions)
+
+		instructions = subgen.instructions
+		positions = subgen.positions
+	}
+
+	err = gen.Generate(args[0])
+	if err != nil {
+		return err
+	}
+	gen.addCode(instructions, positions)
+	return nil
+}
+
+// matchVars checks pat, and appends the variables it binds
+// to vars.
+func matchVars(pat Sexp, seen map[int]bool, vars []*SexpSymbol) ([]*SexpSymbol, error) {
+	var elems []Sexp
+	switch p := pat.(type) {
+	case *SexpSymbol:
+		switch {
+		case p.name == "_" || p.name == "nil" || p.colonTail:
+			return vars, nil
+		case p.name == "&":
+			return nil, fmt.Errorf("match: & outside an array or list pattern")
+		case p.isDot:
+			return nil, fmt.Errorf("match: cannot bind the dot symbol %s", p.name)
+		case seen[p.number]:
+			return nil, fmt.Errorf("match: %s is bound twice in one pattern", p.name)
+		}
+		seen[p.number] = true
+		return append(vars, p), nil
+	case *SexpArray:
+		elems = p.Val
+	case *SexpPair:
+		if isSymbolNamed(p.Head, "quote") {
+			if q, ok := p.Tail.(*SexpPair); !ok || q.Tail != SexpNull {
+				return nil, fmt.Errorf("match: bad quoted pattern %s", p.SexpString(nil))
+			}
+			return vars, nil
+		}
+		_, _, pats, isRecord, err := recordPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		if isRecord {
+			for _, q := range pats {
+				vars, err = matchVars(q, seen, vars)
+				if err != nil {
+					return nil, err
+				}
+			}
+			return vars, nil
+		}
+		elems, err = ListToArray(p)
+		if err != nil {
+			return nil, fmt.Errorf("match: bad list pattern %s", p.SexpString(nil))
+		}
+	default:
+		return vars, nil
+	}
+
+	fixed, rest, err := splitRestPattern(elems)
+	if err != nil {
+		return nil, err
+	}
+	if rest != nil {
+		fixed = append(fixed[:len(fixed):len(fixed)], rest)
+	}
+	for _, q := range fixed {
+		vars, err = matchVars(q, seen, vars)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return vars, nil
+}
+
+// splitRestPattern splits the elements of an array or list
+// pattern at its &, if any.
+func splitRestPattern(elems []Sexp) (fixed []Sexp, rest Sexp, err error) {
+	for i, e := range elems {
+		if isSymbolNamed(e, "&") {
+			if i != len(elems)-2 {
+				return nil, nil, fmt.Errorf("match: & must be followed by a single pattern, for the rest")
+			}
+			return elems[:i], elems[i+1], nil
+		}
+	}
+	return elems, nil, nil
+}
+
+// recordPattern reports whether p is a hash pattern,
+// (hash key: pat ...) as {key: pat ...} parses, or a record
+// pattern (TypeName key: pat ...). typeName is "" for a
+// hash pattern.
+func recordPattern(p *SexpPair) (typeName string, keys, pats []Sexp, ok bool, err error) {
+	head, isSym := p.Head.(*SexpSymbol)
+	if !isSym || head.colonTail || head.isDot {
+		return "", nil, nil, false, nil
+	}
+	rest, err := ListToArray(p.Tail)
+	if err != nil {
+		return "", nil, nil, false, nil
+	}
+	if head.name != "hash" {
+		if len(rest) < 2 {
+			return "", nil, nil, false, nil
+		}
+		if key, isSym := rest[0].(*SexpSymbol); !isSym || !key.colonTail {
+			return "", nil, nil, false, nil
+		}
+		typeName = head.name
+	}
+	for i := 0; i < len(rest); {
+		key := rest[i]
+		i++
+		// {"key": pat} has the colon as a symbol of its own.
+		if i < len(rest) && isSymbolNamed(rest[i], ":") {
+			i++
+		}
+		if i >= len(rest) {
+			return "", nil, nil, true, fmt.Errorf("match: no pattern for key %s in %s", key.SexpString(nil), p.SexpString(nil))
+		}
+		keys = append(keys, key)
+		pats = append(pats, rest[i])
+		i++
+	}
+	return typeName, keys, pats, true, nil
+}
+
+// match matches val against pat, binding its variables in
+// the current scope.
+func (env *Zlisp) match(pat, val Sexp) (bool, error) {
+	var elems []Sexp
+	switch p := pat.(type) {
+	case *SexpSymbol:
+		switch {
+		case p.name == "_":
+			return true, nil
+		case p.name == "nil":
+			return val == SexpNull, nil
+		case p.colonTail:
+			return env.matchLiteral(p, val), nil
+		}
+		return true, env.LexicalBindSymbol(p, val)
+	case *SexpArray:
+		arr, ok := val.(*SexpArray)
+		if !ok {
+			return false, nil
+		}
+		fixed, rest, err := splitRestPattern(p.Val)
+		if err != nil {
+			return false, err
+		}
+		if len(arr.Val) < len(fixed) || (rest == nil && len(arr.Val) != len(fixed)) {
+			return false, nil
+		}
+		for i, q := range fixed {
+			ok, err := env.match(q, arr.Val[i])
+			if !ok || err != nil {
+				return false, err
+			}
+		}
+		if rest != nil {
+			tail := append([]Sexp(nil), arr.Val[len(fixed):]...)
+			return env.match(rest, &SexpArray{Val: tail, Env: env})
+		}
+		return true, nil
+	case *SexpPair:
+		if isSymbolNamed(p.Head, "quote") {
+			return env.matchLiteral(p.Tail.(*SexpPair).Head, val), nil
+		}
+		typeName, keys, pats, isRecord, err := recordPattern(p)
+		if err != nil {
+			return false, err
+		}
+		if isRecord {
+			return env.matchRecord(typeName, keys, pats, val)
+		}
+		elems, err = ListToArray(p)
+		if err != nil {
+			return false, err
+		}
+	case *SexpHash:
+		if p.NumKeys == 0 {
+			_, ok := val.(*SexpHash)
+			return ok, nil
+		}
+		return env.matchLiteral(p, val), nil
+	default:
+		return env.matchLiteral(p, val), nil
+	}
+
+	fixed, rest, err := splitRestPattern(elems)
+	if err != nil {
+		return false, err
+	}
+	for _, q := range fixed {
+		cell, ok := val.(*SexpPair)
+		if !ok {
+			return false, nil
+		}
+		ok, err := env.match(q, cell.Head)
+		if !ok || err != nil {
+			return false, err
+		}
+		val = cell.Tail
+	}
+	if rest != nil {
+		return env.match(rest, val)
+	}
+	return val == SexpNull, nil
+}
+
+func (env *Zlisp) matchRecord(typeName string, keys, pats []Sexp, val Sexp) (bool, error) {
+	h, ok := val.(*SexpHash)
+	if !ok || (typeName != "" && h.TypeName != typeName) {
+		return false, nil
+	}
+	for i, key := range keys {
+		v, err := h.HashGetDefault(env, key, SexpEnd)
+		if err != nil || v == SexpEnd {
+			return false, nil
+		}
+		ok, err := env.match(pats[i], v)
+		if !ok || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (env *Zlisp) matchLiteral(lit, val Sexp) bool {
+	res, err := env.Compare(lit, val)
+	return err == nil && res == 0
+}
+
+// MatchFunction implements __match, which match's code
+// calls with the value and a pattern.
+func MatchFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	val, err := env.RValue(args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	ok, err := env.match(args[1], val)
+	if err != nil {
+		return SexpNull, err
+	}
+	return &SexpBool{Val: ok}, nil
+}
+
+// NoMatchFunction implements __nomatch, which match's code
+// calls when no clause matched.
+func NoMatchFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	// raised, as (error) would, without naming __nomatch.
+	return SexpNull, raised(fmt.Errorf("match: no clause matches %s", args[0].SexpString(nil)))
+}
+
+// matchOpMunchRight parses the infix `match x { clauses }`
+// into (match x clauses...): each clause is a pattern, an
+// optional `if` and infix guard, and a body block.
+func matchOpMunchRight(env *Zlisp, pr *Pratt) (Sexp, error) {
+	subject, err := pr.Expression(env, 5)
+	if err != nil {
+		return SexpNull, err
+	}
+	if pr.IsEOF() || !isForBodyBlock(pr.NextToken) {
+		return SexpNull, fmt.Errorf("match: missing the {} block of clauses")
+	}
+	block := pr.NextToken
+	_ = pr.Advance()
+
+	args := []Sexp{env.MakeSymbol("match"), subject}
+	if isEmptyHashBlock(block) {
+		return MakeList(args), nil
+	}
+	arr, empty, err := InfixArgsToArray("infixExpand", []Sexp{block})
+	if err != nil {
+		return SexpNull, err
+	}
+	if empty {
+		return MakeList(args), nil
+	}
+	toks := arr.Val
+	for i := 0; i < len(toks); {
+		if _, isSemi := toks[i].(*SexpSemicolon); isSemi {
+			i++
+			continue
+		}
+		pat := toks[i]
+		args = append(args, pat)
+		i++
+		if i < len(toks) && isSymbolNamed(toks[i], "if") {
+			j := i + 1
+			for j < len(toks) && !isForBodyBlock(toks[j]) {
+				j++
+			}
+			if j == i+1 {
+				return SexpNull, fmt.Errorf("match: missing guard after pattern %s", pat.SexpString(nil))
+			}
+			guard, err := parsePrattOne(env, toks[i+1:j], "match guard")
+			if err != nil {
+				return SexpNull, err
+			}
+			args = append(args, toks[i], guard)
+			i = j
+		}
+		if i >= len(toks) || !isForBodyBlock(toks[i]) {
+			return SexpNull, fmt.Errorf("match: pattern %s needs a {} body", pat.SexpString(nil))
+		}
+		body := toks[i]
+		if isEmptyHashBlock(body) {
+			body = SexpNull
+		}
+		args = append(args, body)
+		i++
+	}
+	return MakeList(args), nil
+}
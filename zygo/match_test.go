@@ -0,0 +1,123 @@
+package zygo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const matchTestScript = `
+(struct Car [(field Id: int64) (field Name: string)])
+(defmap point)
+(defn classify [x]
+  (match x
+    0 "zero"
+    n if (and (int? n) (< n 0)) "negative"
+    [] "no elements"
+    [a b & rest] (concat "array leaving " (str (len rest)))
+    %stop "stop"
+    ("add" & xs) (concat "add " (str (len xs)))
+    {op: "mul" args: [a [b c]]} (* a b c)
+    (Car Name: name) (concat "car " name)
+    (point x: px y: 0) (+ px 0)
+    {} "a hash"
+    _ "other"))
+(def results [
+  (classify 0) (classify -4) (classify []) (classify [1 2 3 4])
+  (classify %stop) (classify (list "add" 1 2))
+  (classify (hash op:"mul" args:[2 [3 4]])) (classify (Car Id:1 Name:"zoom"))
+  (classify (point x:5 y:0)) (classify (point x:5 y:1)) (classify 9)])
+`
+
+func Test260MatchSpecialForm(t *testing.T) {
+
+	cv.Convey(`Given match over literals, arrays, lists, hashes and records, the first clause to match, guard and all, should pick the result`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		res, err := env.EvalString(matchTestScript + `results`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["zero" "negative" "no elements" "array leaving 2" "stop" "add 2" 24 "car zoom" 5 "a hash" "other"]`)
+
+		// the bindings are scoped to the clause, and closures keep them.
+		res, err = env.EvalString(`
+(def adders (map (fn [x] (match x [k] (fn [y] (+ y k)))) [[1] [10]]))
+[((aget adders 0) 5) ((aget adders 1) 5) (defined? "k")]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[6 15 false]`)
+
+		// and a body in tail position loops.
+		res, err = env.EvalString(`
+(defn total [xs acc] (match xs () acc (h & t) (total t (+ acc h))))
+(total (list 1 2 3 4) 0)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `10`)
+	})
+
+	cv.Convey(`Given infix syntax, match x {pattern {body} ...} should do the same`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		res, err := env.EvalString(`
+(defn order [v]
+  {match v {
+     [a b] if a > b { "down" }
+     [a b] { a + b }
+     {name: n} { n }
+     _ {}
+  }})
+[(order [2 1]) (order [1 2]) (order {name: "x"}) (order 3)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["down" 3 "x" nil]`)
+	})
+
+	cv.Convey(`Given no clause that matches, match should raise an error naming the value; and bad patterns should not compile`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`(match [1 2] [a] a (Car Id: id) id)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "match: no clause matches [1 2]")
+
+		res, err := env.EvalString(`(try (match 5 1 "one") (catch e (errorMessage e)))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"match: no clause matches 5"`)
+
+		for src, msg := range map[string]string{
+			`(match 1 [a a] a)`:      "a is bound twice",
+			`(match 1 [a & b c] a)`:  "& must be followed by a single pattern",
+			`(match 1 a if (> a 0))`: "has no body",
+			`(match 1 {k: v z:} v)`:  "no pattern for key z",
+			`(match 1 x.y 2)`:        "cannot bind the dot symbol",
+			`{match 1 { _ if {2} }}`: "missing guard",
+			`{match 1 { _ "body" }}`: "needs a {} body",
+		} {
+			_, err = env.EvalString(src)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, msg)
+		}
+	})
+
+	cv.Convey(`Given compiled code using match, it should run as the source does`, t, func() {
+
+		comp := NewZlisp()
+		defer comp.Close()
+		comp.StandardSetup()
+		var buf bytes.Buffer
+		err := comp.Compile(&buf, strings.NewReader(matchTestScript+`results`), "match.zy")
+		cv.So(err, cv.ShouldBeNil)
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		cv.So(env.LoadCompiled(&buf), cv.ShouldBeNil)
+		res, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["zero" "negative" "no elements" "array leaving 2" "stop" "add 2" 24 "car zoom" 5 "a hash" "other"]`)
+	})
+}
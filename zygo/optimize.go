@@ -0,0 +1,565 @@
+package zygo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The optimizer
+// =============
+//
+// With SetOptimize(true), or zygo -O, the code generated
+// for each function, and for each batch of top-level
+// expressions, is rewritten before it runs:
+//
+//   - a call of a pure builtin, like (+ 1 2) or
+//     (concat "a" "b"), on constants becomes a push of its
+//     result, or, as an argument of another, that result;
+//   - a jump to a jump, or to labels before one, goes
+//     straight to where that one goes, and a jump to the
+//     next instruction is dropped;
+//   - a scope that nothing can bind in, like that of
+//     (newScope (+ a 1)), is neither pushed nor popped;
+//   - instructions no path reaches, like the return after
+//     a tail call, are dropped.
+//
+// Source positions, loops, and (break) and (continue)
+// follow the instructions they belong to.
+//
+// (_disasm f) lists f's code as generated, and as the
+// optimizer leaves it.
+
+// pureBuiltins may be called while generating code: given
+// constants, they return the same constant every time, and
+// do nothing else.
+var pureBuiltins = map[string]bool{
+	"<": true, ">": true, "<=": true, ">=": true, "==": true, "!=": true,
+	"+": true, "-": true, "*": true, "/": true, "**": true, "mod": true,
+	"sll": true, "sra": true, "srl": true,
+	"bitAnd": true, "bitOr": true, "bitXor": true, "bitNot": true,
+	"isnan": true, "isNaN": true, "not": true,
+	"concat": true, "len": true, "chomp": true, "trim": true,
+}
+
+// SetOptimize turns the optimizer on or off for code
+// generated from now on.
+func (env *Zlisp) SetOptimize(on bool) {
+	env.optimize = on
+}
+
+// Optimizing reports whether the optimizer is on.
+func (env *Zlisp) Optimizing() bool {
+	return env.optimize
+}
+
+// optimize rewrites the code generated so far, when the
+// optimizer is on, and returns it as it was.
+func (gen *Generator) optimize() (generated ZlispFunction) {
+	if !gen.env.optimize {
+		return nil
+	}
+	generated = gen.instructions
+	gen.instructions, gen.positions = optimizeCode(gen.env, gen.instructions, gen.positions)
+	return generated
+}
+
+// noteBound records that a builtin's name has been bound as a
+// variable somewhere, so calls by that name are not folded.
+func (env *Zlisp) noteBound(sym *SexpSymbol) {
+	if _, isBuiltin := env.builtins[sym.number]; isBuiltin {
+		env.rebound[sym.number] = true
+	}
+}
+
+type optimizer struct {
+	env  *Zlisp
+	code []Instruction
+	pos  []SrcPos
+}
+
+// optimizeCode returns an optimized copy of code, and of
+// its positions; code itself is left as it was.
+func optimizeCode(env *Zlisp, code []Instruction, pos []SrcPos) ([]Instruction, []SrcPos) {
+	o := &optimizer{
+		env:  env,
+		code: append([]Instruction(nil), code...),
+		pos:  append([]SrcPos(nil), pos...),
+	}
+	if len(o.pos) < len(o.code) {
+		o.pos = append(o.pos, make([]SrcPos, len(o.code)-len(o.pos))...)
+	}
+	o.pos = o.pos[:len(o.code)]
+
+	o.fold()
+	for {
+		n := len(o.code)
+		o.threadJumps()
+		o.dropEmptyScopes()
+		o.dropUnreachable()
+		if len(o.code) == n {
+			break
+		}
+	}
+	return o.code, o.pos
+}
+
+// fold replaces calls of pure builtins on constants with
+// their results, and such calls made as arguments to other
+// pure builtins with theirs.
+func (o *optimizer) fold() {
+	for i, in := range o.code {
+		c, ok := in.(CallExprInstr)
+		if !ok || c.site.depth(0) >= 0 {
+			continue
+		}
+		if val, ok := o.env.foldCall(c.callee, c.args); ok {
+			o.code[i] = PushInstr{val}
+			continue
+		}
+		if _, ok := o.env.pureBuiltin(c.callee); !ok {
+			continue
+		}
+		var args []Sexp
+		for j, a := range c.args {
+			if _, isCall := a.(*SexpPair); !isCall {
+				continue
+			}
+			if val, ok := o.env.foldConst(a); ok {
+				if args == nil {
+					args = append([]Sexp(nil), c.args...)
+				}
+				args[j] = val
+			}
+		}
+		if args != nil {
+			c.args = args
+			o.code[i] = c
+		}
+	}
+}
+
+// foldConst gives the value of x, if it is a constant or a
+// call that foldCall can make.
+func (env *Zlisp) foldConst(x Sexp) (Sexp, bool) {
+	switch e := x.(type) {
+	case *SexpInt, *SexpFloat, *SexpBool, *SexpChar, *SexpStr:
+		return x, true
+	case *SexpPair:
+		if !IsList(e) {
+			return nil, false
+		}
+		args, err := ListToArray(e.Tail)
+		if err != nil {
+			return nil, false
+		}
+		return env.foldCall(e.Head, args)
+	}
+	return nil, false
+}
+
+// foldCall calls callee now, if it names a pure builtin that
+// nothing has rebound, and args are all constants.
+func (env *Zlisp) foldCall(callee Sexp, args []Sexp) (Sexp, bool) {
+	f, ok := env.pureBuiltin(callee)
+	if !ok {
+		return nil, false
+	}
+	vals := make([]Sexp, len(args))
+	for i, a := range args {
+		v, ok := env.foldConst(a)
+		if !ok {
+			return nil, false
+		}
+		vals[i] = v
+	}
+	return env.callPure(f, vals)
+}
+
+// callPure makes the call for foldCall. An error, or a panic,
+// is left to happen when the code runs.
+func (env *Zlisp) callPure(f *SexpFunction, args []Sexp) (res Sexp, ok bool) {
+	defer func() {
+		if recover() != nil {
+			res, ok = nil, false
+		}
+	}()
+	res, err := f.userfun(env, f.name, args)
+	if err != nil {
+		return nil, false
+	}
+	switch res.(type) {
+	case *SexpInt, *SexpFloat, *SexpBool, *SexpChar, *SexpStr:
+		return res, true
+	}
+	return nil, false
+}
+
+func (env *Zlisp) pureBuiltin(callee Sexp) (*SexpFunction, bool) {
+	sym, ok := callee.(*SexpSymbol)
+	if !ok || !pureBuiltins[sym.name] || env.rebound[sym.number] {
+		return nil, false
+	}
+	if _, isBuiltin := env.builtins[sym.number]; !isBuiltin {
+		return nil, false
+	}
+	x, _ := env.globalScope().get(sym.number)
+	f, ok := x.(*SexpFunction)
+	if !ok || !f.user {
+		return nil, false
+	}
+	return f, true
+}
+
+// jumpTarget gives where in goes, if it is a jump.
+func jumpTarget(in Instruction, pc int) (int, bool) {
+	switch x := in.(type) {
+	case JumpInstr:
+		return pc + x.addpc, true
+	case BranchInstr:
+		return pc + x.location, true
+	case GotoInstr:
+		return x.location, true
+	}
+	return 0, false
+}
+
+// retarget returns jump in, moved to pc, going to target.
+func retarget(in Instruction, pc, target int) Instruction {
+	switch x := in.(type) {
+	case JumpInstr:
+		x.addpc = target - pc
+		return x
+	case BranchInstr:
+		x.location = target - pc
+		return x
+	case GotoInstr:
+		x.location = target
+		return x
+	}
+	return in
+}
+
+// loopStarts finds the LoopStartInstr of each loop in the code.
+func (o *optimizer) loopStarts() map[*Loop]int {
+	loops := make(map[*Loop]int)
+	for i, in := range o.code {
+		if ls, ok := in.(LoopStartInstr); ok {
+			loops[ls.loop] = i
+		}
+	}
+	return loops
+}
+
+// targets marks each pc that something jumps to.
+func (o *optimizer) targets() []bool {
+	n := len(o.code)
+	t := make([]bool, n+1)
+	mark := func(pc int) {
+		if pc >= 0 && pc <= n {
+			t[pc] = true
+		}
+	}
+	for i, in := range o.code {
+		if pc, ok := jumpTarget(in, i); ok {
+			mark(pc)
+		}
+		if ls, ok := in.(LoopStartInstr); ok {
+			mark(i + ls.loop.breakOffset)
+			mark(i + ls.loop.continueOffset)
+		}
+	}
+	return t
+}
+
+func (o *optimizer) skipLabels(pc int) int {
+	for pc < len(o.code) {
+		if _, ok := o.code[pc].(LabelInstr); !ok {
+			break
+		}
+		pc++
+	}
+	return pc
+}
+
+// follow gives where a jump to pc ends up, after any labels
+// and unconditional jumps there.
+func (o *optimizer) follow(pc int) int {
+	final := pc
+	for steps := 0; steps <= len(o.code); steps++ {
+		if final < 0 {
+			return pc
+		}
+		at := o.skipLabels(final)
+		if at >= len(o.code) {
+			return final
+		}
+		switch o.code[at].(type) {
+		case JumpInstr, GotoInstr:
+			final, _ = jumpTarget(o.code[at], at)
+		default:
+			return final
+		}
+	}
+	return pc // jumps in a cycle
+}
+
+func (o *optimizer) threadJumps() {
+	n := len(o.code)
+	drop := make([]bool, n)
+	dropped := false
+	for i, in := range o.code {
+		pc, ok := jumpTarget(in, i)
+		if !ok || pc < 0 || pc > n {
+			continue
+		}
+		final := o.follow(pc)
+		if final != pc {
+			o.code[i] = retarget(in, i, final)
+		}
+		if _, isBranch := in.(BranchInstr); !isBranch && o.skipLabels(final) == o.skipLabels(i+1) {
+			drop[i] = true
+			dropped = true
+		}
+	}
+	if dropped {
+		o.compact(drop)
+	}
+}
+
+func (o *optimizer) dropEmptyScopes() {
+	targets := o.targets()
+	drop := make([]bool, len(o.code))
+	dropped := false
+	for i := 0; i < len(o.code); i++ {
+		if _, ok := o.code[i].(AddScopeInstr); !ok {
+			continue
+		}
+		end, body, ok := o.emptyScope(i, targets)
+		if !ok {
+			continue
+		}
+		copy(o.code[i+1:end], body)
+		drop[i], drop[end] = true, true
+		dropped = true
+		i = end
+	}
+	if dropped {
+		o.compact(drop)
+	}
+}
+
+// emptyScope finds the RemoveScopeInstr that closes the scope
+// added at start, if the code between can neither bind in
+// that scope nor jump out of it, and nothing jumps into it.
+// It returns that code as it should read without the scope.
+func (o *optimizer) emptyScope(start int, targets []bool) (end int, body []Instruction, ok bool) {
+	for pc := start + 1; pc < len(o.code); pc++ {
+		if targets[pc] {
+			return 0, nil, false
+		}
+		switch x := o.code[pc].(type) {
+		case RemoveScopeInstr:
+			return pc, body, true
+		case PushInstr, PopInstr, DupInstr, LabelInstr, EnvToStackInstr:
+			body = append(body, x)
+		case LoadLocalInstr:
+			if x.depth == 0 {
+				return 0, nil, false
+			}
+			x.depth--
+			body = append(body, x)
+		case StoreLocalInstr:
+			if x.depth == 0 {
+				return 0, nil, false
+			}
+			x.depth--
+			body = append(body, x)
+		case CallExprInstr:
+			c, ok := o.outsideScope(x)
+			if !ok {
+				return 0, nil, false
+			}
+			body = append(body, c)
+		default:
+			return 0, nil, false
+		}
+	}
+	return 0, nil, false
+}
+
+// outsideScope returns call c as it should read with one
+// scope fewer around it, if it calls a pure builtin on
+// constants and variables, which cannot bind anything.
+func (o *optimizer) outsideScope(c CallExprInstr) (CallExprInstr, bool) {
+	if _, ok := o.env.pureBuiltin(c.callee); !ok || c.site.depth(0) >= 0 {
+		return c, false
+	}
+	for _, a := range c.args {
+		switch a.(type) {
+		case *SexpSymbol, *SexpInt, *SexpFloat, *SexpBool, *SexpChar, *SexpStr:
+		default:
+			return c, false
+		}
+	}
+	if c.site == nil {
+		return c, true
+	}
+	site := &callSite{lex: c.site.lex, depths: append([]int(nil), c.site.depths...), refs: c.site.refs}
+	for i, d := range site.depths {
+		switch {
+		case d == 0:
+			return c, false
+		case d > 0:
+			site.depths[i] = d - 1
+		}
+	}
+	c.site = site
+	return c, true
+}
+
+func (o *optimizer) dropUnreachable() {
+	n := len(o.code)
+	loops := o.loopStarts()
+	reached := make([]bool, n)
+	work := []int{0}
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		if pc < 0 || pc >= n || reached[pc] {
+			continue
+		}
+		reached[pc] = true
+		work = append(work, o.successors(pc, loops)...)
+	}
+	drop := make([]bool, n)
+	dropped := false
+	for pc := range reached {
+		if !reached[pc] {
+			drop[pc] = true
+			dropped = true
+		}
+	}
+	if dropped {
+		o.compact(drop)
+	}
+}
+
+// successors gives the pcs that may run after pc.
+func (o *optimizer) successors(pc int, loops map[*Loop]int) []int {
+	switch x := o.code[pc].(type) {
+	case JumpInstr, GotoInstr:
+		to, _ := jumpTarget(x, pc)
+		return []int{to}
+	case BranchInstr:
+		return []int{pc + 1, pc + x.location}
+	case ReturnInstr:
+		return nil
+	case *BreakInstr:
+		if start, ok := loops[x.loop]; ok {
+			return []int{start + x.loop.breakOffset}
+		}
+		return nil
+	case *ContinueInstr:
+		if start, ok := loops[x.loop]; ok {
+			return []int{start + x.loop.continueOffset}
+		}
+		return nil
+	}
+	return []int{pc + 1}
+}
+
+// compact removes the instructions marked in drop, and moves
+// jumps and loops to match. A jump to a dropped instruction
+// goes to the next one kept.
+func (o *optimizer) compact(drop []bool) {
+	n := len(o.code)
+	newpc := make([]int, n+1)
+	k := 0
+	for pc := 0; pc < n; pc++ {
+		newpc[pc] = k
+		if !drop[pc] {
+			k++
+		}
+	}
+	newpc[n] = k
+	moved := func(pc int) int {
+		if pc < 0 || pc > n {
+			return pc
+		}
+		return newpc[pc]
+	}
+
+	// loops are shared with the code this was copied from,
+	// so each one moved is replaced, not updated.
+	loops := make(map[*Loop]*Loop)
+	for pc, in := range o.code {
+		ls, ok := in.(LoopStartInstr)
+		if !ok || drop[pc] {
+			continue
+		}
+		l := *ls.loop
+		l.breakOffset = moved(pc+l.breakOffset) - newpc[pc]
+		l.continueOffset = moved(pc+l.continueOffset) - newpc[pc]
+		l.loopStart = newpc[pc] - moved(pc-ls.loop.loopStart)
+		loops[ls.loop] = &l
+	}
+
+	code := make([]Instruction, 0, k)
+	pos := make([]SrcPos, 0, k)
+	for pc, in := range o.code {
+		if drop[pc] {
+			continue
+		}
+		if to, ok := jumpTarget(in, pc); ok && to >= 0 && to <= n {
+			in = retarget(in, newpc[pc], newpc[to])
+		}
+		switch x := in.(type) {
+		case LoopStartInstr:
+			if l := loops[x.loop]; l != nil {
+				in = LoopStartInstr{loop: l}
+			}
+		case *BreakInstr:
+			if l := loops[x.loop]; l != nil {
+				in = &BreakInstr{loop: l, scopesToPop: x.scopesToPop}
+			}
+		case *ContinueInstr:
+			if l := loops[x.loop]; l != nil {
+				in = &ContinueInstr{loop: l, scopesToPop: x.scopesToPop}
+			}
+		}
+		code = append(code, in)
+		pos = append(pos, o.pos[pc])
+	}
+	o.code, o.pos = code, pos
+}
+
+// (_disasm f) returns a listing of f's code as generated,
+// and as optimized.
+func DisasmFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	f, ok := args[0].(*SexpFunction)
+	if !ok || f.user {
+		return SexpNull, fmt.Errorf("%s needs a function defined in a script, not %s",
+			name, args[0].SexpString(nil))
+	}
+	generated := f.generated
+	if generated == nil {
+		generated = f.fun
+	}
+	optimized, _ := optimizeCode(env, generated, nil)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s as generated:\n", f.name)
+	listCode(&b, generated)
+	fmt.Fprintf(&b, "%s optimized:\n", f.name)
+	listCode(&b, optimized)
+	return &SexpStr{S: b.String()}, nil
+}
+
+func listCode(b *strings.Builder, code []Instruction) {
+	for pc, in := range code {
+		fmt.Fprintf(b, "  %3d: %s\n", pc, in.InstrString())
+	}
+}
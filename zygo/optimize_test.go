@@ -0,0 +1,129 @@
+package zygo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+// each gives the same answer with the optimizer on or off.
+var optimizerTestScripts = []string{
+	// folding, down through arguments, and errors left to run time.
+	`(defn f [a] (+ a (* 2 3) (- 10 (len "abcd"))))
+	 [(f 1) (+ 1 2) (concat "a" "b") (not true) {2 * 3 + 1}
+	  (try (/ 1 0) (catch e "divide")) (try (+ 1 "a") (catch e "mixed"))]`,
+	// a builtin's name bound as a parameter is not folded.
+	`(defn mul [+] (+ 2 3))
+	 (mul (fn [a b] (* a b)))`,
+	// empty scopes, dropped around loops, break and continue.
+	`(def acc [])
+	 (for [(def i 0) (< i 6) (set i (+ i 1))]
+	   (newScope (+ 1 2))
+	   (cond (== i 1) (continue) (== i 4) (break) (newScope (set acc (append acc i)))))
+	 acc`,
+	// nested conds, and a tail call, in an empty scope.
+	`(defn g [a b] (newScope (cond (> a 10) (cond b "big" "BIG") (< a 0) (cond b "neg" "NEG") (g (+ a 5) b))))
+	 [(g 1 true) (g 1 false) (g -1 true) (g 12 false)]`,
+	// a scope that does bind is kept.
+	`(defn h [x] (newScope (def y (* 2 x)) (+ y 1)))
+	 (h 20)`,
+}
+
+func Test170OptimizerGivesTheSameAnswers(t *testing.T) {
+
+	cv.Convey(`Given scripts with constant calls, jumps, empty scopes, loops and tail calls, optimized code should agree with code as generated, compiled or not`, t, func() {
+
+		run := func(optimize bool, script string) string {
+			env := NewZlisp()
+			defer env.Close()
+			env.StandardSetup()
+			env.SetOptimize(optimize)
+			res, err := env.EvalString(script)
+			if err != nil {
+				return "error: " + err.Error()
+			}
+			return res.SexpString(nil)
+		}
+		for _, script := range append(optimizerTestScripts, lexicalTestScripts...) {
+			want := run(false, script)
+			cv.So(want, cv.ShouldNotStartWith, "error")
+			cv.So(run(true, script), cv.ShouldEqual, want)
+		}
+
+		script := strings.Join(optimizerTestScripts[2:4], "\n")
+		comp := NewZlisp()
+		defer comp.Close()
+		comp.StandardSetup()
+		comp.SetOptimize(true)
+		var buf bytes.Buffer
+		cv.So(comp.Compile(&buf, strings.NewReader(script), "opt.zy"), cv.ShouldBeNil)
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		cv.So(env.LoadCompiled(&buf), cv.ShouldBeNil)
+		res, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, run(false, script))
+	})
+
+	cv.Convey(`Given the optimizer on, constants should be folded, empty scopes and code after a tail call dropped, no jump should land on another, and (_disasm) should show both`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetOptimize(true)
+		_, err := env.EvalString(`
+(defn f [a] (newScope (+ a (* 2 3))))
+(defn g [a] (cond (> a 0) (cond (> a 9) "big" "small") (g (+ a 1))))
+(defn h [a] (h (+ a 1)))`)
+		panicOn(err)
+
+		code := func(name string) []string {
+			f, _ := env.FindObject(name)
+			var s []string
+			for _, in := range f.(*SexpFunction).fun {
+				s = append(s, in.InstrString())
+			}
+			return s
+		}
+		cv.So(code("f"), cv.ShouldResemble, []string{
+			"add func scope runtime f",
+			"popStackPutEnv a",
+			"callExpr + 2",
+			"rem runtime scope",
+			"ret",
+		})
+		f, _ := env.FindObject("f")
+		args := f.(*SexpFunction).fun[2].(CallExprInstr).args
+		cv.So(args[1].SexpString(nil), cv.ShouldEqual, "6")
+
+		cv.So(code("h"), cv.ShouldResemble, []string{
+			"add func scope runtime h",
+			"popStackPutEnv a",
+			"callExpr + 2",
+			"pre-call h 1",
+			"goto 1",
+		})
+
+		g, _ := env.FindObject("g")
+		gcode := g.(*SexpFunction).fun
+		for pc, in := range gcode {
+			if to, ok := jumpTarget(in, pc); ok && to < len(gcode) {
+				_, isJump := gcode[to].(JumpInstr)
+				cv.So(isJump, cv.ShouldBeFalse)
+			}
+		}
+
+		res, err := env.EvalString(`(_disasm f)`)
+		cv.So(err, cv.ShouldBeNil)
+		listing := res.(*SexpStr).S
+		cv.So(listing, cv.ShouldStartWith, "f as generated:\n")
+		cv.So(listing, cv.ShouldContainSubstring, "add scope newScope")
+		cv.So(listing, cv.ShouldContainSubstring, "f optimized:\n    0: add func scope runtime f\n")
+
+		_, err = env.EvalString(`(_disasm +)`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "_disasm needs a function defined in a script")
+	})
+}
@@ -0,0 +1,482 @@
+package zygo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Optional and keyword parameters
+// ===============================
+//
+// defn and fn take, after the required parameters, optional
+// ones, each a name: followed by its default, then & rest,
+// then &opts and a name:
+//
+//	(defn connect [host port: 80 url: (concat host ":" (str port)) & more &opts o] ...)
+//
+// A call gives the required arguments, and as many of the
+// optional ones as it likes, by position, then any of them
+// by name:
+//
+//	(connect "example.com" 8080)
+//	(connect "example.com" url: "example.com:8443" tls: true)
+//
+// A default is evaluated at call time, when its parameter is
+// not given, and sees the parameters before it. Arguments
+// by name that match no parameter go into the hash &opts
+// names, here o, as {tls: true}; without &opts they are an
+// error. Extra arguments by position go to & rest, as ever.
+//
+// Any function can be called with its arguments by name,
+// (area h: 2 w: 5) say. They start at the first name: that
+// names a parameter, or, for a function taking &opts, or
+// declared with func, at the first name: of all; so a
+// function with only & rest still gets its name: arguments
+// in the rest. When name: symbols passed to a function with
+// neither optional parameters nor &opts, as in
+// (lookup h key:), do not read as a call by name, they are
+// taken by position, as data. Calling with too few or too
+// many arguments is an error that shows the parameters.
+//
+// func declares a default with = after the type, and takes
+// &opts too:
+//
+//	(func connect [host:string port:int64 = 80 &opts o] [c:string] ...)
+
+// paramSpec describes the parameters of a function taking
+// optional ones, or &opts. Its argSyms are the required
+// parameters, then the optional ones, then rest and opts,
+// if it takes them.
+type paramSpec struct {
+	nreq int
+	rest bool
+	opts bool
+}
+
+// unsupplied stands, among the arguments of a call, for an
+// optional parameter not given, until the function replaces
+// it with the default.
+var unsupplied = &SexpSentinel{Val: 3}
+
+// parseFormals takes apart the parameters of defn, fn or
+// defmac: required names, or patterns, then name: default
+// pairs, then & rest, then &opts o. For a function with
+// neither optional parameters nor &opts, spec is nil and
+// params are formals, as buildSexpFun always took them.
+func parseFormals(env *Zlisp, formals []Sexp) (params []Sexp, spec *paramSpec, defaults []Sexp, err error) {
+	spec = &paramSpec{}
+	i := 0
+	for ; i < len(formals) && !isSymbolNamed(formals[i], "&"); i++ {
+		if sym, ok := formals[i].(*SexpSymbol); ok && sym.colonTail {
+			if i+1 >= len(formals) || isSymbolNamed(formals[i+1], "&") {
+				return nil, nil, nil, fmt.Errorf("optional parameter %s: has no default", sym.name)
+			}
+			params = append(params, env.MakeSymbol(sym.name))
+			defaults = append(defaults, formals[i+1])
+			i++
+			continue
+		}
+		if len(defaults) > 0 {
+			return nil, nil, nil, fmt.Errorf("required parameter %s follows optional ones", formals[i].SexpString(nil))
+		}
+		params = append(params, formals[i])
+		spec.nreq++
+	}
+	rest, opts, err := restAndOpts(formals[i:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(defaults) == 0 && opts == nil {
+		return formals, nil, nil, nil
+	}
+	if rest != nil {
+		params = append(params, rest)
+		spec.rest = true
+	}
+	if opts != nil {
+		params = append(params, opts)
+		spec.opts = true
+	}
+	return params, spec, defaults, nil
+}
+
+// restAndOpts takes apart what follows the named
+// parameters: & rest, &opts o, both, or neither.
+func restAndOpts(tail []Sexp) (rest Sexp, opts *SexpSymbol, err error) {
+	isOpts := func(t []Sexp) bool {
+		return len(t) == 3 && isSymbolNamed(t[0], "&") && isSymbolNamed(t[1], "opts")
+	}
+	if len(tail) >= 2 && !isOpts(tail) {
+		if !isSymbolNamed(tail[0], "&") {
+			return nil, nil, fmt.Errorf("malformed parameters: %s", tail[0].SexpString(nil))
+		}
+		rest, tail = tail[1], tail[2:]
+	}
+	if isOpts(tail) {
+		sym, ok := tail[2].(*SexpSymbol)
+		if !ok || sym.colonTail {
+			return nil, nil, fmt.Errorf("&opts needs a name, not %s", tail[2].SexpString(nil))
+		}
+		return rest, sym, nil
+	}
+	if len(tail) > 0 {
+		return nil, nil, fmt.Errorf("malformed parameters: & rest, then &opts and a name, must come last")
+	}
+	return rest, nil, nil
+}
+
+// funcInputs takes the defaults, each = and an expression
+// after its name:type, and &opts o out of the inputs of a
+// func, leaving the name:type pairs for GetFuncArgArray.
+func funcInputs(inputs *SexpArray) (pairs *SexpArray, spec *paramSpec, defaults []Sexp, opts *SexpSymbol, err error) {
+	ar := inputs.Val
+	var kept []Sexp
+	spec = &paramSpec{}
+	i := 0
+	for i < len(ar) && !isSymbolNamed(ar[i], "&") {
+		if i+1 >= len(ar) {
+			kept = append(kept, ar[i])
+			break
+		}
+		kept = append(kept, ar[i], ar[i+1])
+		i += 2
+		if i < len(ar) && isSymbolNamed(ar[i], "=") {
+			if i+1 >= len(ar) {
+				return nil, nil, nil, nil, fmt.Errorf("parameter %s has = but no default", ar[i-2].SexpString(nil))
+			}
+			defaults = append(defaults, ar[i+1])
+			i += 2
+			continue
+		}
+		if len(defaults) > 0 {
+			return nil, nil, nil, nil, fmt.Errorf("required parameter %s follows optional ones", ar[i-2].SexpString(nil))
+		}
+		spec.nreq++
+	}
+	if i < len(ar) {
+		rest, o, err := restAndOpts(ar[i:])
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if rest != nil {
+			return nil, nil, nil, nil, fmt.Errorf("func takes &opts, but not & rest")
+		}
+		opts = o
+	}
+	pairs = &SexpArray{Val: kept, Env: inputs.Env, IsFuncDeclTypeArray: true}
+	if len(defaults) == 0 && opts == nil {
+		return pairs, nil, nil, nil, nil
+	}
+	spec.opts = opts != nil
+	return pairs, spec, defaults, opts, nil
+}
+
+// generateDefaults gives each of syms, the optional
+// parameters, the value of its default, if the call left
+// it unsupplied.
+func (gen *Generator) generateDefaults(syms []*SexpSymbol, defaults []Sexp) error {
+	check := gen.env.MakeSymbol("__unsupplied")
+	for k, dflt := range defaults {
+		// func's parameters come as name:, which would
+		// evaluate to itself.
+		sym := gen.env.MakeSymbol(syms[k].name)
+		subgen := gen.NewSubGenerator()
+		subgen.scopes = gen.scopes
+		subgen.funcname = gen.funcname
+		err := subgen.Generate(dflt)
+		if err != nil {
+			return err
+		}
+		gen.AddInstruction(EnvToStackInstr{sym})
+		gen.AddInstruction(CallInstr{sym: check, nargs: 1})
+		gen.AddInstruction(BranchInstr{false, len(subgen.instructions) + 2})
+		gen.addCode(subgen.instructions, subgen.positions)
+		gen.AddInstruction(PopStackPutEnvInstr{sym})
+	}
+	return nil
+}
+
+// UnsuppliedFunction implements __unsupplied, with which
+// the code for a default checks its parameter.
+func UnsuppliedFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	return &SexpBool{Val: args[0] == unsupplied}, nil
+}
+
+// callArgs readies the nargs arguments on top of the data
+// stack for a call to f, leaving one for each of its
+// argSyms, and their number in nargs.
+func (env *Zlisp) callArgs(f *SexpFunction, nargs *int) error {
+	// do name and type checking
+	if f.inputTypes != nil && !f.varargs {
+		return env.FunctionCallNameTypeCheck(f, nargs)
+	}
+	err := env.prepareLazyCallArgs(f, nargs)
+	if err != nil {
+		return err
+	}
+	if f.params != nil || env.keywordArgs(f, *nargs) {
+		args, err := env.datastack.PopExpressions(*nargs)
+		if err != nil {
+			return err
+		}
+		arranged, err := f.arrangeArgs(env, args)
+		switch {
+		case err == nil:
+			*nargs = len(arranged)
+			return env.datastack.PushExpressions(arranged)
+		case f.params != nil || !f.positionalFits(len(args)):
+			return err
+		}
+		// a plain function given name: symbols as data, as
+		// in (lookup h key:), takes them by position, as ever.
+		err = env.datastack.PushExpressions(args)
+		if err != nil {
+			return err
+		}
+	}
+	if f.varargs {
+		if *nargs < f.nargs {
+			return f.arityError(*nargs)
+		}
+		return env.wrangleOptargs(f.nargs, *nargs)
+	}
+	if *nargs != f.nargs {
+		return f.arityError(*nargs)
+	}
+	return nil
+}
+
+// positionalFits reports whether nargs arguments, all by
+// position, suit f.
+func (f *SexpFunction) positionalFits(nargs int) bool {
+	if f.varargs {
+		return nargs >= f.nargs
+	}
+	return nargs == f.nargs
+}
+
+// keywordArgs reports whether any of the nargs arguments on
+// top of the data stack names a parameter of f.
+func (env *Zlisp) keywordArgs(f *SexpFunction, nargs int) bool {
+	for i := 0; i < nargs; i++ {
+		x, err := env.datastack.GetExpr(i)
+		if err != nil {
+			return false
+		}
+		if sym, ok := namedArgSymbol(x); ok && f.paramIndex(sym.name) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nparams is the number of f's parameters that can be
+// given by name: all but rest and opts.
+func (f *SexpFunction) nparams() int {
+	n := len(f.argSyms)
+	switch {
+	case f.params != nil:
+		if f.params.rest {
+			n--
+		}
+		if f.params.opts {
+			n--
+		}
+	case f.varargs:
+		n--
+	}
+	return n
+}
+
+// paramIndex finds the parameter of f called name, or -1.
+func (f *SexpFunction) paramIndex(name string) int {
+	for i, sym := range f.argSyms[:f.nparams()] {
+		pname := sym.name
+		if isLazyFormalSymbol(sym) {
+			pname = pname[1:]
+		}
+		if pname == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// keywordStart finds where, in args for a call to f, the
+// arguments by name begin.
+func (f *SexpFunction) keywordStart(args []Sexp) int {
+	anyName := f.inputTypes != nil || (f.params != nil && f.params.opts)
+	for i, a := range args {
+		if sym, ok := namedArgSymbol(a); ok && (anyName || f.paramIndex(sym.name) >= 0) {
+			return i
+		}
+	}
+	return len(args)
+}
+
+// arrangeArgs puts args, for a call to f, given by position
+// and then by name, in the order of f's parameters, adding
+// the rest list and opts hash if f takes them, and
+// unsupplied for the optional parameters not given.
+func (f *SexpFunction) arrangeArgs(env *Zlisp, args []Sexp) ([]Sexp, error) {
+	n := f.nparams()
+	nreq, rest, opts := n, f.varargs, false
+	if f.params != nil {
+		nreq, rest, opts = f.params.nreq, f.params.rest, f.params.opts
+	}
+	k := f.keywordStart(args)
+	if (k > n && !rest) || (k == len(args) && k < nreq) {
+		return nil, f.arityError(k)
+	}
+	out := make([]Sexp, n, len(f.argSyms))
+	var more []Sexp
+	if k > n {
+		copy(out, args[:n])
+		more = args[n:k]
+	} else {
+		copy(out, args[:k])
+	}
+	var hash *SexpHash
+	if opts {
+		var err error
+		hash, err = MakeHash(nil, "hash", env)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := k; i < len(args); i += 2 {
+		sym, ok := namedArgSymbol(args[i])
+		if !ok {
+			return nil, fmt.Errorf("%s: argument %s, by position, follows arguments by name",
+				f.name, args[i].SexpString(nil))
+		}
+		if i+1 == len(args) {
+			return nil, fmt.Errorf("named parameter '%s' not followed by value", sym.name)
+		}
+		val := args[i+1]
+		j := f.paramIndex(sym.name)
+		switch {
+		case j >= 0:
+			if out[j] != nil {
+				return nil, fmt.Errorf("duplicate named parameter '%s'", sym.name)
+			}
+			out[j] = val
+		case opts:
+			if had, _ := hash.HashGetDefault(env, sym, SexpEnd); had != SexpEnd {
+				return nil, fmt.Errorf("duplicate named parameter '%s'", sym.name)
+			}
+			err := hash.HashSet(sym, val)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%s takes no argument '%s'", f.name, sym.name)
+		}
+	}
+	for j := range out {
+		if out[j] != nil {
+			continue
+		}
+		if j < nreq {
+			return nil, fmt.Errorf("%s is missing argument '%s'; %s takes %s",
+				f.name, f.paramName(j), f.name, f.paramString())
+		}
+		out[j] = unsupplied
+	}
+	if rest {
+		if len(more) == 0 {
+			out = append(out, SexpNull)
+		} else {
+			out = append(out, MakeList(more))
+		}
+	}
+	if opts {
+		out = append(out, hash)
+	}
+	return out, nil
+}
+
+// lazyArg reports whether the i-th of args, in a call to f,
+// goes unevaluated: whether given by position or by name,
+// when its parameter is lazy.
+func (f *SexpFunction) lazyArg(args []Sexp, i int) bool {
+	if f == nil || !f.hasLazyFormals {
+		return false
+	}
+	k := f.keywordStart(args)
+	if i < k {
+		return f.IsLazyCallArg(i)
+	}
+	if (i-k)%2 == 0 {
+		return false
+	}
+	sym, ok := namedArgSymbol(args[i-1])
+	return ok && f.IsLazyFormal(f.paramIndex(sym.name))
+}
+
+func (f *SexpFunction) paramName(i int) string {
+	name := f.argSyms[i].name
+	if isLazyFormalSymbol(f.argSyms[i]) {
+		name = name[1:]
+	}
+	return name
+}
+
+// arityError says a call to f had the wrong number of
+// arguments, and what f takes.
+func (f *SexpFunction) arityError(got int) error {
+	n := f.nparams()
+	nreq, rest := n, f.varargs
+	if f.params != nil {
+		nreq, rest = f.params.nreq, f.params.rest
+	}
+	want := fmt.Sprint(nreq)
+	switch {
+	case rest:
+		want = "at least " + want
+	case nreq < n:
+		want = fmt.Sprintf("%d to %d", nreq, n)
+	}
+	return fmt.Errorf("%s expected %s arguments, got %d; %s takes %s",
+		f.name, want, got, f.name, f.paramString())
+}
+
+// paramString shows the parameters of f as declared.
+func (f *SexpFunction) paramString() string {
+	if f.sig != "" {
+		return f.sig
+	}
+	names := make([]string, len(f.argSyms))
+	for i, sym := range f.argSyms {
+		names[i] = sym.name
+	}
+	if f.varargs && len(names) > 0 {
+		names = append(names[:len(names)-1], "&", names[len(names)-1])
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+// formalsString shows the parameters of a function as they
+// were declared, putting back the colons the parser took
+// off; typed, for func, keeps each name: next to its type.
+func formalsString(formals []Sexp, typed bool) string {
+	var b strings.Builder
+	b.WriteString("[")
+	colon := false
+	for i, x := range formals {
+		if i > 0 && !(typed && colon) {
+			b.WriteString(" ")
+		}
+		b.WriteString(x.SexpString(nil))
+		sym, ok := x.(*SexpSymbol)
+		colon = ok && sym.colonTail
+		if colon {
+			b.WriteString(":")
+		}
+	}
+	b.WriteString("]")
+	return b.String()
+}
@@ -0,0 +1,126 @@
+package zygo
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const paramsTestScript = `
+(defn connect [host port: 80 url: (concat host ":" (str port)) & more &opts o] [url more o])
+(func dial [host:string port:int64 = 80 &opts o] [s:string] (concat host ":" (str port) "/" (str (len o))))
+(defn sum [n acc: 0] (cond (== n 0) acc (sum (- n 1) acc: (+ acc n))))
+(def results [
+  (connect "a") (connect "a" 8080) (connect "a" 1 "u" 2 3)
+  (connect port: 9 host: "b") (connect "a" tls: true)
+  (dial "h") (dial "h" 2) (dial port: 1 host: "h" tls: true)
+  (sum 1000)])
+`
+
+const paramsTestResults = `[["a:80" nil {}] ["a:8080" nil {}] ["u" (2 3) {}] ["b:9" nil {}] ["a:80" nil {tls:true}] "h:80/0" "h:2/0" "h:1/1" 500500]`
+
+func Test280OptionalDefaultAndKeywordParameters(t *testing.T) {
+
+	cv.Convey(`Given defn and func with optional parameters, defaults and &opts, calls by position and then by name should fill them in, defaults at call time`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		res, err := env.EvalString(paramsTestScript + `results`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, paramsTestResults)
+
+		// a default sees the parameters before it, and runs
+		// only when its parameter is not given.
+		res, err = env.EvalString(`
+(def calls 0)
+(def f (fn [a b: (begin (set calls (+ calls 1)) (* a 2))] (+ a b)))
+[(f 1) (f 1 1) (f b: 7 a: 1) calls]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[3 2 8 1]`)
+
+		// lazy formals stay lazy when given by name.
+		res, err = env.EvalString(`
+(defn lz [a #b: (+ 1 2)] [a (substitute #b)])
+[(lz 1) (lz 1 (+ 2 3)) (lz b: (+ 4 5) a: 1)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[[1 3] [1 (+ 2 3)] [1 (+ 4 5)]]`)
+
+		// a plain function still takes name: symbols, hash keys
+		// say, as data by position, when they do not read as names.
+		res, err = env.EvalString(`
+(defn lookup [h key] (hget h key))
+(def hk {key:1 h:2})
+[(lookup hk key:) (lookup hk h:)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[1 2]`)
+	})
+
+	cv.Convey(`Given bad calls, the errors should say what the function takes`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(paramsTestScript)
+		cv.So(err, cv.ShouldBeNil)
+
+		for src, msg := range map[string]string{
+			`(sum)`:                      "sum expected 1 to 2 arguments, got 0; sum takes [n acc: 0]",
+			`(sum 1 2 3)`:                "sum expected 1 to 2 arguments, got 3; sum takes [n acc: 0]",
+			`(sum acc: 1)`:               "sum is missing argument 'n'; sum takes [n acc: 0]",
+			`(sum 1 z: 2)`:               "sum expected 1 to 2 arguments, got 3",
+			`(sum 1 acc: 2 acc: 3)`:      "duplicate named parameter 'acc'",
+			`(sum n: 1 2)`:               "sum: argument 2, by position, follows arguments by name",
+			`(dial 1)`:                   "type mismatch for parameter 'host'",
+			`(dial)`:                     "dial expected 1 to 2 arguments, got 0; dial takes [host:string port:int64 = 80 & opts o]",
+			`(defn bad [a: 1 b] a)`:      "required parameter b follows optional ones",
+			`(defn bad [a:] a)`:          "optional parameter a: has no default",
+			`(defn bad [& r s] r)`:       "& rest, then &opts and a name, must come last",
+			`(func bad [a:int64 = ] [])`: "parameter a has = but no default",
+		} {
+			_, err = env.EvalString(src)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, msg)
+		}
+	})
+
+	cv.Convey(`Given Go calling with Named arguments, they should go after those by position, as in a script`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(paramsTestScript)
+		cv.So(err, cv.ShouldBeNil)
+
+		s, err := CallAs[string](env, "dial", "h", Named{"tls", true})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(s, cv.ShouldEqual, "h:80/1")
+		n, err := CallAs[int](env, "sum", 4, Named{"acc", 100})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(n, cv.ShouldEqual, 110)
+	})
+
+	cv.Convey(`Given compiled code with optional parameters, it should run, and fail, as the source does`, t, func() {
+
+		comp := NewZlisp()
+		defer comp.Close()
+		comp.StandardSetup()
+		var buf bytes.Buffer
+		err := comp.Compile(&buf, strings.NewReader(paramsTestScript+`results`), "params.zy")
+		cv.So(err, cv.ShouldBeNil)
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		cv.So(env.LoadCompiled(&buf), cv.ShouldBeNil)
+		res, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, paramsTestResults)
+
+		_, err = env.EvalString(`(sum acc: 1)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "sum is missing argument 'n'; sum takes [n acc: 0]")
+	})
+}
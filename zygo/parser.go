@@ -27,6 +27,10 @@ type Parser struct {
 
 	inBacktick bool
 	recur      int64
+
+	// filename labels the positions of parsed expressions;
+	// empty for strings and the repl.
+	filename string
 }
 
 type ParserReply struct {
@@ -54,6 +58,35 @@ func (e *MoreInputError) Error() string {
 
 var ErrMoreInputNeeded = &MoreInputError{}
 
+// SetFilename sets the file name recorded in the
+// positions of expressions parsed from now on.
+func (p *Parser) SetFilename(name string) {
+	p.filename = name
+}
+
+// Filename returns the name set by SetFilename.
+func (p *Parser) Filename() string {
+	return p.filename
+}
+
+// tokPos converts a token's line and column to a SrcPos.
+func (p *Parser) tokPos(tok Token) SrcPos {
+	if tok.line == 0 {
+		return SrcPos{}
+	}
+	return SrcPos{File: p.filename, Line: tok.line, Col: tok.col}
+}
+
+// CurrentPos returns the position the lexer has reached,
+// for reporting syntax errors.
+func (p *Parser) CurrentPos() SrcPos {
+	line, col := p.lexer.Pos()
+	if line == 0 {
+		return SrcPos{File: p.filename}
+	}
+	return SrcPos{File: p.filename, Line: line, Col: col}
+}
+
 func (p *Parser) Start() {
 	// no-op, here for backwards compatability.
 }
@@ -239,6 +272,21 @@ func (parser *Parser) ParseExpression(depth int) (res Sexp, err error) {
 	parser.recur++
 	defer func() { parser.recur-- }()
 
+	tok, err := parser.lexer.GetNextToken()
+	if err != nil {
+		return SexpEnd, err
+	}
+	res, err = parser.parseExpressionFrom(depth, tok)
+	if err == nil && res != nil {
+		inheritPos(res, parser.tokPos(tok))
+	}
+	return res, err
+}
+
+// parseExpressionFrom does the work of ParseExpression
+// once the first token, tok, has been consumed.
+func (parser *Parser) parseExpressionFrom(depth int, tok Token) (res Sexp, err error) {
+
 	// defer func() {
 	// 	if res != nil {
 	// 		//Q("returning from ParseExpression at depth=%v with res='%s'\n", depth, res.SexpString(nil))
@@ -250,12 +298,6 @@ func (parser *Parser) ParseExpression(depth int) (res Sexp, err error) {
 	lexer := parser.lexer
 	env := parser.env
 
-	//getAnother:
-	tok, err := lexer.GetNextToken()
-	if err != nil {
-		return SexpEnd, err
-	}
-
 	switch tok.typ {
 	case TokenLParen:
 		exp, err := parser.ParseList(depth+1, TokenRParen)
@@ -309,7 +351,7 @@ func (parser *Parser) ParseExpression(depth int) (res Sexp, err error) {
 				break
 			}
 			//vv("saw TokenLCurly followed by TokenSymbolColon, tok2 = '%v', typ='%v'", tok2.String(), tok2.typ)
-			lexer.tokens = append([]Token{Token{typ: TokenSymbol, str: "hash"}}, lexer.tokens...)
+			lexer.tokens = append([]Token{Token{typ: TokenSymbol, str: "hash", line: tok.line, col: tok.col}}, lexer.tokens...)
 			exp, err := parser.ParseList(depth+1, TokenRCurly)
 			if err != nil {
 				return SexpNull, err
@@ -326,7 +368,7 @@ func (parser *Parser) ParseExpression(depth int) (res Sexp, err error) {
 			second := lexer.tokens[extra]
 			if second.typ == TokenColonOperator {
 				//vv(`we see { "%v" : `, tok2.str)
-				lexer.tokens = append([]Token{Token{typ: TokenSymbol, str: "hash"}}, lexer.tokens...)
+				lexer.tokens = append([]Token{Token{typ: TokenSymbol, str: "hash", line: tok.line, col: tok.col}}, lexer.tokens...)
 				exp, err := parser.ParseList(depth+1, TokenRCurly)
 				if err != nil {
 					return SexpNull, err
@@ -344,7 +386,7 @@ func (parser *Parser) ParseExpression(depth int) (res Sexp, err error) {
 
 			// if second is the keyname and third is ':', then create anonymous hash, like JSON.
 			if second.typ == TokenBacktickString && third.typ == TokenColonOperator {
-				lexer.tokens = append([]Token{Token{typ: TokenSymbol, str: "hash"}}, lexer.tokens...)
+				lexer.tokens = append([]Token{Token{typ: TokenSymbol, str: "hash", line: tok.line, col: tok.col}}, lexer.tokens...)
 				exp, err := parser.ParseList(depth+1, TokenRCurly)
 				if err != nil {
 					return SexpNull, err
@@ -720,7 +762,7 @@ func (parser *Parser) ParseInfix(depth int) (Sexp, error) {
 	list.Head = parser.env.MakeSymbol("infix")
 	list.Tail = SexpNull
 	if len(arr) > 0 {
-		list.Tail = Cons(&SexpArray{Val: arr, Infix: true, Env: parser.env}, SexpNull)
+		list.Tail = Cons(&SexpArray{Val: arr, Infix: true, Env: parser.env, Pos: PosOf(arr[0])}, SexpNull)
 	}
 	return &list, nil
 	//return &SexpArray{Val: arr, Infix: true, Env: env}, nil
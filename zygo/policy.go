@@ -0,0 +1,236 @@
+package zygo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Policies
+// ========
+//
+// A Policy says what scripts in an environment may do
+// besides compute: which files they may read and write,
+// and which of the capabilities below they have. Each
+// builtin that needs one asks the environment's policy
+// itself, so it does not matter how the builtin came to
+// be bound, whether by the function map, by StandardSetup,
+// or through a macro like req; an operation denied fails
+// with a *PolicyError.
+//
+// An environment with no policy, as NewZlisp makes, may do
+// anything. NewZlispSandbox sets SandboxPolicy, which
+// allows only the clock and random numbers, as sandboxed
+// scripts always had, on top of leaving the system and
+// reflection functions out. A policy file, as given to
+// zygo -policy, is the JSON form of a Policy:
+//
+//	{
+//	  "allow": ["time", "random"],
+//	  "read":  {"allow": ["/srv/scripts"], "deny": ["/srv/scripts/private"]},
+//	  "write": {"allow": ["/tmp/out"]}
+//	}
+//
+// Path rules see a path as the environment's file system
+// does (see filesystem.go): with OSFS, as an absolute
+// path, with relative prefixes taken from the current
+// directory; with any other file system, as a cleaned
+// slash-separated path, where "." is the whole of it. They
+// go by the path's name only, so to keep scripts from
+// following symbolic links out of a directory, use JailFS.
+// Files in file systems added with AddImportFS are the
+// host's to give, and are not checked.
+
+// Capability names something a policy may allow.
+type Capability string
+
+const (
+	// CapExec runs commands, with system and sys, and exits
+	// the process, with exit.
+	CapExec Capability = "exec"
+
+	// CapEnv reads and sets environment variables.
+	CapEnv Capability = "env"
+
+	// CapReflect calls Go methods with _method, lists them
+	// with methodls, and registers the demo structs.
+	CapReflect Capability = "reflect"
+
+	// CapGoValues makes Go values from scripts' with togo,
+	// as bsave does, and back with fromgo.
+	CapGoValues Capability = "togo"
+
+	// CapTime reads the clock, with now, millis and timeit.
+	CapTime Capability = "time"
+
+	// CapRandom draws random numbers.
+	CapRandom Capability = "random"
+
+	// CapRead and CapWrite are not allowed by name, but by
+	// a Policy's Read and Write rules; they name what was
+	// denied in a PolicyError.
+	CapRead  Capability = "read"
+	CapWrite Capability = "write"
+)
+
+var policyCapabilities = []Capability{CapExec, CapEnv, CapReflect, CapGoValues, CapTime, CapRandom}
+
+// Policy is what an environment's scripts may do.
+type Policy struct {
+	// Allow lists the capabilities granted; others are denied.
+	Allow []Capability `json:"allow"`
+
+	// Read and Write say which files may be read, and written.
+	Read  PathRule `json:"read"`
+	Write PathRule `json:"write"`
+}
+
+// PathRule allows a path if it is under some prefix in
+// Allow, unless it is under a longer, or as long, prefix
+// in Deny. A prefix covers itself and what is below it.
+type PathRule struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// PolicyError is the error of an operation a policy denies.
+type PolicyError struct {
+	Capability Capability
+	What       string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("policy error: %s denied: %s", e.Capability, e.What)
+}
+
+// SandboxPolicy allows the clock and random numbers, and
+// nothing else.
+func SandboxPolicy() *Policy {
+	return &Policy{Allow: []Capability{CapTime, CapRandom}}
+}
+
+// LoadPolicy reads a policy file.
+func LoadPolicy(file string) (*Policy, error) {
+	by, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Policy)
+	if err := json.Unmarshal(by, p); err != nil {
+		return nil, fmt.Errorf("policy file '%s': %v", file, err)
+	}
+	for _, c := range p.Allow {
+		if !knownCapability(c) {
+			return nil, fmt.Errorf("policy file '%s': unknown capability '%s'", file, c)
+		}
+	}
+	return p, nil
+}
+
+func knownCapability(c Capability) bool {
+	for _, k := range policyCapabilities {
+		if c == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether p grants c. A nil policy grants all.
+func (p *Policy) Allows(c Capability) bool {
+	if p == nil {
+		return true
+	}
+	for _, a := range p.Allow {
+		if a == c {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPolicy has env, and environments spawned or duplicated
+// from it afterwards, follow p; nil lifts any policy.
+func (env *Zlisp) SetPolicy(p *Policy) {
+	env.policy = p
+}
+
+// Policy returns the policy set by SetPolicy, or nil.
+func (env *Zlisp) Policy() *Policy {
+	return env.policy
+}
+
+// allow is nil if the environment's policy grants c, and
+// if not, a PolicyError saying that what was denied.
+func (env *Zlisp) allow(c Capability, what string) error {
+	if env.policy.Allows(c) {
+		return nil
+	}
+	return &PolicyError{Capability: c, What: what}
+}
+
+// allowPath checks name, as fsys will see it, against the
+// Read or Write rule, as c says.
+func (env *Zlisp) allowPath(c Capability, name, fsName string) error {
+	p := env.policy
+	if p == nil {
+		return nil
+	}
+	rule := p.Read
+	if c == CapWrite {
+		rule = p.Write
+	}
+	isOS := false
+	if _, ok := env.FS().(OSFS); ok {
+		isOS = true
+	}
+	if rule.permits(fsName, isOS) {
+		return nil
+	}
+	return &PolicyError{Capability: c, What: fmt.Sprintf("'%s'", name)}
+}
+
+func (r PathRule) permits(name string, isOS bool) bool {
+	norm := func(s string) string {
+		if isOS {
+			if abs, err := filepath.Abs(s); err == nil {
+				return abs
+			}
+			return filepath.Clean(s)
+		}
+		return path.Clean(filepath.ToSlash(s))
+	}
+	longest := func(prefixes []string) int {
+		best := -1
+		for _, pre := range prefixes {
+			pre = norm(pre)
+			if underPrefix(name, pre, isOS) && len(pre) > best {
+				best = len(pre)
+			}
+		}
+		return best
+	}
+	name = norm(name)
+	allow := longest(r.Allow)
+	return allow >= 0 && allow > longest(r.Deny)
+}
+
+// underPrefix reports whether name is prefix or below it.
+func underPrefix(name, prefix string, isOS bool) bool {
+	sep := "/"
+	if isOS {
+		sep = string(filepath.Separator)
+	} else if prefix == "." {
+		return true
+	}
+	if name == prefix {
+		return true
+	}
+	if !strings.HasSuffix(prefix, sep) {
+		prefix += sep
+	}
+	return strings.HasPrefix(name, prefix)
+}
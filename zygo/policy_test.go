@@ -0,0 +1,163 @@
+package zygo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test200PolicyDeniesAtEachBuiltin(t *testing.T) {
+
+	cv.Convey(`Given a policy allowing only the clock, every other capability should fail with a policy error, however the builtin is reached`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetPolicy(&Policy{Allow: []Capability{CapTime}})
+
+		_, err := env.EvalString(`(now) (millis)`)
+		cv.So(err, cv.ShouldBeNil)
+
+		for _, script := range []string{
+			`(system "echo hi")`,
+			`(sys echo hi)`,
+			`(def s system) (s "echo hi")`,
+			`(exit 3)`,
+			`(getenv "HOME")`,
+			`(setenv "ZYGO_POLICY_TEST" "x")`,
+			`(_method 1 2)`,
+			`(methodls 1)`,
+			`(registerDemoFunctions)`,
+			`(togo (hash))`,
+			`(fromgo 1)`,
+			`(random)`,
+		} {
+			_, err := env.EvalString(script)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "policy error: ")
+		}
+		_, isSet := os.LookupEnv("ZYGO_POLICY_TEST")
+		cv.So(isSet, cv.ShouldBeFalse)
+
+		// and so should a duplicate.
+		_, err = env.Duplicate().EvalString(`(random)`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "policy error: random denied: random")
+
+		var pe *PolicyError
+		_, err = RandomFunction(env, "random", nil)
+		cv.So(errors.As(err, &pe), cv.ShouldBeTrue)
+		cv.So(pe.Capability, cv.ShouldEqual, CapRandom)
+	})
+
+	cv.Convey(`Given the sandbox, what StandardSetup adds back should be denied too, but the clock and random numbers should still work`, t, func() {
+
+		env := NewZlispSandbox()
+		defer env.Close()
+		env.StandardSetup()
+		for _, script := range []string{`(sys echo hi)`} {
+			_, err := env.EvalString(script)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "policy error: ")
+		}
+		res, err := env.EvalString(`(+ 1 2)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "3")
+		res, err = env.EvalString(`[(type? (now)) (< (random) 1.0) (> (millis) 0)]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["time.Time" true true]`)
+	})
+
+	cv.Convey(`Given path rules, scripts should read and write only under allowed prefixes, and not under longer denied ones`, t, func() {
+
+		fsys := memFS{fstest.MapFS{
+			"lib/a.zy":         {Data: []byte(`(def fromA 1)`)},
+			"lib/private/k.zy": {Data: []byte(`(def key "secret")`)},
+			"lib/private/ok":   {Data: []byte("fine\n")},
+			"lib/m.zy":         {Data: []byte(`(package "m" (def V 5))`)},
+			"data/x.txt":       {Data: []byte("x\n")},
+			"out/old.txt":      {Data: []byte("old\n")},
+		}}
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetFS(fsys)
+		env.SetPolicy(&Policy{
+			Read:  PathRule{Allow: []string{"lib", "lib/private/ok"}, Deny: []string{"lib/private"}},
+			Write: PathRule{Allow: []string{"out"}},
+		})
+
+		res, err := env.EvalString(`(source "lib/a.zy") (import "./lib/m") (owritef "y" "out/y.txt") [fromA (+ m.V 0) (slurpf "lib/private/ok")]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[1 5 ["fine"]]`)
+		cv.So(string(fsys.MapFS["out/y.txt"].Data), cv.ShouldEqual, "y\n")
+
+		// writef sees what it would overwrite, without reading it.
+		_, err = env.EvalString(`(writef "z" "out/old.txt")`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "refusing to write to existing file")
+
+		for _, c := range []struct{ script, denied string }{
+			{`(source "lib/private/k.zy")`, "read denied: 'lib/private/k.zy'"},
+			{`(source "lib/x/../private/k.zy")`, "read denied: 'lib/x/../private/k.zy'"},
+			{`(include "lib/private/k.zy")`, "read denied"},
+			{`(slurpf "data/x.txt")`, "read denied: 'data/x.txt'"},
+			{`(slurpf "out/y.txt")`, "read denied"},
+			{`(owritef "z" "lib/a.zy")`, "write denied: 'lib/a.zy'"},
+			{`(owritef "z" "outside.txt")`, "write denied"},
+		} {
+			_, err := env.EvalString(c.script)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "policy error: "+c.denied)
+		}
+		cv.So(string(fsys.MapFS["lib/a.zy"].Data), cv.ShouldEqual, `(def fromA 1)`)
+	})
+
+	cv.Convey(`Given path rules on the operating system's file system, prefixes should be taken as absolute paths`, t, func() {
+
+		dir := t.TempDir()
+		panicOn(os.MkdirAll(filepath.Join(dir, "ok"), 0755))
+		panicOn(os.WriteFile(filepath.Join(dir, "ok", "a.txt"), []byte("a\n"), 0644))
+		panicOn(os.WriteFile(filepath.Join(dir, "no.txt"), []byte("no\n"), 0644))
+		panicOn(os.WriteFile(filepath.Join(dir, "ok2.txt"), []byte("no\n"), 0644))
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetPolicy(&Policy{Read: PathRule{Allow: []string{filepath.Join(dir, "ok")}}})
+
+		res, err := env.EvalString(`(slurpf "` + filepath.Join(dir, "ok", "a.txt") + `")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["a"]`)
+
+		for _, p := range []string{
+			filepath.Join(dir, "no.txt"),
+			filepath.Join(dir, "ok2.txt"),
+			filepath.Join(dir, "ok") + "/../no.txt",
+		} {
+			_, err := env.EvalString(`(slurpf "` + p + `")`)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "policy error: read denied")
+		}
+	})
+
+	cv.Convey(`Given a policy file, LoadPolicy should read it, and refuse capabilities it does not know`, t, func() {
+
+		dir := t.TempDir()
+		good := filepath.Join(dir, "good.json")
+		panicOn(os.WriteFile(good, []byte(`{"allow": ["time", "random"], "read": {"allow": ["."], "deny": ["secret"]}}`), 0644))
+		p, err := LoadPolicy(good)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(p.Allows(CapRandom), cv.ShouldBeTrue)
+		cv.So(p.Allows(CapExec), cv.ShouldBeFalse)
+		cv.So(p.Read.Deny, cv.ShouldResemble, []string{"secret"})
+
+		bad := filepath.Join(dir, "bad.json")
+		panicOn(os.WriteFile(bad, []byte(`{"allow": ["teleport"]}`), 0644))
+		_, err = LoadPolicy(bad)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "unknown capability 'teleport'")
+
+		var none *Policy
+		cv.So(none.Allows(CapExec), cv.ShouldBeTrue)
+	})
+}
@@ -0,0 +1,171 @@
+package zygo
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Environment pools
+// =================
+//
+// An EnvPool hands out environments, one per request say,
+// that start out as copies of a base environment, set up
+// once with StandardSetup, packages, definitions and so on,
+// and then frozen. Getting one costs a few allocations, not
+// a setup.
+//
+// A pooled environment's global scope is a layer over the
+// base's: names it defines, or sets, are its own, and the
+// base, and every other environment of the pool, never see
+// them. A base global is copied into the layer the first
+// time the environment reads it, as spawn copies values
+// for a task (see spawn.go): arrays, hashes, functions and
+// the variables they capture, and packages, so that
+// changing them in place is private too. Macros, infix
+// operators and hooks are copied; builtins, which scripts
+// cannot change, and the type registry, which is layered,
+// are shared. So is the symbol table, through an overlay
+// that takes the names, and gensyms, that the environment
+// makes, so a long-lived pool's table does not grow with
+// every request.
+//
+// The base must not be changed once the pool has it; Run,
+// and so EvalString, Apply and Call, return ErrFrozen.
+// Go values embedded in records, and channels, are shared
+// as with spawn.
+
+// ErrFrozen is returned when running the base environment
+// of an EnvPool.
+var ErrFrozen = errors.New("environment is frozen, as the base of an EnvPool")
+
+// EnvPool makes environments from a frozen base; it is
+// safe for concurrent use.
+type EnvPool struct {
+	base *Zlisp
+	free sync.Pool
+}
+
+// NewEnvPool freezes base, and returns a pool of
+// environments made from it.
+func NewEnvPool(base *Zlisp) *EnvPool {
+	base.frozen = true
+	return &EnvPool{base: base}
+}
+
+// Get returns an environment starting from the base.
+func (p *EnvPool) Get() *Zlisp {
+	if env, ok := p.free.Get().(*Zlisp); ok {
+		return env
+	}
+	env := new(Zlisp)
+	p.fork(env)
+	return env
+}
+
+// Put resets env, which must have come from p's Get, and
+// keeps it for another Get. Don't use env afterwards.
+func (p *EnvPool) Put(env *Zlisp) {
+	p.fork(env)
+	p.free.Put(env)
+}
+
+// fork makes env a fresh copy of the base.
+func (p *EnvPool) fork(env *Zlisp) {
+	base := p.base
+	*env = Zlisp{}
+
+	env.parser = env.NewParser()
+	env.baseTypeCtor = base.baseTypeCtor
+	env.datastack = env.NewStack(DataStackSize)
+	env.linearstack = env.NewStack(ScopeStackSize)
+	env.addrstack = env.NewStack(CallStackSize)
+	env.loopstack = env.NewStack(LoopStackSize)
+
+	glob := env.NewNamedScope("global")
+	glob.IsGlobal = true
+	glob.layer = newScopeLayer(glob, base.globalScope(), nil)
+	env.linearstack.Push(glob)
+
+	env.symbols = newSymbolOverlay(base.symbols)
+	env.builtins = base.builtins
+	env.reserved = base.reserved
+	env.macros = make(map[int]*SexpFunction, len(base.macros))
+	for k, v := range base.macros {
+		env.macros[k] = v
+	}
+	env.infixOps = make(map[string]*InfixOp, len(base.infixOps))
+	for k, v := range base.infixOps {
+		env.infixOps[k] = v
+	}
+	env.rebound = make(map[int]bool, len(base.rebound))
+	for k, v := range base.rebound {
+		env.rebound[k] = v
+	}
+	// appending to these copies them.
+	env.before = base.before[:len(base.before):len(base.before)]
+	env.after = base.after[:len(base.after):len(base.after)]
+
+	env.mainfunc = env.MakeFunction("__main", 0, false, make([]Instruction, 0), nil)
+	env.curfunc = env.mainfunc
+	env.debugSymbolNotFound = base.debugSymbolNotFound
+	env.showGlobalScope = base.showGlobalScope
+	env.Pretty = base.Pretty
+	env.Echo = base.Echo
+	env.WrapLoadExpressionsInInfix = base.WrapLoadExpressionsInInfix
+	env.booter = base.booter
+	env.limits = base.limits
+	env.ctx = base.ctx
+	env.steps = new(atomic.Int64)
+	env.stepsOwner = true
+	env.types = NewGoStructRegistry(base.TypeRegistry())
+	env.imports = base.imports.child()
+	env.optimize = base.optimize
+	env.stdout = base.stdout
+	env.stderr = base.stderr
+	env.stdin = base.stdin
+	env.fsys = base.fsys
+	env.policy = base.policy
+}
+
+// scopeLayer makes a scope a copy-on-write layer over
+// base, a frozen scope that other layers share.
+type scopeLayer struct {
+	base *Scope
+	iso  *isolator
+	// base names deleted from the layer.
+	gone map[int]bool
+}
+
+func newScopeLayer(s, base *Scope, gone map[int]bool) *scopeLayer {
+	l := &scopeLayer{base: base, iso: newIsolator(s.env), gone: make(map[int]bool, len(gone))}
+	for k := range gone {
+		l.gone[k] = true
+	}
+	l.iso.packages = true
+	// closures copied from base capture s instead.
+	l.iso.scopes[base] = s
+	return l
+}
+
+// get looks num up in s, and if s is a layer, in its base.
+func (s *Scope) get(num int) (Sexp, bool) {
+	if i, ok := s.slotOf(num); ok {
+		return s.slots[i], s.slots[i] != nil
+	}
+	val, ok := s.Map[num]
+	if ok || s.layer == nil {
+		return val, ok
+	}
+	l := s.layer
+	if l.gone[num] {
+		return nil, false
+	}
+	val, ok = l.base.Map[num]
+	if !ok {
+		return nil, false
+	}
+	val = l.iso.copy(val)
+	s.Map[num] = val
+	return val, true
+}
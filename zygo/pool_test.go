@@ -0,0 +1,139 @@
+package zygo
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test250EnvPoolIsolatesRequests(t *testing.T) {
+
+	cv.Convey(`Given a pool over a base environment, environments from it should start from the base, and what they define or change should stay their own, even run all at once`, t, func() {
+
+		base := NewZlisp()
+		defer base.Close()
+		base.StandardSetup()
+		_, err := base.EvalString(`
+(def counter 0)
+(defn bump [] (set counter (+ counter 1)) counter)
+(def shared (hash a:1))
+(def arr [1 2 3])
+(def mypkg (package "mypkg" (def hits 0) (defn Hit [] (set hits (+ hits 1)) hits)))
+(def mk (let [n 0] (fn [] (set n (+ n 1)) n)))
+(defmac twice [x] ^(begin ~x ~x))`)
+		panicOn(err)
+
+		pool := NewEnvPool(base)
+
+		const n = 40
+		got := make([]string, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				env := pool.Get()
+				defer pool.Put(env)
+				res, err := env.EvalString(fmt.Sprintf(`
+(def mine %d)
+(twice (bump))
+(set counter (+ counter mine))
+(hset shared b: mine)
+(aset arr 0 mine)
+(defmac thrice [x] ^(begin ~x ~x ~x))
+(thrice (mypkg.Hit))
+(mk)
+[counter (hget shared b:) (aget arr 0) (mypkg.Hit) (mk) (len shared)]`, i))
+				if err == nil {
+					got[i] = res.SexpString(nil)
+				}
+				errs[i] = err
+			}(i)
+		}
+		wg.Wait()
+		for i := 0; i < n; i++ {
+			cv.So(errs[i], cv.ShouldBeNil)
+			cv.So(got[i], cv.ShouldEqual, fmt.Sprintf("[%d %d %d 4 2 2]", 2+i, i, i))
+		}
+
+		// the base is as it was.
+		for name, want := range map[string]string{"counter": "0", "shared": "{a:1}", "arr": "[1 2 3]"} {
+			x, found := base.FindObject(name)
+			cv.So(found, cv.ShouldBeTrue)
+			cv.So(x.SexpString(nil), cv.ShouldEqual, want)
+		}
+		_, found := base.FindObject("mine")
+		cv.So(found, cv.ShouldBeFalse)
+		cv.So(base.HasMacro(base.MakeSymbol("thrice")), cv.ShouldBeFalse)
+
+		_, err = base.EvalString(`(bump)`)
+		cv.So(errors.Is(err, ErrFrozen), cv.ShouldBeTrue)
+	})
+
+	cv.Convey(`Given a base global removed in a pooled environment, it should be gone there only, and come back if rolled back`, t, func() {
+
+		base := NewZlisp()
+		defer base.Close()
+		base.StandardSetup()
+		_, err := base.EvalString(`(def keep 1)`)
+		panicOn(err)
+		pool := NewEnvPool(base)
+
+		env := pool.Get()
+		_, err = env.EvalTx(`(rmsym (quote keep)) (error "undo")`)
+		cv.So(err, cv.ShouldNotBeNil)
+		res, err := env.EvalString(`(+ keep 0)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "1")
+
+		res, err = env.EvalString(`(rmsym (quote keep)) (defined? "keep")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "false")
+		pool.Put(env)
+
+		env = pool.Get()
+		defer pool.Put(env)
+		res, err = env.EvalString(`(+ keep 0)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "1")
+	})
+	cv.Convey(`Given many requests through a pool, the names and gensyms they make should stay in each environment's own symbols, not grow the base's`, t, func() {
+
+		base := NewZlisp()
+		defer base.Close()
+		base.StandardSetup()
+		_, err := base.EvalString(`(defn double [x] (* 2 x)) (defmac twice [x] ^(begin ~x ~x))`)
+		panicOn(err)
+		pool := NewEnvPool(base)
+
+		size := func(t *symbolTable) int {
+			t.mu.RLock()
+			defer t.mu.RUnlock()
+			return len(t.num)
+		}
+		before := size(base.symbols)
+
+		for i := 0; i < 50; i++ {
+			env := pool.Get()
+			res, err := env.EvalString(fmt.Sprintf(`
+(def name%d (gensym))
+(defn f%d [a] (let [b (double a)] (twice (set b (+ b 1))) b))
+(f%d 1)`, i, i, i))
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 4)
+			pool.Put(env)
+		}
+		cv.So(size(base.symbols), cv.ShouldEqual, before)
+
+		// a gensym never takes a name the base has.
+		env := pool.Get()
+		defer pool.Put(env)
+		_, taken := base.symbols.lookup(env.GenSymbol("double").name)
+		cv.So(taken, cv.ShouldBeFalse)
+		cv.So(env.MakeSymbol("double").number, cv.ShouldEqual, base.MakeSymbol("double").number)
+	})
+}
@@ -0,0 +1,177 @@
+package zygo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SrcPos is a location in zygo source text. Line and Col
+// are 1-based; Col counts runes, not bytes. The zero
+// SrcPos is invalid and means "position unknown".
+type SrcPos struct {
+	File string
+	Line int
+	Col  int
+}
+
+// IsValid reports whether the position is known.
+func (p SrcPos) IsValid() bool {
+	return p.Line > 0
+}
+
+// String renders the position as file:line:col, or
+// line:col when the source had no file name.
+func (p SrcPos) String() string {
+	if !p.IsValid() {
+		if p.File != "" {
+			return p.File
+		}
+		return "-"
+	}
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// PosOf returns the source position recorded on x by the
+// parser. Lists, arrays and symbols carry positions; for
+// everything else the zero SrcPos is returned.
+func PosOf(x Sexp) SrcPos {
+	switch e := x.(type) {
+	case *SexpPair:
+		return e.Pos
+	case *SexpArray:
+		return e.Pos
+	case *SexpSymbol:
+		return e.Pos
+	}
+	return SrcPos{}
+}
+
+// setPos records p on x, if x is able to carry a position.
+func setPos(x Sexp, p SrcPos) Sexp {
+	switch e := x.(type) {
+	case *SexpPair:
+		e.Pos = p
+	case *SexpArray:
+		e.Pos = p
+	case *SexpSymbol:
+		e.Pos = p
+	}
+	return x
+}
+
+// inheritPos gives x the position p if x does not already
+// have one. Used when rewriting (infix, macros) makes new
+// nodes that stand in for parsed source.
+func inheritPos(x Sexp, p SrcPos) Sexp {
+	if p.IsValid() && !PosOf(x).IsValid() {
+		setPos(x, p)
+	}
+	return x
+}
+
+// posError tags an error with the position of the
+// instruction that raised it. Its message is unchanged so
+// that (expectError) and friends keep matching; the
+// position surfaces when EvalString, LoadFile and the
+// like convert it to a *SourceError.
+type posError struct {
+	pos   SrcPos
+	err   error
+	stack []StackFrame
+}
+
+func (e *posError) Error() string { return e.err.Error() }
+func (e *posError) Unwrap() error { return e.err }
+
+// annotatePos wraps err with p, unless err already knows
+// where it came from.
+func annotatePos(err error, p SrcPos) error {
+	if err == nil || !p.IsValid() {
+		return err
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		switch e.(type) {
+		case *posError:
+			return err
+		case *SourceError:
+			// a nested load (source, import) already
+			// reported its own position; add ours in front.
+			return &posError{pos: p, err: err}
+		}
+	}
+	return &posError{pos: p, err: err}
+}
+
+// SourceError is returned from EvalString, LoadFile,
+// SourceFile and friends when the failure can be traced
+// to a location in the script. Its message reads
+// "config.zy:212:9: symbol `foo` not found".
+type SourceError struct {
+	Pos SrcPos
+	Err error
+}
+
+func (e *SourceError) Error() string {
+	return e.Pos.String() + ": " + e.Err.Error()
+}
+
+func (e *SourceError) Unwrap() error { return e.Err }
+
+// ErrorPos reports the source position carried by err, if
+// any. The outermost position in the wrap chain wins.
+func ErrorPos(err error) (SrcPos, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case *SourceError:
+			return e.Pos, true
+		case *posError:
+			return e.pos, true
+		}
+		err = errors.Unwrap(err)
+	}
+	return SrcPos{}, false
+}
+
+// sourceError converts a positioned error into a
+// *SourceError for return across the public API.
+func sourceError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		switch x := e.(type) {
+		case *SourceError:
+			return err
+		case *posError:
+			if e == err {
+				return &SourceError{Pos: x.pos, Err: x.err}
+			}
+			return &SourceError{Pos: x.pos, Err: err}
+		}
+	}
+	return err
+}
+
+// appendCode extends the function body, keeping
+// positions aligned with instructions.
+func (sf *SexpFunction) appendCode(instr []Instruction, pos []SrcPos) {
+	if len(sf.positions) < len(sf.fun) {
+		sf.positions = append(sf.positions, make([]SrcPos, len(sf.fun)-len(sf.positions))...)
+	}
+	sf.fun = append(sf.fun, instr...)
+	sf.positions = append(sf.positions, pos...)
+	if len(sf.positions) < len(sf.fun) {
+		sf.positions = append(sf.positions, make([]SrcPos, len(sf.fun)-len(sf.positions))...)
+	}
+}
+
+// PosAt returns the source position of the instruction at pc.
+func (sf *SexpFunction) PosAt(pc int) SrcPos {
+	if sf == nil || pc < 0 || pc >= len(sf.positions) {
+		return SrcPos{}
+	}
+	return sf.positions[pc]
+}
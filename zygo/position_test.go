@@ -0,0 +1,140 @@
+package zygo
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test060ParsedExpressionsCarrySourcePositions(t *testing.T) {
+
+	cv.Convey(`Given source spread over several lines, lists, arrays and symbols should record the line and column where they begin`, t, func() {
+
+		str := "(defn hello [x]\n  (+ x  yy))"
+		env := NewZlisp()
+		defer env.Close()
+
+		env.parser.ResetAddNewInput(bytes.NewBuffer([]byte(str)))
+		env.parser.SetFilename("hello.zy")
+		expressions, err := env.parser.ParseTokens()
+		panicOn(err)
+
+		defn := expressions[0].(*SexpPair)
+		cv.So(defn.Pos.String(), cv.ShouldEqual, "hello.zy:1:1")
+		cv.So(PosOf(defn.Head).String(), cv.ShouldEqual, "hello.zy:1:2")
+
+		args, _ := ListToArray(defn)
+		cv.So(PosOf(args[2]).String(), cv.ShouldEqual, "hello.zy:1:13")
+
+		body := args[3].(*SexpPair)
+		cv.So(body.Pos.String(), cv.ShouldEqual, "hello.zy:2:3")
+		call, _ := ListToArray(body)
+		cv.So(PosOf(call[0]).String(), cv.ShouldEqual, "hello.zy:2:4")
+		cv.So(PosOf(call[2]).String(), cv.ShouldEqual, "hello.zy:2:9")
+	})
+}
+
+func Test061RuntimeErrorsReportSourcePositions(t *testing.T) {
+
+	cv.Convey(`Given a script that refers to an unbound symbol, EvalString should return a *SourceError naming the line and column of the symbol`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+
+		_, err := env.EvalString("(def a 1)\n(defn f [x]\n   (+ x undefinedFoo))\n(f a)")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldEqual, "3:9: symbol `undefinedFoo` not found")
+
+		var se *SourceError
+		cv.So(errors.As(err, &se), cv.ShouldBeTrue)
+		cv.So(se.Pos.Line, cv.ShouldEqual, 3)
+		cv.So(se.Pos.Col, cv.ShouldEqual, 9)
+
+		// and the env is still usable afterwards.
+		env.Clear()
+		res, err := env.EvalString("(+ 1 2)")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 3)
+	})
+
+	cv.Convey(`Given infix code, the Pratt rewriter should keep positions so errors still point at the offending token`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+
+		_, err := env.EvalString("{a := 1\nb := a +\n   nope}")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldEqual, "3:4: symbol `nope` not found")
+	})
+
+	cv.Convey(`Given a file, LoadFile and SourceFile should report positions against its name`, t, func() {
+
+		dir := t.TempDir()
+		path := filepath.Join(dir, "config.zy")
+		src := "(def x 10)\n\n   (println (* x foo))\n"
+		panicOn(os.WriteFile(path, []byte(src), 0644))
+
+		env := NewZlisp()
+		defer env.Close()
+
+		f, err := os.Open(path)
+		panicOn(err)
+		defer f.Close()
+		err = env.LoadFile(f)
+		cv.So(err, cv.ShouldBeNil)
+		_, err = env.Run()
+		cv.So(err, cv.ShouldNotBeNil)
+		pos, ok := ErrorPos(err)
+		cv.So(ok, cv.ShouldBeTrue)
+		cv.So(pos.String(), cv.ShouldEqual, path+":3:18")
+
+		env.Clear()
+		f2, err := os.Open(path)
+		panicOn(err)
+		defer f2.Close()
+		err = env.SourceFile(f2)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldEqual, path+":3:18: symbol `foo` not found")
+	})
+
+	cv.Convey(`Given syntax and code generation errors, both should carry a position`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+
+		_, err := env.EvalString("(def a 1)\n(def b 1abc)")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(strings.HasPrefix(err.Error(), "2:"), cv.ShouldBeTrue)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "Unrecognized atom")
+
+		env.Clear()
+		_, err = env.EvalString("(def a 1)\n  (def b 0:)")
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(strings.HasPrefix(err.Error(), "2:3: Error generating"), cv.ShouldBeTrue)
+	})
+}
+
+func Test062InstructionsMapToSourcePositions(t *testing.T) {
+
+	cv.Convey(`Given a compiled function, every instruction should have a source position alongside it`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+
+		_, err := env.EvalString("(defn g [a b]\n  (cond (> a b) a\n        b))")
+		panicOn(err)
+		fn := recentLookupFunction(t, env, "g")
+		cv.So(len(fn.positions), cv.ShouldEqual, len(fn.fun))
+		for pc := range fn.fun {
+			cv.So(fn.PosAt(pc).IsValid(), cv.ShouldBeTrue)
+		}
+		cv.So(fn.PosAt(0).Line, cv.ShouldEqual, 1)
+		cv.So(fn.PosAt(len(fn.fun)-3).Line, cv.ShouldBeGreaterThanOrEqualTo, 2)
+	})
+}
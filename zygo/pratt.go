@@ -399,13 +399,15 @@ func findRangeAssign(tokens []Sexp) (int, string, bool) {
 	return -1, "", false
 }
 
-func parseRangeTargets(tokens []Sexp) ([]*SexpSymbol, error) {
+// parseRangeTargets returns the targets: symbols, except
+// that the second may be a pattern, destructuring the value.
+func parseRangeTargets(tokens []Sexp) ([]Sexp, error) {
 	if len(tokens) == 1 {
 		sym, ok := tokens[0].(*SexpSymbol)
 		if !ok {
 			return nil, fmt.Errorf("go-style for range header: range target must be a symbol")
 		}
-		return []*SexpSymbol{sym}, nil
+		return []Sexp{sym}, nil
 	}
 	if len(tokens) == 3 {
 		left, ok := tokens[0].(*SexpSymbol)
@@ -415,16 +417,16 @@ func parseRangeTargets(tokens []Sexp) ([]*SexpSymbol, error) {
 		if _, ok := tokens[1].(*SexpComma); !ok {
 			return nil, fmt.Errorf("go-style for range header: two range targets must be separated by comma")
 		}
-		right, ok := tokens[2].(*SexpSymbol)
-		if !ok {
-			return nil, fmt.Errorf("go-style for range header: second range target must be a symbol")
+		right := tokens[2]
+		if _, ok := right.(*SexpSymbol); !ok && !isDestructuring(right) {
+			return nil, fmt.Errorf("go-style for range header: second range target must be a symbol or a pattern")
 		}
-		return []*SexpSymbol{left, right}, nil
+		return []Sexp{left, right}, nil
 	}
 	return nil, fmt.Errorf("go-style for range header: expected one or two range targets")
 }
 
-func lowerRangeBinding(env *Zlisp, targets []*SexpSymbol, define bool, sourceSym, indexSym *SexpSymbol, body []Sexp) Sexp {
+func lowerRangeBinding(env *Zlisp, targets []Sexp, define bool, sourceSym, indexSym *SexpSymbol, body []Sexp) Sexp {
 	if len(targets) == 1 {
 		op := "set"
 		if define {
@@ -469,6 +471,9 @@ func lowerRangeFor(env *Zlisp, label *SexpSymbol, header []Sexp, body []Sexp) (S
 	if err != nil {
 		return SexpNull, true, err
 	}
+	if len(targets) == 2 && isDestructuring(targets[1]) && op != ":=" {
+		return SexpNull, true, fmt.Errorf("go-style for range header: destructuring the value needs :=")
+	}
 	sourceTokens := header[assignPos+2:]
 	if len(sourceTokens) == 0 {
 		return SexpNull, true, fmt.Errorf("go-style for range header: missing range expression")
@@ -694,6 +699,9 @@ func (env *Zlisp) InitInfixOps() {
 		return list, nil
 	}
 
+	matchOp := env.Prefix("match", 5)
+	matchOp.MunchRight = matchOpMunchRight
+
 	env.Infix("comma", 15)
 }
 
@@ -951,6 +959,8 @@ func (p *Pratt) Expression(env *Zlisp, rbp int) (ret Sexp, err error) {
 			//Q("Expression(%v) MunchRight saw err = %v", rbp, err)
 			return SexpNull, err
 		}
+		// the rewritten form stands where the operator was written.
+		inheritPos(p.AccumTree, PosOf(cnode))
 		//Q("after MunchRight on cnode = %v, p.AccumTree = '%v'",
 		//	cnode.SexpString(nil), p.AccumTree.SexpString(nil))
 	} else {
@@ -1020,6 +1030,7 @@ func (p *Pratt) Expression(env *Zlisp, rbp int) (ret Sexp, err error) {
 				//Q("curOp.MunchLeft saw err = %v", err)
 				return SexpNull, err
 			}
+			inheritPos(p.AccumTree, PosOf(cnode))
 		} else {
 			//Q("curOp has not MunchLeft, setting AccumTree <- cnode. here cnode = %v", cnode.SexpString(nil))
 			// do this, or have the default MunchLeft return itself.
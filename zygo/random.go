@@ -9,6 +9,9 @@ var defaultRand = rand.New(rand.NewSource(time.Now().Unix()))
 
 func RandomFunction(env *Zlisp, name string,
 	args []Sexp) (Sexp, error) {
+	if err := env.allow(CapRandom, name); err != nil {
+		return SexpNull, err
+	}
 	return &SexpFloat{Val: defaultRand.Float64()}, nil
 }
 
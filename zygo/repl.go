@@ -85,7 +85,7 @@ func (pr *Prompter) getExpressionWithLiner(env *Zlisp, reader *bufio.Reader, noL
 	var line, nextline string
 
 	if noLiner {
-		fmt.Print(pr.prompt)
+		fmt.Fprint(env.Output(), pr.prompt)
 		line, err = getLine(reader)
 	} else {
 		line, err = pr.Getline(nil)
@@ -120,7 +120,7 @@ func (pr *Prompter) getExpressionWithLiner(env *Zlisp, reader *bufio.Reader, noL
 
 		if err == ErrMoreInputNeeded || err == UnexpectedEnd || err == ResetRequested {
 			if noLiner {
-				fmt.Print(continuationPrompt)
+				fmt.Fprint(env.Output(), continuationPrompt)
 				nextline, err = getLine(reader)
 			} else {
 				nextline, err = pr.Getline(&continuationPrompt)
@@ -143,18 +143,21 @@ func processDumpCommand(env *Zlisp, args []string) {
 	} else {
 		err := env.DumpFunctionByName(args[0])
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.ErrOutput(), err)
 		}
 	}
 }
 
 func Repl(env *Zlisp, cfg *ZlispConfig) {
 
+	// liner reads the terminal, so is not used if the env
+	// has its own input.
+	noLiner := cfg.NoLiner || env.stdin != nil
 	var reader *bufio.Reader
-	if cfg.NoLiner {
+	if noLiner {
 		// reader is used if one wishes to drop the liner library.
 		// Useful for not full terminal env, like under test.
-		reader = bufio.NewReader(os.Stdin)
+		reader = env.inputReader()
 	}
 
 	if cfg.Trace {
@@ -164,14 +167,14 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 
 	if !cfg.Quiet {
 		if cfg.Sandboxed {
-			fmt.Printf("zygo [sandbox mode] version %s\n", Version())
+			fmt.Fprintf(env.Output(), "zygo [sandbox mode] version %s\n", Version())
 		} else {
-			fmt.Printf("zygo version %s\n", Version())
+			fmt.Fprintf(env.Output(), "zygo version %s\n", Version())
 		}
-		fmt.Printf("press tab (repeatedly) to get completion suggestions. Shift-tab goes back. Ctrl-d to exit.\n")
+		fmt.Fprintf(env.Output(), "press tab (repeatedly) to get completion suggestions. Shift-tab goes back. Ctrl-d to exit.\n")
 	}
 	var pr *Prompter // can be nil if noLiner
-	if !cfg.NoLiner {
+	if !noLiner {
 		pr = NewPrompter(cfg.Prompt)
 		defer pr.Close()
 	} else {
@@ -180,11 +183,15 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 	infixSym := env.MakeSymbol("infix")
 
 	for {
-		line, exprsInput, err := pr.getExpressionWithLiner(env, reader, cfg.NoLiner)
+		line, exprsInput, err := pr.getExpressionWithLiner(env, reader, noLiner)
 		//Q("\n exprsInput(len=%d) = '%v'\n line = '%s'\n", len(exprsInput), (&SexpArray{Val: exprsInput}).SexpString(nil), line)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.ErrOutput(), err)
 			if err == io.EOF {
+				// an env reading its own input goes back to its caller.
+				if env.stdin != nil {
+					return
+				}
 				os.Exit(0)
 			}
 			env.Clear()
@@ -205,19 +212,19 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 
 			if first == ".cd" {
 				if len(parts) < 2 {
-					fmt.Printf("provide directory path to change to.\n")
+					fmt.Fprintf(env.Output(), "provide directory path to change to.\n")
 					continue
 				}
 				err := os.Chdir(parts[1])
 				if err != nil {
-					fmt.Printf("error: %s\n", err)
+					fmt.Fprintf(env.ErrOutput(), "error: %s\n", err)
 					continue
 				}
 				pwd, err := os.Getwd()
 				if err == nil {
-					fmt.Printf("cur dir: %s\n", pwd)
+					fmt.Fprintf(env.Output(), "cur dir: %s\n", pwd)
 				} else {
-					fmt.Printf("error: %s\n", err)
+					fmt.Fprintf(env.ErrOutput(), "error: %s\n", err)
 				}
 				continue
 			}
@@ -240,13 +247,13 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 			}
 
 			if first == ".gls" {
-				fmt.Printf("\nScopes:\n")
+				fmt.Fprintf(env.Output(), "\nScopes:\n")
 				prev := env.showGlobalScope
 				env.showGlobalScope = true
 				err = env.ShowStackStackAndScopeStack()
 				env.showGlobalScope = prev
 				if err != nil {
-					fmt.Printf("%s\n", err)
+					fmt.Fprintf(env.ErrOutput(), "%s\n", err)
 				}
 				continue
 			}
@@ -254,26 +261,26 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 			if first == ".ls" {
 				err := env.ShowStackStackAndScopeStack()
 				if err != nil {
-					fmt.Println(err)
+					fmt.Fprintln(env.ErrOutput(), err)
 				}
 				continue
 			}
 
 			if first == ".verb" {
 				Verbose = !Verbose
-				fmt.Printf("verbose: %v.\n", Verbose)
+				fmt.Fprintf(env.Output(), "verbose: %v.\n", Verbose)
 				continue
 			}
 
 			if first == ".debug" {
 				env.debugExec = true
-				fmt.Printf("instruction debugging on.\n")
+				fmt.Fprintf(env.Output(), "instruction debugging on.\n")
 				continue
 			}
 
 			if first == ".undebug" {
 				env.debugExec = false
-				fmt.Printf("instruction debugging off.\n")
+				fmt.Fprintf(env.Output(), "instruction debugging off.\n")
 				continue
 			}
 		} // end if !cfg.Sandboxed
@@ -298,7 +305,7 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 			env.Clear()
 			continue
 		default:
-			fmt.Print(env.GetStackTrace(err))
+			fmt.Fprint(env.ErrOutput(), env.GetStackTrace(err))
 			env.Clear()
 			continue
 		}
@@ -312,9 +319,9 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 			switch e := expr.(type) {
 			case *SexpStr:
 				if e.backtick {
-					fmt.Printf("`%s`\n", e.S)
+					fmt.Fprintf(env.Output(), "`%s`\n", e.S)
 				} else {
-					fmt.Printf("%s\n", strconv.Quote(e.S))
+					fmt.Fprintf(env.Output(), "%s\n", strconv.Quote(e.S))
 				}
 			default:
 				switch sym := expr.(type) {
@@ -323,27 +330,27 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 					rhs, err := sym.RHS(env)
 					if err != nil {
 						Q("repl problem in call to RHS() on SexpSelector: '%v'", err)
-						fmt.Print(env.GetStackTrace(err))
+						fmt.Fprint(env.ErrOutput(), env.GetStackTrace(err))
 						env.Clear()
 						continue
 					} else {
 						Q("got back rhs of type %T", rhs)
-						fmt.Println(rhs.SexpString(nil))
+						fmt.Fprintln(env.Output(), rhs.SexpString(nil))
 						continue
 					}
 				case *SexpSymbol:
 					if sym.isDot {
 						resolved, err := dotGetSetHelper(env, sym.name, nil)
 						if err != nil {
-							fmt.Print(env.GetStackTrace(err))
+							fmt.Fprint(env.ErrOutput(), env.GetStackTrace(err))
 							env.Clear()
 							continue
 						}
-						fmt.Println(resolved.SexpString(nil))
+						fmt.Fprintln(env.Output(), resolved.SexpString(nil))
 						continue
 					}
 				}
-				fmt.Println(expr.SexpString(nil))
+				fmt.Fprintln(env.Output(), expr.SexpString(nil))
 			}
 		}
 	}
@@ -352,14 +359,14 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 func runScript(env *Zlisp, fname string, cfg *ZlispConfig) {
 	file, err := os.Open(fname)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(env.ErrOutput(), err)
 		return
 	}
 	defer file.Close()
 
-	err = env.LoadFile(file)
+	err = loadScript(env, file)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(env.ErrOutput(), err)
 		if cfg.ExitOnFailure {
 			os.Exit(-1)
 		}
@@ -368,17 +375,17 @@ func runScript(env *Zlisp, fname string, cfg *ZlispConfig) {
 
 	_, err = env.Run()
 	if cfg.CountFuncCalls {
-		fmt.Println("Pre:")
+		fmt.Fprintln(env.Output(), "Pre:")
 		for name, count := range precounts {
-			fmt.Printf("\t%s: %d\n", name, count)
+			fmt.Fprintf(env.Output(), "\t%s: %d\n", name, count)
 		}
-		fmt.Println("Post:")
+		fmt.Fprintln(env.Output(), "Post:")
 		for name, count := range postcounts {
-			fmt.Printf("\t%s: %d\n", name, count)
+			fmt.Fprintf(env.Output(), "\t%s: %d\n", name, count)
 		}
 	}
 	if err != nil {
-		fmt.Print(env.GetStackTrace(err))
+		fmt.Fprint(env.ErrOutput(), env.GetStackTrace(err))
 		if cfg.ExitOnFailure {
 			os.Exit(-1)
 		}
@@ -386,6 +393,15 @@ func runScript(env *Zlisp, fname string, cfg *ZlispConfig) {
 	}
 }
 
+// loadScript loads file, compiled if it is a .zyc file,
+// ready to Run.
+func loadScript(env *Zlisp, file *os.File) error {
+	if strings.HasSuffix(file.Name(), ".zyc") {
+		return env.LoadCompiled(bufio.NewReader(file))
+	}
+	return env.LoadFile(file)
+}
+
 func (env *Zlisp) StandardSetup() {
 	env.ImportBaseTypes()
 	env.ImportEval()
@@ -433,6 +449,8 @@ func (env *Zlisp) StandardSetup() {
 	env.ImportChannels()
 	env.ImportRegex()
 	env.ImportRandom()
+	env.ImportCollections()
+	env.ImportStrings()
 
 	gob.Register(SexpHash{})
 	gob.Register(SexpArray{})
@@ -440,30 +458,51 @@ func (env *Zlisp) StandardSetup() {
 
 // like main() for a standalone repl, now in library
 func ReplMain(cfg *ZlispConfig) {
-	var env *Zlisp
 	if cfg.LoadDemoStructs {
 		RegisterDemoStructs()
 	}
-	if cfg.Sandboxed {
-		env = NewZlispSandbox()
-	} else {
-		env = NewZlisp()
-	}
-	env.StandardSetup()
-	if cfg.LoadDemoStructs {
-		// avoid data conflicts by only loading these in demo mode.
-		env.ImportDemoData()
+	newEnv := func() *Zlisp {
+		var env *Zlisp
+		if cfg.Sandboxed {
+			env = NewZlispSandbox()
+		} else {
+			env = NewZlisp()
+		}
+		env.StandardSetup()
+		env.SetOptimize(cfg.Optimize)
+		if cfg.Jail != "" {
+			fsys, err := JailFS(cfg.Jail)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			env.SetFS(fsys)
+		}
+		if cfg.Policy != "" {
+			policy, err := LoadPolicy(cfg.Policy)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			env.SetPolicy(policy)
+		}
+		if cfg.LoadDemoStructs {
+			// avoid data conflicts by only loading these in demo mode.
+			env.ImportDemoData()
+		}
+		return env
 	}
+	env := newEnv()
 
 	if cfg.CpuProfile != "" {
 		f, err := os.Create(cfg.CpuProfile)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.ErrOutput(), err)
 			os.Exit(-1)
 		}
 		err = pprof.StartCPUProfile(f)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.ErrOutput(), err)
 			os.Exit(-1)
 		}
 		defer func() {
@@ -480,10 +519,34 @@ func ReplMain(cfg *ZlispConfig) {
 		env.AddPostHook(CountPostHook)
 	}
 
+	if cfg.Compile != "" {
+		err := env.CompileFile(cfg.Compile, cfg.CompileOut)
+		if err != nil {
+			fmt.Fprintf(env.ErrOutput(), "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.DAP != "" {
+		err := ServeDAP(cfg.DAP, newEnv)
+		fmt.Fprintf(env.ErrOutput(), "%v\n", err)
+		os.Exit(1)
+	}
+
+	if cfg.LSP {
+		err := ServeLSP(os.Stdin, os.Stdout, env)
+		if err != nil {
+			fmt.Fprintf(env.ErrOutput(), "%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if cfg.Command != "" {
 		_, err := env.EvalString(cfg.Command)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
+			fmt.Fprintf(env.ErrOutput(), "%v\n", err)
 			os.Exit(1)
 		}
 		os.Exit(0)
@@ -505,14 +568,14 @@ func ReplMain(cfg *ZlispConfig) {
 	if cfg.MemProfile != "" {
 		f, err := os.Create(cfg.MemProfile)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.ErrOutput(), err)
 			os.Exit(-1)
 		}
 		defer f.Close()
 
 		err = pprof.Lookup("heap").WriteTo(f, 1)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(env.ErrOutput(), err)
 			os.Exit(-1)
 		}
 	}
@@ -21,6 +21,15 @@ type Scope struct {
 	MyFunction  *SexpFunction // so we can query captured closure scopes.
 	IsPackage   bool
 	env         *Zlisp
+
+	// for the global scope of an environment from an
+	// EnvPool; see pool.go.
+	layer *scopeLayer
+
+	// for a scope laid out by the generator, the values of
+	// its frame's names, by slot; see lexical.go.
+	frame *lexFrame
+	slots []Sexp
 }
 
 // SexpString satisfies the Sexp interface, producing a string presentation of the value.
@@ -66,9 +75,9 @@ func (env *Zlisp) NewNamedScope(name string) *Scope {
 
 func (s *Scope) CloneScope() *Scope {
 	n := s.env.NewScope()
-	for k, v := range s.Map {
+	s.each(func(k int, v Sexp) {
 		n.Map[k] = v
-	}
+	})
 	return n
 }
 
@@ -103,11 +112,11 @@ func (stack *Stack) lookupSymbol(sym *SexpSymbol, minFrame int, setVal *Sexp) (S
 			}
 			switch scope := elem.(type) {
 			case (*Scope):
-				expr, ok := scope.Map[sym.number]
+				expr, ok := scope.get(sym.number)
 				if ok {
 					//P("lookupSymbol at stack scope# i=%v, we found sym '%s' with value '%s'", i, sym.name, expr.SexpString(0))
 					if setVal != nil {
-						scope.Map[sym.number] = *setVal
+						scope.bind(sym.number, *setVal)
 					}
 					return expr, nil, scope
 				}
@@ -148,7 +157,7 @@ func (stack *Stack) LookupSymbolUntilFunction(sym *SexpSymbol, setVal *Sexp, max
 			switch scope := elem.(type) {
 			case (*Scope):
 				//VPrintf("   ...looking up in scope '%s'\n", scope.Name)
-				expr, ok := scope.Map[sym.number]
+				expr, ok := scope.get(sym.number)
 				if ok {
 					if setVal != nil {
 						scope.UpdateSymbolInScope(sym, *setVal)
@@ -180,7 +189,7 @@ func (stack *Stack) LookupSymbolUntilFunction(sym *SexpSymbol, setVal *Sexp, max
 	}
 
 	if stack != nil && stack.env != nil && stack.env.debugSymbolNotFound {
-		fmt.Printf("debugSymbolNotFound is true, here are scopes:\n")
+		fmt.Fprintf(stack.env.Output(), "debugSymbolNotFound is true, here are scopes:\n")
 		stack.env.ShowStackStackAndScopeStack()
 	}
 	return SexpNull, SymNotFound, nil
@@ -190,9 +199,9 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 	if stack.IsEmpty() {
 		panic("empty stack!!")
 	}
-	cur, already := stack.elements[stack.tos].(*Scope).Map[sym.number]
+	cur, already := stack.elements[stack.tos].(*Scope).get(sym.number)
 	if already {
-		Q("BindSymbol already sees symbol %v, currently bound to '%v'", sym.name, cur.SexpString(nil))
+		Q("BindSymbol already sees symbol %v, currently bound to '%v'", sym.name, cur)
 
 		lhsTy := cur.Type()
 		rhsTy := expr.Type()
@@ -200,7 +209,7 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 			// for backcompat with closure.zy, just do the binding for now if the LHS isn't typed.
 			//return fmt.Errorf("left-hand-side had nil type")
 			// TODO: fix this? or require removal of previous symbol binding to avoid type errors?
-			stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+			stack.elements[stack.tos].(*Scope).bind(sym.number, expr)
 			return nil
 		}
 		if rhsTy == nil {
@@ -212,11 +221,11 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 		}
 
 		// both sides have type
-		Q("BindSymbol: both sides have type. rhs=%v, lhs=%v", rhsTy.SexpString(nil), lhsTy.SexpString(nil))
+		Q("BindSymbol: both sides have type. rhs=%v, lhs=%v", rhsTy, lhsTy)
 
 		if lhsTy == rhsTy {
 			Q("BindSymbol: YES types match exactly. Good.")
-			stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+			stack.elements[stack.tos].(*Scope).bind(sym.number, expr)
 			return nil
 		}
 
@@ -235,7 +244,7 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 		if lhsTy.TypeCache != nil && rhsTy.TypeCache != nil {
 			if rhsTy.TypeCache.AssignableTo(lhsTy.TypeCache) {
 				Q("BindSymbol: YES: rhsTy.TypeCache (%v) is AssigntableTo(lhsTy.TypeCache) (%v). Good.", rhsTy.TypeCache, lhsTy.TypeCache)
-				stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+				stack.elements[stack.tos].(*Scope).bind(sym.number, expr)
 				return nil
 			}
 		}
@@ -244,7 +253,7 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 	} else {
 		Q("BindSymbol: new symbol %v", sym.name)
 	}
-	stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+	stack.elements[stack.tos].(*Scope).bind(sym.number, expr)
 	return nil
 }
 
@@ -253,32 +262,32 @@ func (stack *Stack) DeleteSymbolFromTopOfStackScope(sym *SexpSymbol) error {
 		panic("empty stack!!")
 		//return errors.New("no scope available")
 	}
-	_, present := stack.elements[stack.tos].(*Scope).Map[sym.number]
+	_, present := stack.elements[stack.tos].(*Scope).get(sym.number)
 	if !present {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	delete(stack.elements[stack.tos].(*Scope).Map, sym.number)
+	stack.elements[stack.tos].(*Scope).unbind(sym.number)
 	return nil
 }
 
 // used to implement (set v 10)
 func (scope *Scope) UpdateSymbolInScope(sym *SexpSymbol, expr Sexp) error {
 
-	_, found := scope.Map[sym.number]
+	_, found := scope.get(sym.number)
 	if !found {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	scope.Map[sym.number] = expr
+	scope.bind(sym.number, expr)
 	return nil
 }
 
 func (scope *Scope) DeleteSymbolInScope(sym *SexpSymbol) error {
 
-	_, found := scope.Map[sym.number]
+	_, found := scope.get(sym.number)
 	if !found {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	delete(scope.Map, sym.number)
+	scope.unbind(sym.number)
 	return nil
 }
 
@@ -317,15 +326,15 @@ func (scop *Scope) Show(env *Zlisp, ps *PrintState, label string) (s string, err
 		s += fmt.Sprintf("%s (global scope - omitting content for brevity)\n", rep4)
 		return
 	}
-	if len(scop.Map) == 0 {
+	if scop.count() == 0 {
 		s += fmt.Sprintf("%s empty-scope: no symbols\n", rep4)
 		return
 	}
 	sortme := []*SymtabE{}
-	for symbolNumber, val := range scop.Map {
-		symbolName := env.revsymtable[symbolNumber]
+	scop.each(func(symbolNumber int, val Sexp) {
+		symbolName := env.symbols.nameOf(symbolNumber)
 		sortme = append(sortme, &SymtabE{Key: symbolName, Val: val.SexpString(ps)})
-	}
+	})
 	sort.Sort(SymtabSorter(sortme))
 	for i := range sortme {
 		s += fmt.Sprintf("%s %s -> %s\n", rep4,
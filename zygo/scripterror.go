@@ -0,0 +1,389 @@
+package zygo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors
+// ======
+//
+// (try body... (catch e handler...) (finally cleanup...))
+// evaluates body. If it fails, e is bound to the error
+// and handler runs instead; its value becomes the value of
+// the try. cleanup runs last whatever happened, and its
+// value is discarded. Either clause may be left out.
+//
+// (throw v) raises v; (catch e) then binds e to v itself.
+// (error "fmt" args...) raises an error with the formatted
+// message. Any other failure, including a Go error
+// returned by a ZlispUserFunction, is caught as an
+// *SexpError, which (errorMessage), (errorCause),
+// (errorPos) and (errorStack) take apart.
+//
+// Running out of budget, or having the context cancelled,
+// is not catchable: see Limits.
+
+// StackFrame is one call on the script stack when an
+// error was raised.
+type StackFrame struct {
+	Func string
+	Pos  SrcPos
+}
+
+func (f StackFrame) String() string {
+	return fmt.Sprintf("%s (%s)", f.Func, f.Pos)
+}
+
+// ScriptError is returned from EvalString, EvalStringContext
+// and SourceFile when parsing, compiling or evaluation fails.
+// It unwraps to a *SourceError when the failure has a
+// position, and from there to the underlying cause, so
+// errors.Is and errors.As see the Go errors returned by
+// user functions.
+type ScriptError struct {
+	SourceError
+
+	// Value is what (catch e) would have bound e to.
+	Value Sexp
+
+	// Stack lists the calls in progress, innermost first.
+	Stack []StackFrame
+}
+
+func (e *ScriptError) Error() string {
+	if e.Pos.IsValid() {
+		return e.SourceError.Error()
+	}
+	return e.Err.Error()
+}
+
+func (e *ScriptError) Unwrap() error {
+	if e.Pos.IsValid() {
+		return &e.SourceError
+	}
+	return e.Err
+}
+
+// scriptError converts an error from Run into a
+// *ScriptError for return across the public API.
+func scriptError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if se, ok := err.(*ScriptError); ok {
+		return se
+	}
+	s := &ScriptError{Value: errorValue(err), Stack: errorStack(err)}
+	if src, ok := sourceError(err).(*SourceError); ok {
+		s.SourceError = *src
+	} else {
+		s.Err = err
+	}
+	return s
+}
+
+// Message returns the error message, without position.
+func (e *SexpError) Message() string {
+	return e.error.Error()
+}
+
+func (e *SexpError) Unwrap() error {
+	return e.error
+}
+
+// errorStack returns the script stack recorded when err
+// was raised.
+func errorStack(err error) []StackFrame {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if pe, ok := e.(*posError); ok && pe.stack != nil {
+			return pe.stack
+		}
+	}
+	return nil
+}
+
+// errorValue returns the value that (catch e) binds e to
+// for err: whatever was thrown, or else an *SexpError
+// describing err.
+func errorValue(err error) Sexp {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if thrown, ok := e.(*SexpError); ok && thrown.Value != nil {
+			return thrown.Value
+		}
+	}
+
+	pos, _ := ErrorPos(err)
+	stack := errorStack(err)
+	for {
+		err = stripPos(err)
+		se, ok := err.(*SexpError)
+		if !ok || !se.passing {
+			break
+		}
+		err = se.error
+	}
+	if se, ok := err.(*SexpError); ok {
+		cp := *se
+		if !cp.Pos.IsValid() {
+			cp.Pos = pos
+		}
+		if cp.Stack == nil {
+			cp.Stack = stack
+		}
+		return &cp
+	}
+	return &SexpError{error: err, Pos: pos, Stack: stack}
+}
+
+// scriptStack lists the calls in progress while running
+// the instruction at pc in fn. Frames with no source
+// position, such as those of builders, are left out;
+// code generated on the fly to evaluate an argument or an
+// (eval) is credited to the function that ran it.
+func (env *Zlisp) scriptStack(fn *SexpFunction, pc int) []StackFrame {
+	var stack []StackFrame
+	add := func(f *SexpFunction, pc int) {
+		if pos := f.PosAt(pc); pos.IsValid() {
+			stack = append(stack, StackFrame{Func: f.name, Pos: pos})
+			return
+		}
+		if n := len(stack); n > 0 && generatedFunction(stack[n-1].Func) {
+			stack[n-1].Func = f.name
+		}
+	}
+	add(fn, pc)
+	for i := 0; i < env.addrstack.Size(); i++ {
+		elem, err := env.addrstack.Get(i)
+		if err != nil {
+			break
+		}
+		addr := elem.(Address)
+		// the address is the return point, just past the call.
+		add(addr.function, addr.position-1)
+	}
+	return stack
+}
+
+func generatedFunction(name string) bool {
+	return name == "callExprEval" || name == "evalGeneratedFunction"
+}
+
+// annotateErr is annotatePos for the instruction at pc in
+// fn, also recording the script stack.
+func (env *Zlisp) annotateErr(err error, fn *SexpFunction, pc int) error {
+	err = annotatePos(err, fn.PosAt(pc))
+	if pe, ok := err.(*posError); ok && pe.stack == nil {
+		pe.stack = env.scriptStack(fn, pc)
+	}
+	return err
+}
+
+// uncatchable errors stop the script no matter what.
+func uncatchable(err error) bool {
+	return errors.Is(err, ErrBudgetExceeded) ||
+		errors.Is(err, ErrDebugTerminated) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// raised marks err as coming from the script, so that
+// CallUserFunction passes it on as is.
+func raised(err error) error {
+	if _, ok := err.(*SexpError); ok {
+		return err
+	}
+	return &SexpError{error: err, passing: true}
+}
+
+// stripPos removes the position tags around err.
+func stripPos(err error) error {
+	for {
+		pe, ok := err.(*posError)
+		if !ok {
+			return err
+		}
+		err = pe.err
+	}
+}
+
+func ErrorFunctions() map[string]ZlispUserFunction {
+	return map[string]ZlispUserFunction{
+		"throw":        ThrowFunction,
+		"error":        ErrorFunction,
+		"error?":       ErrorAccessFunction("error?"),
+		"errorMessage": ErrorAccessFunction("errorMessage"),
+		"errorCause":   ErrorAccessFunction("errorCause"),
+		"errorPos":     ErrorAccessFunction("errorPos"),
+		"errorStack":   ErrorAccessFunction("errorStack"),
+	}
+}
+
+type tryClause struct {
+	sym  *SexpSymbol
+	body []Sexp
+}
+
+func TryBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	var body []Sexp
+	var catch, finally *tryClause
+	for i, x := range args {
+		head, clause := tryClauseHead(x)
+		switch head {
+		case "catch":
+			if catch != nil || finally != nil {
+				return SexpNull, fmt.Errorf("%s: catch must come once, before finally", name)
+			}
+			if len(clause) < 1 {
+				return SexpNull, fmt.Errorf("%s: (catch) needs a symbol to bind the error to", name)
+			}
+			sym, ok := clause[0].(*SexpSymbol)
+			if !ok {
+				return SexpNull, fmt.Errorf("%s: (catch) needs a symbol to bind the error to; we saw %T", name, clause[0])
+			}
+			catch = &tryClause{sym: sym, body: clause[1:]}
+		case "finally":
+			if finally != nil {
+				return SexpNull, fmt.Errorf("%s: more than one finally", name)
+			}
+			finally = &tryClause{body: clause}
+		default:
+			if catch != nil || finally != nil {
+				return SexpNull, fmt.Errorf("%s: argument %d follows catch or finally", name, i)
+			}
+			body = append(body, x)
+		}
+	}
+
+	state := env.captureControlState()
+	loops := env.loopstack.Size()
+	restore := func() {
+		env.restoreControlState(state)
+		env.loopstack.TruncateToSize(loops)
+	}
+
+	res, err := evalTryBody(env, body)
+	if err != nil && catch != nil && !uncatchable(err) {
+		restore()
+		res, err = evalCatch(env, catch, errorValue(err))
+	}
+	if finally != nil {
+		if err != nil {
+			restore()
+		}
+		_, ferr := evalTryBody(env, finally.body)
+		if ferr != nil {
+			restore()
+			err = ferr
+		}
+	}
+	if err != nil {
+		return SexpNull, raised(err)
+	}
+	return res, nil
+}
+
+func tryClauseHead(x Sexp) (string, []Sexp) {
+	pair, ok := x.(*SexpPair)
+	if !ok {
+		return "", nil
+	}
+	sym, ok := pair.Head.(*SexpSymbol)
+	if !ok || (sym.name != "catch" && sym.name != "finally") {
+		return "", nil
+	}
+	clause, err := ListToArray(pair.Tail)
+	if err != nil {
+		return "", nil
+	}
+	return sym.name, clause
+}
+
+func evalTryBody(env *Zlisp, body []Sexp) (Sexp, error) {
+	if len(body) == 0 {
+		return SexpNull, nil
+	}
+	return EvalFunction(env, "try", body)
+}
+
+func evalCatch(env *Zlisp, c *tryClause, e Sexp) (Sexp, error) {
+	sc := env.NewNamedScope("catch")
+	sc.Map[c.sym.number] = e
+	// popped whether the body fails or not.
+	stack := env.linearstack
+	defer stack.TruncateToSize(stack.Size())
+	stack.Push(sc)
+	return evalTryBody(env, c.body)
+}
+
+func ThrowFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	switch v := args[0].(type) {
+	case *SexpError:
+		return SexpNull, v
+	case *SexpStr:
+		return SexpNull, &SexpError{error: errors.New(v.S), Value: v}
+	}
+	return SexpNull, &SexpError{error: errors.New(args[0].SexpString(nil)), Value: args[0]}
+}
+
+// (error "fmt" args...)
+func ErrorFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 {
+		return SexpNull, WrongNargs
+	}
+	if _, ok := args[0].(*SexpStr); !ok {
+		return SexpNull, fmt.Errorf("first argument to %s must be a format string; we saw %T", name, args[0])
+	}
+	msg, err := PrintFunction("sprintf")(env, name, args)
+	if err != nil {
+		return SexpNull, err
+	}
+	return SexpNull, &SexpError{error: errors.New(msg.(*SexpStr).S)}
+}
+
+// ErrorAccessFunction implements errorMessage, errorCause,
+// errorPos, errorStack and error?.
+func ErrorAccessFunction(name string) ZlispUserFunction {
+	return func(env *Zlisp, _ string, args []Sexp) (Sexp, error) {
+		if len(args) != 1 {
+			return SexpNull, WrongNargs
+		}
+		e, isErr := args[0].(*SexpError)
+		if name == "error?" {
+			return &SexpBool{Val: isErr}, nil
+		}
+		if !isErr {
+			return SexpNull, fmt.Errorf("argument to %s must be an error; we saw %T", name, args[0])
+		}
+
+		switch name {
+		case "errorMessage":
+			return &SexpStr{S: e.Message()}, nil
+		case "errorCause":
+			cause := stripPos(errors.Unwrap(e.error))
+			if cause == nil {
+				return SexpNull, nil
+			}
+			if se, ok := cause.(*SexpError); ok {
+				return se, nil
+			}
+			return &SexpError{error: cause}, nil
+		case "errorPos":
+			if !e.Pos.IsValid() {
+				return SexpNull, nil
+			}
+			return &SexpStr{S: e.Pos.String()}, nil
+		case "errorStack":
+			frames := make([]Sexp, len(e.Stack))
+			for i, f := range e.Stack {
+				frames[i] = &SexpStr{S: f.String()}
+			}
+			return env.NewSexpArray(frames), nil
+		}
+		return SexpNull, fmt.Errorf("unknown error accessor '%s'", name)
+	}
+}
@@ -0,0 +1,138 @@
+package zygo
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+var errNoSuchAccount = errors.New("no such account")
+
+func Test100GoErrorsReachTheScriptAndComeBack(t *testing.T) {
+
+	cv.Convey(`Given a Go function that fails with a wrapped sentinel, a script should catch it as an error whose cause is the sentinel, and EvalString should return a *ScriptError that errors.Is still matches`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.AddFunction("lookup", func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+			return SexpNull, fmt.Errorf("lookup %s: %w", args[0].SexpString(nil), errNoSuchAccount)
+		})
+
+		res, err := env.EvalString(`
+(try (lookup "bob")
+  (catch e [(errorMessage e) (errorMessage (errorCause e)) (errorPos e)]))`)
+		cv.So(err, cv.ShouldBeNil)
+		v := res.(*SexpArray).Val
+		cv.So(v[0].(*SexpStr).S, cv.ShouldEqual, `Error calling 'lookup': lookup "bob": no such account`)
+		cv.So(v[1].(*SexpStr).S, cv.ShouldEqual, `lookup "bob": no such account`)
+		cv.So(v[2].(*SexpStr).S, cv.ShouldEqual, "2:6")
+
+		env.Clear()
+		_, err = env.EvalString("(defn outer [] (+ 1 (inner)))\n(defn inner [] (lookup \"al\"))\n(outer)")
+		cv.So(errors.Is(err, errNoSuchAccount), cv.ShouldBeTrue)
+
+		var se *ScriptError
+		cv.So(errors.As(err, &se), cv.ShouldBeTrue)
+		cv.So(se.Pos.String(), cv.ShouldEqual, "2:16")
+		cv.So(len(se.Stack), cv.ShouldBeGreaterThanOrEqualTo, 3)
+		cv.So(se.Stack[0].Func, cv.ShouldEqual, "inner")
+		cv.So(se.Stack[1].Func, cv.ShouldEqual, "outer")
+		cv.So(se.Stack[1].Pos.String(), cv.ShouldEqual, "1:21")
+		cv.So(se.Value.(*SexpError).Message(), cv.ShouldContainSubstring, "no such account")
+
+		// positioned errors still unwrap to a *SourceError.
+		var src *SourceError
+		cv.So(errors.As(err, &src), cv.ShouldBeTrue)
+		cv.So(src.Pos, cv.ShouldResemble, se.Pos)
+	})
+
+	cv.Convey(`Given a syntax error, or a form that cannot be compiled, EvalString should return a *ScriptError with its position too`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+
+		for src, pos := range map[string]string{
+			"(def a 1)\n[1 2)": "2:5",
+			"(def)":            "1:1",
+		} {
+			env.Clear()
+			_, err := env.EvalString(src)
+			var se *ScriptError
+			cv.So(errors.As(err, &se), cv.ShouldBeTrue)
+			cv.So(se.Pos.String(), cv.ShouldEqual, pos)
+			cv.So(err.Error(), cv.ShouldStartWith, pos+": ")
+		}
+	})
+}
+
+func Test101ThrowCatchFinally(t *testing.T) {
+
+	cv.Convey(`Given throw, error, catch and finally, the right handlers should run and the stacks should be left tidy`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+
+		res, err := env.EvalString(`
+(def log [])
+(defn note [x] (set log (append log x)))
+(defn risky [n]
+  (let [local 10]
+    (try
+      (cond (== n 0) (throw (hash code: 42))
+            (== n 1) (error "bad n=%d" n)
+            (+ n local))
+      (catch e (cond (hash? e) (:code e) (errorMessage e)))
+      (finally (note n)))))
+[(risky 0) (risky 1) (risky 2) log]`)
+		cv.So(err, cv.ShouldBeNil)
+		v := res.(*SexpArray).Val
+		cv.So(v[0].(*SexpInt).Val, cv.ShouldEqual, 42)
+		cv.So(v[1].(*SexpStr).S, cv.ShouldEqual, "bad n=1")
+		cv.So(v[2].(*SexpInt).Val, cv.ShouldEqual, 12)
+		cv.So(v[3].SexpString(nil), cv.ShouldEqual, "[0 1 2]")
+		cv.So(env.datastack.Size(), cv.ShouldEqual, 0)
+
+		// an error with no catch runs finally, then goes on up
+		// with its message unchanged.
+		env.Clear()
+		_, err = env.EvalString(`(def done false) (try (error "boom") (finally (set done true)))`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldEqual, "1:23: boom")
+		done, _ := env.FindObject("done")
+		cv.So(done.(*SexpBool).Val, cv.ShouldBeTrue)
+
+		// a thrown value reaches Go as the ScriptError's Value.
+		env.Clear()
+		_, err = env.EvalString(`(throw "plain")`)
+		var se *ScriptError
+		cv.So(errors.As(err, &se), cv.ShouldBeTrue)
+		cv.So(se.Value.(*SexpStr).S, cv.ShouldEqual, "plain")
+
+		// a catch body that fails leaves no scope behind.
+		env.Clear()
+		res, err = env.EvalString(`(defn rethrow [] (try (throw "a") (catch e (throw "b")))) (try (rethrow) (catch f f))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"b"`)
+		depth := env.linearstack.Size()
+		body := []Sexp{MakeList([]Sexp{env.MakeSymbol("throw"), &SexpStr{S: "b"}})}
+		_, err = evalCatch(env, &tryClause{sym: env.MakeSymbol("e"), body: body}, &SexpStr{S: "a"})
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(env.linearstack.Size(), cv.ShouldEqual, depth)
+	})
+
+	cv.Convey(`Given a budget, running out of it inside a try should not be catchable`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.SetLimits(Limits{MaxInstructions: 2000})
+
+		_, err := env.EvalString(`(try (for [(def i 0) true (set i (+ i 1))] i) (catch e "caught"))`)
+		cv.So(errors.Is(err, ErrBudgetExceeded), cv.ShouldBeTrue)
+	})
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"os"
 	"strings"
 )
 
@@ -21,10 +20,10 @@ func SlurpfileFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, fmt.Errorf("slurp requires a string path to read. we got type %T / value = %v", args[0], args[0])
 	}
 
-	if !FileExists(string(fn)) {
-		return SexpNull, fmt.Errorf("file '%s' does not exist", fn)
+	if err := env.checkFile(fn); err != nil {
+		return SexpNull, err
 	}
-	f, err := os.Open(fn)
+	f, err := env.openFile(fn)
 	if err != nil {
 		return SexpNull, err
 	}
@@ -80,14 +79,14 @@ func WriteToFileFunction(name string) ZlispUserFunction {
 
 		if name == "write" || name == "writef" || name == "save" {
 			// don't overwrite existing file
-			if FileExists(fn) {
+			if env.fileExists(fn) {
 				return SexpNull, fmt.Errorf("refusing to write to existing file '%s'",
 					fn)
 			}
 		}
 		// owrite / owritef overwrite indiscriminately.
 
-		f, err := os.Create(fn)
+		f, err := env.createFile(fn)
 		if err != nil {
 			return SexpNull, err
 		}
@@ -20,13 +20,13 @@ func SimpleSourceFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	}
 
 	file := src.S
-	if !FileExists(file) {
+	if !env.fileExists(file) {
 		return SexpNull, fmt.Errorf("path '%s' does not exist", file)
 	}
 
 	env2 := env.Duplicate()
 
-	f, err := os.Open(file)
+	f, err := env.openFile(file)
 	if err != nil {
 		return SexpNull, err
 	}
@@ -52,9 +52,16 @@ func (env *Zlisp) SourceExpressions(expressions []Sexp) error {
 	if err != nil {
 		return err
 	}
+	gen.optimize()
 	//P("debug: in SourceExpressions, FROM expressions='%s'", (&SexpArray{Val: expressions, Env: env}).SexpString(0))
 	//P("debug: in SourceExpressions, gen=")
 	//DumpFunction(ZlispFunction(gen.instructions), -1)
+	return env.sourceCode(gen.instructions, gen.positions)
+}
+
+// sourceCode runs generated code the way (source) does,
+// leaving its result on the datastack.
+func (env *Zlisp) sourceCode(code []Instruction, positions []SrcPos) error {
 	curfunc := env.curfunc
 	curpc := env.pc
 	defer func() {
@@ -63,7 +70,8 @@ func (env *Zlisp) SourceExpressions(expressions []Sexp) error {
 	}()
 
 	env.curfunc = env.MakeFunction("__source", 0, false,
-		gen.instructions, nil)
+		code, nil)
+	env.curfunc.positions = positions
 	env.pc = 0
 
 	result, err := env.Run()
@@ -81,21 +89,29 @@ func (env *Zlisp) SourceExpressions(expressions []Sexp) error {
 }
 
 func (env *Zlisp) SourceStream(stream io.RuneScanner) error {
+	return env.sourceNamedStream(stream, "")
+}
+
+func (env *Zlisp) sourceNamedStream(stream io.RuneScanner, filename string) error {
+	prevName := env.parser.Filename()
+	defer env.parser.SetFilename(prevName)
+
 	env.parser.ResetAddNewInput(stream)
+	env.parser.SetFilename(filename)
 	expressions, err := env.parser.ParseTokens()
 	if err != nil {
-		return errors.New(fmt.Sprintf(
-			"Error parsing on line %d: %v\n", env.parser.Linenum(), err))
+		return scriptError(&SourceError{Pos: env.parser.CurrentPos(), Err: errors.New(fmt.Sprintf(
+			"Error parsing on line %d: %v\n", env.parser.Linenum(), err))})
 	}
 
 	// like LoadExpressions in environment.go, remove comments.
 	expressions = env.FilterArray(expressions, RemoveCommentsFilter)
 
-	return env.SourceExpressions(expressions)
+	return scriptError(env.SourceExpressions(expressions))
 }
 
 func (env *Zlisp) SourceFile(file *os.File) error {
-	return env.SourceStream(bufio.NewReader(file))
+	return env.sourceNamedStream(bufio.NewReader(file), file.Name())
 }
 
 func SourceFileFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
@@ -135,14 +151,16 @@ func (env *Zlisp) sourceItem(item Sexp) error {
 			expr = list.Tail
 		}
 	case *SexpStr:
-		var f *os.File
-		var err error
+		if done, err := env.sourceCompiled(t.S); done {
+			return err
+		}
 
-		if f, err = os.Open(t.S); err != nil {
+		f, err := env.openFile(t.S)
+		if err != nil {
 			return err
 		}
 		defer f.Close()
-		if err = env.SourceFile(f); err != nil {
+		if err = env.sourceNamedStream(bufio.NewReader(f), t.S); err != nil {
 			return err
 		}
 
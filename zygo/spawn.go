@@ -0,0 +1,422 @@
+package zygo
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Concurrency
+// ===========
+//
+// (spawn f args...) calls f on a new goroutine, in a child
+// environment of its own, and returns a task handle at
+// once. (wait task) blocks until f returns, yielding its
+// value or raising its error.
+//
+// The child starts from a snapshot of the spawning
+// environment: globals, the arguments, and the variables
+// captured by closures are copied, arrays, hashes and
+// lists included, so neither side can see the other's
+// later changes. Builtins, macros and the type registry
+// are layered so that definitions made by the task stay in
+// the task. Channels (makeChan) are the one thing shared
+// on purpose; communicate through them, and through the
+// task's return value. Values sent on a channel are not
+// copied, so don't modify them after sending. Symbols are
+// interned in a table common to both, which locks.
+//
+// Go values embedded in records (shadow structs) and
+// packages are shared, not copied; leave them alone while
+// tasks run.
+
+// SexpTask is the handle returned by (spawn).
+type SexpTask struct {
+	name string
+	done chan struct{}
+	res  Sexp
+	err  error
+}
+
+func (t *SexpTask) SexpString(ps *PrintState) string {
+	return fmt.Sprintf("[task %s]", t.name)
+}
+
+func (t *SexpTask) Type() *RegisteredType {
+	return nil
+}
+
+// Done is closed once the task has finished.
+func (t *SexpTask) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait blocks until the task finishes, returning the
+// value or error of the spawned function.
+func (t *SexpTask) Wait() (Sexp, error) {
+	<-t.done
+	return t.res, t.err
+}
+
+// Spawn starts fun(args...) on a new goroutine; see above
+// for what the child environment shares with env.
+func (env *Zlisp) Spawn(fun *SexpFunction, args []Sexp) *SexpTask {
+	child, iso := env.spawnEnv()
+	fun = iso.copy(fun).(*SexpFunction)
+	cargs := make([]Sexp, len(args))
+	for i := range args {
+		cargs[i] = iso.copy(args[i])
+	}
+	child.funcCopies = iso.functions()
+
+	t := &SexpTask{name: fun.name, done: make(chan struct{})}
+	go func() {
+		defer close(t.done)
+		defer child.Close()
+		defer func() {
+			if r := recover(); r != nil {
+				t.res = SexpNull
+				t.err = fmt.Errorf("spawned function '%s' panicked: %v", t.name, r)
+			}
+		}()
+		t.res, t.err = child.Apply(fun, cargs)
+	}()
+	return t
+}
+
+// spawnEnv makes the child environment for a task.
+func (env *Zlisp) spawnEnv() (*Zlisp, *isolator) {
+	child := env.Duplicate()
+	child.parser = child.NewParser()
+
+	child.builtins = make(map[int]*SexpFunction, len(env.builtins))
+	for k, v := range env.builtins {
+		child.builtins[k] = v
+	}
+	child.macros = make(map[int]*SexpFunction, len(env.macros))
+	for k, v := range env.macros {
+		child.macros[k] = v
+	}
+	child.infixOps = make(map[string]*InfixOp, len(env.infixOps))
+	for k, v := range env.infixOps {
+		child.infixOps[k] = v
+	}
+	child.types = NewGoStructRegistry(env.TypeRegistry())
+
+	iso := newIsolator(child)
+	glob := env.linearstack.elements[0].(*Scope)
+	child.linearstack.elements[0] = iso.scope(glob)
+	return child, iso
+}
+
+// isolator deep-copies the mutable values handed to a
+// task, preserving sharing and cycles among them.
+type isolator struct {
+	env    *Zlisp
+	seen   map[Sexp]Sexp
+	scopes map[*Scope]*Scope
+	// packages are copied too, if set.
+	packages bool
+}
+
+func newIsolator(env *Zlisp) *isolator {
+	return &isolator{
+		env:    env,
+		seen:   make(map[Sexp]Sexp),
+		scopes: make(map[*Scope]*Scope),
+	}
+}
+
+func (iso *isolator) copy(x Sexp) Sexp {
+	if c, ok := iso.seen[x]; ok {
+		return c
+	}
+	switch e := x.(type) {
+	case *SexpArray:
+		cp := *e
+		cp.Env = iso.env
+		cp.Val = make([]Sexp, len(e.Val))
+		iso.seen[x] = &cp
+		for i, v := range e.Val {
+			cp.Val[i] = iso.copy(v)
+		}
+		return &cp
+
+	case *SexpPair:
+		cp := *e
+		iso.seen[x] = &cp
+		cp.Head = iso.copy(e.Head)
+		cp.Tail = iso.copy(e.Tail)
+		return &cp
+
+	case *SexpHash:
+		cp := *e
+		cp.Env = iso.env
+		iso.seen[x] = &cp
+		cp.Map = make(map[int][]*SexpPair, len(e.Map))
+		for k, pairs := range e.Map {
+			cpairs := make([]*SexpPair, len(pairs))
+			for i, p := range pairs {
+				cpairs[i] = Cons(iso.copy(p.Head), iso.copy(p.Tail))
+			}
+			cp.Map[k] = cpairs
+		}
+		cp.KeyOrder = make([]Sexp, len(e.KeyOrder))
+		for i, k := range e.KeyOrder {
+			cp.KeyOrder[i] = iso.copy(k)
+		}
+		return &cp
+
+	case *Stack:
+		if !iso.packages {
+			return x
+		}
+		cp := *e
+		cp.env = iso.env
+		cp.elements = make([]StackElem, len(e.elements))
+		iso.seen[x] = &cp
+		for i, elem := range e.elements {
+			if s, ok := elem.(*Scope); ok {
+				cp.elements[i] = iso.scope(s)
+			} else {
+				cp.elements[i] = elem
+			}
+		}
+		return &cp
+
+	case *SexpFunction:
+		if e.closingOverScopes == nil && e.parent == nil {
+			// nothing captured, nothing mutable.
+			return x
+		}
+		cp := e.Copy()
+		iso.seen[x] = cp
+		if e.closingOverScopes != nil {
+			cp.closingOverScopes = iso.closing(e.closingOverScopes)
+		}
+		if e.parent != nil {
+			cp.parent = iso.copy(e.parent).(*SexpFunction)
+		}
+		iso.code(e.fun)
+		return cp
+	}
+	return x
+}
+
+// code copies the function templates that e's
+// instructions refer to. Function scopes look up captured
+// variables through their template, so the task must not
+// reach the parent's scopes that way; see ownFunction.
+func (iso *isolator) code(fun ZlispFunction) {
+	for _, instr := range fun {
+		switch in := instr.(type) {
+		case AddFuncScopeInstr:
+			if in.Helper != nil && in.Helper.MyFunction != nil {
+				iso.copy(in.Helper.MyFunction)
+			}
+		case CreateClosureInstr:
+			iso.copy(in.sfun)
+		}
+	}
+}
+
+// functions returns the copy made of each function.
+func (iso *isolator) functions() map[*SexpFunction]*SexpFunction {
+	m := make(map[*SexpFunction]*SexpFunction)
+	for orig, cp := range iso.seen {
+		if f, ok := orig.(*SexpFunction); ok {
+			m[f] = cp.(*SexpFunction)
+		}
+	}
+	return m
+}
+
+// ownFunction maps a function shared with the parent of
+// a spawned task to the task's private copy of it.
+func (env *Zlisp) ownFunction(f *SexpFunction) *SexpFunction {
+	if cp, ok := env.funcCopies[f]; ok {
+		return cp
+	}
+	return f
+}
+
+func (iso *isolator) closing(c *Closing) *Closing {
+	stk := iso.env.NewStack(c.Stack.Size())
+	for _, elem := range c.Stack.elements[:c.Stack.tos+1] {
+		if s, ok := elem.(*Scope); ok {
+			stk.Push(iso.scope(s))
+		} else {
+			stk.Push(elem)
+		}
+	}
+	return &Closing{Stack: stk, Name: c.Name, env: iso.env}
+}
+
+func (iso *isolator) scope(s *Scope) *Scope {
+	if c, ok := iso.scopes[s]; ok {
+		return c
+	}
+	cp := *s
+	cp.env = iso.env
+	cp.Map = make(map[int]Sexp, len(s.Map))
+	iso.scopes[s] = &cp
+	if s.layer != nil {
+		cp.layer = newScopeLayer(&cp, s.layer.base, s.layer.gone)
+	}
+	for k, v := range s.Map {
+		cp.Map[k] = iso.copy(v)
+	}
+	if s.slots != nil {
+		cp.slots = make([]Sexp, len(s.slots))
+		for i, v := range s.slots {
+			if v != nil {
+				cp.slots[i] = iso.copy(v)
+			}
+		}
+	}
+	if s.Parent != nil {
+		cp.Parent = iso.scope(s.Parent)
+	}
+	if s.MyFunction != nil {
+		cp.MyFunction = iso.copy(s.MyFunction).(*SexpFunction)
+	}
+	return &cp
+}
+
+func SpawnFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 {
+		return SexpNull, WrongNargs
+	}
+	fun, ok := args[0].(*SexpFunction)
+	if !ok {
+		return SexpNull, fmt.Errorf("first argument to %s must be a function; we saw %T", name, args[0])
+	}
+	return env.Spawn(fun, args[1:]), nil
+}
+
+func WaitFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	t, ok := args[0].(*SexpTask)
+	if !ok {
+		return SexpNull, fmt.Errorf("argument to %s must be a task from (spawn); we saw %T", name, args[0])
+	}
+	select {
+	case <-t.done:
+	case <-env.Context().Done():
+		return SexpNull, fmt.Errorf("evaluation stopped: %w", env.Context().Err())
+	}
+	if t.err != nil {
+		return SexpNull, t.err
+	}
+	return t.res, nil
+}
+
+// (select case... [default:] [timeout: dur])
+//
+// Each case is a channel to receive from, or an array
+// [ch value] to send value on ch. select blocks until one
+// case can proceed, and returns [i v]: the index of that
+// case among the arguments, and the value received (nil
+// for a send). With default:, or when the timeout (a
+// (dur) or a string like "100ms") expires first, it
+// returns [-1 nil] instead of blocking.
+func SelectFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	var cases []reflect.SelectCase
+	nonblocking := false
+	var timeout time.Duration
+
+	for i := 0; i < len(args); i++ {
+		if sym, ok := namedArgSymbol(args[i]); ok {
+			switch sym.name {
+			case "default":
+				nonblocking = true
+			case "timeout":
+				i++
+				if i >= len(args) {
+					return SexpNull, fmt.Errorf("%s: timeout: needs a duration", name)
+				}
+				d, err := selectTimeout(args[i])
+				if err != nil {
+					return SexpNull, fmt.Errorf("%s: %v", name, err)
+				}
+				timeout = d
+			default:
+				return SexpNull, fmt.Errorf("%s: unknown option '%s:'", name, sym.name)
+			}
+			continue
+		}
+
+		switch c := args[i].(type) {
+		case *SexpChannel:
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(c.Val),
+			})
+		case *SexpArray:
+			ch, ok := sendCaseChannel(c)
+			if !ok {
+				return SexpNull, fmt.Errorf("%s: a send case must be [channel value]", name)
+			}
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectSend,
+				Chan: reflect.ValueOf(ch.Val),
+				Send: reflect.ValueOf(&c.Val[1]).Elem(),
+			})
+		default:
+			return SexpNull, fmt.Errorf("%s: case %d must be a channel or "+
+				"[channel value]; we saw %T", name, len(cases), args[i])
+		}
+	}
+	ncase := len(cases)
+
+	if nonblocking {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	} else {
+		if timeout > 0 {
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(time.After(timeout)),
+			})
+		}
+		if done := env.Context().Done(); done != nil {
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(done),
+			})
+		}
+	}
+
+	chosen, recv, recvOK := reflect.Select(cases)
+	if chosen >= ncase {
+		if err := env.Context().Err(); err != nil && !nonblocking {
+			return SexpNull, fmt.Errorf("evaluation stopped: %w", err)
+		}
+		return env.NewSexpArray([]Sexp{&SexpInt{Val: -1}, SexpNull}), nil
+	}
+
+	var val Sexp = SexpNull
+	if cases[chosen].Dir == reflect.SelectRecv && recvOK && !recv.IsNil() {
+		val = recv.Interface().(Sexp)
+	}
+	return env.NewSexpArray([]Sexp{&SexpInt{Val: int64(chosen)}, val}), nil
+}
+
+func sendCaseChannel(arr *SexpArray) (*SexpChannel, bool) {
+	if len(arr.Val) != 2 {
+		return nil, false
+	}
+	ch, ok := arr.Val[0].(*SexpChannel)
+	return ch, ok
+}
+
+func selectTimeout(x Sexp) (time.Duration, error) {
+	switch t := x.(type) {
+	case *SexpDur:
+		return t.Dur, nil
+	case *SexpStr:
+		return time.ParseDuration(t.S)
+	}
+	return 0, fmt.Errorf("timeout: must be a (dur) or a duration string; we saw %T", x)
+}
@@ -0,0 +1,101 @@
+package zygo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+// run these with -race; the point is that nothing the
+// tasks touch is shared with the parent, or each other.
+
+func Test090SpawnedTasksDoNotRace(t *testing.T) {
+
+	cv.Convey(`Given many tasks that define, rebind and mutate globals, arrays, hashes and closures, each should see only its own copy`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		env.ImportChannels()
+
+		res, err := env.EvalString(`
+(def shared [0 0 0])
+(def h (hash a: 1))
+(def g 0)
+(def mk (let [n 0] (fn [] (set n (+ n 1)) n)))
+(defn churn [id]
+  (for [(def i 0) (< i 50) (set i (+ i 1))]
+     (aset shared 0 (+ (aget shared 0) 1))
+     (hset h %a i)
+     (set g id)
+     (mk)
+     (def fresh (concat "sym" (str id))))
+  [(aget shared 0) (mk) g])
+(def tasks [])
+(for [(def k 0) (< k 8) (set k (+ k 1))]
+   (set tasks (append tasks (spawn churn k))))
+(def got [])
+(for [(def k 0) (< k 8) (set k (+ k 1))]
+   (set got (append got (wait (aget tasks k)))))`)
+		cv.So(err, cv.ShouldBeNil)
+		res, found := env.FindObject("got")
+		cv.So(found, cv.ShouldBeTrue)
+		got := res.(*SexpArray).Val
+		cv.So(len(got), cv.ShouldEqual, 8)
+		for k, x := range got {
+			v := x.(*SexpArray).Val
+			cv.So(v[0].(*SexpInt).Val, cv.ShouldEqual, 50)
+			cv.So(v[1].(*SexpInt).Val, cv.ShouldEqual, 51)
+			cv.So(v[2].(*SexpInt).Val, cv.ShouldEqual, k)
+		}
+
+		// and the parent's values are untouched.
+		res, err = env.EvalString(`[(aget shared 0) (hget h %a) g (mk)]`)
+		cv.So(err, cv.ShouldBeNil)
+		v := res.(*SexpArray).Val
+		cv.So(v[0].(*SexpInt).Val, cv.ShouldEqual, 0)
+		cv.So(v[1].(*SexpInt).Val, cv.ShouldEqual, 1)
+		cv.So(v[2].(*SexpInt).Val, cv.ShouldEqual, 0)
+		cv.So(v[3].(*SexpInt).Val, cv.ShouldEqual, 1)
+	})
+}
+
+func Test091SelectAndWaitHonorTheContext(t *testing.T) {
+
+	cv.Convey(`Given a select or wait that can never proceed, cancelling the context should unblock it`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.ImportChannels()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := env.EvalStringContext(ctx, `(def never (makeChan)) (select never)`)
+		cv.So(errors.Is(err, context.DeadlineExceeded), cv.ShouldBeTrue)
+
+		env.Clear()
+		ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel2()
+		_, err = env.EvalStringContext(ctx2, `(defn stuck [] (<! (makeChan))) (wait (spawn stuck))`)
+		cv.So(errors.Is(err, context.DeadlineExceeded), cv.ShouldBeTrue)
+	})
+
+	cv.Convey(`Given a task started from Go, Wait should return its result`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.ImportChannels()
+
+		_, err := env.EvalString(`(defn add [a b] (+ a b))`)
+		panicOn(err)
+		fn, found := env.FindObject("add")
+		cv.So(found, cv.ShouldBeTrue)
+		task := env.Spawn(fn.(*SexpFunction), []Sexp{&SexpInt{Val: 2}, &SexpInt{Val: 3}})
+		res, err := task.Wait()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 5)
+	})
+}
@@ -242,7 +242,7 @@ func (s *Stack) nestedPathGetSet(env *Zlisp, dotpaths []string, setVal *Sexp) (S
 			}
 
 			// assign now
-			scop.Map[curSym.number] = *setVal
+			scop.bind(curSym.number, *setVal)
 			// done with SET
 			return *setVal, nil
 		}
@@ -0,0 +1,444 @@
+package zygo
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Strings
+// =======
+//
+// The strings and unicode/utf8 functions, so that text work
+// need not go out to sed:
+//
+//	(contains s sub) (hasPrefix s p) (hasSuffix s p)
+//	(index s sub) (lastIndex s sub)
+//	(replace s old new n) (replaceAll s old new)
+//	(join strs sep) (fields s) (repeat s n)
+//	(upper s) (lower s) (title s)
+//	(padLeft s width) (padRight s width pad)
+//	(trimPrefix s p) (trimSuffix s p) (trimLeft s) (trimRight s cutset)
+//	(runeLen s) (substr s start) (substr s start end)
+//
+// Positions and lengths count runes, not bytes, so that the
+// index of a substring is where substr finds it, whatever the
+// text; len and slice still count bytes. trimLeft and
+// trimRight take off white space, or the runes of a cutset.
+// join takes an array or list of strings or chars, and a pad
+// is a string or char, a space if not given.
+//
+// A strBuilder accumulates a string without copying it at
+// each step:
+//
+//	(def b (strBuilder))
+//	(strWrite b "n=" 3 '\n')
+//	(strBuilderString b)  ; "n=3\n"
+//
+// strWrite writes strings and chars as they are, and other
+// values as they print. These are globals rather than
+// builtins, so that a host's own (AddGoFunc "repeat" ...), or
+// a script's own join, goes on being used.
+
+func (env *Zlisp) ImportStrings() {
+	for _, name := range []string{"contains", "hasPrefix", "hasSuffix",
+		"index", "lastIndex", "trimPrefix", "trimSuffix"} {
+		env.AddFunction(name, StringPairFunction(name))
+	}
+	for _, name := range []string{"upper", "lower", "title", "fields", "runeLen"} {
+		env.AddFunction(name, StringUnaryFunction(name))
+	}
+	env.AddFunction("trimLeft", TrimSideFunction)
+	env.AddFunction("trimRight", TrimSideFunction)
+	env.AddFunction("replace", ReplaceFunction)
+	env.AddFunction("replaceAll", ReplaceFunction)
+	env.AddFunction("join", JoinFunction)
+	env.AddFunction("repeat", RepeatFunction)
+	env.AddFunction("padLeft", PadFunction)
+	env.AddFunction("padRight", PadFunction)
+	env.AddFunction("substr", SubstrFunction)
+	env.AddFunction("strBuilder", StrBuilderFunction)
+	env.AddFunction("strWrite", StrWriteFunction)
+	env.AddFunction("strBuilderString", StrBuilderStringFunction)
+}
+
+// textArg returns args[i] as a string, for a string or a char.
+func textArg(args []Sexp, i int) (string, error) {
+	switch t := args[i].(type) {
+	case *SexpStr:
+		return t.S, nil
+	case *SexpChar:
+		return string(t.Val), nil
+	}
+	return "", fmt.Errorf("argument %d must be a string, got %T", i+1, args[i])
+}
+
+// intArg returns args[i] as an int.
+func intArg(args []Sexp, i int) (int, error) {
+	n, ok := args[i].(*SexpInt)
+	if !ok {
+		return 0, fmt.Errorf("argument %d must be an integer, got %T", i+1, args[i])
+	}
+	return int(n.Val), nil
+}
+
+// runeIndex turns byte position i in s, or -1, into a rune position.
+func runeIndex(s string, i int) int {
+	if i < 0 {
+		return i
+	}
+	return utf8.RuneCountInString(s[:i])
+}
+
+// StringPairFunction gives the functions of a string and
+// a second string to look for in it.
+func StringPairFunction(name string) ZlispUserFunction {
+	return func(env *Zlisp, _ string, args []Sexp) (Sexp, error) {
+		if len(args) != 2 {
+			return SexpNull, WrongNargs
+		}
+		s, err := textArg(args, 0)
+		if err != nil {
+			return SexpNull, err
+		}
+		t, err := textArg(args, 1)
+		if err != nil {
+			return SexpNull, err
+		}
+
+		switch name {
+		case "contains":
+			return &SexpBool{Val: strings.Contains(s, t)}, nil
+		case "hasPrefix":
+			return &SexpBool{Val: strings.HasPrefix(s, t)}, nil
+		case "hasSuffix":
+			return &SexpBool{Val: strings.HasSuffix(s, t)}, nil
+		case "index":
+			return &SexpInt{Val: int64(runeIndex(s, strings.Index(s, t)))}, nil
+		case "lastIndex":
+			return &SexpInt{Val: int64(runeIndex(s, strings.LastIndex(s, t)))}, nil
+		case "trimPrefix":
+			return &SexpStr{S: strings.TrimPrefix(s, t)}, nil
+		case "trimSuffix":
+			return &SexpStr{S: strings.TrimSuffix(s, t)}, nil
+		}
+		return SexpNull, fmt.Errorf("unrecognized command '%s'", name)
+	}
+}
+
+// StringUnaryFunction gives the functions of one string.
+func StringUnaryFunction(name string) ZlispUserFunction {
+	return func(env *Zlisp, _ string, args []Sexp) (Sexp, error) {
+		if len(args) != 1 {
+			return SexpNull, WrongNargs
+		}
+		s, err := textArg(args, 0)
+		if err != nil {
+			return SexpNull, err
+		}
+
+		switch name {
+		case "upper":
+			return &SexpStr{S: strings.ToUpper(s)}, nil
+		case "lower":
+			return &SexpStr{S: strings.ToLower(s)}, nil
+		case "title":
+			return &SexpStr{S: title(s)}, nil
+		case "fields":
+			f := strings.Fields(s)
+			arr := make([]Sexp, len(f))
+			for i := range f {
+				arr[i] = &SexpStr{S: f[i]}
+			}
+			return env.NewSexpArray(arr), nil
+		case "runeLen":
+			return &SexpInt{Val: int64(utf8.RuneCountInString(s))}, nil
+		}
+		return SexpNull, fmt.Errorf("unrecognized command '%s'", name)
+	}
+}
+
+// title upper-cases the first letter of each word; words
+// are separated by white space.
+func title(s string) string {
+	var b strings.Builder
+	prev := ' '
+	for _, r := range s {
+		if unicode.IsSpace(prev) {
+			b.WriteRune(unicode.ToTitle(r))
+		} else {
+			b.WriteRune(r)
+		}
+		prev = r
+	}
+	return b.String()
+}
+
+// (trimLeft s) and (trimRight s) take off white space;
+// (trimLeft s cutset) and (trimRight s cutset), the runes in cutset.
+func TrimSideFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	s, err := textArg(args, 0)
+	if err != nil {
+		return SexpNull, err
+	}
+	if len(args) == 1 {
+		if name == "trimLeft" {
+			return &SexpStr{S: strings.TrimLeftFunc(s, unicode.IsSpace)}, nil
+		}
+		return &SexpStr{S: strings.TrimRightFunc(s, unicode.IsSpace)}, nil
+	}
+	cutset, err := textArg(args, 1)
+	if err != nil {
+		return SexpNull, err
+	}
+	if name == "trimLeft" {
+		return &SexpStr{S: strings.TrimLeft(s, cutset)}, nil
+	}
+	return &SexpStr{S: strings.TrimRight(s, cutset)}, nil
+}
+
+// (replace s old new n) replaces the first n of old, or all
+// if n < 0; (replaceAll s old new) replaces all.
+func ReplaceFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	n := -1
+	switch {
+	case name == "replace" && len(args) == 4:
+		var err error
+		n, err = intArg(args, 3)
+		if err != nil {
+			return SexpNull, err
+		}
+	case name == "replaceAll" && len(args) == 3:
+	default:
+		return SexpNull, WrongNargs
+	}
+	var strs [3]string
+	for i := range strs {
+		var err error
+		strs[i], err = textArg(args, i)
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	s, old, repl := strs[0], strs[1], strs[2]
+	count := strings.Count(s, old)
+	if n >= 0 && n < count {
+		count = n
+	}
+	err := env.checkAlloc("string", len(s)+count*(len(repl)-len(old)))
+	if err != nil {
+		return SexpNull, err
+	}
+	return &SexpStr{S: strings.Replace(s, old, repl, n)}, nil
+}
+
+// (join strs sep) joins an array or list of strings, or chars.
+func JoinFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	var elems []Sexp
+	switch c := args[0].(type) {
+	case *SexpArray:
+		elems = c.Val
+	default:
+		var err error
+		elems, err = ListToArray(args[0])
+		if err != nil {
+			return SexpNull, fmt.Errorf("join requires an array or list of strings, got %T", args[0])
+		}
+	}
+	sep, err := textArg(args, 1)
+	if err != nil {
+		return SexpNull, err
+	}
+	strs := make([]string, len(elems))
+	size := 0
+	for i := range elems {
+		strs[i], err = textArg(elems, i)
+		if err != nil {
+			return SexpNull, fmt.Errorf("join: element %d must be a string, got %T", i, elems[i])
+		}
+		size += len(strs[i]) + len(sep)
+	}
+	err = env.checkAlloc("string", size)
+	if err != nil {
+		return SexpNull, err
+	}
+	return &SexpStr{S: strings.Join(strs, sep)}, nil
+}
+
+// (repeat s n) gives n copies of s.
+func RepeatFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 {
+		return SexpNull, WrongNargs
+	}
+	s, err := textArg(args, 0)
+	if err != nil {
+		return SexpNull, err
+	}
+	n, err := intArg(args, 1)
+	if err != nil {
+		return SexpNull, err
+	}
+	if n < 0 {
+		return SexpNull, fmt.Errorf("repeat count must not be negative, got %d", n)
+	}
+	// checked before multiplying, which could overflow.
+	if len(s) > 0 && n > math.MaxInt/len(s) {
+		return SexpNull, fmt.Errorf("repeat count %d is too large for a string of %d bytes", n, len(s))
+	}
+	err = env.checkAlloc("string", n*len(s))
+	if err != nil {
+		return SexpNull, err
+	}
+	return &SexpStr{S: strings.Repeat(s, n)}, nil
+}
+
+// (padLeft s width) and (padRight s width) pad s with spaces,
+// or with (padLeft s width pad), to width runes.
+func PadFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return SexpNull, WrongNargs
+	}
+	s, err := textArg(args, 0)
+	if err != nil {
+		return SexpNull, err
+	}
+	width, err := intArg(args, 1)
+	if err != nil {
+		return SexpNull, err
+	}
+	pad := " "
+	if len(args) == 3 {
+		pad, err = textArg(args, 2)
+		if err != nil {
+			return SexpNull, err
+		}
+		if pad == "" {
+			return SexpNull, fmt.Errorf("%s needs a pad that is not empty", name)
+		}
+	}
+	short := width - utf8.RuneCountInString(s)
+	if short <= 0 {
+		return &SexpStr{S: s}, nil
+	}
+	if short > (math.MaxInt-len(s))/len(pad) {
+		return SexpNull, fmt.Errorf("%s width %d is too large", name, width)
+	}
+	err = env.checkAlloc("string", len(s)+short*len(pad))
+	if err != nil {
+		return SexpNull, err
+	}
+	// a pad of several runes is cut to fit.
+	padding := []rune(strings.Repeat(pad, short))[:short]
+	if name == "padLeft" {
+		return &SexpStr{S: string(padding) + s}, nil
+	}
+	return &SexpStr{S: s + string(padding)}, nil
+}
+
+// (substr s start) and (substr s start end) give the runes
+// from start up to end, or to the end of s.
+func SubstrFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return SexpNull, WrongNargs
+	}
+	s, err := textArg(args, 0)
+	if err != nil {
+		return SexpNull, err
+	}
+	runes := []rune(s)
+	start, err := intArg(args, 1)
+	if err != nil {
+		return SexpNull, err
+	}
+	end := len(runes)
+	if len(args) == 3 {
+		end, err = intArg(args, 2)
+		if err != nil {
+			return SexpNull, err
+		}
+	}
+	if start < 0 || end > len(runes) || start > end {
+		return SexpNull, fmt.Errorf("[%d:%d] is out of range for %d runes", start, end, len(runes))
+	}
+	return &SexpStr{S: string(runes[start:end])}, nil
+}
+
+// SexpStrBuilder is a strings.Builder, made by strBuilder.
+type SexpStrBuilder struct {
+	B strings.Builder
+}
+
+func (sb *SexpStrBuilder) SexpString(ps *PrintState) string {
+	return fmt.Sprintf("(strBuilder %q)", sb.B.String())
+}
+
+func (sb *SexpStrBuilder) Type() *RegisteredType {
+	return nil
+}
+
+// (strBuilder) makes a builder; (strBuilder x ...) starts it
+// off as (strWrite b x ...) would.
+func StrBuilderFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	sb := &SexpStrBuilder{}
+	err := sb.write(env, args)
+	if err != nil {
+		return SexpNull, err
+	}
+	return sb, nil
+}
+
+// (strWrite b x ...) writes each x to b, and returns b.
+func StrWriteFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) < 1 {
+		return SexpNull, WrongNargs
+	}
+	sb, ok := args[0].(*SexpStrBuilder)
+	if !ok {
+		return SexpNull, fmt.Errorf("strWrite requires a strBuilder, got %T", args[0])
+	}
+	err := sb.write(env, args[1:])
+	if err != nil {
+		return SexpNull, err
+	}
+	return sb, nil
+}
+
+func (sb *SexpStrBuilder) write(env *Zlisp, args []Sexp) error {
+	for _, x := range args {
+		var s string
+		switch t := x.(type) {
+		case *SexpStr:
+			s = t.S
+		case *SexpChar:
+			s = string(t.Val)
+		default:
+			s = x.SexpString(nil)
+		}
+		err := env.checkAlloc("string", sb.B.Len()+len(s))
+		if err != nil {
+			return err
+		}
+		sb.B.WriteString(s)
+	}
+	return nil
+}
+
+// (strBuilderString b) gives what has been written to b.
+func StrBuilderStringFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	sb, ok := args[0].(*SexpStrBuilder)
+	if !ok {
+		return SexpNull, fmt.Errorf("strBuilderString requires a strBuilder, got %T", args[0])
+	}
+	return &SexpStr{S: sb.B.String()}, nil
+}
@@ -0,0 +1,72 @@
+package zygo
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test300StringsLibrary(t *testing.T) {
+
+	cv.Convey(`Given the strings library, it should search, edit and measure strings, counting positions in runes`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		res, err := env.EvalString(`
+(def s "héllo wörld")
+[(contains s "wö") (hasPrefix s "hé") (hasSuffix s 'd') (index s "o") (lastIndex s "l") (index s "z")
+ (substr s (index s "w")) (substr s 1 4) (runeLen s) (len s)
+ (replace "aaa" "a" "b" 1) (replaceAll s "l" "L") (join (list "a" 'b' "c") "/") (fields " x  y ")
+ (upper s) (lower "ÉA") (title s) (repeat "-" 3)
+ (padLeft "42" 5 '0') (padRight "ab" 3) (padLeft "ab" 5 "xy")
+ (trimPrefix s "hé") (trimSuffix s "örld") (trimLeft "\t x") (trimRight "x..!" ".!")]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[true true true 4 9 -1 "wörld" "éll" 11 13 "baa" "héLLo wörLd" "a/b/c" ["x" "y"] "HÉLLO WÖRLD" "éa" "Héllo Wörld" "---" "00042" "ab " "xyxab" "llo wörld" "héllo w" "x" "x"]`)
+	})
+
+	cv.Convey(`Given a strBuilder, strWrite should accumulate strings, chars and printed values`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		res, err := env.EvalString(`
+(def b (strBuilder "["))
+(for [(def i 0) (< i 3) (def i (+ i 1))] (strWrite b i ','))
+(strBuilderString (strWrite b "]"))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `"[0,1,2,]"`)
+	})
+
+	cv.Convey(`Given bad arguments or limits, the strings library should return errors`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		for src, msg := range map[string]string{
+			`(contains 1 "a")`:                      "argument 1 must be a string",
+			`(substr "abc" 2 1)`:                    "[2:1] is out of range for 3 runes",
+			`(repeat "a" -1)`:                       "repeat count must not be negative",
+			`(repeat "ab" 0x7fffffffffffffff)`:      "repeat count 9223372036854775807 is too large for a string of 2 bytes",
+			`(padLeft "a" 0x7fffffffffffffff "ab")`: "padLeft width 9223372036854775807 is too large",
+			`(join ["a" 1] ",")`:                    "join: element 1 must be a string",
+			`(padLeft "a" 3 "")`:                    "padLeft needs a pad that is not empty",
+			`(strWrite "a" "b")`:                    "strWrite requires a strBuilder",
+			`(replace "a" "a" "b")`:                 "wrong number of arguments",
+			`(padRight "a" "3")`:                    "argument 2 must be an integer",
+			`(trimLeft "a" "b" "c")`:                "wrong number of arguments",
+			`(strBuilderString "ab")`:               "strBuilderString requires a strBuilder",
+		} {
+			_, err := env.EvalString(src)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, msg)
+		}
+
+		env.SetLimits(Limits{MaxStringLen: 100})
+		for _, src := range []string{`(repeat "ab" 51)`, `(padLeft "" 101)`, `(strWrite (strBuilder) (repeat "a" 60) (repeat "b" 60))`} {
+			_, err := env.EvalString(src)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "string length")
+		}
+	})
+}
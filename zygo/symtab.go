@@ -0,0 +1,181 @@
+package zygo
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// symbolTable interns symbol names to the numbers that
+// scopes are keyed by. One table is shared by an
+// environment and every child made from it, including
+// spawned tasks running on other goroutines, so it locks.
+//
+// An environment from an EnvPool has an overlay: a table
+// with a base, the pool's, that it only reads. Names the
+// base has keep their numbers; new names, gensyms among
+// them, are numbered in the overlay, well clear of the
+// base's numbers, and go when the environment does.
+type symbolTable struct {
+	mu   sync.RWMutex
+	num  map[string]int
+	name map[int]string
+	next int
+	base *symbolTable
+
+	// hyphenated holds the registered names, such as
+	// with-output-to-string, that the lexer reads as one
+	// symbol rather than as words and minus signs.
+	hyphenated map[string]bool
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{
+		num:        make(map[string]int),
+		name:       make(map[int]string),
+		next:       1,
+		hyphenated: make(map[string]bool),
+	}
+}
+
+// overlayGap is how far above the base's next number an
+// overlay starts numbering its own names.
+const overlayGap = 1 << 24
+
+func newSymbolOverlay(base *symbolTable) *symbolTable {
+	t := newSymbolTable()
+	t.base = base
+	base.mu.RLock()
+	t.next = base.next + overlayGap
+	base.mu.RUnlock()
+	return t
+}
+
+// lookup returns the number of name, if it has one here
+// or in the base.
+func (t *symbolTable) lookup(name string) (int, bool) {
+	t.mu.RLock()
+	n, ok := t.num[name]
+	t.mu.RUnlock()
+	if !ok && t.base != nil {
+		return t.base.lookup(name)
+	}
+	return n, ok
+}
+
+// intern returns the number for name, assigning the
+// next free one if name has not been seen before.
+func (t *symbolTable) intern(name string) int {
+	if n, ok := t.lookup(name); ok {
+		return n
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.internLocked(name)
+}
+
+func (t *symbolTable) internLocked(name string) int {
+	if n, ok := t.num[name]; ok {
+		return n
+	}
+	for {
+		_, used := t.name[t.next]
+		if !used {
+			break
+		}
+		t.next++
+	}
+	n := t.next
+	t.num[name] = n
+	t.name[n] = name
+	t.next++
+	return n
+}
+
+// gensym interns a fresh name made from prefix. Names
+// taken already, by compiled code say, are skipped.
+func (t *symbolTable) gensym(prefix string) (string, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		name := prefix + strconv.Itoa(t.next)
+		_, taken := t.num[name]
+		if !taken && t.base != nil {
+			_, taken = t.base.lookup(name)
+		}
+		if !taken {
+			return name, t.internLocked(name)
+		}
+		t.next++
+	}
+}
+
+func (t *symbolTable) nameOf(n int) string {
+	t.mu.RLock()
+	name, ok := t.name[n]
+	t.mu.RUnlock()
+	if !ok && t.base != nil {
+		return t.base.nameOf(n)
+	}
+	return name
+}
+
+// each calls f on every interned name, in no particular order.
+func (t *symbolTable) each(f func(name string, n int)) {
+	if t.base != nil {
+		t.base.each(f)
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for name, n := range t.num {
+		f(name, n)
+	}
+}
+
+// isHyphenatedName reports whether name is words joined by
+// hyphens, each word starting with a letter.
+func isHyphenatedName(name string) bool {
+	words := strings.Split(name, "-")
+	if len(words) < 2 {
+		return false
+	}
+	for _, w := range words {
+		if w == "" || !unicode.IsLetter([]rune(w)[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// addHyphenated has the lexer read name as one symbol.
+func (t *symbolTable) addHyphenated(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hyphenated[name] = true
+}
+
+func (t *symbolTable) isHyphenated(name string) bool {
+	t.mu.RLock()
+	ok := t.hyphenated[name]
+	t.mu.RUnlock()
+	if !ok && t.base != nil {
+		return t.base.isHyphenated(name)
+	}
+	return ok
+}
+
+// hyphenatedPrefix reports whether some hyphenated name
+// starts with prefix.
+func (t *symbolTable) hyphenatedPrefix(prefix string) bool {
+	t.mu.RLock()
+	for name := range t.hyphenated {
+		if strings.HasPrefix(name, prefix) {
+			t.mu.RUnlock()
+			return true
+		}
+	}
+	t.mu.RUnlock()
+	return t.base != nil && t.base.hyphenatedPrefix(prefix)
+}
@@ -39,6 +39,9 @@ func SystemBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 }
 
 func SystemFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if err := env.allow(CapExec, name); err != nil {
+		return SexpNull, err
+	}
 	if len(args) == 0 {
 		return SexpNull, WrongNargs
 	}
@@ -52,13 +55,22 @@ func SystemFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	}
 
 	joined := strings.Join(flat, " ")
-	cmd := ShellCmd
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command(ShellCmd, "/c", joined)
+	} else {
+		cmd = exec.Command(ShellCmd, "-c", joined)
+	}
+	if env.stdin != nil {
+		cmd.Stdin = env.inputReader()
+	}
 
 	var out []byte
-	if runtime.GOOS == "windows" {
-		out, err = exec.Command(cmd, "/c", joined).CombinedOutput()
+	if env.stderr != nil {
+		cmd.Stderr = env.stderr
+		out, err = cmd.Output()
 	} else {
-		out, err = exec.Command(cmd, "-c", joined).CombinedOutput()
+		out, err = cmd.CombinedOutput()
 	}
 	if err != nil {
 		return SexpNull, fmt.Errorf("error from command: '%s'. Output:'%s'", err, string(Chomp(out)))
@@ -31,6 +31,9 @@ func (t *SexpTime) SexpString(ps *PrintState) string {
 
 func NowFunction(env *Zlisp, name string,
 	args []Sexp) (Sexp, error) {
+	if err := env.allow(CapTime, name); err != nil {
+		return SexpNull, err
+	}
 	return &SexpTime{Tm: time.Now()}, nil
 }
 
@@ -66,6 +69,9 @@ func AsTmFunction(env *Zlisp, name string,
 
 func TimeitFunction(env *Zlisp, name string,
 	args []Sexp) (Sexp, error) {
+	if err := env.allow(CapTime, name); err != nil {
+		return SexpNull, err
+	}
 	nargs := len(args)
 	if nargs != 1 && nargs != 2 {
 		return SexpNull, WrongNargs
@@ -112,9 +118,9 @@ func TimeitFunction(env *Zlisp, name string,
 	}
 
 	elapsed := time.Since(starttime)
-	fmt.Printf("ran %d iterations in %f seconds\n",
+	fmt.Fprintf(env.Output(), "ran %d iterations in %f seconds\n",
 		iterations, elapsed.Seconds())
-	fmt.Printf("average %f seconds per run\n",
+	fmt.Fprintf(env.Output(), "average %f seconds per run\n",
 		elapsed.Seconds()/float64(iterations))
 
 	return SexpNull, nil
@@ -122,6 +128,9 @@ func TimeitFunction(env *Zlisp, name string,
 
 func MillisFunction(env *Zlisp, name string,
 	args []Sexp) (Sexp, error) {
+	if err := env.allow(CapTime, name); err != nil {
+		return SexpNull, err
+	}
 	millis := time.Now().UnixNano() / 1000000
 	return &SexpInt{Val: int64(millis)}, nil
 }
@@ -0,0 +1,199 @@
+package zygo
+
+// Transactions
+// ============
+//
+// EvalTx evaluates like EvalString, but if evaluation
+// fails, for whatever reason, running out of budget
+// included, it first undoes what the script did to
+// variables and hashes: bindings changed by def, set and
+// the like get their old values back, new ones are
+// removed, and hashes get back their old keys and values.
+// In a script, (atomically body...) does the same for
+// body, and then raises the error again, for try to catch.
+// Transactions nest: what an inner one did is kept, or
+// undone, with the outer one.
+//
+// Only variables and hashes are restored, and only those
+// belonging to the environment: arrays changed in place,
+// Go values, files and output stay as they are.
+
+// txLog holds the values, before the transaction, of what
+// it changed.
+type txLog struct {
+	outer  *txLog
+	scopes map[scopeSlot]scopeWas
+	hashes map[*SexpHash]hashWas
+}
+
+type scopeSlot struct {
+	scope *Scope
+	num   int
+}
+
+type scopeWas struct {
+	val   Sexp
+	bound bool
+}
+
+type hashWas struct {
+	m        map[int][]*SexpPair
+	keyOrder []Sexp
+	numKeys  int
+}
+
+// EvalTx is EvalString, with what the script changed
+// undone if it fails.
+func (env *Zlisp) EvalTx(str string) (Sexp, error) {
+	tx := env.beginTx()
+	res, err := env.EvalString(str)
+	env.endTx(tx, err == nil)
+	return res, err
+}
+
+// AtomicallyBuilder implements (atomically body...).
+func AtomicallyBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	state := env.captureControlState()
+	loops := env.loopstack.Size()
+
+	tx := env.beginTx()
+	res, err := EvalFunction(env, name, args)
+	env.endTx(tx, err == nil)
+	if err != nil {
+		env.restoreControlState(state)
+		env.loopstack.TruncateToSize(loops)
+		return SexpNull, raised(err)
+	}
+	return res, nil
+}
+
+func (env *Zlisp) beginTx() *txLog {
+	tx := &txLog{
+		outer:  env.tx,
+		scopes: make(map[scopeSlot]scopeWas),
+		hashes: make(map[*SexpHash]hashWas),
+	}
+	env.tx = tx
+	return tx
+}
+
+// endTx commits tx, into the transaction it is in if any,
+// or rolls it back.
+func (env *Zlisp) endTx(tx *txLog, commit bool) {
+	env.tx = tx.outer
+	if !commit {
+		tx.rollback()
+		return
+	}
+	if outer := tx.outer; outer != nil {
+		for k, was := range tx.scopes {
+			if _, seen := outer.scopes[k]; !seen {
+				outer.scopes[k] = was
+			}
+		}
+		for h, was := range tx.hashes {
+			if _, seen := outer.hashes[h]; !seen {
+				outer.hashes[h] = was
+			}
+		}
+	}
+}
+
+func (tx *txLog) rollback() {
+	for k, was := range tx.scopes {
+		k.scope.restore(k.num, was)
+	}
+	for h, was := range tx.hashes {
+		h.Map = was.m
+		h.KeyOrder = was.keyOrder
+		h.NumKeys = was.numKeys
+	}
+}
+
+// bind and unbind change s, noting in any transaction
+// what they change.
+func (s *Scope) bind(num int, val Sexp) {
+	if i, ok := s.slotOf(num); ok {
+		s.setSlot(i, num, val)
+		return
+	}
+	s.willChange(num)
+	s.Map[num] = val
+	if s.layer != nil {
+		delete(s.layer.gone, num)
+	}
+}
+
+// setSlot binds num, kept in slot i of s.
+func (s *Scope) setSlot(i, num int, val Sexp) {
+	s.willChange(num)
+	if val == nil {
+		// a nil slot is unbound.
+		val = SexpNull
+	}
+	s.slots[i] = val
+}
+
+func (s *Scope) unbind(num int) {
+	s.willChange(num)
+	if i, ok := s.slotOf(num); ok {
+		s.slots[i] = nil
+		return
+	}
+	delete(s.Map, num)
+	if s.layer != nil {
+		s.layer.gone[num] = true
+	}
+}
+
+func (s *Scope) willChange(num int) {
+	if s.env == nil || s.env.tx == nil {
+		return
+	}
+	tx := s.env.tx
+	k := scopeSlot{scope: s, num: num}
+	if _, seen := tx.scopes[k]; seen {
+		return
+	}
+	val, bound := s.Map[num]
+	if i, ok := s.slotOf(num); ok {
+		val, bound = s.slots[i], s.slots[i] != nil
+	}
+	tx.scopes[k] = scopeWas{val: val, bound: bound}
+}
+
+// restore puts num back in s as it was.
+func (s *Scope) restore(num int, was scopeWas) {
+	if i, ok := s.slotOf(num); ok {
+		s.slots[i] = nil
+		if was.bound {
+			s.slots[i] = was.val
+		}
+		return
+	}
+	if was.bound {
+		s.Map[num] = was.val
+	} else {
+		delete(s.Map, num)
+	}
+}
+
+// willChange notes hash as it is, for any transaction.
+func (hash *SexpHash) willChange() {
+	if hash.Env == nil || hash.Env.tx == nil {
+		return
+	}
+	tx := hash.Env.tx
+	if _, seen := tx.hashes[hash]; seen {
+		return
+	}
+	m := make(map[int][]*SexpPair, len(hash.Map))
+	for k, arr := range hash.Map {
+		m[k] = append([]*SexpPair(nil), arr...)
+	}
+	tx.hashes[hash] = hashWas{
+		m:        m,
+		keyOrder: append([]Sexp(nil), hash.KeyOrder...),
+		numKeys:  hash.NumKeys,
+	}
+}
@@ -0,0 +1,82 @@
+package zygo
+
+import (
+	"errors"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test230EvalTxRollsBackOnError(t *testing.T) {
+
+	cv.Convey(`Given a script that fails halfway, EvalTx should leave the globals and hashes as they were before it`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`(def a 1) (def h (hash x:1 y:2)) (def gone 3)`)
+		panicOn(err)
+
+		_, err = env.EvalTx(`
+(set a 2)
+(def fresh 10)
+(hset h z: 3)
+(hset h x: 100)
+(hdel h y:)
+(rmsym (quote gone))
+(defn f [] (error "halfway"))
+(f)
+(set a 3)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "halfway")
+
+		res, err := env.EvalString(`[a (defined? "fresh") (defined? "f") (defined? "gone") h]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[1 false false true {x:1 y:2}]`)
+
+		// and on success, keeps it all.
+		_, err = env.EvalTx(`(set a 5) (def fresh 6) (hset h z: 7)`)
+		cv.So(err, cv.ShouldBeNil)
+		res, err = env.EvalString(`[a fresh h]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[5 6 {x:1 y:2 z:7}]`)
+	})
+
+	cv.Convey(`Given a budget that runs out, EvalTx should roll back too`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`(def n 0)`)
+		panicOn(err)
+		env.SetLimits(Limits{MaxInstructions: 500})
+
+		_, err = env.EvalTx(`(for [(def i 0) true (set i (+ i 1))] (set n i))`)
+		var be *BudgetError
+		cv.So(errors.As(err, &be), cv.ShouldBeTrue)
+
+		env.SetLimits(Limits{})
+		res, err := env.EvalString(`[n (defined? "i")]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[0 false]`)
+	})
+
+	cv.Convey(`Given atomically inside EvalTx, the inner changes should go with the outer transaction`, t, func() {
+
+		env := NewZlisp()
+		defer env.Close()
+		env.StandardSetup()
+		_, err := env.EvalString(`(def a 1) (def b 1)`)
+		panicOn(err)
+
+		_, err = env.EvalTx(`(atomically (set a 2)) (set b 2) (error "later")`)
+		cv.So(err, cv.ShouldNotBeNil)
+		res, err := env.EvalString(`[a b]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[1 1]`)
+
+		res, err = env.EvalTx(`(try (atomically (set a 3) (set b 3) (error "inner")) (catch e (set b 4))) [a b]`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `[1 4]`)
+	})
+}
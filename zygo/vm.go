@@ -342,6 +342,7 @@ func (c CallInstr) Execute(env *Zlisp) error {
 type CallExprInstr struct {
 	callee Sexp
 	args   []Sexp
+	site   *callSite
 }
 
 func (c CallExprInstr) InstrString() string {
@@ -353,7 +354,7 @@ func (c CallExprInstr) InstrString() string {
 }
 
 func (c CallExprInstr) Execute(env *Zlisp) error {
-	funcobj, err := env.EvalCallExpression(c.callee)
+	funcobj, err := env.evalCallExpression(c.callee, c.site.frame(), c.site.depth(0), c.site.ref(0))
 	if err != nil {
 		return err
 	}
@@ -361,7 +362,7 @@ func (c CallExprInstr) Execute(env *Zlisp) error {
 	if err != nil {
 		return err
 	}
-	return env.CallResolved(funcobj, callName, c.args)
+	return env.callResolved(funcobj, callName, c.args, c.site)
 }
 
 type DispatchInstr struct {
@@ -421,7 +422,8 @@ func (r ReturnInstr) InstrString() string {
 }
 
 type AddScopeInstr struct {
-	Name string
+	Name  string
+	frame *lexFrame // the scope's layout, if the generator knew it.
 }
 
 func (a AddScopeInstr) InstrString() string {
@@ -429,8 +431,8 @@ func (a AddScopeInstr) InstrString() string {
 }
 
 func (a AddScopeInstr) Execute(env *Zlisp) error {
-	sc := env.NewNamedScope(fmt.Sprintf("scope Name: '%s'",
-		a.Name))
+	sc := env.newFrameScope(fmt.Sprintf("scope Name: '%s'",
+		a.Name), a.frame)
 	env.linearstack.Push(sc)
 	env.pc++
 	return nil
@@ -443,6 +445,7 @@ type AddFuncScopeInstr struct {
 
 type AddFuncScopeHelper struct {
 	MyFunction *SexpFunction
+	frame      *lexFrame
 }
 
 func (a AddFuncScopeInstr) InstrString() string {
@@ -450,10 +453,10 @@ func (a AddFuncScopeInstr) InstrString() string {
 }
 
 func (a AddFuncScopeInstr) Execute(env *Zlisp) error {
-	sc := env.NewNamedScope(fmt.Sprintf("%s at pc=%v",
-		env.curfunc.name, env.pc))
+	sc := env.newFrameScope(fmt.Sprintf("%s at pc=%v",
+		env.curfunc.name, env.pc), a.Helper.frame)
 	sc.IsFunction = true
-	sc.MyFunction = a.Helper.MyFunction
+	sc.MyFunction = env.ownFunction(a.Helper.MyFunction)
 	env.linearstack.Push(sc)
 	env.pc++
 	return nil
@@ -812,7 +815,7 @@ func (a CreateClosureInstr) Execute(env *Zlisp) error {
 	myInvok := a.sfun.Copy()
 	myInvok.SetClosing(cls)
 	if env.curfunc != nil {
-		a.sfun.parent = env.curfunc
+		// only the copy; a.sfun is shared by every env running this code.
 		myInvok.parent = env.curfunc
 		//P("myInvok is copy of a.sfun '%s' with parent = %s", a.sfun.name, myInvok.parent.name)
 	}
@@ -963,12 +966,7 @@ func (c PrepareCallInstr) execute(env *Zlisp) error {
 		case *SexpFunction:
 			if !g.user {
 				nargs := c.nargs
-				if err := env.prepareLazyCallArgs(g, &nargs); err != nil {
-					return err
-				}
-				if g.varargs {
-					return env.wrangleOptargs(g.nargs, nargs)
-				}
+				return env.callArgs(g, &nargs)
 			}
 			return nil
 		}
@@ -976,12 +974,7 @@ func (c PrepareCallInstr) execute(env *Zlisp) error {
 	case *SexpFunction:
 		if !f.user {
 			nargs := c.nargs
-			if err := env.prepareLazyCallArgs(f, &nargs); err != nil {
-				return err
-			}
-			if f.varargs {
-				return env.wrangleOptargs(f.nargs, nargs)
-			}
+			return env.callArgs(f, &nargs)
 		}
 	}
 	return nil